@@ -1,25 +1,43 @@
 package cmd
 
 import (
-	"os"
+	"context"
 
 	"github.com/Annany2002/guard/pkg/backup"
 	"github.com/Annany2002/guard/pkg/logger"
-	"github.com/Annany2002/guard/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
 var (
 	output_directory string
 	customLog        = logger.NewLogger()
-	backupFilePath   string
 )
 
 func BackupCommand() *cobra.Command {
 	var backupCmd = &cobra.Command{
 		Use:   "backup",
 		Short: "Backup a database",
-		Long:  `Backup a database to a specified storage location`,
+		Long: `Backup a database to a specified storage location.
+
+--storage accepts a storage URL such as file:///backups, local:/backups or
+s3://bucket/prefix. The legacy values "local" (the --output directory) and
+"s3" (the bucket in BUCKET_NAME) are still accepted.
+
+Repeat --storage to send the backup to several destinations at once;
+--require decides how many of them must succeed.
+
+--erasure 3+2 splits the backup into three data and two parity shards,
+one per --storage location; any three of them restore it.
+
+--dedup splits the backup into content-defined chunks and only stores the
+chunks a storage location does not hold yet, so unchanged data is stored
+once across backups and databases. guard prune deletes unused chunks.
+
+--layout places backups below the storage location, for example
+'{db}/{yyyy}/{mm}/{db}-{ts}.{ext}'.
+
+--schema, --table-prefix and --table-suffix select the tables to back up,
+and --compress gzip stores the dump gzip-compressed.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			customLog.Info("Starting backup operation...")
 
@@ -29,35 +47,49 @@ func BackupCommand() *cobra.Command {
 			username, _ := cmd.Flags().GetString("username")
 			password, _ := cmd.Flags().GetString("password")
 			dbname, _ := cmd.Flags().GetString("dbname")
-			storageType, _ := cmd.Flags().GetString("storage")
 			output_directory, _ := cmd.Flags().GetString("output")
+			require, _ := cmd.Flags().GetString("require")
+			layout, _ := cmd.Flags().GetString("layout")
 
-			switch storageType {
-			case "s3":
-				// Handle S3 storage
-				bucketName := os.Getenv("BUCKET_NAME")
-				s3Client, err := storage.NewS3Client(bucketName)
-				if err != nil {
-					customLog.Errorf("Failed to create S3 client: %v", err)
-					return
-				}
-				objectKey := backupFilePath
-				err = s3Client.UploadFileToS3(backupFilePath, objectKey)
-				if err != nil {
-					customLog.Errorf("Failed to upload backup file to S3: %v", err)
-					return
-				}
-
-			// Handle Local Storage
-			case "local":
-				{
-				}
+			locations, err := storageLocations(cmd, output_directory, "")
+			if err != nil {
+				customLog.Fatalf("Invalid storage location: %v", err)
+			}
+			policy, err := backup.ParsePolicy(require)
+			if err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			if err := backup.ValidateLayout(layout); err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			scheme, err := erasureScheme(cmd)
+			if err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			deduplicate, _ := cmd.Flags().GetBool("dedup")
+			tables := tableFilter(cmd)
+			if err := tables.Validate(); err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			compressFlag, _ := cmd.Flags().GetString("compress")
+			compression, err := backup.ParseCompression(compressFlag)
+			if err != nil {
+				customLog.Fatalf("%v", err)
 			}
 
 			switch dbms {
 			case "pg":
 				{
-					err := backup.FullBackup(dbname, password, username, host, output_directory, port)
+					_, err := runBackup(context.TODO(), backup.Options{
+						DBName:      dbname,
+						Password:    password,
+						Username:    username,
+						Host:        host,
+						Port:        port,
+						Layout:      layout,
+						Tables:      tables,
+						Compression: compression,
+					}, locations, policy, scheme, deduplicate)
 					if err != nil {
 						customLog.Fatalf("Error while performing backup: %v", err)
 
@@ -75,7 +107,14 @@ func BackupCommand() *cobra.Command {
 	backupCmd.Flags().StringP("username", "u", "", "Database username")
 	backupCmd.Flags().StringP("password", "P", "", "Database password")
 	backupCmd.Flags().StringP("dbname", "D", "", "Database name")
-	backupCmd.Flags().StringP("storage", "s", "local", "Storage location (local, s3, gcs, azure)")
+	backupCmd.Flags().StringArrayP("storage", "s", []string{"local"}, "Storage location, repeatable: a URL such as s3://bucket/prefix, gs://bucket or azblob://container, or local (the --output directory), s3, gcs or azure")
+	backupCmd.Flags().String("require", "all", "Destinations that must store the backup: all, any or a number")
+	addLayoutFlag(backupCmd)
+	addErasureFlag(backupCmd)
+	addDedupFlag(backupCmd)
+	addFilterFlags(backupCmd)
+	addCompressionFlag(backupCmd)
+	addSSEFlags(backupCmd)
 
 	backupCmd.MarkFlagRequired("username")
 	backupCmd.MarkFlagRequired("password")
@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/catalog"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func BackupsCommand() *cobra.Command {
+	var backupsCmd = &cobra.Command{
+		Use:   "backups",
+		Short: "Query the backup catalog",
+		Long: `Query the catalog of every backup taken by guard backup and guard sched.
+
+The catalog is an embedded database at ~/.guard/catalog.db, or the file
+given by --catalog or GUARD_CATALOG.`,
+	}
+
+	backupsCmd.PersistentFlags().String("catalog", catalog.DefaultPath(), "Path of the catalog database")
+	backupsCmd.PersistentFlags().Bool("json", false, "Print JSON")
+	backupsCmd.AddCommand(listBackupsCommand(), showBackupCommand(), latestBackupCommand(), holdBackupCommand())
+
+	return backupsCmd
+}
+
+func listBackupsCommand() *cobra.Command {
+	var listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List backups, newest first",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			dbname, _ := cmd.Flags().GetString("db")
+			since, _ := cmd.Flags().GetString("since")
+			status, _ := cmd.Flags().GetString("status")
+
+			filter := catalog.Filter{Database: dbname, Status: status}
+			if since != "" {
+				d, err := retention.ParseDuration(since)
+				if err != nil {
+					customLog.Fatalf("Invalid --since: %v", err)
+				}
+				filter.Since = time.Now().Add(-d)
+			}
+
+			cat := openCatalog(cmd)
+			defer cat.Close()
+			entries, err := cat.List(filter)
+			if err != nil {
+				customLog.Fatalf("Failed to list backups: %v", err)
+			}
+
+			if asJSON(cmd) {
+				if entries == nil {
+					entries = []catalog.Entry{}
+				}
+				printJSON(entries)
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tDATABASE\tCREATED\tSIZE\tSTATUS\tDURATION\tLOCATIONS")
+			for _, e := range entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%d\n", e.ID, e.Database, e.CreatedAt.Local().Format(time.DateTime), e.Size, e.Status, formatSeconds(e.DurationSeconds), len(e.Stored()))
+			}
+			w.Flush()
+		},
+	}
+
+	listCmd.Flags().String("db", "", "Only list backups of this database")
+	listCmd.Flags().String("since", "", "Only list backups younger than this (e.g. 7d, 12h)")
+	listCmd.Flags().String("status", "", "Only list backups with this status (completed, partial, failed, deleted)")
+
+	return listCmd
+}
+
+func showBackupCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "show <id>",
+		Short: "Show a backup",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cat := openCatalog(cmd)
+			defer cat.Close()
+			entry, err := cat.Get(args[0])
+			if err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			printEntry(cmd, entry)
+		},
+	}
+}
+
+func latestBackupCommand() *cobra.Command {
+	var latestCmd = &cobra.Command{
+		Use:   "latest",
+		Short: "Show the newest backup that has a stored copy",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			dbname, _ := cmd.Flags().GetString("db")
+
+			cat := openCatalog(cmd)
+			defer cat.Close()
+			entry, err := cat.Latest(dbname)
+			if err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			printEntry(cmd, entry)
+		},
+	}
+
+	latestCmd.Flags().String("db", "", "Only consider backups of this database")
+
+	return latestCmd
+}
+
+func holdBackupCommand() *cobra.Command {
+	var holdCmd = &cobra.Command{
+		Use:   "hold <id>",
+		Short: "Place or release a legal hold on a backup",
+		Long: `Place a legal hold on every stored copy of a backup, or release it with
+--release. A held backup cannot be deleted, not even by guard prune, until
+the hold is released. Requires storage with Object Lock enabled, such as an
+S3 bucket.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx := context.TODO()
+			release, _ := cmd.Flags().GetBool("release")
+
+			cat := openCatalog(cmd)
+			defer cat.Close()
+			entry, err := cat.Get(args[0])
+			if err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			if len(entry.Stored()) == 0 {
+				customLog.Fatalf("Backup %s has no stored copies", entry.ID)
+			}
+
+			failed := false
+			for _, l := range entry.Stored() {
+				if err := setLegalHold(ctx, l, !release); err != nil {
+					customLog.Errorf("Failed to update the legal hold in %s: %v", l.URL, err)
+					failed = true
+				}
+			}
+			if failed {
+				cat.Close()
+				os.Exit(1)
+			}
+			if err := cat.Update(entry.ID, func(e *catalog.Entry) { e.LegalHold = !release }); err != nil {
+				customLog.Fatalf("Failed to update the catalog: %v", err)
+			}
+			if release {
+				customLog.Infof("Released the legal hold on backup %s", entry.ID)
+			} else {
+				customLog.Infof("Placed a legal hold on backup %s", entry.ID)
+			}
+		},
+	}
+
+	holdCmd.Flags().Bool("release", false, "Release the legal hold")
+
+	return holdCmd
+}
+
+// setLegalHold places or releases a legal hold on a stored backup and its
+// manifest
+func setLegalHold(ctx context.Context, l catalog.Location, hold bool) error {
+	b, err := storage.Open(ctx, l.URL)
+	if err != nil {
+		return err
+	}
+	defer storage.Close(b)
+
+	locker, ok := b.(storage.Locker)
+	if !ok {
+		return fmt.Errorf("%s does not support legal holds", b.URL())
+	}
+	for _, key := range []string{l.Key, manifest.PathFor(l.Key)} {
+		if err := locker.SetLegalHold(ctx, key, hold); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openCatalog(cmd *cobra.Command) *catalog.Catalog {
+	path, _ := cmd.Flags().GetString("catalog")
+	cat, err := catalog.Open(path)
+	if err != nil {
+		customLog.Fatalf("%v", err)
+	}
+	return cat
+}
+
+func asJSON(cmd *cobra.Command) bool {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	return asJSON
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func printEntry(cmd *cobra.Command, e *catalog.Entry) {
+	if asJSON(cmd) {
+		printJSON(e)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", e.ID)
+	fmt.Fprintf(w, "Database:\t%s\n", e.Database)
+	fmt.Fprintf(w, "Type:\t%s %s\n", e.DBMS, e.Type)
+	fmt.Fprintf(w, "Created:\t%s\n", e.CreatedAt.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "Size:\t%d\n", e.Size)
+	fmt.Fprintf(w, "Checksum:\t%s\n", e.Checksum)
+	fmt.Fprintf(w, "Status:\t%s\n", e.Status)
+	fmt.Fprintf(w, "Duration:\t%s\n", formatSeconds(e.DurationSeconds))
+	if e.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s\n", e.Error)
+	}
+	if e.LegalHold {
+		fmt.Fprintf(w, "Legal hold:\tyes\n")
+	}
+	for _, l := range e.Locations {
+		line := []string{l.Status, l.URL, l.Key}
+		if l.Class != "" {
+			line = append(line, l.Class)
+		}
+		if l.Error != "" {
+			line = append(line, l.Error)
+		}
+		fmt.Fprintf(w, "Location:\t%s\n", strings.Join(line, " "))
+	}
+	w.Flush()
+}
+
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond).String()
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Annany2002/guard/pkg/catalog"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func CatalogCommand() *cobra.Command {
+	var catalogCmd = &cobra.Command{
+		Use:   "catalog",
+		Short: "Maintain the backup catalog",
+		Long: `Rebuild the backup catalog from the manifests in storage, or reconcile it
+with what is actually stored.`,
+	}
+
+	catalogCmd.PersistentFlags().String("catalog", catalog.DefaultPath(), "Path of the catalog database")
+	catalogCmd.PersistentFlags().Bool("json", false, "Print JSON")
+	catalogCmd.PersistentFlags().StringArrayP("storage", "s", nil, "Storage location to scan, repeatable (directory or URL such as s3://bucket/prefix)")
+	catalogCmd.AddCommand(rebuildCatalogCommand(), reconcileCatalogCommand())
+
+	return catalogCmd
+}
+
+func rebuildCatalogCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rebuild",
+		Short: "Index the manifests found in storage",
+		Long: `Scan every storage location, read the backup manifests and add the backups
+to the catalog. Backups already in the catalog gain the scanned locations.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx := context.TODO()
+			locations, err := storageLocations(cmd, "./backup", "")
+			if err != nil {
+				customLog.Fatalf("Invalid storage location: %v", err)
+			}
+			if len(locations) == 0 {
+				customLog.Fatalf("No storage location given, use --storage or GUARD_STORAGE")
+			}
+
+			cat := openCatalog(cmd)
+			defer cat.Close()
+			failed := false
+			for _, location := range locations {
+				b, err := storage.Open(ctx, location)
+				if err != nil {
+					customLog.Errorf("Failed to open %s: %v", location, err)
+					failed = true
+					continue
+				}
+				count, err := cat.Rebuild(ctx, b)
+				storage.Close(b)
+				if err != nil {
+					customLog.Errorf("Failed to index %s: %v", b.URL(), err)
+					failed = true
+					continue
+				}
+				customLog.Infof("Indexed %d backups from %s", count, b.URL())
+			}
+			if failed {
+				cat.Close()
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func reconcileCatalogCommand() *cobra.Command {
+	var reconcileCmd = &cobra.Command{
+		Use:   "reconcile",
+		Short: "Compare the catalog with storage",
+		Long: `Report artifacts without manifests, catalog entries whose objects are
+missing, objects whose size or checksum drifted from the catalog, and backups
+the catalog does not know. Without --storage every location recorded in the
+catalog is checked. Exits with status 1 if any issue is found.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx := context.TODO()
+			verify, _ := cmd.Flags().GetBool("verify")
+
+			cat := openCatalog(cmd)
+			defer cat.Close()
+			locations, err := storageLocations(cmd, "./backup", "")
+			if err == nil && len(locations) == 0 {
+				locations, err = cat.URLs()
+			}
+			if err != nil {
+				customLog.Fatalf("Invalid storage location: %v", err)
+			}
+
+			issues := []catalog.Issue{}
+			failed := false
+			for _, location := range locations {
+				b, err := storage.Open(ctx, location)
+				if err != nil {
+					customLog.Errorf("Failed to open %s: %v", location, err)
+					failed = true
+					continue
+				}
+				found, err := cat.Reconcile(ctx, b, verify)
+				storage.Close(b)
+				if err != nil {
+					customLog.Errorf("Failed to reconcile %s: %v", b.URL(), err)
+					failed = true
+					continue
+				}
+				issues = append(issues, found...)
+			}
+
+			if asJSON(cmd) {
+				printJSON(issues)
+			} else if len(issues) > 0 {
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "KIND\tLOCATION\tKEY\tBACKUP\tDETAIL")
+				for _, issue := range issues {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", issue.Kind, issue.URL, issue.Key, issue.ID, issue.Detail)
+				}
+				w.Flush()
+			} else {
+				customLog.Info("Catalog and storage agree")
+			}
+			if failed || len(issues) > 0 {
+				cat.Close()
+				os.Exit(1)
+			}
+		},
+	}
+
+	reconcileCmd.Flags().Bool("verify", false, "Download every stored copy and compare its checksum")
+
+	return reconcileCmd
+}
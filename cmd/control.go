@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/control"
+	"github.com/Annany2002/guard/pkg/jobs"
+	"github.com/Annany2002/guard/pkg/scheduler"
+	"github.com/spf13/cobra"
+)
+
+func StatusCommand() *cobra.Command {
+	var statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the state of the running daemon",
+		Long:  `Show the state of the running guard daemon and the jobs it runs.`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			client := daemonClient(cmd)
+			info, err := client.Info(context.Background())
+			if err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			statuses, err := client.Jobs(context.Background())
+			if err != nil {
+				customLog.Fatalf("%v", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "PID:\t%d\n", info.PID)
+			fmt.Fprintf(w, "Started:\t%s (up %s)\n", info.Started.Format(time.DateTime), time.Since(info.Started).Round(time.Second))
+			fmt.Fprintf(w, "Socket:\t%s\n", info.Socket)
+			fmt.Fprintf(w, "Job store:\t%s\n", info.JobStore)
+			fmt.Fprintf(w, "Jobs:\t%d (%d running, %d paused)\n", info.Jobs, info.Running, info.Paused)
+			w.Flush()
+			if len(statuses) > 0 {
+				fmt.Println()
+				printStatuses(statuses)
+			}
+		},
+	}
+
+	addSocketFlag(statusCmd)
+
+	return statusCmd
+}
+
+func RunNowCommand() *cobra.Command {
+	var runNowCmd = &cobra.Command{
+		Use:   "run-now <job>",
+		Short: "Run a scheduled job right away",
+		Long: `Ask the running daemon to run a job right away, even if it is paused. The
+job runs in the background of the daemon; follow it with guard status.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			id := parseJobID(args[0])
+			if err := daemonClient(cmd).RunNow(context.Background(), id); err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			customLog.Infof("Started job %d", id)
+		},
+	}
+
+	addSocketFlag(runNowCmd)
+
+	return runNowCmd
+}
+
+func PauseCommand() *cobra.Command {
+	var pauseCmd = &cobra.Command{
+		Use:   "pause <job>",
+		Short: "Stop running a job on its schedule",
+		Long: `Stop running a job on its schedule until it is resumed. A run in progress
+finishes, and guard run-now still runs the job. The job stays paused when
+the daemon restarts.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			id := parseJobID(args[0])
+			setPaused(cmd, id, true)
+			customLog.Infof("Paused job %d", id)
+		},
+	}
+
+	addSocketFlag(pauseCmd)
+	addJobStoreFlag(pauseCmd)
+
+	return pauseCmd
+}
+
+func ResumeCommand() *cobra.Command {
+	var resumeCmd = &cobra.Command{
+		Use:   "resume <job>",
+		Short: "Run a paused job on its schedule again",
+		Long:  `Run a job paused with guard pause on its schedule again.`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			id := parseJobID(args[0])
+			setPaused(cmd, id, false)
+			customLog.Infof("Resumed job %d", id)
+		},
+	}
+
+	addSocketFlag(resumeCmd)
+	addJobStoreFlag(resumeCmd)
+
+	return resumeCmd
+}
+
+// setPaused pauses or resumes a job through the daemon, or in the job
+// store when no daemon is running
+func setPaused(cmd *cobra.Command, id int64, paused bool) {
+	err := daemonClient(cmd).Pause(context.Background(), id, paused)
+	if errors.Is(err, control.ErrNotRunning) {
+		store := openJobStore(cmd)
+		err = store.Update(id, func(j *jobs.Job) { j.Paused = paused })
+		store.Close()
+	}
+	if err != nil {
+		customLog.Fatalf("%v", err)
+	}
+}
+
+func addSocketFlag(cmd *cobra.Command) {
+	cmd.Flags().String("socket", control.DefaultSocket(), "Path of the daemon's control socket")
+}
+
+func daemonClient(cmd *cobra.Command) *control.Client {
+	socket, _ := cmd.Flags().GetString("socket")
+	return control.NewClient(socket)
+}
+
+func parseJobID(arg string) int64 {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || id <= 0 {
+		customLog.Fatalf("Invalid job ID %q", arg)
+	}
+	return id
+}
+
+// printStatuses prints the live state of the jobs of a daemon
+func printStatuses(statuses []scheduler.Status) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTASK\tDATABASE\tCRON\tSTATE\tNEXT RUN\tLAST RUN\tRESULT\tSTORAGE")
+	for _, status := range statuses {
+		state, next := "scheduled", "-"
+		switch {
+		case status.Running:
+			state = "running since " + status.Started.Format(time.TimeOnly)
+		case status.Job.Paused:
+			state = "paused"
+		}
+		if !status.Next.IsZero() {
+			next = status.Next.Format(time.DateTime)
+		}
+		last, result := "-", "-"
+		if status.Last != nil {
+			last = status.Last.Started.Format(time.DateTime)
+			result = "ok"
+			if status.Last.Error != "" {
+				result = "failed: " + status.Last.Error
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", status.Job.ID, jobName(status.Job), status.Job.Task, status.Job.Database, status.Job.Cron, state, next, last, result, strings.Join(status.Job.Storage, " "))
+	}
+	w.Flush()
+}
+
+// jobName returns the name of a job declared in a config file, or - for
+// other jobs
+func jobName(job jobs.Job) string {
+	if job.Name == "" {
+		return "-"
+	}
+	return job.Name
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/config"
+	"github.com/Annany2002/guard/pkg/control"
+	"github.com/Annany2002/guard/pkg/jobs"
+	"github.com/Annany2002/guard/pkg/scheduler"
+	"github.com/spf13/cobra"
+)
+
+func DaemonCommand() *cobra.Command {
+	var daemonCmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "Run the stored scheduled jobs",
+		Long: `Run every job in the job store on its schedule until stopped.
+
+Jobs are added with guard sched add and removed with guard unschedule. The
+daemon reads the job store again every --reload interval, so changes take
+effect without a restart. A job that is still running when it is due again
+is skipped. On SIGINT or SIGTERM the daemon waits for running jobs to
+finish before it exits.
+
+--config guard.yaml runs the jobs declared in a config file as well. They
+are kept in the job store under their names, so that guard list, pause and
+run-now work on them, and the file is read again with the job store.
+
+The daemon listens on a Unix control socket, used by guard status, list,
+run-now, pause, resume and unschedule. Anyone allowed to connect by
+--socket-mode may read the state of the jobs; only the user running the
+daemon and root may change them.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("jobs")
+			reload, _ := cmd.Flags().GetDuration("reload")
+			if reload <= 0 {
+				customLog.Fatalf("Invalid --reload %s", reload)
+			}
+			socket, _ := cmd.Flags().GetString("socket")
+			modeFlag, _ := cmd.Flags().GetString("socket-mode")
+			mode, err := strconv.ParseUint(modeFlag, 8, 32)
+			if err != nil || mode > 0o777 {
+				customLog.Fatalf("Invalid --socket-mode %q, expected octal permissions such as 0660", modeFlag)
+			}
+
+			configPath, _ := cmd.Flags().GetString("config")
+			if configPath != "" {
+				if configPath, err = filepath.Abs(configPath); err != nil {
+					customLog.Fatalf("%v", err)
+				}
+				if err := syncConfig(configPath, path); err != nil {
+					customLog.Fatalf("%v", err)
+				}
+			}
+
+			s := scheduler.New(runJob)
+			if err := s.Load(path); err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			srv, err := control.Listen(socket, os.FileMode(mode), s, path)
+			if err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			go func() {
+				if err := srv.Serve(); err != nil {
+					customLog.Errorf("Control socket failed: %v", err)
+				}
+			}()
+			s.Start()
+			customLog.Infof("Daemon started with job store %s, control socket %s", path, socket)
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			ticker := time.NewTicker(reload)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					// Keep the current jobs if the config or the store
+					// cannot be read
+					if configPath != "" {
+						if err := syncConfig(configPath, path); err != nil {
+							customLog.Errorf("%v", err)
+						}
+					}
+					if err := s.Load(path); err != nil {
+						customLog.Errorf("%v", err)
+					}
+				case sig := <-signals:
+					customLog.Infof("Received %s, waiting for running jobs to finish", sig)
+					srv.Close()
+					s.Stop()
+					customLog.Info("Daemon stopped")
+					return
+				}
+			}
+		},
+	}
+
+	addJobStoreFlag(daemonCmd)
+	addSocketFlag(daemonCmd)
+	daemonCmd.Flags().String("config", "", "Config file declaring jobs, e.g. guard.yaml")
+	daemonCmd.Flags().Duration("reload", 30*time.Second, "How often to read the job store and config for changes")
+	daemonCmd.Flags().String("socket-mode", "0600", "File mode of the control socket, 0660 lets the socket's group read job states")
+
+	return daemonCmd
+}
+
+// syncConfig stores the jobs declared in the config file at configPath in
+// the job store at storePath. Nothing changes unless every job is valid.
+func syncConfig(configPath, storePath string) error {
+	f, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	list, err := f.Resolve()
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %w", configPath, err)
+	}
+	for _, job := range list {
+		if _, err := planJob(job); err != nil {
+			return fmt.Errorf("invalid config %s: job %s: %w", configPath, job.Name, err)
+		}
+		// The password is read again when the job runs and may be
+		// provided by then
+		if _, err := job.ResolvePassword(); err != nil {
+			customLog.Warnf("Config %s: job %s: %v", configPath, job.Name, err)
+		}
+	}
+
+	store, err := jobs.Open(storePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	added, changed, removed, err := store.SyncConfig(configPath, list)
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %w", configPath, err)
+	}
+	if added+changed+removed > 0 {
+		customLog.Infof("Config %s: %d jobs added, %d changed, %d removed", configPath, added, changed, removed)
+	}
+	return nil
+}
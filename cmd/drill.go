@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/drill"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func DrillCommand() *cobra.Command {
+	var drillCmd = &cobra.Command{
+		Use:   "drill",
+		Short: "Verify that a backup restores",
+		Long: `Restore the latest (or a specified) backup into a temporary database,
+check table presence, row counts against the backup manifest and any
+user-supplied SQL assertions, report pass or fail and drop the scratch database.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			customLog.Info("Starting restore drill...")
+
+			dbms, _ := cmd.Flags().GetString("dbms")
+			if dbms != "pg" && dbms != "postgres" {
+				customLog.Fatalf("Unsupported --dbms %q, restore drills only support PostgreSQL (pg, postgres)", dbms)
+			}
+
+			host, _ := cmd.Flags().GetString("host")
+			port, _ := cmd.Flags().GetString("port")
+			username, _ := cmd.Flags().GetString("username")
+			password, _ := cmd.Flags().GetString("password")
+			dbname, _ := cmd.Flags().GetString("dbname")
+			filePath, _ := cmd.Flags().GetString("file")
+			location, _ := cmd.Flags().GetString("storage")
+			assertions, _ := cmd.Flags().GetStringArray("assert")
+			assertFile, _ := cmd.Flags().GetString("assert-file")
+			keep, _ := cmd.Flags().GetBool("keep")
+
+			opts := drill.Options{
+				Host:       host,
+				Port:       port,
+				Username:   username,
+				Password:   password,
+				FilePath:   filePath,
+				Assertions: assertions,
+				Keep:       keep,
+			}
+
+			if err := runDrill(opts, location, dbname, assertFile); err != nil {
+				customLog.Fatalf("Restore drill failed: %v", err)
+			}
+		},
+	}
+
+	drillCmd.Flags().StringP("dbms", "d", "pg", "Database Management System (only pg or postgres is supported)")
+	drillCmd.Flags().StringP("host", "H", "localhost", "Database host")
+	drillCmd.Flags().StringP("port", "p", "5432", "Database port")
+	drillCmd.Flags().StringP("username", "u", "", "Database username")
+	drillCmd.Flags().StringP("password", "P", "", "Database password")
+	drillCmd.Flags().StringP("dbname", "D", "", "Only consider backups of this database")
+	drillCmd.Flags().StringP("file", "f", "", "Key of the backup to drill within --storage (default: latest backup)")
+	drillCmd.Flags().StringP("storage", "s", "./backup", "Storage location of the backups (directory or URL such as s3://bucket/prefix)")
+	addDrillFlags(drillCmd)
+
+	drillCmd.MarkFlagRequired("username")
+	drillCmd.MarkFlagRequired("password")
+
+	return drillCmd
+}
+
+// addDrillFlags registers the flags shared by drill and scheduled drills
+func addDrillFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("assert", nil, "SQL assertion returning a boolean that must be true (repeatable)")
+	cmd.Flags().String("assert-file", "", "File of SQL assertions separated by semicolons")
+	cmd.Flags().Bool("keep", false, "Keep the scratch database after the drill")
+}
+
+// runDrill resolves the backup to drill in the storage location, fetches it,
+// runs the drill and logs the report
+func runDrill(opts drill.Options, location, dbname, assertFile string) error {
+	ctx := context.TODO()
+	b, err := storage.Open(ctx, location)
+	if err != nil {
+		return err
+	}
+	defer storage.Close(b)
+
+	key := opts.FilePath
+	if key == "" {
+		key, err = drill.Latest(ctx, b, dbname)
+		if err != nil {
+			return err
+		}
+	}
+
+	workDir, err := os.MkdirTemp("", "guard-drill-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	opts.FilePath, err = drill.Fetch(ctx, b, key, workDir)
+	if err != nil {
+		return err
+	}
+
+	if assertFile != "" {
+		fileAssertions, err := drill.LoadAssertions(assertFile)
+		if err != nil {
+			return err
+		}
+		opts.Assertions = append(opts.Assertions, fileAssertions...)
+	}
+
+	report, err := drill.Run(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, check := range report.Checks {
+		status := "PASS"
+		if !check.Passed {
+			status = "FAIL"
+		}
+		if check.Detail != "" {
+			customLog.Infof("[%s] %s: %s", status, check.Name, check.Detail)
+		} else {
+			customLog.Infof("[%s] %s", status, check.Name)
+		}
+	}
+
+	if !report.Passed {
+		return fmt.Errorf("%d of %d checks failed for %s", len(report.Failed()), len(report.Checks), report.Backup)
+	}
+	customLog.Infof("Restore drill of %s passed (%d checks in %s)", report.Backup, len(report.Checks), report.Duration.Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/catalog"
+	"github.com/Annany2002/guard/pkg/dedup"
+	"github.com/Annany2002/guard/pkg/jobs"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+func PruneCommand() *cobra.Command {
+	var pruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Delete backups according to a retention policy",
+		Long: `Apply a grandfather-father-son retention policy to the backups in one or
+more storage locations and delete the backups it does not keep.
+
+Every database is handled separately. A backup is kept if any rule keeps it:
+--keep-last keeps the newest N backups, --keep-daily, --keep-weekly,
+--keep-monthly and --keep-yearly keep the newest backup of each of the last N
+days, weeks, months and years that have backups, and --keep-within keeps
+every backup younger than a duration such as 30d.
+
+Chunks of deduplicated backups that no remaining backup references are
+deleted afterwards, once they are older than --chunk-grace. Locations where a
+deduplicated backup is being stored are skipped.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			dbname, _ := cmd.Flags().GetString("dbname")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			policy, err := retentionPolicy(cmd)
+			if err != nil {
+				customLog.Fatalf("Invalid retention policy: %v", err)
+			}
+			if policy.IsZero() {
+				customLog.Fatalf("No retention policy given, use --keep-last, --keep-daily, --keep-weekly, --keep-monthly, --keep-yearly or --keep-within")
+			}
+			locations, err := storageLocations(cmd, "./backup", "")
+			if err != nil {
+				customLog.Fatalf("Invalid storage location: %v", err)
+			}
+
+			grace, err := chunkGrace(cmd)
+			if err != nil {
+				customLog.Fatalf("Invalid --chunk-grace: %v", err)
+			}
+
+			if err := runPrune(context.TODO(), locations, policy, retention.PruneOptions{Database: dbname, DryRun: dryRun}, grace); err != nil {
+				customLog.Fatalf("Prune failed: %v", err)
+			}
+		},
+	}
+
+	pruneCmd.Flags().StringArrayP("storage", "s", []string{"./backup"}, "Storage location of the backups, repeatable (directory or URL such as s3://bucket/prefix)")
+	pruneCmd.Flags().StringP("dbname", "D", "", "Only prune backups of this database")
+	pruneCmd.Flags().Bool("dry-run", false, "Show what would be deleted without deleting anything")
+	addRetentionFlags(pruneCmd)
+	pruneCmd.Flags().String("chunk-grace", "24h", "Keep unreferenced chunks of deduplicated backups younger than this")
+
+	return pruneCmd
+}
+
+func addRetentionFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("keep-last", 0, "Keep the newest N backups")
+	cmd.Flags().Int("keep-daily", 0, "Keep the newest backup of each of the last N days")
+	cmd.Flags().Int("keep-weekly", 0, "Keep the newest backup of each of the last N weeks")
+	cmd.Flags().Int("keep-monthly", 0, "Keep the newest backup of each of the last N months")
+	cmd.Flags().Int("keep-yearly", 0, "Keep the newest backup of each of the last N years")
+	cmd.Flags().String("keep-within", "", "Keep every backup younger than this (e.g. 30d, 12h)")
+}
+
+// retentionPolicy reads the retention flags
+func retentionPolicy(cmd *cobra.Command) (retention.Policy, error) {
+	return retentionFrom(retentionSpec(cmd))
+}
+
+// retentionSpec reads the retention flags as stored in a job
+func retentionSpec(cmd *cobra.Command) jobs.Retention {
+	var spec jobs.Retention
+	spec.KeepLast, _ = cmd.Flags().GetInt("keep-last")
+	spec.KeepDaily, _ = cmd.Flags().GetInt("keep-daily")
+	spec.KeepWeekly, _ = cmd.Flags().GetInt("keep-weekly")
+	spec.KeepMonthly, _ = cmd.Flags().GetInt("keep-monthly")
+	spec.KeepYearly, _ = cmd.Flags().GetInt("keep-yearly")
+	spec.KeepWithin, _ = cmd.Flags().GetString("keep-within")
+	return spec
+}
+
+// retentionFrom parses the retention policy of a job
+func retentionFrom(spec jobs.Retention) (retention.Policy, error) {
+	policy := retention.Policy{
+		KeepLast:    spec.KeepLast,
+		KeepDaily:   spec.KeepDaily,
+		KeepWeekly:  spec.KeepWeekly,
+		KeepMonthly: spec.KeepMonthly,
+		KeepYearly:  spec.KeepYearly,
+	}
+	if spec.KeepWithin != "" {
+		d, err := retention.ParseDuration(spec.KeepWithin)
+		if err != nil {
+			return policy, err
+		}
+		policy.KeepWithin = d
+	}
+	return policy, nil
+}
+
+// chunkGrace reads the --chunk-grace flag
+func chunkGrace(cmd *cobra.Command) (time.Duration, error) {
+	value, _ := cmd.Flags().GetString("chunk-grace")
+	return retention.ParseDuration(value)
+}
+
+// pruned is the outcome of pruning one storage location
+type pruned struct {
+	url       string
+	decisions []retention.Decision
+	gc        dedup.GCResult
+}
+
+// runPrune applies the retention policy in every location, then collects
+// the chunks no backup references any more, carrying on past locations
+// that fail. The catalog is only opened to record the deletions once the
+// storage work is done, so that other commands are not locked out of it.
+func runPrune(ctx context.Context, locations []string, policy retention.Policy, opts retention.PruneOptions, grace time.Duration) error {
+	var errs []error
+	var results []pruned
+	for _, location := range locations {
+		b, err := storage.Open(ctx, location)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// A prune that failed for some backups still deleted others, which
+		// have to leave the catalog
+		decisions, err := retention.Prune(ctx, b, policy, opts)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		// A running deduplicated backup may rely on unreferenced chunks, the
+		// next prune collects them
+		gc, err := dedup.GC(ctx, b, dedup.GCOptions{DryRun: opts.DryRun, Grace: grace})
+		if errors.Is(err, dedup.ErrLocked) {
+			customLog.Warnf("Skipping garbage collection: %v", err)
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+		for _, d := range decisions {
+			if d.Keep {
+				customLog.Infof("Keeping %s (%s)", storage.JoinURL(b, d.Backup.Key), strings.Join(d.Reasons, ", "))
+			}
+		}
+		results = append(results, pruned{url: b.URL(), decisions: decisions, gc: gc})
+		storage.Close(b)
+	}
+
+	var cat *catalog.Catalog
+	if !opts.DryRun {
+		var err error
+		if cat, err = catalog.Open(catalog.DefaultPath()); err != nil {
+			customLog.Warnf("Deleted backups will not be updated in the catalog: %v", err)
+		} else {
+			defer cat.Close()
+		}
+	}
+
+	for _, r := range results {
+		if cat != nil {
+			if err := cat.ForgetPruned(r.url, r.decisions); err != nil {
+				customLog.Warnf("Failed to update the catalog: %v", err)
+			}
+		}
+		deleted, pending := 0, 0
+		for _, d := range r.decisions {
+			if d.Keep {
+				continue
+			}
+			pending++
+			if d.Deleted {
+				deleted++
+			}
+		}
+		if opts.DryRun {
+			customLog.Infof("%s: would delete %d of %d backups", r.url, pending, len(r.decisions))
+		} else {
+			customLog.Infof("%s: deleted %d of %d backups", r.url, deleted, len(r.decisions))
+		}
+		gc := r.gc
+		switch {
+		case gc.Chunks == 0:
+		case opts.DryRun:
+			customLog.Infof("%s: would delete %d of %d chunks (%d bytes), %d unreferenced chunks are within the grace period", r.url, gc.Deleted, gc.Chunks, gc.Bytes, gc.Unreferenced-gc.Deleted)
+		default:
+			customLog.Infof("%s: deleted %d of %d chunks (%d bytes), %d unreferenced chunks are within the grace period", r.url, gc.Deleted, gc.Chunks, gc.Bytes, gc.Unreferenced-gc.Deleted)
+		}
+	}
+	return errors.Join(errs...)
+}
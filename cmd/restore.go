@@ -1,7 +1,17 @@
 package cmd
 
 import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/dedup"
+	"github.com/Annany2002/guard/pkg/erasure"
+	"github.com/Annany2002/guard/pkg/manifest"
 	"github.com/Annany2002/guard/pkg/restore"
+	"github.com/Annany2002/guard/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -11,7 +21,25 @@ func RestoreCommand() *cobra.Command {
 	var restoreCmd = &cobra.Command{
 		Use:   "restore",
 		Short: "Restore a database from a backup",
-		Long:  `Restore a database from a specified storage location`,
+		Long: `Restore a database from a specified storage location.
+
+Progress is checkpointed into a journal file (by default next to the backup
+file). If a restore is interrupted, run it again with --resume <journal> to
+continue where it stopped; partly loaded tables are truncated and reloaded.
+
+Ownership, grants and schemas can be adapted to the target cluster with
+--map-role, --map-schema, --no-owner and --no-privileges.
+
+With --mode data only table data is loaded into the existing database.
+--conflict decides what happens to rows that already exist: error, skip,
+upsert (on the primary key) or truncate all tables in the dump first.
+Deferrable foreign keys are checked at commit, or all triggers are disabled
+with --disable-triggers. Sequences are reset to follow the loaded data.
+
+With --storage the --file key is downloaded from a storage URL such as
+s3://bucket/prefix into a local cache before restoring. Repeat --storage
+with every location of an erasure-coded backup so that its shards are read
+with the options of their location.`,
 
 		Run: func(cmd *cobra.Command, args []string) {
 			customLog.Info("Starting restoring operation")
@@ -23,11 +51,76 @@ func RestoreCommand() *cobra.Command {
 			port, _ := cmd.Flags().GetString("port")
 			username, _ := cmd.Flags().GetString("username")
 			password, _ := cmd.Flags().GetString("password")
+			journalPath, _ := cmd.Flags().GetString("journal")
+			resumePath, _ := cmd.Flags().GetString("resume")
+			roleMappings, _ := cmd.Flags().GetStringArray("map-role")
+			schemaMappings, _ := cmd.Flags().GetStringArray("map-schema")
+			noOwner, _ := cmd.Flags().GetBool("no-owner")
+			noPrivileges, _ := cmd.Flags().GetBool("no-privileges")
+			mode, _ := cmd.Flags().GetString("mode")
+			conflict, _ := cmd.Flags().GetString("conflict")
+			disableTriggers, _ := cmd.Flags().GetBool("disable-triggers")
+			locations, _ := cmd.Flags().GetStringArray("storage")
+			thawTier, _ := cmd.Flags().GetString("thaw-tier")
+			thawDays, _ := cmd.Flags().GetInt("thaw-days")
+			thawTimeout, _ := cmd.Flags().GetDuration("thaw-timeout")
+
+			roleMap, err := restore.ParseMappings(roleMappings)
+			if err != nil {
+				customLog.Errorf("Invalid --map-role: %v", err)
+				return
+			}
+			schemaMap, err := restore.ParseMappings(schemaMappings)
+			if err != nil {
+				customLog.Errorf("Invalid --map-schema: %v", err)
+				return
+			}
+
+			opts := restore.Options{
+				Host:        host,
+				Port:        port,
+				Username:    username,
+				Password:    password,
+				DBName:      dbname,
+				FilePath:    filePath,
+				JournalPath: journalPath,
+				Rewrite: restore.Rewriter{
+					RoleMap:      roleMap,
+					SchemaMap:    schemaMap,
+					NoOwner:      noOwner,
+					NoPrivileges: noPrivileges,
+				},
+				Mode:            mode,
+				Conflict:        conflict,
+				DisableTriggers: disableTriggers,
+			}
+			if resumePath != "" {
+				opts.JournalPath = resumePath
+				opts.Resume = true
+			} else if filePath == "" || dbname == "" {
+				customLog.Error("--file and --dbname are required unless --resume is given")
+				return
+			} else if len(locations) > 0 {
+				for i, location := range locations {
+					if locations[i], err = withSSE(cmd, location); err != nil {
+						customLog.Errorf("Invalid storage location: %v", err)
+						return
+					}
+				}
+				ctx, cancel := context.WithTimeout(context.TODO(), thawTimeout)
+				localPath, err := fetchBackup(ctx, locations, filePath, storage.ThawOptions{Days: thawDays, Tier: thawTier})
+				cancel()
+				if err != nil {
+					customLog.Errorf("Failed to fetch backup: %v", err)
+					return
+				}
+				opts.FilePath = localPath
+			}
 
 			switch dbms {
-			case "postgres":
+			case "pg", "postgres":
 				{
-					err := restore.RestorePostgres(host, username, password, dbname, filePath, port)
+					err := restore.Run(context.TODO(), opts)
 					if err != nil {
 						customLog.Errorf("Failed to restore PostgreSQL database: %v", err)
 						return
@@ -35,6 +128,9 @@ func RestoreCommand() *cobra.Command {
 				}
 			}
 
+			if len(locations) > 0 && !opts.Resume {
+				os.Remove(opts.FilePath)
+			}
 			customLog.Info("Restore operation completed successfully.")
 		},
 	}
@@ -46,14 +142,83 @@ func RestoreCommand() *cobra.Command {
 	restoreCmd.Flags().StringP("host", "H", "", "Database host")
 	restoreCmd.Flags().StringP("username", "U", "", "Database username")
 	restoreCmd.Flags().StringP("password", "P", "", "Database password")
+	restoreCmd.Flags().String("journal", "", "Restore journal path (default <file>.journal)")
+	restoreCmd.Flags().String("resume", "", "Resume an interrupted restore from its journal")
+	restoreCmd.Flags().StringArray("map-role", nil, "Rename a role in ownership and grant statements (from=to, repeatable)")
+	restoreCmd.Flags().StringArray("map-schema", nil, "Restore objects of a schema into another schema (from=to, repeatable)")
+	restoreCmd.Flags().Bool("no-owner", false, "Skip statements that set object ownership")
+	restoreCmd.Flags().Bool("no-privileges", false, "Skip GRANT and REVOKE statements")
+	restoreCmd.Flags().String("mode", "", "Restore mode: full recreates the database, data loads rows into existing tables (default full)")
+	restoreCmd.Flags().String("conflict", "", "Handling of existing rows in data mode (error, skip, upsert, truncate) (default error)")
+	restoreCmd.Flags().Bool("disable-triggers", false, "Disable triggers and foreign key checks during a data-only restore")
+
+	restoreCmd.Flags().StringArrayP("storage", "s", nil, "Storage location to fetch --file from, repeatable for erasure-coded backups (directory or URL such as s3://bucket/prefix)")
+	restoreCmd.Flags().String("sse-c-key-file", "", "File holding the customer key of backups stored with --sse c")
+	restoreCmd.Flags().String("thaw-tier", "Standard", "Retrieval tier for backups in archive storage classes (Standard, Bulk, Expedited)")
+	restoreCmd.Flags().Int("thaw-days", 1, "Days a thawed backup stays readable")
+	restoreCmd.Flags().Duration("thaw-timeout", 48*time.Hour, "How long to wait for a backup to be thawed and fetched")
 
 	restoreCmd.MarkFlagRequired("host")
-	restoreCmd.MarkFlagRequired("file")
 	restoreCmd.MarkFlagRequired("dbms")
 	restoreCmd.MarkFlagRequired("port")
 	restoreCmd.MarkFlagRequired("username")
 	restoreCmd.MarkFlagRequired("password")
-	restoreCmd.MarkFlagRequired("dbname")
 
 	return restoreCmd
 }
+
+// fetchBackup downloads the backup stored under key into the local restore
+// cache so that an interrupted restore can be resumed from the same file.
+// Backups in archive storage classes are thawed first, and the download is
+// checked against the checksum in the manifest if there is one.
+// The backup is fetched from the first location. Erasure-coded backups are
+// rebuilt from their shards in all locations and deduplicated backups
+// reassembled from their chunks.
+func fetchBackup(ctx context.Context, locations []string, key string, thaw storage.ThawOptions) (string, error) {
+	var backends []storage.Backend
+	defer func() {
+		for _, b := range backends {
+			storage.Close(b)
+		}
+	}()
+	for _, location := range locations {
+		b, err := storage.Open(ctx, location)
+		if err != nil {
+			return "", err
+		}
+		backends = append(backends, b)
+	}
+	b := backends[0]
+	var m *manifest.Manifest
+	if body, err := b.Get(ctx, manifest.PathFor(key)); err == nil {
+		m, _ = manifest.Decode(body)
+		body.Close()
+	}
+	localPath := filepath.Join(os.TempDir(), "guard-restore", filepath.FromSlash(path.Clean("/"+key)))
+	if m != nil && m.Erasure != nil {
+		if err := erasure.Join(ctx, m, backends, localPath); err != nil {
+			return "", err
+		}
+		customLog.Infof("Rebuilt %s to %s", storage.JoinURL(b, key), localPath)
+		return localPath, nil
+	}
+	if m != nil && m.Deduplicated() {
+		if err := dedup.Restore(ctx, b, m, localPath); err != nil {
+			return "", err
+		}
+		customLog.Infof("Reassembled %s to %s", storage.JoinURL(b, key), localPath)
+		return localPath, nil
+	}
+	if err := storage.Thaw(ctx, b, key, thaw); err != nil {
+		return "", err
+	}
+	checksum := ""
+	if m != nil {
+		checksum = m.Checksum
+	}
+	if err := storage.DownloadVerified(ctx, b, key, localPath, checksum); err != nil {
+		return "", err
+	}
+	customLog.Infof("Fetched %s to %s", storage.JoinURL(b, key), localPath)
+	return localPath, nil
+}
@@ -28,5 +28,5 @@ func init() {
 }
 
 func initCommands() {
-	rootCmd.AddCommand(BackupCommand(), VersionCommand(), RestoreCommand(), ScheduleCommand(), UnscheduleCmd(), ListScheduleCommand())
+	rootCmd.AddCommand(BackupCommand(), VersionCommand(), RestoreCommand(), ScheduleCommand(), UnscheduleCmd(), ListScheduleCommand(), DrillCommand(), PruneCommand(), TierCommand(), TransferCommand(), BackupsCommand(), CatalogCommand(), VerifyCommand(), DaemonCommand(), StatusCommand(), RunNowCommand(), PauseCommand(), ResumeCommand())
 }
@@ -1,75 +1,71 @@
 package cmd
 
 import (
-	"path/filepath"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Annany2002/guard/pkg/backup"
-	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/Annany2002/guard/pkg/control"
+	"github.com/Annany2002/guard/pkg/dedup"
+	"github.com/Annany2002/guard/pkg/drill"
+	"github.com/Annany2002/guard/pkg/erasure"
+	"github.com/Annany2002/guard/pkg/jobs"
+	"github.com/Annany2002/guard/pkg/notify"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/tiering"
 	"github.com/robfig/cron/v3"
 	"github.com/spf13/cobra"
 )
 
-var (
-	storagePath string
-	c           cron.Cron
-	jobs        map[cron.EntryID]*cron.Entry
-)
-
 func ScheduleCommand() *cobra.Command {
 	var scheduleCmd = &cobra.Command{
 		Use:   "sched",
 		Short: "Schedule backups",
-		Long:  `Schedule a backup task to run at specified intervals or cron expressions.`,
+		Long: `Schedule a backup task to run at specified intervals or cron expressions.
+
+guard sched runs the job in the foreground until it is stopped. Use
+guard sched add to store the job instead, so that guard daemon runs it
+and it survives restarts.
+
+--storage accepts a storage URL such as s3://bucket/prefix; the legacy values
+"local" (the --path directory) and "s3" (the --bucket bucket) still work.
+Repeat --storage to send every backup to several destinations.
+
+Pass retention flags such as --keep-daily to prune the backups of the
+database in every storage location after each successful backup, and
+--stage flags to move its older backups out of the first storage location
+as in guard tier.
+
+--layout places backups below the storage location, --erasure splits them
+into shards and --dedup stores them as chunks as in guard backup.
+
+Use --task drill to schedule restore drills of the latest backup in the
+storage location instead of backups.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			customLog.Info("Starting scheduling operation...")
 
-			cronExp, _ := cmd.Flags().GetString("cron")
-			// dbms, _ := cmd.Flags().GetString("dbms")
-			host, _ := cmd.Flags().GetString("host")
-			port, _ := cmd.Flags().GetString("port")
-			username, _ := cmd.Flags().GetString("username")
-			password, _ := cmd.Flags().GetString("password")
-			dbname, _ := cmd.Flags().GetString("dbname")
-			storageType, _ := cmd.Flags().GetString("storage")
-			storagePath, _ := cmd.Flags().GetString("path")
-			bucketName, _ := cmd.Flags().GetString("bucket")
+			job, err := jobFromFlags(cmd)
+			if err != nil {
+				customLog.Errorf("%v", err)
+				return
+			}
 
 			// create a cron scheduler
 			c := cron.New()
 
-			backupFunc := func() {
-				customLog.Info("Started backup operation")
-
-				switch storageType {
-				case "local":
-					err := backup.FullBackup(dbname, password, username, host, storagePath, port)
-					if err != nil {
-						customLog.Fatalf("Error while backup: %v", err)
-						return
-					}
-
-				case "s3":
-					// Handle S3 storage
-					s3Client, err := storage.NewS3Client(bucketName)
-					if err != nil {
-						customLog.Errorf("%v", err)
-					}
-
-					objectKey := filepath.Base(backupFilePath)
-
-					err = s3Client.UploadFileToS3(backupFilePath, objectKey)
-					if err != nil {
-						customLog.Errorf("Failed to upload backup file to S3: %v", err)
-						return
-					}
-					customLog.Infof("Storing backup file %s in S3 bucket %s as %s", backupFilePath, bucketName, objectKey)
+			// Add the job function to the cron scheduler
+			_, err = c.AddFunc(job.Cron, func() {
+				if err := runJob(*job); err != nil {
+					customLog.Errorf("Scheduled %s failed: %v", job.Task, err)
 				}
-			}
-
-			// Add the backup function to the cron scheduler
-			_, err := c.AddFunc(cronExp, backupFunc)
+			})
 			if err != nil {
-				customLog.Errorf("Failed to add backup function to cron scheduler: %v", err)
+				customLog.Errorf("Failed to add %s function to cron scheduler: %v", job.Task, err)
 				return
 			}
 
@@ -81,54 +77,289 @@ func ScheduleCommand() *cobra.Command {
 		},
 	}
 
-	scheduleCmd.Flags().StringP("cron", "c", "@daily", "Cron expression for scheduling (e.g., @daily, @hourly, */5 * * * *)")
-	scheduleCmd.Flags().StringP("dbms", "d", "pg", "Database Management System (m: mysql, pg: postgres, mg: mongodb, s: sqlite)")
-	scheduleCmd.Flags().StringP("host", "H", "localhost", "Database host")
-	scheduleCmd.Flags().StringP("port", "p", "5432", "Database port")
-	scheduleCmd.Flags().StringP("username", "u", "", "Database username")
-	scheduleCmd.Flags().StringP("password", "P", "", "Database password")
-	scheduleCmd.Flags().StringP("dbname", "D", "", "Database name")
-	scheduleCmd.Flags().StringP("storage", "s", "local", "Storage location (local, s3, gcs, azure)")
-	scheduleCmd.Flags().StringVar(&storagePath, "path", "backups", "Local storage path (only for local storage)")
-	scheduleCmd.Flags().StringP("bucket", "b", "", "S3 bucket name (only for S3 storage)")
-
-	scheduleCmd.MarkFlagRequired("username")
-	scheduleCmd.MarkFlagRequired("password")
-	scheduleCmd.MarkFlagRequired("dbname")
+	addJobFlags(scheduleCmd)
+	scheduleCmd.AddCommand(addScheduleCommand())
 
 	return scheduleCmd
 }
 
+func addScheduleCommand() *cobra.Command {
+	var addCmd = &cobra.Command{
+		Use:   "add",
+		Short: "Store a scheduled job for guard daemon",
+		Long: `Store a backup or restore drill job in the job store, ~/.guard/jobs.db or
+the file given by --jobs or GUARD_JOBS. guard daemon runs every stored job
+on its schedule and picks up new jobs while it is running. The flags are
+the same as for guard sched.
+
+The job store holds the database password of every job and is only
+readable by its owner.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			job, err := jobFromFlags(cmd)
+			if err != nil {
+				customLog.Fatalf("%v", err)
+			}
+
+			store := openJobStore(cmd)
+			defer store.Close()
+			if err := store.Add(job); err != nil {
+				store.Close()
+				customLog.Fatalf("Failed to store the job: %v", err)
+			}
+			customLog.Infof("Added job %d: %s of %s at %s, next run %s", job.ID, job.Task, job.Database, job.Cron, job.Next(time.Now()).Format(time.DateTime))
+		},
+	}
+
+	addJobFlags(addCmd)
+	addJobStoreFlag(addCmd)
+
+	return addCmd
+}
+
+// addJobFlags registers the flags describing a scheduled job
+func addJobFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("cron", "c", "@daily", "Cron expression for scheduling (e.g., @daily, @hourly, */5 * * * *)")
+	cmd.Flags().StringP("dbms", "d", "pg", "Database Management System (m: mysql, pg: postgres, mg: mongodb, s: sqlite)")
+	cmd.Flags().StringP("host", "H", "localhost", "Database host")
+	cmd.Flags().StringP("port", "p", "5432", "Database port")
+	cmd.Flags().StringP("username", "u", "", "Database username")
+	cmd.Flags().StringP("password", "P", "", "Database password")
+	cmd.Flags().StringP("dbname", "D", "", "Database name")
+	cmd.Flags().StringArrayP("storage", "s", []string{"local"}, "Storage location, repeatable: a URL such as s3://bucket/prefix, gs://bucket or azblob://container, or local (the --path directory), s3, gcs or azure")
+	cmd.Flags().String("require", "all", "Destinations that must store the backup: all, any or a number")
+	addSSEFlags(cmd)
+	addLayoutFlag(cmd)
+	addErasureFlag(cmd)
+	addDedupFlag(cmd)
+	addFilterFlags(cmd)
+	addCompressionFlag(cmd)
+	cmd.Flags().String("path", "backups", "Local storage path (only for local storage)")
+	cmd.Flags().StringP("bucket", "b", "", "S3 bucket name (only for S3 storage)")
+	cmd.Flags().String("task", jobs.TaskBackup, "Task to schedule (backup, drill)")
+	addDrillFlags(cmd)
+	addRetentionFlags(cmd)
+	addTieringFlags(cmd)
+	cmd.Flags().StringArray("notify", nil, "Webhook URL to post the outcome of every run to (repeatable)")
+	cmd.Flags().String("notify-on", notify.OnFailure, "When to notify the --notify webhooks: failure, success or always")
+
+	cmd.MarkFlagRequired("username")
+	cmd.MarkFlagRequired("password")
+	cmd.MarkFlagRequired("dbname")
+}
+
+// jobFromFlags reads a job from the flags registered by addJobFlags and
+// checks that it can run
+func jobFromFlags(cmd *cobra.Command) (*jobs.Job, error) {
+	storagePath, _ := cmd.Flags().GetString("path")
+	bucketName, _ := cmd.Flags().GetString("bucket")
+	locations, err := storageLocations(cmd, storagePath, bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage location: %w", err)
+	}
+
+	job := &jobs.Job{Storage: locations, Retention: retentionSpec(cmd)}
+	job.Task, _ = cmd.Flags().GetString("task")
+	job.Cron, _ = cmd.Flags().GetString("cron")
+	job.Host, _ = cmd.Flags().GetString("host")
+	job.Port, _ = cmd.Flags().GetString("port")
+	job.Username, _ = cmd.Flags().GetString("username")
+	job.Password, _ = cmd.Flags().GetString("password")
+	job.Database, _ = cmd.Flags().GetString("dbname")
+	job.Require, _ = cmd.Flags().GetString("require")
+	job.Layout, _ = cmd.Flags().GetString("layout")
+	job.Erasure, _ = cmd.Flags().GetString("erasure")
+	job.Dedup, _ = cmd.Flags().GetBool("dedup")
+	filter := tableFilter(cmd)
+	job.Tables = jobs.Filter{Schema: filter.Schema, Prefix: filter.Prefix, Suffix: filter.Suffix}
+	job.Compression, _ = cmd.Flags().GetString("compress")
+	urls, _ := cmd.Flags().GetStringArray("notify")
+	on, _ := cmd.Flags().GetString("notify-on")
+	for _, url := range urls {
+		job.Notify = append(job.Notify, jobs.Notification{URL: url, On: on})
+	}
+	job.Stages, _ = cmd.Flags().GetStringArray("stage")
+	job.Assertions, _ = cmd.Flags().GetStringArray("assert")
+	job.AssertFile, _ = cmd.Flags().GetString("assert-file")
+	job.Keep, _ = cmd.Flags().GetBool("keep")
+
+	if _, err := planJob(*job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// jobPlan is a job with its options parsed
+type jobPlan struct {
+	job         jobs.Job
+	policy      backup.Policy
+	scheme      erasure.Scheme
+	tables      backup.Filter
+	compression backup.Compression
+	retain      retention.Policy
+	tiers       tiering.Policy
+	notify      []notify.Target
+}
+
+// planJob parses the options of a job
+func planJob(job jobs.Job) (*jobPlan, error) {
+	if err := job.Validate(); err != nil {
+		return nil, err
+	}
+	plan := &jobPlan{job: job}
+	var err error
+	if plan.policy, err = backup.ParsePolicy(job.Require); err != nil {
+		return nil, err
+	}
+	if err := backup.ValidateLayout(job.Layout); err != nil {
+		return nil, err
+	}
+	if plan.scheme, err = erasure.ParseScheme(job.Erasure); err != nil {
+		return nil, err
+	}
+	plan.tables = backup.Filter{Schema: job.Tables.Schema, Prefix: job.Tables.Prefix, Suffix: job.Tables.Suffix}
+	if err := plan.tables.Validate(); err != nil {
+		return nil, err
+	}
+	if plan.compression, err = backup.ParseCompression(job.Compression); err != nil {
+		return nil, err
+	}
+	if plan.retain, err = retentionFrom(job.Retention); err != nil {
+		return nil, fmt.Errorf("invalid retention policy: %w", err)
+	}
+	// Tiering moves backups out of the first destination
+	if plan.tiers, err = tieringFrom(job.Storage[0], job.Stages); err != nil {
+		return nil, fmt.Errorf("invalid tiering policy: %w", err)
+	}
+	for _, n := range job.Notify {
+		target := notify.Target{URL: n.URL, On: n.On, Headers: n.Headers}
+		if err := target.Validate(); err != nil {
+			return nil, err
+		}
+		plan.notify = append(plan.notify, target)
+	}
+	return plan, nil
+}
+
+// runJob runs a scheduled job once and sends its notifications
+func runJob(job jobs.Job) error {
+	plan, err := planJob(job)
+	if err != nil {
+		return err
+	}
+	// Passwords kept outside the job store are read anew on every run, so
+	// that rotated passwords take effect
+	if plan.job.Password, err = job.ResolvePassword(); err != nil {
+		return err
+	}
+	start := time.Now()
+	if job.Task == jobs.TaskDrill {
+		err = plan.drill()
+	} else {
+		err = plan.backup()
+	}
+	if len(plan.notify) > 0 {
+		event := notify.NewEvent(job.ID, job.Name, job.Task, job.Database, start, err)
+		if nerr := notify.Send(context.TODO(), plan.notify, event); nerr != nil {
+			customLog.Errorf("Job %d: %v", job.ID, nerr)
+		}
+	}
+	return err
+}
+
+// backup takes a backup, then applies the retention and tiering policies
+func (p *jobPlan) backup() error {
+	customLog.Info("Started backup operation")
+	job := p.job
+	_, err := runBackup(context.TODO(), backup.Options{
+		DBName:      job.Database,
+		Password:    job.Password,
+		Username:    job.Username,
+		Host:        job.Host,
+		Port:        job.Port,
+		Layout:      job.Layout,
+		Tables:      p.tables,
+		Compression: p.compression,
+	}, job.Storage, p.policy, p.scheme, job.Dedup)
+	if err != nil {
+		return fmt.Errorf("error while backup: %w", err)
+	}
+
+	var errs []error
+	if !p.retain.IsZero() {
+		if err := runPrune(context.TODO(), job.Storage, p.retain, retention.PruneOptions{Database: job.Database}, dedup.DefaultGrace); err != nil {
+			errs = append(errs, fmt.Errorf("retention failed: %w", err))
+		}
+	}
+	if len(p.tiers.Stages) > 0 {
+		if err := runTiering(context.TODO(), p.tiers, tiering.Options{Database: job.Database}); err != nil {
+			errs = append(errs, fmt.Errorf("tiering failed: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// drill runs a restore drill of the latest backup in the first destination
+func (p *jobPlan) drill() error {
+	customLog.Info("Started restore drill")
+	job := p.job
+	opts := drill.Options{
+		Host:       job.Host,
+		Port:       job.Port,
+		Username:   job.Username,
+		Password:   job.Password,
+		Assertions: job.Assertions,
+		Keep:       job.Keep,
+	}
+	if err := runDrill(opts, job.Storage[0], job.Database, job.AssertFile); err != nil {
+		return fmt.Errorf("restore drill failed: %w", err)
+	}
+	return nil
+}
+
+func addJobStoreFlag(cmd *cobra.Command) {
+	cmd.Flags().String("jobs", jobs.DefaultPath(), "Path of the job store")
+}
+
+func openJobStore(cmd *cobra.Command) *jobs.Store {
+	path, _ := cmd.Flags().GetString("jobs")
+	store, err := jobs.Open(path)
+	if err != nil {
+		customLog.Fatalf("%v", err)
+	}
+	return store
+}
+
 func UnscheduleCmd() *cobra.Command {
 	var unscheduleCmd = &cobra.Command{
 		Use:   "unschedule",
 		Short: "Unschedule a backup task",
-		Long:  `Unschedule a backup task using its job ID.`,
+		Long: `Unschedule a backup task using its job ID. The job is removed from the
+job store; a running guard daemon is asked to remove it, so that it stops
+scheduling the job right away.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			customLog.Info("Starting unschedule operation...")
 
 			jobID, _ := cmd.Flags().GetInt64("id")
 
-			// Convert int64 to cron.EntryID
-			entryID := cron.EntryID(jobID)
-
-			// Check if the job exists
-			if _, exists := jobs[entryID]; !exists {
-				customLog.Errorf("Job ID %d not found", jobID)
-				return
+			err := daemonClient(cmd).Unschedule(context.Background(), jobID)
+			if errors.Is(err, control.ErrNotRunning) {
+				// Remove the job from the job store
+				store := openJobStore(cmd)
+				err = store.Remove(jobID)
+				store.Close()
+			}
+			if err != nil {
+				customLog.Fatalf("%v", err)
 			}
 
-			// Remove the job from the cron scheduler
-			c.Remove(entryID)
-
-			// Remove the job from the jobs map
-			delete(jobs, entryID)
-
-			customLog.Infof("Unscheduled backup job with ID %d", jobID)
+			customLog.Infof("Unscheduled job with ID %d", jobID)
 		},
 	}
 
 	unscheduleCmd.Flags().Int64P("id", "j", 0, "Job ID to unschedule")
+	addJobStoreFlag(unscheduleCmd)
+	addSocketFlag(unscheduleCmd)
 
 	unscheduleCmd.MarkFlagRequired("id")
 
@@ -139,20 +370,54 @@ func ListScheduleCommand() *cobra.Command {
 	var listScheduleCmd = &cobra.Command{
 		Use:   "list",
 		Short: "List all scheduled backup jobs",
-		Long:  `List all scheduled backup jobs with their IDs and cron expressions.`,
+		Long: `List all scheduled jobs with their IDs, cron expressions and next runs.
+
+While guard daemon runs, the list comes from the daemon and also shows
+whether each job is running or paused and how its last run went. Otherwise
+the job store is read.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			customLog.Info("Listing scheduled backup jobs...")
+			statuses, err := daemonClient(cmd).Jobs(context.Background())
+			if err == nil {
+				if len(statuses) == 0 {
+					customLog.Info("No scheduled jobs found.")
+					return
+				}
+				printStatuses(statuses)
+				return
+			}
+			if !errors.Is(err, control.ErrNotRunning) {
+				customLog.Fatalf("%v", err)
+			}
 
-			if len(jobs) == 0 {
+			store := openJobStore(cmd)
+			defer store.Close()
+			list, err := store.List()
+			if err != nil {
+				store.Close()
+				customLog.Fatalf("Failed to list jobs: %v", err)
+			}
+
+			if len(list) == 0 {
 				customLog.Info("No scheduled jobs found.")
 				return
 			}
 
-			for id, entry := range jobs {
-				customLog.Infof("Job ID: %d, Cron Expression: %s", id, entry.Schedule)
+			now := time.Now()
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tTASK\tDATABASE\tCRON\tNEXT RUN\tSTORAGE")
+			for _, job := range list {
+				next := job.Next(now).Format(time.DateTime)
+				if job.Paused {
+					next = "paused"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", job.ID, jobName(job), job.Task, job.Database, job.Cron, next, strings.Join(job.Storage, " "))
 			}
+			w.Flush()
 		},
 	}
 
+	addJobStoreFlag(listScheduleCmd)
+	addSocketFlag(listScheduleCmd)
+
 	return listScheduleCmd
 }
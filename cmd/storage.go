@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/backup"
+	"github.com/Annany2002/guard/pkg/catalog"
+	"github.com/Annany2002/guard/pkg/erasure"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+// uploadAttempts is how often a backup upload is tried before giving up
+const uploadAttempts = 3
+
+// legacySchemes maps the legacy --storage values to storage URL schemes
+var legacySchemes = map[string]string{"s3": "s3", "gcs": "gs", "azure": "azblob"}
+
+// storageLocation resolves a --storage value into a storage URL. The legacy
+// values "local", "s3", "gcs" and "azure" map to the local directory and the bucket
+// given by the other flags (or BUCKET_NAME); anything else is used as a URL.
+func storageLocation(storageType, localPath, bucket string) (string, error) {
+	switch storageType {
+	case "", "local":
+		return localPath, nil
+	case "s3", "gcs", "azure":
+		if bucket == "" {
+			bucket = os.Getenv("BUCKET_NAME")
+		}
+		if bucket == "" {
+			return "", fmt.Errorf("no bucket given for %s storage, use a storage URL or set BUCKET_NAME", storageType)
+		}
+		return legacySchemes[storageType] + "://" + bucket, nil
+	}
+	return storageType, nil
+}
+
+// storageLocations resolves the values of a repeatable --storage flag. When
+// the flag is not given, the space separated locations in GUARD_STORAGE are
+// used instead. Encryption flags apply to every S3 location.
+func storageLocations(cmd *cobra.Command, localPath, bucket string) ([]string, error) {
+	values, _ := cmd.Flags().GetStringArray("storage")
+	if env := strings.Fields(os.Getenv("GUARD_STORAGE")); !cmd.Flags().Changed("storage") && len(env) > 0 {
+		values = env
+	}
+	locations := make([]string, 0, len(values))
+	for _, value := range values {
+		location, err := storageLocation(value, localPath, bucket)
+		if err != nil {
+			return nil, err
+		}
+		if location, err = withSSE(cmd, location); err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+func addLayoutFlag(cmd *cobra.Command) {
+	cmd.Flags().String("layout", backup.DefaultLayout, "Path of every backup below the storage location, e.g. {db}/{yyyy}/{mm}/{db}-{ts}.{ext}")
+}
+
+func addErasureFlag(cmd *cobra.Command) {
+	cmd.Flags().String("erasure", "", "Split every backup into DATA+PARITY shards, e.g. 3+2, one per --storage location")
+}
+
+// erasureScheme reads the --erasure flag
+func erasureScheme(cmd *cobra.Command) (erasure.Scheme, error) {
+	value, _ := cmd.Flags().GetString("erasure")
+	return erasure.ParseScheme(value)
+}
+
+func addDedupFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("dedup", false, "Store backups as deduplicated chunks")
+}
+
+func addFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().String("schema", "", "Schema to back up (default public)")
+	cmd.Flags().String("table-prefix", "", "Only back up tables whose names start with this")
+	cmd.Flags().String("table-suffix", "", "Only back up tables whose names end with this")
+}
+
+// tableFilter reads the flags registered by addFilterFlags
+func tableFilter(cmd *cobra.Command) backup.Filter {
+	var f backup.Filter
+	f.Schema, _ = cmd.Flags().GetString("schema")
+	f.Prefix, _ = cmd.Flags().GetString("table-prefix")
+	f.Suffix, _ = cmd.Flags().GetString("table-suffix")
+	return f
+}
+
+func addCompressionFlag(cmd *cobra.Command) {
+	cmd.Flags().String("compress", "none", "Compress backups: none, gzip or gzip:LEVEL (1-9)")
+}
+
+func addSSEFlags(cmd *cobra.Command) {
+	cmd.Flags().String("sse", "", "Server-side encryption of S3 backups: aes256, kms or c (customer-provided key)")
+	cmd.Flags().String("sse-kms-key-id", "", "KMS key for --sse kms (default the AWS managed key)")
+	cmd.Flags().String("sse-c-key-file", "", "File holding the 32 byte key for --sse c, raw or base64 encoded")
+}
+
+// withSSE adds the encryption flags of cmd, if it has any, as parameters to
+// an s3:// location. A customer key file alone implies --sse c.
+func withSSE(cmd *cobra.Command, location string) (string, error) {
+	mode, _ := cmd.Flags().GetString("sse")
+	kmsKeyID, _ := cmd.Flags().GetString("sse-kms-key-id")
+	keyFile, _ := cmd.Flags().GetString("sse-c-key-file")
+	if mode == "" && keyFile != "" {
+		mode = storage.SSEC
+	}
+	if mode == "" && kmsKeyID == "" {
+		return location, nil
+	}
+
+	u, err := storage.ParseURL(location)
+	if err != nil || u.Scheme != "s3" {
+		return location, err
+	}
+	q := u.Query()
+	for param, value := range map[string]string{"sse": mode, "sse_kms_key_id": kmsKeyID, "sse_c_key_file": keyFile} {
+		if value != "" && !q.Has(param) {
+			q.Set(param, value)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// runBackup dumps a database into a staging directory and stores the dump
+// and its manifest in every location, or with an erasure scheme one shard
+// of the dump in every location, or with deduplicate the chunks of the dump
+// that are not stored yet
+func runBackup(ctx context.Context, opts backup.Options, locations []string, policy backup.Policy, scheme erasure.Scheme, deduplicate bool) (*backup.Result, error) {
+	if policy.MinStored > len(locations) {
+		return nil, fmt.Errorf("policy requires %d destinations but only %d are given", policy.MinStored, len(locations))
+	}
+	if !scheme.IsZero() && scheme.Shards() != len(locations) {
+		return nil, fmt.Errorf("erasure scheme %s needs %d storage locations, %d are given", scheme, scheme.Shards(), len(locations))
+	}
+	if !scheme.IsZero() && deduplicate {
+		return nil, fmt.Errorf("erasure-coded backups cannot be deduplicated")
+	}
+	staging, err := os.MkdirTemp("", "guard-backup-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	start := time.Now()
+	opts.OutputDir = staging
+	result, err := backup.Run(opts)
+	if err != nil {
+		recordBackup(&catalog.Entry{
+			ID:              backup.NewID(opts.DBName, start),
+			Database:        opts.DBName,
+			DBMS:            "postgres",
+			Status:          catalog.StatusFailed,
+			Error:           err.Error(),
+			CreatedAt:       start,
+			DurationSeconds: time.Since(start).Seconds(),
+		})
+		return nil, err
+	}
+
+	switch {
+	case !scheme.IsZero():
+		err = backup.Disperse(ctx, result, locations, uploadAttempts, scheme, policy)
+	case deduplicate:
+		err = backup.Deduplicate(ctx, result, locations, uploadAttempts, policy)
+	default:
+		err = backup.Replicate(ctx, result, locations, uploadAttempts, policy)
+	}
+	entry := catalog.FromManifest(result.Manifest)
+	entry.DurationSeconds = time.Since(start).Seconds()
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	recordBackup(entry)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// recordBackup adds a backup to the catalog. A catalog that cannot be
+// written does not fail the backup.
+func recordBackup(entry *catalog.Entry) {
+	cat, err := catalog.Open(catalog.DefaultPath())
+	if err != nil {
+		customLog.Warnf("Failed to record backup %s in the catalog: %v", entry.ID, err)
+		return
+	}
+	defer cat.Close()
+	if err := cat.Put(entry); err != nil {
+		customLog.Warnf("Failed to record backup %s in the catalog: %v", entry.ID, err)
+	}
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Annany2002/guard/pkg/catalog"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/tiering"
+	"github.com/spf13/cobra"
+)
+
+func TierCommand() *cobra.Command {
+	var tierCmd = &cobra.Command{
+		Use:   "tier",
+		Short: "Move older backups to cheaper storage",
+		Long: `Move backups to other storage locations and storage classes as they age.
+
+Each --stage is AGE:LOCATION or AGE:CLASS, ordered from young to old. A
+location stage moves backups older than AGE from the previous location to
+LOCATION, a class stage moves them to a colder storage class such as
+STANDARD_IA, GLACIER or DEEP_ARCHIVE within the current location. For
+example, to keep a week on local disk, move to S3 Standard after 7 days,
+to Glacier after 30 days and to Deep Archive after 180 days:
+
+  guard tier --storage ./backup --stage 7d:s3://backups/prod \
+    --stage 30d:GLACIER --stage 180d:DEEP_ARCHIVE
+
+Restores from Glacier and Deep Archive wait until the backup is thawed.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			dbname, _ := cmd.Flags().GetString("dbname")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			locations, err := storageLocations(cmd, "./backup", "")
+			if err != nil {
+				customLog.Fatalf("Invalid storage location: %v", err)
+			}
+			if len(locations) != 1 {
+				customLog.Fatalf("Tiering needs exactly one source location")
+			}
+			policy, err := tieringPolicy(cmd, locations[0])
+			if err != nil {
+				customLog.Fatalf("Invalid tiering policy: %v", err)
+			}
+			if len(policy.Stages) == 0 {
+				customLog.Fatalf("No tiering stage given, use --stage")
+			}
+
+			if err := runTiering(context.TODO(), policy, tiering.Options{Database: dbname, DryRun: dryRun}); err != nil {
+				customLog.Fatalf("Tiering failed: %v", err)
+			}
+		},
+	}
+
+	tierCmd.Flags().StringArrayP("storage", "s", []string{"./backup"}, "Storage location new backups are written to (directory or URL such as s3://bucket/prefix)")
+	tierCmd.Flags().StringP("dbname", "D", "", "Only move backups of this database")
+	tierCmd.Flags().Bool("dry-run", false, "Show what would be moved without moving anything")
+	addTieringFlags(tierCmd)
+
+	return tierCmd
+}
+
+func addTieringFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("stage", nil, "Tiering stage AGE:LOCATION or AGE:CLASS, repeatable (e.g. 7d:s3://bucket/prefix, 30d:GLACIER)")
+}
+
+// tieringPolicy reads the --stage flags for backups written to source
+func tieringPolicy(cmd *cobra.Command, source string) (tiering.Policy, error) {
+	specs, _ := cmd.Flags().GetStringArray("stage")
+	return tieringFrom(source, specs)
+}
+
+// tieringFrom parses tiering stages for backups written to source
+func tieringFrom(source string, specs []string) (tiering.Policy, error) {
+	policy := tiering.Policy{Source: source}
+	for _, spec := range specs {
+		stage, err := tiering.ParseStage(spec)
+		if err != nil {
+			return policy, err
+		}
+		policy.Stages = append(policy.Stages, stage)
+	}
+	return policy, policy.Validate()
+}
+
+// runTiering applies the tiering policy and records moved backups in the
+// catalog. The catalog is only opened once the backups have been moved, so
+// that other commands are not locked out of it while the data is copied.
+func runTiering(ctx context.Context, policy tiering.Policy, opts tiering.Options) error {
+	actions, err := tiering.Apply(ctx, policy, opts)
+
+	var cat *catalog.Catalog
+	if !opts.DryRun {
+		var openErr error
+		if cat, openErr = catalog.Open(catalog.DefaultPath()); openErr != nil {
+			customLog.Warnf("Moved backups will not be updated in the catalog: %v", openErr)
+		} else {
+			defer cat.Close()
+		}
+	}
+
+	moved, pending := 0, 0
+	for _, a := range actions {
+		if a.Skipped == "" {
+			pending++
+		}
+		if !a.Done {
+			continue
+		}
+		moved++
+		if cat == nil {
+			continue
+		}
+		id := a.Backup.Manifest.ID
+		location := catalog.Location{URL: a.From, Key: a.Backup.Key, Status: manifest.StatusStored, Class: a.Class}
+		if a.To != "" {
+			location.URL = a.To
+			if err := cat.RemoveLocation(id, a.From); err != nil && !errors.Is(err, catalog.ErrNotFound) {
+				customLog.Warnf("Failed to update backup %s in the catalog: %v", id, err)
+			}
+		}
+		if err := cat.SetLocation(id, location); err != nil && !errors.Is(err, catalog.ErrNotFound) {
+			customLog.Warnf("Failed to update backup %s in the catalog: %v", id, err)
+		}
+	}
+	if opts.DryRun {
+		customLog.Infof("Would move %d backups", pending)
+	} else {
+		customLog.Infof("Moved %d backups", moved)
+	}
+	return err
+}
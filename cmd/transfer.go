@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Annany2002/guard/pkg/catalog"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/Annany2002/guard/pkg/transfer"
+	"github.com/spf13/cobra"
+)
+
+func TransferCommand() *cobra.Command {
+	var transferCmd = &cobra.Command{
+		Use:   "transfer",
+		Short: "Copy or move backups between storage locations",
+		Long: `Stream backups and their manifests from one storage location to another.
+Every copy is read back and its SHA-256 checksum compared with the manifest
+before the manifest is written, so an interrupted or corrupted transfer
+never looks like a complete backup. Deduplicated backups are copied chunk by
+chunk, skipping the chunks the destination already holds.
+
+--select picks backups with comma separated terms: db=NAME, id=ID,
+since=AGE (younger than) and before=AGE (older than), for example
+'db=orders,since=30d'. With --delete-source the source copy of every
+verified backup is deleted, unless it is locked.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx := context.TODO()
+			fromLocation, _ := cmd.Flags().GetString("from")
+			toLocation, _ := cmd.Flags().GetString("to")
+			selector, _ := cmd.Flags().GetString("select")
+			deleteSource, _ := cmd.Flags().GetBool("delete-source")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			sel, err := transfer.ParseSelector(selector)
+			if err != nil {
+				customLog.Fatalf("%v", err)
+			}
+			from, err := storage.Open(ctx, fromLocation)
+			if err != nil {
+				customLog.Fatalf("Failed to open %s: %v", fromLocation, err)
+			}
+			defer storage.Close(from)
+			to, err := storage.Open(ctx, toLocation)
+			if err != nil {
+				customLog.Fatalf("Failed to open %s: %v", toLocation, err)
+			}
+			defer storage.Close(to)
+
+			items, err := transfer.Transfer(ctx, from, to, transfer.Options{Select: sel, DeleteSource: deleteSource, DryRun: dryRun})
+			if dryRun {
+				customLog.Infof("Would transfer %d backups", len(items))
+			} else {
+				recordTransfer(items, from.URL(), to.URL())
+			}
+			if err != nil {
+				customLog.Fatalf("Transfer failed: %v", err)
+			}
+		},
+	}
+
+	transferCmd.Flags().String("from", "", "Storage location to copy backups from (directory or URL such as s3://bucket/prefix)")
+	transferCmd.Flags().String("to", "", "Storage location to copy backups to")
+	transferCmd.Flags().String("select", "", "Backups to transfer, e.g. 'db=orders,since=30d' (default all)")
+	transferCmd.Flags().Bool("delete-source", false, "Delete the source copy of every verified backup")
+	transferCmd.Flags().Bool("dry-run", false, "Show what would be transferred without copying anything")
+	transferCmd.MarkFlagRequired("from")
+	transferCmd.MarkFlagRequired("to")
+
+	return transferCmd
+}
+
+// recordTransfer adds the new copies to the catalog and marks deleted
+// sources. Backups the catalog does not know are added from their manifest.
+func recordTransfer(items []transfer.Item, fromURL, toURL string) {
+	cat, err := catalog.Open(catalog.DefaultPath())
+	if err != nil {
+		customLog.Warnf("Transferred backups will not be updated in the catalog: %v", err)
+		return
+	}
+	defer cat.Close()
+
+	copied, deleted := 0, 0
+	for _, item := range items {
+		if !item.Copied {
+			continue
+		}
+		copied++
+		m := item.Backup.Manifest
+		// The catalog records deduplicated backups by their manifest
+		key := item.Backup.Key
+		if m.Deduplicated() {
+			key = manifest.PathFor(key)
+		}
+		location := catalog.Location{URL: toURL, Key: key, Status: manifest.StatusStored}
+		err := cat.SetLocation(m.ID, location)
+		if errors.Is(err, catalog.ErrNotFound) {
+			entry := catalog.FromManifest(m)
+			entry.Locations = []catalog.Location{location}
+			if !item.Deleted {
+				entry.Locations = append(entry.Locations, catalog.Location{URL: fromURL, Key: key, Status: manifest.StatusStored})
+			}
+			entry.UpdateStatus()
+			err = cat.Put(entry)
+		}
+		if err != nil {
+			customLog.Warnf("Failed to update backup %s in the catalog: %v", m.ID, err)
+		}
+		if item.Deleted {
+			deleted++
+			if err := cat.RemoveLocation(m.ID, fromURL); err != nil {
+				customLog.Warnf("Failed to update backup %s in the catalog: %v", m.ID, err)
+			}
+		}
+	}
+	customLog.Infof("Transferred %d of %d backups, deleted %d from %s", copied, len(items), deleted, fromURL)
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Annany2002/guard/pkg/dedup"
+	"github.com/Annany2002/guard/pkg/erasure"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/Annany2002/guard/pkg/transfer"
+	"github.com/spf13/cobra"
+)
+
+func VerifyCommand() *cobra.Command {
+	var verifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Check that stored backups are intact",
+		Long: `Read stored backups and compare them with the checksums in their manifests.
+
+Every backup in the --storage locations is checked, or only the one given by
+--file. Backups taken with --erasure are checked shard by shard across all
+of their storage locations, and the health of every shard is shown. Pass
+every location of such a backup with a repeated --storage so that their
+options, such as endpoints and keys, are used to read the shards. A backup
+that still has enough healthy shards to be restored is reported as degraded.
+Deduplicated backups are checked chunk by chunk.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx := context.TODO()
+			dbname, _ := cmd.Flags().GetString("dbname")
+			file, _ := cmd.Flags().GetString("file")
+
+			locations, err := storageLocations(cmd, "./backup", "")
+			if err != nil {
+				customLog.Fatalf("Invalid storage location: %v", err)
+			}
+			var backends []storage.Backend
+			for _, location := range locations {
+				b, err := storage.Open(ctx, location)
+				if err != nil {
+					customLog.Errorf("Failed to open %s: %v", location, err)
+					continue
+				}
+				defer storage.Close(b)
+				backends = append(backends, b)
+			}
+			if len(backends) == 0 {
+				customLog.Fatalf("None of the storage locations can be opened")
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "BACKUP\tSHARD\tLOCATION\tSTATUS\tDETAIL")
+			failed, verified := 0, 0
+			// An erasure-coded backup has its manifest in every location of
+			// its shards but is checked once
+			dispersed := make(map[string]bool)
+			for _, b := range backends {
+				backups, err := retention.Scan(ctx, b, dbname)
+				if err != nil {
+					customLog.Errorf("Failed to list backups in %s: %v", b.URL(), err)
+					failed++
+					continue
+				}
+				if file != "" {
+					backups = selectBackup(backups, file)
+				}
+				for _, backup := range backups {
+					if m := backup.Manifest; m.Erasure != nil {
+						if dispersed[m.ID] {
+							continue
+						}
+						dispersed[m.ID] = true
+					}
+					verified++
+					if !verifyBackup(ctx, w, b, backup, backends) {
+						failed++
+					}
+				}
+			}
+			w.Flush()
+			if file != "" && verified == 0 {
+				customLog.Fatalf("No backup %s in the storage locations", file)
+			}
+			if failed > 0 {
+				customLog.Fatalf("%d of %d backups cannot be restored", failed, verified)
+			}
+			customLog.Infof("Verified %d backups", verified)
+		},
+	}
+
+	verifyCmd.Flags().StringArrayP("storage", "s", []string{"./backup"}, "Storage location of the backups, repeatable (directory or URL such as s3://bucket/prefix)")
+	verifyCmd.Flags().StringP("dbname", "D", "", "Only verify backups of this database")
+	verifyCmd.Flags().StringP("file", "f", "", "Only verify this backup")
+
+	return verifyCmd
+}
+
+// selectBackup returns the backup stored under key
+func selectBackup(backups []retention.Backup, key string) []retention.Backup {
+	for _, backup := range backups {
+		if backup.Key == key {
+			return []retention.Backup{backup}
+		}
+	}
+	return nil
+}
+
+// verifyBackup prints the state of a backup and reports whether it can be
+// restored
+func verifyBackup(ctx context.Context, w *tabwriter.Writer, b storage.Backend, backup retention.Backup, backends []storage.Backend) bool {
+	m := backup.Manifest
+	if m.Deduplicated() {
+		report, err := dedup.Verify(ctx, b, m)
+		status, detail := erasure.StatusHealthy, fmt.Sprintf("%d chunks", report.Chunks)
+		switch {
+		case err != nil:
+			status, detail = erasure.StatusUnreachable, err.Error()
+		case len(report.Missing) > 0:
+			status, detail = erasure.StatusMissing, fmt.Sprintf("%d of %d chunks not found, %d corrupt", len(report.Missing), report.Chunks, len(report.Corrupt))
+		case len(report.Corrupt) > 0:
+			status, detail = erasure.StatusCorrupt, fmt.Sprintf("%d of %d chunks corrupt", len(report.Corrupt), report.Chunks)
+		}
+		fmt.Fprintf(w, "%s\t-\t%s\t%s\t%s\n", m.ID, b.URL(), status, detail)
+		return status == erasure.StatusHealthy
+	}
+	if m.Erasure == nil {
+		status, detail := erasure.StatusHealthy, ""
+		checksum, err := transfer.Checksum(ctx, b, backup.Key)
+		switch {
+		case errors.Is(err, storage.ErrNotExist):
+			status, detail = erasure.StatusMissing, "backup not found"
+		case err != nil:
+			status, detail = erasure.StatusUnreachable, err.Error()
+		case m.Checksum == "":
+			detail = "no checksum recorded"
+		case checksum != m.Checksum:
+			status, detail = erasure.StatusCorrupt, fmt.Sprintf("checksum %s, expected %s", checksum, m.Checksum)
+		}
+		fmt.Fprintf(w, "%s\t-\t%s\t%s\t%s\n", m.ID, b.URL(), status, detail)
+		return status == erasure.StatusHealthy
+	}
+
+	report, err := erasure.Verify(ctx, m, backends)
+	if err != nil {
+		fmt.Fprintf(w, "%s\t-\t%s\t%s\t%v\n", m.ID, b.URL(), erasure.StatusUnreachable, err)
+		return false
+	}
+	for _, h := range report {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", m.ID, h.Shard.Index, h.Shard.URL, h.Status, h.Error)
+	}
+	healthy := erasure.Healthy(report)
+	switch {
+	case healthy < m.Erasure.Data:
+		customLog.Errorf("Backup %s has %d healthy shards, %d are needed to restore it", m.ID, healthy, m.Erasure.Data)
+		return false
+	case healthy < len(report):
+		customLog.Warnf("Backup %s is degraded: %d of %d shards are healthy, it can lose %d more", m.ID, healthy, len(report), healthy-m.Erasure.Data)
+	}
+	return true
+}
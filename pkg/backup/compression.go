@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Compression algorithms
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// Compression is how a dump is compressed before it is stored
+type Compression struct {
+	// Algorithm is CompressionGzip, or empty for uncompressed dumps
+	Algorithm string
+	// Level is the gzip level from 1 to 9, 0 for the default level
+	Level int
+}
+
+// ParseCompression parses a compression such as gzip or gzip:9. An empty
+// string and none leave dumps uncompressed.
+func ParseCompression(s string) (Compression, error) {
+	if s == "" || s == CompressionNone {
+		return Compression{}, nil
+	}
+	algorithm, level, hasLevel := strings.Cut(s, ":")
+	if algorithm != CompressionGzip {
+		return Compression{}, fmt.Errorf("unknown compression %q, expected none, gzip or gzip:LEVEL", s)
+	}
+	c := Compression{Algorithm: algorithm}
+	if hasLevel {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < gzip.BestSpeed || n > gzip.BestCompression {
+			return Compression{}, fmt.Errorf("invalid gzip level in %q, expected 1 to 9", s)
+		}
+		c.Level = n
+	}
+	return c, nil
+}
+
+// IsZero reports whether dumps are left uncompressed
+func (c Compression) IsZero() bool {
+	return c.Algorithm == ""
+}
+
+func (c Compression) String() string {
+	switch {
+	case c.IsZero():
+		return CompressionNone
+	case c.Level != 0:
+		return fmt.Sprintf("%s:%d", c.Algorithm, c.Level)
+	}
+	return c.Algorithm
+}
+
+// Ext returns the file extension the compression adds, restore picks the
+// decompressor by it
+func (c Compression) Ext() string {
+	if c.IsZero() {
+		return ""
+	}
+	return ".gz"
+}
+
+// compressFile writes a compressed copy of the file at path next to it and
+// removes the original. It returns the path of the copy.
+func compressFile(path string, c Compression) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	target := path + c.Ext()
+	dst, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	zw, err := gzip.NewWriterLevel(dst, level)
+	if err != nil {
+		dst.Close()
+		os.Remove(target)
+		return "", err
+	}
+	if _, err := io.Copy(zw, src); err != nil {
+		zw.Close()
+		dst.Close()
+		os.Remove(target)
+		return "", fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(target)
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(target)
+		return "", err
+	}
+	src.Close()
+	os.Remove(path)
+	return target, nil
+}
@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/Annany2002/guard/pkg/erasure"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+// Disperse erasure codes the dump into one shard per location and stores
+// every shard, then the manifest, which records where each shard is, next
+// to each shard. Any scheme.Data stored shards are enough to restore the
+// backup; the policy decides how many must be stored for the backup to
+// succeed, and never fewer than scheme.Data.
+func Disperse(ctx context.Context, result *Result, locations []string, attempts int, scheme erasure.Scheme, policy Policy) error {
+	if len(locations) != scheme.Shards() {
+		return fmt.Errorf("erasure scheme %s needs %d storage locations, %d are given", scheme, scheme.Shards(), len(locations))
+	}
+	dir, err := os.MkdirTemp("", "guard-shards-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	paths, layout, err := erasure.Split(result.FilePath, result.Manifest.File, scheme, dir)
+	if err != nil {
+		return err
+	}
+
+	destinations := make([]manifest.Destination, len(locations))
+	backends := make([]storage.Backend, len(locations))
+	defer func() {
+		for _, b := range backends {
+			if b != nil {
+				storage.Close(b)
+			}
+		}
+	}()
+	seen := make(map[string]bool)
+	for i, location := range locations {
+		b, err := storage.Open(ctx, location)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", location, err)
+		}
+		backends[i] = b
+		if seen[b.URL()] {
+			return fmt.Errorf("every shard needs its own storage location, %s is given twice", b.URL())
+		}
+		seen[b.URL()] = true
+		layout.Shards[i].URL = b.URL()
+		destinations[i] = manifest.Destination{URL: b.URL(), Status: manifest.StatusStored, Encryption: encryptionOf(b)}
+	}
+
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func(i int, b storage.Backend) {
+			defer wg.Done()
+			shard := layout.Shards[i]
+			err := retry(attempts, b.URL(), func() error {
+				return storage.UploadVerified(ctx, b, paths[i], shard.Key, shard.Checksum)
+			})
+			if err != nil {
+				customLog.Errorf("Failed to store shard %d of backup %s in %s: %v", i, result.Manifest.ID, b.URL(), err)
+				destinations[i].Status = manifest.StatusFailed
+				destinations[i].Error = err.Error()
+			}
+		}(i, b)
+	}
+	wg.Wait()
+
+	result.Manifest.Erasure = layout
+	result.Manifest.Destinations = destinations
+	if err := result.Manifest.Write(result.ManifestPath); err != nil {
+		return err
+	}
+
+	// The manifest goes last so that its presence marks a stored shard
+	key := manifest.PathFor(result.Manifest.File)
+	var failures []error
+	stored := 0
+	for i, b := range backends {
+		if destinations[i].Status != manifest.StatusStored {
+			failures = append(failures, fmt.Errorf("%s: %s", destinations[i].URL, destinations[i].Error))
+			continue
+		}
+		err := retry(attempts, b.URL(), func() error {
+			return storage.Upload(ctx, b, result.ManifestPath, key)
+		})
+		if err != nil {
+			customLog.Errorf("Failed to store manifest of backup %s in %s: %v", result.Manifest.ID, b.URL(), err)
+			destinations[i].Status = manifest.StatusFailed
+			destinations[i].Error = err.Error()
+			failures = append(failures, fmt.Errorf("%s: %w", b.URL(), err))
+			continue
+		}
+		stored++
+	}
+
+	if len(failures) == 0 {
+		customLog.Infof("Stored backup %s as %s shards in %d locations", result.Manifest.ID, scheme, stored)
+		return nil
+	}
+	if stored < scheme.Data {
+		return fmt.Errorf("backup %s stored %d shards, %d are needed to restore it: %w", result.Manifest.ID, stored, scheme.Data, errors.Join(failures...))
+	}
+	if !policy.Satisfied(stored, len(locations)) {
+		return fmt.Errorf("backup %s stored %d of %d shards: %w", result.Manifest.ID, stored, len(locations), errors.Join(failures...))
+	}
+	customLog.Warnf("Backup %s stored %d of %d shards, it can lose %d more", result.Manifest.ID, stored, len(locations), stored-scheme.Data)
+	return nil
+}
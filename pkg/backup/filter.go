@@ -0,0 +1,30 @@
+package backup
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// identifier matches the names a table filter may use; the dumper puts them
+// into its queries unquoted
+var identifier = regexp.MustCompile(`^[A-Za-z0-9_$]*$`)
+
+// Filter selects the tables of a backup
+type Filter struct {
+	// Schema is the schema whose tables are dumped, default public
+	Schema string
+	// Prefix and Suffix restrict the dump to tables whose names start and
+	// end with them
+	Prefix string
+	Suffix string
+}
+
+// Validate checks that the filter only uses plain identifiers
+func (f Filter) Validate() error {
+	for name, value := range map[string]string{"schema": f.Schema, "table prefix": f.Prefix, "table suffix": f.Suffix} {
+		if !identifier.MatchString(value) {
+			return fmt.Errorf("invalid %s %q, only letters, digits, _ and $ are allowed", name, value)
+		}
+	}
+	return nil
+}
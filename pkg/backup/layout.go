@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/manifest"
+)
+
+// DefaultLayout stores every backup at the top of a storage location, named
+// after its ID
+const DefaultLayout = "{db}-{ts}.{ext}"
+
+// layoutField matches a {field} placeholder of a layout
+var layoutField = regexp.MustCompile(`\{([a-z]*)\}`)
+
+// layoutFields are the placeholders a layout may use
+var layoutFields = map[string]func(database string, t time.Time, ext string) string{
+	"db":   func(database string, t time.Time, ext string) string { return database },
+	"id":   func(database string, t time.Time, ext string) string { return NewID(database, t) },
+	"ts":   func(database string, t time.Time, ext string) string { return t.Format("20060102T150405") },
+	"yyyy": func(database string, t time.Time, ext string) string { return t.Format("2006") },
+	"mm":   func(database string, t time.Time, ext string) string { return t.Format("01") },
+	"dd":   func(database string, t time.Time, ext string) string { return t.Format("02") },
+	"hh":   func(database string, t time.Time, ext string) string { return t.Format("15") },
+	"ext":  func(database string, t time.Time, ext string) string { return ext },
+}
+
+// ValidateLayout checks that a layout only uses known placeholders and
+// gives every backup its own relative key, which needs {ts} or {id}
+func ValidateLayout(layout string) error {
+	if layout == "" {
+		return nil
+	}
+	for _, m := range layoutField.FindAllStringSubmatch(layout, -1) {
+		if _, ok := layoutFields[m[1]]; !ok {
+			return fmt.Errorf("unknown placeholder %s in layout %q, expected {db}, {id}, {ts}, {yyyy}, {mm}, {dd}, {hh} or {ext}", m[0], layout)
+		}
+	}
+	if !strings.Contains(layout, "{ts}") && !strings.Contains(layout, "{id}") {
+		return fmt.Errorf("layout %q must contain {ts} or {id} so that backups do not overwrite each other", layout)
+	}
+	if strings.HasPrefix(layout, manifest.ChunkDir) {
+		return fmt.Errorf("layout %q must not place backups in %s, which holds the chunks of deduplicated backups", layout, manifest.ChunkDir)
+	}
+	if strings.HasPrefix(layout, "/") || strings.HasSuffix(layout, "/") {
+		return fmt.Errorf("layout %q must be a relative file path", layout)
+	}
+	for _, segment := range strings.Split(layout, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("layout %q must be a relative file path", layout)
+		}
+	}
+	return nil
+}
+
+// Key returns the storage key of a backup of database taken at t with the
+// file extension ext, such as "sql", laid out by layout. An empty layout is
+// DefaultLayout.
+func Key(layout, database string, t time.Time, ext string) (string, error) {
+	if layout == "" {
+		layout = DefaultLayout
+	}
+	if err := ValidateLayout(layout); err != nil {
+		return "", err
+	}
+	key := layoutField.ReplaceAllStringFunc(layout, func(field string) string {
+		return layoutFields[strings.Trim(field, "{}")](database, t, ext)
+	})
+	if clean := path.Clean(key); clean != key || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("layout %q gives the invalid key %q for database %s", layout, key, database)
+	}
+	return key, nil
+}
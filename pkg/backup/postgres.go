@@ -1,13 +1,20 @@
 package backup
 
 import (
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/Annany2002/guard/pkg/logger"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/restore"
+	"github.com/Annany2002/guard/pkg/storage"
 	"github.com/Annany2002/guard/pkg/utils"
 	"github.com/JCoupalK/go-pgdump"
 )
@@ -16,42 +23,199 @@ var (
 	customLog = logger.NewLogger()
 )
 
+// Options configures a PostgreSQL backup
+type Options struct {
+	DBName    string
+	Password  string
+	Username  string
+	Host      string
+	Port      string
+	OutputDir string
+	// Layout is the storage key template of the backup, default
+	// DefaultLayout
+	Layout string
+	// Tables selects the tables to dump, default every table of the public
+	// schema
+	Tables      Filter
+	Compression Compression
+}
+
+// Result describes a finished backup
+type Result struct {
+	// FilePath is the location of the dump file
+	FilePath string
+	// ManifestPath is the location of the manifest written next to it
+	ManifestPath string
+	Manifest     *manifest.Manifest
+}
+
 func FullBackup(db_name, db_password, db_user, db_host, outputDir, db_port string) error {
-	dbURL, err := utils.GenerateConnectionString(db_name, db_password, db_user, db_host, db_port)
+	_, err := Run(Options{
+		DBName:    db_name,
+		Password:  db_password,
+		Username:  db_user,
+		Host:      db_host,
+		Port:      db_port,
+		OutputDir: outputDir,
+	})
+	return err
+}
+
+// NewID returns the ID of a backup of database started at t
+func NewID(database string, t time.Time) string {
+	return fmt.Sprintf("%s-%s", database, t.Format("20060102T150405"))
+}
+
+// Run dumps a PostgreSQL database and writes a manifest describing the dump
+func Run(opts Options) (*Result, error) {
+	dbURL, err := utils.GenerateConnectionString(opts.DBName, opts.Password, opts.Username, opts.Host, opts.Port)
 	if err != nil {
-		customLog.Fatal("All environment variables not set")
-		return err
+		customLog.Error("All connection parameters not set")
+		return nil, err
+	}
+	if err := opts.Tables.Validate(); err != nil {
+		return nil, err
 	}
 
 	// Create output directory
-	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+	if err := os.MkdirAll(opts.OutputDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
 	}
 
 	currTime := time.Now()
-
-	// Create output file name
-	dumpFileName := filepath.Join(outputDir, fmt.Sprintf("%s-%s.sql", db_name, currTime.Format("20060102T150405")))
-
-	// Opening the file for write
-	file, err := os.Create(dumpFileName)
+	id := NewID(opts.DBName, currTime)
+	key, err := Key(opts.Layout, opts.DBName, currTime, "sql"+opts.Compression.Ext())
 	if err != nil {
-		return fmt.Errorf("failed to create dump file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
 
-	// Create a gzip writer
-	gzipWriter := gzip.NewWriter(file)
-	defer gzipWriter.Close()
+	// Create output file name
+	dumpFileName := filepath.Join(opts.OutputDir, id+".sql")
 
 	// Create a new dumper instance
 	dumper := pgdump.NewDumper(dbURL, 8)
 
-	if err := dumper.DumpDatabase(dumpFileName, &pgdump.TableOptions{}); err != nil {
+	tableOptions := &pgdump.TableOptions{Schema: opts.Tables.Schema, TablePrefix: opts.Tables.Prefix, TableSuffix: opts.Tables.Suffix}
+	if err := dumper.DumpDatabase(dumpFileName, tableOptions); err != nil {
 		os.Remove(dumpFileName) // Cleanup on failure
-		return fmt.Errorf("error dumping database: %w", err)
+		return nil, fmt.Errorf("error dumping database: %w", err)
+	}
+
+	tables, err := countRows(dumpFileName)
+	if err != nil {
+		os.Remove(dumpFileName)
+		return nil, fmt.Errorf("error counting table rows: %w", err)
+	}
+
+	if !opts.Compression.IsZero() {
+		compressed, err := compressFile(dumpFileName, opts.Compression)
+		if err != nil {
+			os.Remove(dumpFileName)
+			return nil, err
+		}
+		dumpFileName = compressed
+	}
+
+	size, checksum, err := checksumFile(dumpFileName)
+	if err != nil {
+		os.Remove(dumpFileName)
+		return nil, fmt.Errorf("error checksumming dump file: %w", err)
+	}
+
+	m := &manifest.Manifest{
+		Version:         manifest.Version,
+		ID:              id,
+		Database:        opts.DBName,
+		DBMS:            "postgres",
+		Type:            "full",
+		File:            key,
+		Size:            size,
+		Checksum:        checksum,
+		CreatedAt:       currTime,
+		DurationSeconds: time.Since(currTime).Seconds(),
+		Tables:          tables,
+		Compression:     opts.Compression.Algorithm,
+	}
+
+	manifestPath := manifest.PathFor(dumpFileName)
+	if err := m.Write(manifestPath); err != nil {
+		os.Remove(dumpFileName)
+		return nil, err
 	}
 
 	customLog.Info("Backup successfully saved")
+	return &Result{FilePath: dumpFileName, ManifestPath: manifestPath, Manifest: m}, nil
+}
+
+// Store uploads the dump and its manifest to a storage backend. The dump is
+// checked against the manifest checksum and the manifest is uploaded last
+// so that its presence marks a complete backup.
+func Store(ctx context.Context, result *Result, b storage.Backend) error {
+	if err := storage.UploadVerified(ctx, b, result.FilePath, result.Manifest.File, result.Manifest.Checksum); err != nil {
+		return err
+	}
+	if err := storage.Upload(ctx, b, result.ManifestPath, manifest.PathFor(result.Manifest.File)); err != nil {
+		return err
+	}
+	customLog.Infof("Stored backup %s in %s", result.Manifest.ID, b.URL())
 	return nil
 }
+
+// countRows records the number of rows the dump holds for every table.
+// The rows are counted in the dump itself rather than queried, so that the
+// counts match the snapshot the dump was taken from.
+func countRows(dumpPath string) ([]manifest.Table, error) {
+	file, err := os.Open(dumpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	counts := make(map[string]int64)
+	sc := restore.NewScanner(file)
+	for {
+		stmt, err := sc.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if stmt.Kind != restore.KindCopy {
+			continue
+		}
+		count := counts[stmt.Table]
+		for {
+			if _, err := sc.NextRow(); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to read rows of %s: %w", stmt.Table, err)
+			}
+			count++
+		}
+		counts[stmt.Table] = count
+	}
+
+	tables := make([]manifest.Table, 0, len(counts))
+	for name, count := range counts {
+		tables = append(tables, manifest.Table{Name: name, Rows: count})
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	return tables, nil
+}
+
+// checksumFile returns the size and SHA-256 checksum of a file
+func checksumFile(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, storage.FormatChecksum(hash.Sum(nil)), nil
+}
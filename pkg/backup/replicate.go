@@ -0,0 +1,198 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/Annany2002/guard/pkg/dedup"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+// Policy decides whether a backup that reached only some of its
+// destinations counts as successful
+type Policy struct {
+	// MinStored is the number of destinations that must store the backup,
+	// zero means all of them
+	MinStored int
+}
+
+// ParsePolicy parses a replication policy: "all", "any" or the number of
+// destinations that must succeed
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "", "all":
+		return Policy{}, nil
+	case "any":
+		return Policy{MinStored: 1}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return Policy{}, fmt.Errorf("invalid replication policy %q, expected all, any or a number", s)
+	}
+	return Policy{MinStored: n}, nil
+}
+
+// Satisfied reports whether stored of total destinations is enough
+func (p Policy) Satisfied(stored, total int) bool {
+	if p.MinStored == 0 {
+		return stored == total
+	}
+	return stored >= p.MinStored
+}
+
+// Replicate uploads the dump to every location in parallel, then stores the
+// manifest, which records the status of every destination, next to each
+// copy. Uploads are tried attempts times; retried uploads resume where the
+// backend supports it. An error is returned when the stored copies do not
+// satisfy the policy.
+func Replicate(ctx context.Context, result *Result, locations []string, attempts int, policy Policy) error {
+	return replicate(ctx, result, locations, attempts, policy, func(b storage.Backend) error {
+		return storage.UploadVerified(ctx, b, result.FilePath, result.Manifest.File, result.Manifest.Checksum)
+	}, nil)
+}
+
+// Deduplicate splits the dump into content-defined chunks and stores the
+// chunks each location does not hold yet, then the manifest, which lists
+// the chunks, as Replicate does. The dump itself is not stored. Every
+// location stays locked until its manifest is stored, so that garbage
+// collection does not delete chunks the backup reuses.
+func Deduplicate(ctx context.Context, result *Result, locations []string, attempts int, policy Policy) error {
+	chunks, err := dedup.Split(result.FilePath, dedup.DefaultParams)
+	if err != nil {
+		return err
+	}
+	result.Manifest.Chunks = chunks
+
+	var mu sync.Mutex
+	locks := make(map[storage.Backend]*dedup.RepoLock)
+	release := func() {
+		for _, l := range locks {
+			l.Release(ctx)
+		}
+	}
+	return replicate(ctx, result, locations, attempts, policy, func(b storage.Backend) error {
+		mu.Lock()
+		_, locked := locks[b]
+		mu.Unlock()
+		if !locked {
+			l, err := dedup.Lock(ctx, b)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			locks[b] = l
+			mu.Unlock()
+		}
+		stats, err := dedup.Store(ctx, b, result.FilePath, chunks)
+		if err == nil {
+			customLog.Infof("Stored %d new of %d chunks (%d bytes) of backup %s in %s", stats.New, stats.Chunks, stats.NewBytes, result.Manifest.ID, b.URL())
+		}
+		return err
+	}, release)
+}
+
+// replicate stores the dump in every location with store, which is tried
+// attempts times, and then the manifest. release, if given, is called once
+// the manifests are stored, before the backends are closed.
+func replicate(ctx context.Context, result *Result, locations []string, attempts int, policy Policy, store func(b storage.Backend) error, release func()) error {
+	destinations := make([]manifest.Destination, len(locations))
+	backends := make([]storage.Backend, len(locations))
+
+	var wg sync.WaitGroup
+	for i, location := range locations {
+		wg.Add(1)
+		go func(i int, location string) {
+			defer wg.Done()
+			destinations[i] = manifest.Destination{URL: location, Status: manifest.StatusStored}
+			b, err := storage.Open(ctx, location)
+			if err == nil {
+				backends[i] = b
+				destinations[i].URL = b.URL()
+				destinations[i].Encryption = encryptionOf(b)
+				err = retry(attempts, b.URL(), func() error {
+					return store(b)
+				})
+			}
+			if err != nil {
+				customLog.Errorf("Failed to store backup %s in %s: %v", result.Manifest.ID, location, err)
+				destinations[i].Status = manifest.StatusFailed
+				destinations[i].Error = err.Error()
+			}
+		}(i, location)
+	}
+	wg.Wait()
+	defer func() {
+		for _, b := range backends {
+			if b != nil {
+				storage.Close(b)
+			}
+		}
+	}()
+	if release != nil {
+		defer release()
+	}
+
+	result.Manifest.Destinations = destinations
+	if err := result.Manifest.Write(result.ManifestPath); err != nil {
+		return err
+	}
+
+	// The manifest goes last so that its presence marks a complete backup.
+	// A copy whose manifest cannot be written counts as failed, although
+	// the manifests stored elsewhere already list it as stored.
+	key := manifest.PathFor(result.Manifest.File)
+	var failures []error
+	stored := 0
+	for i, b := range backends {
+		if destinations[i].Status != manifest.StatusStored {
+			failures = append(failures, fmt.Errorf("%s: %s", destinations[i].URL, destinations[i].Error))
+			continue
+		}
+		err := retry(attempts, b.URL(), func() error {
+			return storage.Upload(ctx, b, result.ManifestPath, key)
+		})
+		if err != nil {
+			customLog.Errorf("Failed to store manifest of backup %s in %s: %v", result.Manifest.ID, b.URL(), err)
+			destinations[i].Status = manifest.StatusFailed
+			destinations[i].Error = err.Error()
+			failures = append(failures, fmt.Errorf("%s: %w", b.URL(), err))
+			continue
+		}
+		stored++
+		customLog.Infof("Stored backup %s in %s", result.Manifest.ID, b.URL())
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+	if !policy.Satisfied(stored, len(locations)) {
+		return fmt.Errorf("backup %s stored in %d of %d destinations: %w", result.Manifest.ID, stored, len(locations), errors.Join(failures...))
+	}
+	customLog.Warnf("Backup %s stored in %d of %d destinations", result.Manifest.ID, stored, len(locations))
+	return nil
+}
+
+// encryptionOf returns the server-side encryption b applies to new objects
+func encryptionOf(b storage.Backend) *manifest.Encryption {
+	encrypter, ok := b.(storage.Encrypter)
+	if !ok || encrypter.Encryption() == nil {
+		return nil
+	}
+	e := encrypter.Encryption()
+	return &manifest.Encryption{Mode: e.Mode, KMSKeyID: e.KMSKeyID, KeyMD5: e.KeyMD5}
+}
+
+// retry calls fn until it succeeds or attempts tries are used up
+func retry(attempts int, target string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		customLog.Warnf("Upload attempt %d of %d to %s failed, retrying: %v", attempt, attempts, target, err)
+	}
+}
@@ -0,0 +1,299 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/manifest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNotFound is returned when no backup matches
+var ErrNotFound = errors.New("backup not found in catalog")
+
+// Backup statuses
+const (
+	// StatusCompleted means the backup reached every destination
+	StatusCompleted = "completed"
+	// StatusPartial means the backup reached some of its destinations
+	StatusPartial = "partial"
+	// StatusFailed means the backup was not stored anywhere
+	StatusFailed = "failed"
+	// StatusDeleted means every stored copy has been deleted
+	StatusDeleted = "deleted"
+)
+
+var backupsBucket = []byte("backups")
+
+// Location is a storage location holding a copy of a backup
+type Location struct {
+	URL    string `json:"url"`
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Class is the storage class of the copy, if it was tiered
+	Class string `json:"class,omitempty"`
+}
+
+// Entry is the catalog record of a backup
+type Entry struct {
+	ID        string     `json:"id"`
+	Database  string     `json:"database"`
+	DBMS      string     `json:"dbms,omitempty"`
+	Type      string     `json:"type,omitempty"`
+	Size      int64      `json:"size"`
+	Checksum  string     `json:"checksum,omitempty"`
+	Locations []Location `json:"locations"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	LegalHold bool       `json:"legal_hold,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	// DurationSeconds is how long the backup took, including uploads
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// Stored returns the locations that hold a copy of the backup
+func (e *Entry) Stored() []Location {
+	var stored []Location
+	for _, l := range e.Locations {
+		if l.Status == manifest.StatusStored {
+			stored = append(stored, l)
+		}
+	}
+	return stored
+}
+
+// UpdateStatus derives the status of the backup from its locations
+func (e *Entry) UpdateStatus() {
+	var stored, failed, deleted int
+	for _, l := range e.Locations {
+		switch l.Status {
+		case manifest.StatusStored:
+			stored++
+		case StatusDeleted:
+			deleted++
+		default:
+			failed++
+		}
+	}
+	switch {
+	case stored == 0 && deleted > 0:
+		e.Status = StatusDeleted
+	case stored == 0:
+		e.Status = StatusFailed
+	case failed > 0:
+		e.Status = StatusPartial
+	default:
+		e.Status = StatusCompleted
+	}
+}
+
+// FromManifest creates a catalog entry from a backup manifest, with one
+// location per destination recorded in the manifest. The locations of an
+// erasure-coded backup point at its shards.
+func FromManifest(m *manifest.Manifest) *Entry {
+	e := &Entry{
+		ID:              m.ID,
+		Database:        m.Database,
+		DBMS:            m.DBMS,
+		Type:            m.Type,
+		Size:            m.Size,
+		Checksum:        m.Checksum,
+		CreatedAt:       m.CreatedAt,
+		DurationSeconds: m.DurationSeconds,
+	}
+	for _, d := range m.Destinations {
+		e.Locations = append(e.Locations, Location{URL: d.URL, Key: locationKey(m, d.URL), Status: d.Status, Error: d.Error})
+	}
+	e.UpdateStatus()
+	return e
+}
+
+// locationKey returns the key of the object a backup stores in the location
+// url, its artifact or, for erasure-coded backups, its shard and, for
+// deduplicated backups, the manifest listing its chunks
+func locationKey(m *manifest.Manifest, url string) string {
+	if m.Erasure != nil {
+		if shard, ok := m.Erasure.ShardIn(url); ok {
+			return shard.Key
+		}
+	}
+	if m.Deduplicated() {
+		return manifest.PathFor(m.File)
+	}
+	return m.File
+}
+
+// Filter selects catalog entries
+type Filter struct {
+	Database string
+	// Since only selects backups created at or after this time
+	Since  time.Time
+	Status string
+}
+
+func (f Filter) matches(e *Entry) bool {
+	return (f.Database == "" || e.Database == f.Database) &&
+		(f.Since.IsZero() || !e.CreatedAt.Before(f.Since)) &&
+		(f.Status == "" || e.Status == f.Status)
+}
+
+// Catalog is an embedded database of the backups taken
+type Catalog struct {
+	db *bolt.DB
+}
+
+// DefaultPath returns the catalog location: GUARD_CATALOG, or
+// ~/.guard/catalog.db
+func DefaultPath() string {
+	if path := os.Getenv("GUARD_CATALOG"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".guard", "catalog.db")
+	}
+	return filepath.Join(home, ".guard", "catalog.db")
+}
+
+// Open opens the catalog at path, creating it if needed. The catalog is
+// locked while open, so callers should close it as soon as possible.
+func Open(path string) (*Catalog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create catalog directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(backupsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Catalog{db: db}, nil
+}
+
+// Close closes the catalog
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
+
+// Put adds or replaces the entry of a backup
+func (c *Catalog) Put(e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(backupsBucket).Put([]byte(e.ID), data)
+	})
+}
+
+// Get returns the entry of the backup with the given id
+func (c *Catalog) Get(id string) (*Entry, error) {
+	var e *Entry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(backupsBucket).Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("%s: %w", id, ErrNotFound)
+		}
+		e = &Entry{}
+		return json.Unmarshal(data, e)
+	})
+	return e, err
+}
+
+// Update applies fn to the entry of a backup and stores the result
+func (c *Catalog) Update(id string, fn func(e *Entry)) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(backupsBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("%s: %w", id, ErrNotFound)
+		}
+		e := &Entry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return err
+		}
+		fn(e)
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+}
+
+// Delete removes the entry of a backup
+func (c *Catalog) Delete(id string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(backupsBucket).Delete([]byte(id))
+	})
+}
+
+// List returns the entries matching the filter, newest first
+func (c *Catalog) List(f Filter) ([]Entry, error) {
+	var entries []Entry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(backupsBucket).ForEach(func(k, v []byte) error {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("corrupt catalog entry %s: %w", k, err)
+			}
+			if f.matches(&e) {
+				entries = append(entries, e)
+			}
+			return nil
+		})
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.After(entries[j].CreatedAt)
+	})
+	return entries, err
+}
+
+// Latest returns the newest backup of a database (of any database if empty)
+// that has a stored copy
+func (c *Catalog) Latest(database string) (*Entry, error) {
+	entries, err := c.List(Filter{Database: database})
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if len(entries[i].Stored()) > 0 {
+			return &entries[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// RemoveLocation marks the copy of a backup in a storage location as
+// deleted. A backup without stored copies left is marked deleted.
+func (c *Catalog) RemoveLocation(id, url string) error {
+	return c.Update(id, func(e *Entry) {
+		for i, l := range e.Locations {
+			if l.URL == url {
+				e.Locations[i].Status = StatusDeleted
+			}
+		}
+		e.UpdateStatus()
+	})
+}
+
+// SetLocation adds a location of a backup, or replaces the one with the
+// same URL
+func (c *Catalog) SetLocation(id string, location Location) error {
+	return c.Update(id, func(e *Entry) {
+		e.setLocation(location)
+		e.UpdateStatus()
+	})
+}
@@ -0,0 +1,221 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/Annany2002/guard/pkg/transfer"
+)
+
+// ForgetPruned marks the copies in url of the backups a prune deleted as
+// deleted. Backups the catalog does not know are ignored.
+func (c *Catalog) ForgetPruned(url string, decisions []retention.Decision) error {
+	var errs []error
+	for _, d := range decisions {
+		if !d.Deleted {
+			continue
+		}
+		err := c.RemoveLocation(d.Backup.Manifest.ID, url)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, fmt.Errorf("failed to update backup %s: %w", d.Backup.Manifest.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Rebuild indexes the manifests found in b. Backups already in the catalog
+// gain a stored location for b; unknown backups are added.
+func (c *Catalog) Rebuild(ctx context.Context, b storage.Backend) (int, error) {
+	backups, err := retention.Scan(ctx, b, "")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, backup := range backups {
+		key := backup.Key
+		if backup.Manifest.Erasure != nil || backup.Manifest.Deduplicated() {
+			key = locationKey(backup.Manifest, b.URL())
+		}
+		location := Location{URL: b.URL(), Key: key, Status: manifest.StatusStored}
+		entry, err := c.Get(backup.Manifest.ID)
+		if errors.Is(err, ErrNotFound) {
+			entry = FromManifest(backup.Manifest)
+			entry.Locations = nil
+		} else if err != nil {
+			return 0, err
+		}
+		entry.setLocation(location)
+		entry.UpdateStatus()
+		if err := c.Put(entry); err != nil {
+			return 0, err
+		}
+	}
+	return len(backups), nil
+}
+
+// setLocation adds a location or replaces the one with the same URL
+func (e *Entry) setLocation(location Location) {
+	for i, l := range e.Locations {
+		if l.URL == location.URL {
+			e.Locations[i] = location
+			return
+		}
+	}
+	e.Locations = append(e.Locations, location)
+}
+
+// Issue kinds found by Reconcile
+const (
+	// IssueOrphan is an artifact without a manifest, or a manifest without
+	// its artifact
+	IssueOrphan = "orphan"
+	// IssueMissing is a stored copy in the catalog whose object is gone
+	IssueMissing = "missing"
+	// IssueDrift is an object whose size or checksum differs from the
+	// catalog
+	IssueDrift = "drift"
+	// IssueUntracked is a backup in storage that the catalog does not know
+	IssueUntracked = "untracked"
+)
+
+// Issue is a difference between the catalog and a storage backend
+type Issue struct {
+	Kind   string `json:"kind"`
+	URL    string `json:"url"`
+	Key    string `json:"key"`
+	ID     string `json:"id,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Reconcile compares the catalog with the objects in b. With verify set,
+// every stored copy is downloaded and its checksum compared with the
+// catalog; otherwise only sizes are compared.
+func (c *Catalog) Reconcile(ctx context.Context, b storage.Backend, verify bool) ([]Issue, error) {
+	objects, err := b.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]storage.Object, len(objects))
+	// inPieces holds artifacts stored as shards or chunks instead of whole
+	inPieces := make(map[string]bool)
+	for _, obj := range objects {
+		present[obj.Key] = obj
+		if artifact, ok := manifest.ShardOf(obj.Key); ok {
+			inPieces[artifact] = true
+		}
+	}
+
+	backups, err := retention.Scan(ctx, b, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, backup := range backups {
+		if backup.Manifest.Deduplicated() {
+			inPieces[backup.Key] = true
+		}
+	}
+
+	var issues []Issue
+	add := func(kind, key, id, detail string) {
+		issues = append(issues, Issue{Kind: kind, URL: b.URL(), Key: key, ID: id, Detail: detail})
+	}
+
+	// Objects without their counterpart, and backups the catalog misses.
+	// Chunks are shared between backups and collected by guard prune.
+	for _, obj := range objects {
+		if manifest.IsChunk(obj.Key) || manifest.IsLock(obj.Key) {
+			continue
+		}
+		if !manifest.IsManifest(obj.Key) {
+			artifact := obj.Key
+			if shardOf, ok := manifest.ShardOf(obj.Key); ok {
+				artifact = shardOf
+			}
+			if _, ok := present[manifest.PathFor(artifact)]; !ok && !isTemporary(obj.Key) {
+				add(IssueOrphan, obj.Key, "", "artifact without manifest")
+			}
+			continue
+		}
+		artifact := manifest.ArtifactFor(obj.Key)
+		if _, ok := present[artifact]; !ok && !inPieces[artifact] {
+			add(IssueOrphan, obj.Key, "", "manifest without artifact")
+		}
+	}
+	for _, backup := range backups {
+		if entry, err := c.Get(backup.Manifest.ID); errors.Is(err, ErrNotFound) || (err == nil && !entry.storedIn(b.URL())) {
+			add(IssueUntracked, backup.Key, backup.Manifest.ID, "run guard catalog rebuild to index it")
+		}
+	}
+
+	// Copies the catalog records in this backend
+	entries, err := c.List(Filter{})
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		for _, l := range entry.Stored() {
+			if l.URL != b.URL() {
+				continue
+			}
+			obj, ok := present[l.Key]
+			_, shard := manifest.ShardOf(l.Key)
+			switch {
+			case !ok:
+				add(IssueMissing, l.Key, entry.ID, "object not found")
+			case shard || manifest.IsManifest(l.Key):
+				// Shards and chunks are checked by guard verify
+			case entry.Size > 0 && obj.Size != entry.Size:
+				add(IssueDrift, l.Key, entry.ID, fmt.Sprintf("size %d, catalog has %d", obj.Size, entry.Size))
+			case verify && entry.Checksum != "":
+				checksum, err := transfer.Checksum(ctx, b, l.Key)
+				if err != nil {
+					return nil, err
+				}
+				if checksum != entry.Checksum {
+					add(IssueDrift, l.Key, entry.ID, fmt.Sprintf("checksum %s, catalog has %s", checksum, entry.Checksum))
+				}
+			}
+		}
+	}
+	return issues, nil
+}
+
+// storedIn reports whether the catalog records a copy in the backend at url
+func (e *Entry) storedIn(url string) bool {
+	for _, l := range e.Stored() {
+		if l.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
+// isTemporary reports whether key is a leftover of an interrupted upload
+func isTemporary(key string) bool {
+	return strings.HasPrefix(path.Base(key), ".") || strings.HasSuffix(key, ".part")
+}
+
+// URLs returns the distinct storage locations recorded in the catalog
+func (c *Catalog) URLs() ([]string, error) {
+	entries, err := c.List(Filter{})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var urls []string
+	for _, entry := range entries {
+		for _, l := range entry.Locations {
+			if !seen[l.URL] {
+				seen[l.URL] = true
+				urls = append(urls, l.URL)
+			}
+		}
+	}
+	return urls, nil
+}
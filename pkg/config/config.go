@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Annany2002/guard/pkg/jobs"
+	"github.com/spf13/viper"
+)
+
+// Connection is how guard connects to a database server. The password is
+// read from the environment variable PasswordEnv or the file PasswordFile
+// whenever a job runs, so that neither the config file nor the job store
+// holds secrets; Password is accepted for tests and local setups.
+type Connection struct {
+	Host         string `mapstructure:"host"`
+	Port         string `mapstructure:"port"`
+	Username     string `mapstructure:"username"`
+	Password     string `mapstructure:"password"`
+	PasswordEnv  string `mapstructure:"password_env"`
+	PasswordFile string `mapstructure:"password_file"`
+	// Database is the database of jobs that do not name one
+	Database string `mapstructure:"database"`
+}
+
+// Filters select the tables a job backs up
+type Filters struct {
+	Schema      string `mapstructure:"schema"`
+	TablePrefix string `mapstructure:"table_prefix"`
+	TableSuffix string `mapstructure:"table_suffix"`
+}
+
+// Retention is the retention policy applied after every backup of a job
+type Retention struct {
+	KeepLast    int    `mapstructure:"keep_last"`
+	KeepDaily   int    `mapstructure:"keep_daily"`
+	KeepWeekly  int    `mapstructure:"keep_weekly"`
+	KeepMonthly int    `mapstructure:"keep_monthly"`
+	KeepYearly  int    `mapstructure:"keep_yearly"`
+	KeepWithin  string `mapstructure:"keep_within"`
+}
+
+// Notification is a webhook notified about the runs of a job
+type Notification struct {
+	URL     string            `mapstructure:"url"`
+	On      string            `mapstructure:"on"`
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+// Job declares a scheduled job
+type Job struct {
+	Name string `mapstructure:"name"`
+	// Connection names an entry of the connections section
+	Connection string `mapstructure:"connection"`
+	Database   string `mapstructure:"database"`
+	Task       string `mapstructure:"task"`
+	Cron       string `mapstructure:"cron"`
+
+	Storage     []string  `mapstructure:"storage"`
+	Require     string    `mapstructure:"require"`
+	Layout      string    `mapstructure:"layout"`
+	Erasure     string    `mapstructure:"erasure"`
+	Dedup       bool      `mapstructure:"dedup"`
+	Filters     Filters   `mapstructure:"filters"`
+	Compression string    `mapstructure:"compression"`
+	Retention   Retention `mapstructure:"retention"`
+	Stages      []string  `mapstructure:"stages"`
+
+	Assertions []string `mapstructure:"assertions"`
+	AssertFile string   `mapstructure:"assert_file"`
+	Keep       bool     `mapstructure:"keep"`
+
+	Notify []Notification `mapstructure:"notify"`
+}
+
+// File is a guard config file
+type File struct {
+	Connections map[string]Connection `mapstructure:"connections"`
+	Jobs        []Job                 `mapstructure:"jobs"`
+}
+
+// Load reads the config file at path. Its format follows the extension,
+// usually .yaml. Unknown keys are rejected, so that a misspelt option does
+// not silently fall back to its default.
+func Load(path string) (*File, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	f := &File{}
+	if err := v.UnmarshalExact(f); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Resolve turns the declared jobs into jobs for the job store, filling in
+// their connections. Connection names are not case-sensitive.
+func (f *File) Resolve() ([]jobs.Job, error) {
+	if len(f.Jobs) == 0 {
+		return nil, fmt.Errorf("no jobs declared")
+	}
+	list := make([]jobs.Job, 0, len(f.Jobs))
+	for i, decl := range f.Jobs {
+		if decl.Name == "" {
+			return nil, fmt.Errorf("job %d has no name", i+1)
+		}
+		conn, ok := f.Connections[strings.ToLower(decl.Connection)]
+		if !ok {
+			return nil, fmt.Errorf("job %s: unknown connection %q", decl.Name, decl.Connection)
+		}
+		job := jobs.Job{
+			Name:         decl.Name,
+			Task:         decl.Task,
+			Cron:         decl.Cron,
+			Host:         conn.Host,
+			Port:         conn.Port,
+			Username:     conn.Username,
+			Password:     conn.Password,
+			PasswordEnv:  conn.PasswordEnv,
+			PasswordFile: conn.PasswordFile,
+			Database:     decl.Database,
+			Storage:      decl.Storage,
+			Require:      decl.Require,
+			Layout:       decl.Layout,
+			Erasure:      decl.Erasure,
+			Dedup:        decl.Dedup,
+			Tables:       jobs.Filter{Schema: decl.Filters.Schema, Prefix: decl.Filters.TablePrefix, Suffix: decl.Filters.TableSuffix},
+			Compression:  decl.Compression,
+			Retention:    jobs.Retention(decl.Retention),
+			Stages:       decl.Stages,
+			Assertions:   decl.Assertions,
+			AssertFile:   decl.AssertFile,
+			Keep:         decl.Keep,
+		}
+		if job.Task == "" {
+			job.Task = jobs.TaskBackup
+		}
+		if job.Host == "" {
+			job.Host = "localhost"
+		}
+		if job.Port == "" {
+			job.Port = "5432"
+		}
+		if job.Database == "" {
+			job.Database = conn.Database
+		}
+		for _, n := range decl.Notify {
+			job.Notify = append(job.Notify, jobs.Notification(n))
+		}
+		if err := job.Validate(); err != nil {
+			return nil, fmt.Errorf("job %s: %w", decl.Name, err)
+		}
+		list = append(list, job)
+	}
+	return list, nil
+}
@@ -0,0 +1,120 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/Annany2002/guard/pkg/jobs"
+	"github.com/Annany2002/guard/pkg/scheduler"
+)
+
+// ErrNotRunning is returned when no daemon listens on the control socket
+var ErrNotRunning = errors.New("guard daemon is not running")
+
+// Client talks to a running daemon over its control socket
+type Client struct {
+	socket string
+	http   *http.Client
+}
+
+// NewClient returns a client for the daemon listening on socket
+func NewClient(socket string) *Client {
+	return &Client{
+		socket: socket,
+		http: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}},
+	}
+}
+
+// Info returns the state of the daemon
+func (c *Client) Info(ctx context.Context) (*Info, error) {
+	info := &Info{}
+	return info, c.do(ctx, http.MethodGet, "/v1/status", info)
+}
+
+// Jobs returns the state of every scheduled job
+func (c *Client) Jobs(ctx context.Context) ([]scheduler.Status, error) {
+	var statuses []scheduler.Status
+	return statuses, c.do(ctx, http.MethodGet, "/v1/jobs", &statuses)
+}
+
+// Unschedule removes a job from the job store and the scheduler
+func (c *Client) Unschedule(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/v1/jobs/%d", id), nil)
+}
+
+// RunNow starts a job right away
+func (c *Client) RunNow(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/v1/jobs/%d/run", id), nil)
+}
+
+// Pause stops running a job on its schedule, or resumes it
+func (c *Client) Pause(ctx context.Context, id int64, paused bool) error {
+	action := "resume"
+	if paused {
+		action = "pause"
+	}
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/v1/jobs/%d/%s", id, action), nil)
+}
+
+// do sends a request and decodes the response into v
+func (c *Client) do(ctx context.Context, method, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://guard"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%w, no daemon listens on %s", ErrNotRunning, c.socket)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var body errorResponse
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &body) != nil || body.Error == "" {
+			body.Error = fmt.Sprintf("daemon answered %s", resp.Status)
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return &remoteError{msg: body.Error, err: jobs.ErrNotFound}
+		case http.StatusConflict:
+			if strings.Contains(body.Error, jobs.ErrDeclared.Error()) {
+				return &remoteError{msg: body.Error, err: jobs.ErrDeclared}
+			}
+			return &remoteError{msg: body.Error, err: scheduler.ErrRunning}
+		case http.StatusForbidden:
+			return &remoteError{msg: body.Error, err: ErrForbidden}
+		}
+		return errors.New(body.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// remoteError is an error returned by the daemon, matching the sentinel
+// error it was created from
+type remoteError struct {
+	msg string
+	err error
+}
+
+func (e *remoteError) Error() string { return e.msg }
+
+func (e *remoteError) Unwrap() error { return e.err }
@@ -0,0 +1,264 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/jobs"
+	"github.com/Annany2002/guard/pkg/logger"
+	"github.com/Annany2002/guard/pkg/scheduler"
+)
+
+var customLog = logger.NewLogger()
+
+// ErrForbidden is returned when a user who may only read the state of the
+// daemon tries to change it
+var ErrForbidden = errors.New("only the user running the daemon or root may change jobs")
+
+// errInvalidID is returned for job IDs that are not numbers
+var errInvalidID = errors.New("invalid job ID")
+
+// DefaultSocket returns the control socket location: GUARD_SOCKET, or
+// ~/.guard/guard.sock
+func DefaultSocket() string {
+	if path := os.Getenv("GUARD_SOCKET"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".guard", "guard.sock")
+	}
+	return filepath.Join(home, ".guard", "guard.sock")
+}
+
+// Info describes the running daemon
+type Info struct {
+	PID      int       `json:"pid"`
+	Started  time.Time `json:"started"`
+	Socket   string    `json:"socket"`
+	JobStore string    `json:"job_store"`
+	Jobs     int       `json:"jobs"`
+	Running  int       `json:"running"`
+	Paused   int       `json:"paused"`
+}
+
+// Server exposes a scheduler on a Unix socket. Anyone who can connect to
+// the socket, as allowed by its file mode, may read the state of the jobs;
+// only the user running the daemon and root may change them.
+type Server struct {
+	scheduler *scheduler.Scheduler
+	jobStore  string
+	socket    string
+	started   time.Time
+	listener  net.Listener
+	http      *http.Server
+}
+
+// peerKey holds the user ID of the peer of a connection in its context
+type peerKey struct{}
+
+// peer is the user on the other end of a connection
+type peer struct {
+	uid   int
+	known bool
+}
+
+// Listen creates the control socket at path with the given file mode. A
+// stale socket left behind by a daemon that did not exit cleanly is
+// replaced, but not the socket of a daemon that is still running.
+func Listen(path string, mode os.FileMode, s *scheduler.Scheduler, jobStore string) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another daemon is listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set the mode of %s: %w", path, err)
+	}
+
+	srv := &Server{scheduler: s, jobStore: jobStore, socket: path, started: time.Now(), listener: listener}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", srv.status)
+	mux.HandleFunc("GET /v1/jobs", srv.list)
+	mux.HandleFunc("DELETE /v1/jobs/{id}", srv.owner(srv.unschedule))
+	mux.HandleFunc("POST /v1/jobs/{id}/run", srv.owner(srv.runNow))
+	mux.HandleFunc("POST /v1/jobs/{id}/pause", srv.owner(srv.pause(true)))
+	mux.HandleFunc("POST /v1/jobs/{id}/resume", srv.owner(srv.pause(false)))
+	srv.http = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			uid, known := peerUID(conn)
+			return context.WithValue(ctx, peerKey{}, peer{uid: uid, known: known})
+		},
+	}
+	return srv, nil
+}
+
+// Serve answers requests until Close is called
+func (srv *Server) Serve() error {
+	err := srv.http.Serve(srv.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops answering requests and removes the socket
+func (srv *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := srv.http.Shutdown(ctx)
+	os.Remove(srv.socket)
+	return err
+}
+
+// owner only lets the user running the daemon and root call h. Where the
+// peer cannot be identified the file mode of the socket decides alone.
+func (srv *Server) owner(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, _ := r.Context().Value(peerKey{}).(peer)
+		if p.known && p.uid != 0 && p.uid != os.Getuid() {
+			customLog.Warnf("Refused %s %s from user %d", r.Method, r.URL.Path, p.uid)
+			writeError(w, ErrForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (srv *Server) status(w http.ResponseWriter, r *http.Request) {
+	info := Info{PID: os.Getpid(), Started: srv.started, Socket: srv.socket, JobStore: srv.jobStore}
+	for _, status := range srv.scheduler.Status() {
+		info.Jobs++
+		if status.Running {
+			info.Running++
+		}
+		if status.Job.Paused {
+			info.Paused++
+		}
+	}
+	writeJSON(w, info)
+}
+
+func (srv *Server) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, srv.scheduler.Status())
+}
+
+func (srv *Server) unschedule(w http.ResponseWriter, r *http.Request) {
+	id, err := jobID(r)
+	if err == nil {
+		err = srv.updateStore(func(store *jobs.Store) error { return store.Remove(id) })
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	customLog.Infof("Unscheduled job %d on request", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) runNow(w http.ResponseWriter, r *http.Request) {
+	id, err := jobID(r)
+	if err == nil {
+		err = srv.scheduler.RunNow(id)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	customLog.Infof("Started job %d on request", id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// pause pauses or resumes a job. The change is kept in the job store, so
+// that it survives a restart of the daemon.
+func (srv *Server) pause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := jobID(r)
+		if err == nil {
+			err = srv.updateStore(func(store *jobs.Store) error {
+				return store.Update(id, func(j *jobs.Job) { j.Paused = paused })
+			})
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// updateStore changes the job store and schedules the result right away
+// instead of at the next reload
+func (srv *Server) updateStore(fn func(store *jobs.Store) error) error {
+	store, err := jobs.Open(srv.jobStore)
+	if err != nil {
+		return err
+	}
+	err = fn(store)
+	store.Close()
+	if err != nil {
+		return err
+	}
+	return srv.scheduler.Load(srv.jobStore)
+}
+
+func jobID(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w %q", errInvalidID, r.PathValue("id"))
+	}
+	return id, nil
+}
+
+// errorResponse is the body of a failed request
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, scheduler.ErrRunning), errors.Is(err, jobs.ErrDeclared):
+		code = http.StatusConflict
+	case errors.Is(err, ErrForbidden):
+		code = http.StatusForbidden
+	case errors.Is(err, errInvalidID):
+		code = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,143 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Params bound the size of chunks. Chunk boundaries depend only on the
+// content and the params, so changing them stops new backups from sharing
+// chunks with older ones.
+type Params struct {
+	Min int
+	// Avg is the size chunks are normalized around, a power of two
+	Avg int
+	Max int
+}
+
+// DefaultParams cut chunks of 256 KiB to 4 MiB, 1 MiB on average
+var DefaultParams = Params{Min: 256 << 10, Avg: 1 << 20, Max: 4 << 20}
+
+// Validate checks that the params describe a usable chunk size range
+func (p Params) Validate() error {
+	if p.Min < 64 || p.Avg <= p.Min || p.Max <= p.Avg || bits.OnesCount(uint(p.Avg)) != 1 {
+		return fmt.Errorf("invalid chunk sizes %d/%d/%d, expected 64 <= min < avg < max with avg a power of two", p.Min, p.Avg, p.Max)
+	}
+	return nil
+}
+
+// gear maps every byte to a random value for the rolling hash. The table is
+// generated from a fixed seed so that all builds cut the same chunks.
+var gear = func() (table [256]uint64) {
+	seed := uint64(0x6775617264)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker splits a stream into content-defined chunks with FastCDC: a
+// rolling gear hash over the last 64 bytes decides where chunks end, so an
+// insertion only changes the chunks around it and the rest of the stream
+// still deduplicates.
+type Chunker struct {
+	r      io.Reader
+	params Params
+	// maskS is used below the average size and is harder to match than
+	// maskL, which keeps chunk sizes close to the average
+	maskS, maskL uint64
+	buf          []byte
+	start, end   int
+	eof          bool
+}
+
+// NewChunker returns a chunker reading from r
+func NewChunker(r io.Reader, params Params) (*Chunker, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	avgBits := bits.Len(uint(params.Avg)) - 1
+	return &Chunker{
+		r:      r,
+		params: params,
+		maskS:  topBits(avgBits + 2),
+		maskL:  topBits(avgBits - 2),
+		buf:    make([]byte, 2*params.Max),
+	}, nil
+}
+
+// topBits returns a mask of the n most significant bits, which depend on
+// the most bytes of the gear hash
+func topBits(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill reads until the buffer holds a maximum sized chunk or the stream
+// ends
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.params.Max {
+		return nil
+	}
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	n, err := io.ReadFull(c.r, c.buf[c.end:])
+	c.end += n
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		c.eof = true
+		return nil
+	}
+	return err
+}
+
+// cut returns the length of the chunk at the start of data
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.params.Min {
+		return n
+	}
+	if n > c.params.Max {
+		n = c.params.Max
+	}
+	normal := c.params.Avg
+	if normal > n {
+		normal = n
+	}
+
+	var hash uint64
+	i := c.params.Min
+	for ; i < normal; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
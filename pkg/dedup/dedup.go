@@ -0,0 +1,404 @@
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/logger"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+var customLog = logger.NewLogger()
+
+// uploadWorkers is the number of chunks uploaded in parallel
+const uploadWorkers = 4
+
+// Split cuts the file at filePath into content-defined chunks and returns
+// them in order
+func Split(filePath string, params Params) ([]manifest.Chunk, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	chunker, err := NewChunker(file, params)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []manifest.Chunk
+	for {
+		data, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filePath, err)
+		}
+		sum := sha256.Sum256(data)
+		chunks = append(chunks, manifest.Chunk{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))})
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("cannot deduplicate the empty file %s", filePath)
+	}
+	return chunks, nil
+}
+
+// Stats counts the chunks of a stored backup
+type Stats struct {
+	Chunks int
+	// New chunks were uploaded, the others were already stored
+	New      int
+	NewBytes int64
+}
+
+// Store uploads the chunks of the file at filePath that b does not hold
+// yet. Chunks are checked against their hash while they are uploaded, and
+// b is listed again afterwards so that chunks removed by a concurrent
+// garbage collection are uploaded once more. The caller holds a Lock on b
+// until the manifest is stored, so that no garbage collection starts in
+// between and deletes chunks Store found to be present.
+func Store(ctx context.Context, b storage.Backend, filePath string, chunks []manifest.Chunk) (Stats, error) {
+	stats := Stats{Chunks: len(chunks)}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return stats, err
+	}
+	defer file.Close()
+
+	offsets := make(map[string]int64, len(chunks))
+	var offset int64
+	for _, c := range chunks {
+		offsets[c.Hash] = offset
+		offset += c.Size
+	}
+
+	uploaded := make(map[string]bool)
+	for pass := 0; pass < 2; pass++ {
+		stored, err := storedChunks(ctx, b)
+		if err != nil {
+			return stats, err
+		}
+		var missing []manifest.Chunk
+		queued := make(map[string]bool)
+		for _, c := range chunks {
+			if obj, ok := stored[manifest.ChunkKey(c.Hash)]; (!ok || obj.Size != c.Size) && !queued[c.Hash] {
+				queued[c.Hash] = true
+				missing = append(missing, c)
+			}
+		}
+		if len(missing) == 0 {
+			return stats, nil
+		}
+		if pass > 0 {
+			customLog.Warnf("%d chunks disappeared from %s while storing them, uploading them again", len(missing), b.URL())
+		}
+		if err := upload(ctx, b, file, offsets, missing); err != nil {
+			return stats, err
+		}
+		for _, c := range missing {
+			if !uploaded[c.Hash] {
+				uploaded[c.Hash] = true
+				stats.New++
+				stats.NewBytes += c.Size
+			}
+		}
+	}
+	return stats, nil
+}
+
+// storedChunks lists the chunks stored in b by key
+func storedChunks(ctx context.Context, b storage.Backend) (map[string]storage.Object, error) {
+	objects, err := b.List(ctx, manifest.ChunkDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks in %s: %w", b.URL(), err)
+	}
+	stored := make(map[string]storage.Object, len(objects))
+	for _, obj := range objects {
+		stored[obj.Key] = obj
+	}
+	return stored, nil
+}
+
+// upload stores chunks read from file in parallel
+func upload(ctx context.Context, b storage.Backend, file *os.File, offsets map[string]int64, chunks []manifest.Chunk) error {
+	queue := make(chan manifest.Chunk)
+	errs := make([]error, uploadWorkers)
+	var wg sync.WaitGroup
+	for w := 0; w < uploadWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for c := range queue {
+				if errs[w] != nil {
+					continue
+				}
+				errs[w] = putChunk(ctx, b, io.NewSectionReader(file, offsets[c.Hash], c.Size), c)
+			}
+		}(w)
+	}
+	for _, c := range chunks {
+		queue <- c
+	}
+	close(queue)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// putChunk uploads a chunk and deletes it again if the data read did not
+// match its hash
+func putChunk(ctx context.Context, b storage.Backend, r io.Reader, c manifest.Chunk) error {
+	key := manifest.ChunkKey(c.Hash)
+	hash := sha256.New()
+	if err := b.Put(ctx, key, io.TeeReader(r, hash)); err != nil {
+		return fmt.Errorf("failed to store chunk %s: %w", c.Hash, err)
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != c.Hash {
+		b.Delete(ctx, key)
+		return storage.ChecksumMismatch("chunk "+c.Hash, got, c.Hash)
+	}
+	return nil
+}
+
+// Copy copies the chunks of a deduplicated backup that to does not hold
+// yet from another backend, checking every chunk against its hash while it
+// is streamed. As with Store, the caller holds a Lock on to until the
+// manifest is stored.
+func Copy(ctx context.Context, from, to storage.Backend, m *manifest.Manifest) (Stats, error) {
+	stats := Stats{Chunks: len(m.Chunks)}
+	stored, err := storedChunks(ctx, to)
+	if err != nil {
+		return stats, err
+	}
+	copied := make(map[string]bool)
+	for _, c := range m.Chunks {
+		if obj, ok := stored[manifest.ChunkKey(c.Hash)]; (ok && obj.Size == c.Size) || copied[c.Hash] {
+			continue
+		}
+		if err := copyChunkTo(ctx, from, to, c); err != nil {
+			return stats, err
+		}
+		copied[c.Hash] = true
+		stats.New++
+		stats.NewBytes += c.Size
+	}
+	return stats, nil
+}
+
+// copyChunkTo streams a chunk from one backend to another
+func copyChunkTo(ctx context.Context, from, to storage.Backend, c manifest.Chunk) error {
+	body, err := from.Get(ctx, manifest.ChunkKey(c.Hash))
+	if err != nil {
+		return fmt.Errorf("failed to read chunk %s: %w", c.Hash, err)
+	}
+	defer body.Close()
+	return putChunk(ctx, to, io.LimitReader(body, c.Size+1), c)
+}
+
+// Restore reassembles a deduplicated backup from its chunks in b into
+// filePath. Every chunk is checked against its hash and the whole file
+// against the manifest checksum.
+func Restore(ctx context.Context, b storage.Backend, m *manifest.Manifest, filePath string) error {
+	if !m.Deduplicated() {
+		return fmt.Errorf("backup %s is not deduplicated", m.ID)
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	for _, c := range m.Chunks {
+		if err := copyChunk(ctx, b, c, tmp); err != nil {
+			return fmt.Errorf("failed to restore backup %s: %w", m.ID, err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if m.Checksum != "" {
+		if err := storage.VerifyFile(tmp.Name(), m.Checksum); err != nil {
+			return fmt.Errorf("restored backup %s is corrupt: %w", m.ID, err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return err
+	}
+	customLog.Infof("Restored backup %s from %d chunks in %s", m.ID, len(m.Chunks), b.URL())
+	return nil
+}
+
+// copyChunk writes a chunk to w after checking it against its hash
+func copyChunk(ctx context.Context, b storage.Backend, c manifest.Chunk, w io.Writer) error {
+	body, err := b.Get(ctx, manifest.ChunkKey(c.Hash))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, c.Size+1))
+	if err != nil {
+		return fmt.Errorf("failed to read chunk %s: %w", c.Hash, err)
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != c.Hash {
+		return storage.ChecksumMismatch("chunk "+c.Hash, got, c.Hash)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Report is the state of the chunks of a deduplicated backup
+type Report struct {
+	Chunks  int
+	Missing []manifest.Chunk
+	Corrupt []manifest.Chunk
+}
+
+// Healthy reports whether every chunk is intact
+func (r Report) Healthy() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+// Verify reads every chunk of a deduplicated backup and checks it against
+// its hash
+func Verify(ctx context.Context, b storage.Backend, m *manifest.Manifest) (Report, error) {
+	report := Report{Chunks: len(m.Chunks)}
+	checked := make(map[string]bool)
+	for _, c := range m.Chunks {
+		if checked[c.Hash] {
+			continue
+		}
+		checked[c.Hash] = true
+		err := copyChunk(ctx, b, c, io.Discard)
+		switch {
+		case errors.Is(err, storage.ErrNotExist):
+			report.Missing = append(report.Missing, c)
+		case errors.Is(err, storage.ErrChecksumMismatch):
+			report.Corrupt = append(report.Corrupt, c)
+		case err != nil:
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// DefaultGrace protects chunks younger than this from garbage collection,
+// as they may belong to a backup whose manifest is not stored yet
+const DefaultGrace = 24 * time.Hour
+
+// GCOptions configures a garbage collection
+type GCOptions struct {
+	// DryRun reports what would be deleted without deleting anything
+	DryRun bool
+	// Grace is the age below which unreferenced chunks are kept, default
+	// DefaultGrace
+	Grace time.Duration
+	// Now is the reference time for Grace, default time.Now()
+	Now time.Time
+}
+
+// GCResult counts the chunks found by a garbage collection
+type GCResult struct {
+	Chunks       int
+	Unreferenced int
+	// Deleted counts the deleted chunks, or those that would be deleted in
+	// a dry run, and Bytes their size
+	Deleted int
+	Bytes   int64
+}
+
+// GC deletes the chunks in b that no manifest in b references. Every
+// manifest must be readable, otherwise nothing is deleted, since the chunks
+// of an unreadable manifest cannot be told apart from garbage. GC fails with
+// ErrLocked while a backup holds a Lock on b.
+func GC(ctx context.Context, b storage.Backend, opts GCOptions) (GCResult, error) {
+	var result GCResult
+	if opts.Grace == 0 {
+		opts.Grace = DefaultGrace
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	if !opts.DryRun {
+		lock, err := lockGarbageCollection(ctx, b)
+		if err != nil {
+			return result, fmt.Errorf("not collecting garbage in %s: %w", b.URL(), err)
+		}
+		defer lock.Release(ctx)
+	}
+
+	// Chunks are listed before the manifests, so a backup finishing in
+	// between keeps its chunks
+	chunks, err := b.List(ctx, manifest.ChunkDir)
+	if err != nil || len(chunks) == 0 {
+		return result, err
+	}
+	objects, err := b.List(ctx, "")
+	if err != nil {
+		return result, err
+	}
+	referenced := make(map[string]bool)
+	for _, obj := range objects {
+		if !manifest.IsManifest(obj.Key) {
+			continue
+		}
+		m, err := readManifest(ctx, b, obj.Key)
+		if err != nil {
+			return result, fmt.Errorf("not collecting garbage in %s, manifest %s is unreadable: %w", b.URL(), obj.Key, err)
+		}
+		for _, c := range m.Chunks {
+			referenced[manifest.ChunkKey(c.Hash)] = true
+		}
+	}
+
+	result.Chunks = len(chunks)
+	var errs []error
+	for _, obj := range chunks {
+		if referenced[obj.Key] {
+			continue
+		}
+		result.Unreferenced++
+		if !obj.ModTime.IsZero() && opts.Now.Sub(obj.ModTime) < opts.Grace {
+			continue
+		}
+		if opts.DryRun {
+			result.Deleted++
+			result.Bytes += obj.Size
+			continue
+		}
+		if err := b.Delete(ctx, obj.Key); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			customLog.Errorf("Failed to delete chunk %s: %v", storage.JoinURL(b, obj.Key), err)
+			errs = append(errs, err)
+			continue
+		}
+		result.Deleted++
+		result.Bytes += obj.Size
+	}
+	return result, errors.Join(errs...)
+}
+
+func readManifest(ctx context.Context, b storage.Backend, key string) (*manifest.Manifest, error) {
+	body, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return manifest.Decode(body)
+}
@@ -0,0 +1,150 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+// Lock kinds. Any number of backups may hold a lock at once, garbage
+// collection only runs while no other lock is held.
+const (
+	lockBackup = "backup"
+	lockGC     = "gc"
+)
+
+// lockStale is the age after which a lock is taken to be left behind by a
+// process that died. Backups may run for long; garbage collection does not.
+var lockStale = map[string]time.Duration{lockBackup: DefaultGrace, lockGC: time.Hour}
+
+// lockRetry is how often a backup checks whether garbage collection is done
+const lockRetry = 5 * time.Second
+
+// ErrLocked is returned by GC when backups are in progress
+var ErrLocked = errors.New("storage location is locked")
+
+// RepoLock is a lock object stored in a storage location
+type RepoLock struct {
+	b   storage.Backend
+	key string
+}
+
+// lockInfo is the content of a lock object
+type lockInfo struct {
+	Kind    string    `json:"kind"`
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Created time.Time `json:"created"`
+}
+
+// Lock takes a backup lock in b, waiting while garbage collection runs. It
+// keeps GC from deleting chunks a backup relies on, so it is held from
+// before Store lists the stored chunks until the manifest is stored.
+func Lock(ctx context.Context, b storage.Backend) (*RepoLock, error) {
+	waiting := false
+	for {
+		l, err := putLock(ctx, b, lockBackup)
+		if err != nil {
+			return nil, err
+		}
+		other, err := l.conflict(ctx, lockGC)
+		if err != nil {
+			l.Release(ctx)
+			return nil, err
+		}
+		if other == "" {
+			return l, nil
+		}
+		l.Release(ctx)
+		if !waiting {
+			customLog.Infof("Waiting for garbage collection in %s to finish (%s)", b.URL(), other)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up waiting for garbage collection in %s: %w", b.URL(), ctx.Err())
+		case <-time.After(lockRetry):
+		}
+	}
+}
+
+// lockGarbageCollection takes the lock of a garbage collection, which fails
+// with ErrLocked while any other lock is held
+func lockGarbageCollection(ctx context.Context, b storage.Backend) (*RepoLock, error) {
+	l, err := putLock(ctx, b, lockGC)
+	if err != nil {
+		return nil, err
+	}
+	other, err := l.conflict(ctx, lockBackup, lockGC)
+	if err == nil && other != "" {
+		err = fmt.Errorf("%w by %s", ErrLocked, other)
+	}
+	if err != nil {
+		l.Release(ctx)
+		return nil, err
+	}
+	return l, nil
+}
+
+// putLock stores a new lock of the given kind
+func putLock(ctx context.Context, b storage.Backend, kind string) (*RepoLock, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	data, err := json.Marshal(lockInfo{Kind: kind, Host: host, PID: os.Getpid(), Created: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	l := &RepoLock{b: b, key: manifest.LockDir + kind + "-" + hex.EncodeToString(id) + ".json"}
+	if err := b.Put(ctx, l.key, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %w", b.URL(), err)
+	}
+	return l, nil
+}
+
+// conflict returns the key of another live lock of one of the given kinds.
+// Every lock is stored before the others are listed, so of two processes
+// taking conflicting locks at least one sees the other.
+func (l *RepoLock) conflict(ctx context.Context, kinds ...string) (string, error) {
+	objects, err := l.b.List(ctx, manifest.LockDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to list the locks in %s: %w", l.b.URL(), err)
+	}
+	for _, obj := range objects {
+		if obj.Key == l.key {
+			continue
+		}
+		for _, kind := range kinds {
+			if !strings.HasPrefix(obj.Key, manifest.LockDir+kind+"-") {
+				continue
+			}
+			if !obj.ModTime.IsZero() && time.Since(obj.ModTime) > lockStale[kind] {
+				customLog.Warnf("Ignoring stale lock %s", storage.JoinURL(l.b, obj.Key))
+				continue
+			}
+			return obj.Key, nil
+		}
+	}
+	return "", nil
+}
+
+// Release deletes the lock, also after ctx has been canceled
+func (l *RepoLock) Release(ctx context.Context) error {
+	if err := l.b.Delete(context.WithoutCancel(ctx), l.key); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		customLog.Warnf("Failed to remove lock %s: %v", storage.JoinURL(l.b, l.key), err)
+		return err
+	}
+	return nil
+}
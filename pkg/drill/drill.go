@@ -0,0 +1,328 @@
+package drill
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/dedup"
+	"github.com/Annany2002/guard/pkg/erasure"
+	"github.com/Annany2002/guard/pkg/logger"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/restore"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/Annany2002/guard/pkg/utils"
+	"github.com/lib/pq"
+)
+
+var customLog = logger.NewLogger()
+
+// Options configures a restore drill
+type Options struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+
+	// FilePath is the backup to restore
+	FilePath string
+	// Assertions are SQL queries returning a single boolean that must be true
+	Assertions []string
+	// Keep leaves the scratch database in place after the drill
+	Keep bool
+}
+
+// Check is the outcome of a single drill check
+type Check struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report summarizes a restore drill
+type Report struct {
+	Backup    string        `json:"backup"`
+	Scratch   string        `json:"scratch"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Checks    []Check       `json:"checks"`
+	Passed    bool          `json:"passed"`
+}
+
+func (r *Report) add(name string, passed bool, detail string) {
+	r.Checks = append(r.Checks, Check{Name: name, Passed: passed, Detail: detail})
+}
+
+// Failed returns the checks that did not pass
+func (r *Report) Failed() []Check {
+	var failed []Check
+	for _, c := range r.Checks {
+		if !c.Passed {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// Run restores a backup into a scratch database, verifies it and drops the
+// scratch database again. An error is only returned if the drill could not
+// be carried out; failed checks are reported in the returned report.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	report := &Report{
+		Backup:    opts.FilePath,
+		Scratch:   ScratchName(opts.FilePath),
+		StartedAt: time.Now(),
+	}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt)
+		report.Passed = len(report.Checks) > 0 && len(report.Failed()) == 0
+	}()
+
+	m, err := manifest.Read(manifest.PathFor(opts.FilePath))
+	if err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+
+	journalDir, err := os.MkdirTemp("", "guard-drill")
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(journalDir)
+
+	customLog.Infof("Restoring %s into scratch database %s", opts.FilePath, report.Scratch)
+	restoreErr := restore.Run(ctx, restore.Options{
+		Host:        opts.Host,
+		Port:        opts.Port,
+		Username:    opts.Username,
+		Password:    opts.Password,
+		DBName:      report.Scratch,
+		FilePath:    opts.FilePath,
+		JournalPath: filepath.Join(journalDir, "restore.journal"),
+	})
+	if !opts.Keep {
+		defer func() {
+			if err := dropDatabase(opts, report.Scratch); err != nil {
+				customLog.Errorf("Failed to drop scratch database %s: %v", report.Scratch, err)
+			}
+		}()
+	}
+	if restoreErr != nil {
+		report.add("restore", false, restoreErr.Error())
+		return report, nil
+	}
+	report.add("restore", true, "")
+
+	db, err := open(opts, report.Scratch)
+	if err != nil {
+		return report, err
+	}
+	defer db.Close()
+
+	if m == nil {
+		customLog.Warnf("No manifest found for %s, skipping table and row count checks", opts.FilePath)
+	} else {
+		checkTables(ctx, db, m, report)
+	}
+
+	for i, assertion := range opts.Assertions {
+		name := fmt.Sprintf("assertion %d", i+1)
+		var ok bool
+		if err := db.QueryRowContext(ctx, assertion).Scan(&ok); err != nil {
+			report.add(name, false, err.Error())
+			continue
+		}
+		detail := ""
+		if !ok {
+			detail = "returned false: " + assertion
+		}
+		report.add(name, ok, detail)
+	}
+
+	return report, nil
+}
+
+// checkTables verifies table presence and row counts against the manifest
+func checkTables(ctx context.Context, db *sql.DB, m *manifest.Manifest, report *Report) {
+	for _, table := range m.Tables {
+		var present bool
+		if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", quoteQualified(table.Name)).Scan(&present); err != nil {
+			report.add("table "+table.Name, false, err.Error())
+			continue
+		}
+		if !present {
+			report.add("table "+table.Name, false, "table is missing")
+			continue
+		}
+		report.add("table "+table.Name, true, "")
+
+		var rows int64
+		if err := db.QueryRowContext(ctx, "SELECT count(*) FROM "+quoteQualified(table.Name)).Scan(&rows); err != nil {
+			report.add("rows "+table.Name, false, err.Error())
+			continue
+		}
+		if rows != table.Rows {
+			report.add("rows "+table.Name, false, fmt.Sprintf("expected %d rows, found %d", table.Rows, rows))
+			continue
+		}
+		report.add("rows "+table.Name, true, fmt.Sprintf("%d rows", rows))
+	}
+}
+
+// LoadAssertions reads SQL assertions from a file, one statement each
+func LoadAssertions(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var assertions []string
+	sc := restore.NewScanner(file)
+	for {
+		stmt, err := sc.Next()
+		if errors.Is(err, io.EOF) {
+			return assertions, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse assertions in %s: %w", path, err)
+		}
+		assertions = append(assertions, stmt.SQL)
+	}
+}
+
+// Latest returns the key of the most recent backup of dbname stored in a
+// backend. An empty dbname matches backups of any database.
+func Latest(ctx context.Context, b storage.Backend, dbname string) (string, error) {
+	objects, err := b.List(ctx, "")
+	if err != nil {
+		return "", err
+	}
+
+	type candidate struct {
+		key     string
+		created time.Time
+	}
+	var candidates []candidate
+	for _, obj := range objects {
+		if !manifest.IsManifest(obj.Key) {
+			continue
+		}
+		m, err := readManifest(ctx, b, obj.Key)
+		if err != nil {
+			customLog.Warnf("Skipping unreadable manifest %s: %v", obj.Key, err)
+			continue
+		}
+		if dbname != "" && m.Database != dbname {
+			continue
+		}
+		candidates = append(candidates, candidate{
+			key:     manifest.ArtifactFor(obj.Key),
+			created: m.CreatedAt,
+		})
+	}
+
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no backups found in %s", b.URL())
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].created.After(candidates[j].created)
+	})
+	return candidates[0].key, nil
+}
+
+// Fetch downloads a backup and its manifest (if any) into dir and returns
+// the local path of the backup. The backup is checked against the checksum
+// in its manifest; erasure-coded backups are rebuilt from their shards.
+func Fetch(ctx context.Context, b storage.Backend, key, dir string) (string, error) {
+	filePath := filepath.Join(dir, path.Base(key))
+	checksum := ""
+	err := storage.Download(ctx, b, manifest.PathFor(key), manifest.PathFor(filePath))
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return "", err
+	}
+	if err == nil {
+		m, err := manifest.Read(manifest.PathFor(filePath))
+		if err != nil {
+			return "", err
+		}
+		if m.Erasure != nil {
+			return filePath, erasure.Join(ctx, m, []storage.Backend{b}, filePath)
+		}
+		if m.Deduplicated() {
+			return filePath, dedup.Restore(ctx, b, m, filePath)
+		}
+		checksum = m.Checksum
+	}
+	if err := storage.DownloadVerified(ctx, b, key, filePath, checksum); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+func readManifest(ctx context.Context, b storage.Backend, key string) (*manifest.Manifest, error) {
+	body, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return manifest.Decode(body)
+}
+
+// ScratchName generates the name of the temporary database for a drill
+func ScratchName(filePath string) string {
+	base := strings.ToLower(filepath.Base(filePath))
+	base = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, base)
+	name := fmt.Sprintf("guard_drill_%d_%s", time.Now().Unix(), base)
+	// PostgreSQL truncates identifiers to 63 bytes
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+func open(opts Options, dbname string) (*sql.DB, error) {
+	connStr, err := utils.GenerateConnectionString(dbname, opts.Password, opts.Username, opts.Host, opts.Port)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func dropDatabase(opts Options, dbname string) error {
+	db, err := open(opts, "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(dbname))
+	return err
+}
+
+func quoteQualified(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return pq.QuoteIdentifier(name[:i]) + "." + pq.QuoteIdentifier(name[i+1:])
+	}
+	return pq.QuoteIdentifier(name)
+}
@@ -0,0 +1,365 @@
+package erasure
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Annany2002/guard/pkg/logger"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/Annany2002/guard/pkg/transfer"
+	"github.com/klauspost/reedsolomon"
+)
+
+var customLog = logger.NewLogger()
+
+// Scheme is the number of data and parity shards of an erasure-coded backup
+type Scheme struct {
+	Data   int
+	Parity int
+}
+
+// ParseScheme parses a scheme such as "3+2", three data and two parity
+// shards. An empty string is the zero scheme, no erasure coding.
+func ParseScheme(s string) (Scheme, error) {
+	if s == "" {
+		return Scheme{}, nil
+	}
+	data, parity, ok := strings.Cut(s, "+")
+	d, err1 := strconv.Atoi(data)
+	p, err2 := strconv.Atoi(parity)
+	if !ok || err1 != nil || err2 != nil || d < 1 || p < 1 || d+p > 256 {
+		return Scheme{}, fmt.Errorf("invalid erasure scheme %q, expected DATA+PARITY such as 3+2", s)
+	}
+	return Scheme{Data: d, Parity: p}, nil
+}
+
+// IsZero reports whether the scheme disables erasure coding
+func (s Scheme) IsZero() bool {
+	return s.Data == 0
+}
+
+// Shards returns the total number of shards
+func (s Scheme) Shards() int {
+	return s.Data + s.Parity
+}
+
+func (s Scheme) String() string {
+	return fmt.Sprintf("%d+%d", s.Data, s.Parity)
+}
+
+// Split erasure codes the file at filePath into one shard file per shard in
+// dir and returns their paths together with the shard layout of the backup
+// stored under key. URLs of the shards are left to the caller.
+func Split(filePath, key string, scheme Scheme, dir string) ([]string, *manifest.Erasure, error) {
+	enc, err := reedsolomon.NewStream(scheme.Data, scheme.Parity)
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		return nil, nil, fmt.Errorf("cannot erasure code the empty file %s", filePath)
+	}
+
+	paths := make([]string, scheme.Shards())
+	files := make([]*os.File, scheme.Shards())
+	hashes := make([]hash.Hash, scheme.Shards())
+	writers := make([]io.Writer, scheme.Shards())
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("shard%02d", i))
+		if files[i], err = os.Create(paths[i]); err != nil {
+			return nil, nil, err
+		}
+		hashes[i] = sha256.New()
+		writers[i] = io.MultiWriter(files[i], hashes[i])
+	}
+
+	if err := enc.Split(src, writers[:scheme.Data], info.Size()); err != nil {
+		return nil, nil, fmt.Errorf("failed to split %s into shards: %w", filePath, err)
+	}
+	data := make([]io.Reader, scheme.Data)
+	for i := range data {
+		if _, err := files[i].Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		data[i] = files[i]
+	}
+	if err := enc.Encode(data, writers[scheme.Data:]); err != nil {
+		return nil, nil, fmt.Errorf("failed to compute parity shards of %s: %w", filePath, err)
+	}
+
+	layout := &manifest.Erasure{
+		Data:      scheme.Data,
+		Parity:    scheme.Parity,
+		ShardSize: (info.Size() + int64(scheme.Data) - 1) / int64(scheme.Data),
+	}
+	for i := range paths {
+		if err := files[i].Sync(); err != nil {
+			return nil, nil, err
+		}
+		layout.Shards = append(layout.Shards, manifest.Shard{
+			Index:    i,
+			Key:      manifest.ShardKey(key, i),
+			Checksum: storage.FormatChecksum(hashes[i].Sum(nil)),
+		})
+	}
+	return paths, layout, nil
+}
+
+// Join rebuilds an erasure-coded backup from its shards into filePath and
+// checks it against the manifest checksum. Data shards are preferred, parity
+// shards replace data shards that are missing or corrupt. Shards are read
+// from the given backends when their URL matches, so that options such as
+// keys are kept, and from the URL recorded in the manifest otherwise. The
+// given backends are left open.
+func Join(ctx context.Context, m *manifest.Manifest, given []storage.Backend, filePath string) error {
+	layout := m.Erasure
+	if layout == nil {
+		return fmt.Errorf("backup %s is not erasure coded", m.ID)
+	}
+	enc, err := reedsolomon.NewStream(layout.Data, layout.Parity)
+	if err != nil {
+		return err
+	}
+	backends := openBackends(ctx, m, given)
+	defer backends.close()
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(filePath), ".shards-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// Fetch shards in index order until enough are verified
+	paths := make([]string, layout.Data+layout.Parity)
+	fetched := 0
+	for _, shard := range layout.Shards {
+		if fetched == layout.Data {
+			break
+		}
+		b, ok := backends.byURL[shard.URL]
+		if !ok {
+			customLog.Warnf("Shard %d of backup %s is unreachable at %s", shard.Index, m.ID, shard.URL)
+			continue
+		}
+		path := filepath.Join(dir, fmt.Sprintf("shard%02d", shard.Index))
+		if err := storage.DownloadVerified(ctx, b, shard.Key, path, shard.Checksum); err != nil {
+			customLog.Warnf("Shard %d of backup %s is unusable: %v", shard.Index, m.ID, err)
+			continue
+		}
+		paths[shard.Index] = path
+		fetched++
+	}
+	if fetched < layout.Data {
+		return fmt.Errorf("backup %s has %d readable shards, %d are needed", m.ID, fetched, layout.Data)
+	}
+
+	if err := reconstruct(enc, layout, paths, dir); err != nil {
+		return fmt.Errorf("failed to rebuild backup %s: %w", m.ID, err)
+	}
+	if err := join(enc, paths[:layout.Data], m.Size, filePath); err != nil {
+		return fmt.Errorf("failed to rebuild backup %s: %w", m.ID, err)
+	}
+	if m.Checksum != "" {
+		if err := storage.VerifyFile(filePath, m.Checksum); err != nil {
+			os.Remove(filePath)
+			return fmt.Errorf("rebuilt backup %s is corrupt: %w", m.ID, err)
+		}
+	}
+	customLog.Infof("Rebuilt backup %s from %d of %d shards", m.ID, fetched, len(layout.Shards))
+	return nil
+}
+
+// reconstruct recreates the missing data shards in dir from the fetched
+// shards and fills in their paths
+func reconstruct(enc reedsolomon.StreamEncoder, layout *manifest.Erasure, paths []string, dir string) error {
+	valid := make([]io.Reader, len(paths))
+	fill := make([]io.Writer, len(paths))
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	missing := false
+	for i, path := range paths {
+		if path != "" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			files = append(files, f)
+			valid[i] = f
+			continue
+		}
+		if i >= layout.Data {
+			continue
+		}
+		missing = true
+		paths[i] = filepath.Join(dir, fmt.Sprintf("shard%02d", i))
+		f, err := os.Create(paths[i])
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		fill[i] = f
+	}
+	if !missing {
+		return nil
+	}
+	return enc.Reconstruct(valid, fill)
+}
+
+// join concatenates the data shards into filePath, trimmed to size
+func join(enc reedsolomon.StreamEncoder, paths []string, size int64, filePath string) error {
+	shards := make([]io.Reader, len(paths))
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		shards[i] = f
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := enc.Join(tmp, shards, size); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// Shard health
+const (
+	StatusHealthy     = "healthy"
+	StatusMissing     = "missing"
+	StatusCorrupt     = "corrupt"
+	StatusUnreachable = "unreachable"
+)
+
+// Health is the state of one shard
+type Health struct {
+	Shard  manifest.Shard
+	Status string
+	// Error explains why a shard is not healthy
+	Error string
+}
+
+// Verify reads every shard of an erasure-coded backup and compares its
+// checksum with the manifest. Backends are resolved as in Join.
+func Verify(ctx context.Context, m *manifest.Manifest, given []storage.Backend) ([]Health, error) {
+	if m.Erasure == nil {
+		return nil, fmt.Errorf("backup %s is not erasure coded", m.ID)
+	}
+	backends := openBackends(ctx, m, given)
+	defer backends.close()
+
+	report := make([]Health, 0, len(m.Erasure.Shards))
+	for _, shard := range m.Erasure.Shards {
+		h := Health{Shard: shard, Status: StatusHealthy}
+		b, ok := backends.byURL[shard.URL]
+		if !ok {
+			h.Status, h.Error = StatusUnreachable, "storage location cannot be opened"
+			report = append(report, h)
+			continue
+		}
+		checksum, err := transfer.Checksum(ctx, b, shard.Key)
+		switch {
+		case errors.Is(err, storage.ErrNotExist):
+			h.Status, h.Error = StatusMissing, "shard not found"
+		case err != nil:
+			h.Status, h.Error = StatusUnreachable, err.Error()
+		case checksum != shard.Checksum:
+			h.Status, h.Error = StatusCorrupt, fmt.Sprintf("checksum %s, expected %s", checksum, shard.Checksum)
+		}
+		report = append(report, h)
+	}
+	return report, nil
+}
+
+// Healthy counts the healthy shards of a report
+func Healthy(report []Health) int {
+	n := 0
+	for _, h := range report {
+		if h.Status == StatusHealthy {
+			n++
+		}
+	}
+	return n
+}
+
+// shardBackends holds the backends shards are read from by URL
+type shardBackends struct {
+	byURL map[string]storage.Backend
+	// opened are the backends opened from shard URLs, to be closed
+	opened []storage.Backend
+}
+
+// openBackends keys the given backends by URL and opens the URL of every
+// shard that none of them serves. URLs that cannot be opened are logged and
+// left out.
+func openBackends(ctx context.Context, m *manifest.Manifest, given []storage.Backend) *shardBackends {
+	s := &shardBackends{byURL: make(map[string]storage.Backend)}
+	for _, b := range given {
+		s.byURL[b.URL()] = b
+	}
+	failed := make(map[string]bool)
+	for _, shard := range m.Erasure.Shards {
+		if _, ok := s.byURL[shard.URL]; ok || failed[shard.URL] {
+			continue
+		}
+		b, err := storage.Open(ctx, shard.URL)
+		if err != nil {
+			customLog.Warnf("Failed to open %s: %v", shard.URL, err)
+			failed[shard.URL] = true
+			continue
+		}
+		s.byURL[shard.URL] = b
+		s.opened = append(s.opened, b)
+	}
+	return s
+}
+
+func (s *shardBackends) close() {
+	for _, b := range s.opened {
+		storage.Close(b)
+	}
+}
@@ -0,0 +1,404 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNotFound is returned when no job has the given ID
+var ErrNotFound = errors.New("job not found")
+
+// ErrDeclared is returned when a job declared in a config file is removed
+// from the job store rather than from the file
+var ErrDeclared = errors.New("job is declared in a config file")
+
+// Tasks a job can run
+const (
+	TaskBackup = "backup"
+	TaskDrill  = "drill"
+)
+
+var jobsBucket = []byte("jobs")
+
+// Retention is the retention policy applied after every backup of a job
+type Retention struct {
+	KeepLast    int `json:"keep_last,omitempty"`
+	KeepDaily   int `json:"keep_daily,omitempty"`
+	KeepWeekly  int `json:"keep_weekly,omitempty"`
+	KeepMonthly int `json:"keep_monthly,omitempty"`
+	KeepYearly  int `json:"keep_yearly,omitempty"`
+	// KeepWithin is a duration such as 30d
+	KeepWithin string `json:"keep_within,omitempty"`
+}
+
+// Filter selects the tables a job backs up
+type Filter struct {
+	Schema string `json:"schema,omitempty"`
+	// Prefix and Suffix select the tables whose names start and end with
+	// them
+	Prefix string `json:"prefix,omitempty"`
+	Suffix string `json:"suffix,omitempty"`
+}
+
+// Notification is a webhook notified about the runs of a job
+type Notification struct {
+	URL string `json:"url"`
+	// On is failure, success or always
+	On      string            `json:"on,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Job is a scheduled backup or restore drill of one database
+type Job struct {
+	ID   int64  `json:"id"`
+	Task string `json:"task"`
+	Cron string `json:"cron"`
+	// Name and Config are set for jobs declared in a config file: the name
+	// of the job and the path of the file
+	Name   string `json:"name,omitempty"`
+	Config string `json:"config,omitempty"`
+
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// PasswordEnv and PasswordFile name where the password of a job
+	// declared in a config file is read from when the job runs, so that it
+	// is not kept in the store
+	PasswordEnv  string `json:"password_env,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+	Database     string `json:"database"`
+
+	// Storage lists the storage URLs backups are sent to; drills restore
+	// from the first
+	Storage []string `json:"storage"`
+	// Require is the replication policy: all, any or a number
+	Require string `json:"require,omitempty"`
+	Layout  string `json:"layout,omitempty"`
+	// Erasure is an erasure scheme such as 3+2
+	Erasure string `json:"erasure,omitempty"`
+	Dedup   bool   `json:"dedup,omitempty"`
+	Tables  Filter `json:"tables,omitempty"`
+	// Compression is none, gzip or gzip:LEVEL
+	Compression string    `json:"compression,omitempty"`
+	Retention   Retention `json:"retention,omitempty"`
+	// Stages are tiering stages such as 30d:GLACIER
+	Stages []string       `json:"stages,omitempty"`
+	Notify []Notification `json:"notify,omitempty"`
+
+	// Assertions and AssertFile are checked by drills, and Keep keeps the
+	// scratch database of a drill
+	Assertions []string `json:"assertions,omitempty"`
+	AssertFile string   `json:"assert_file,omitempty"`
+	Keep       bool     `json:"keep,omitempty"`
+
+	// Paused jobs are not run on their schedule
+	Paused    bool      `json:"paused,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate checks the fields every job needs
+func (j *Job) Validate() error {
+	if j.Task != TaskBackup && j.Task != TaskDrill {
+		return fmt.Errorf("unknown task %q, expected %s or %s", j.Task, TaskBackup, TaskDrill)
+	}
+	if _, err := cron.ParseStandard(j.Cron); err != nil {
+		return fmt.Errorf("invalid cron expression %q: %w", j.Cron, err)
+	}
+	if j.Database == "" {
+		return fmt.Errorf("no database given")
+	}
+	if len(j.Storage) == 0 {
+		return fmt.Errorf("no storage location given")
+	}
+	set := 0
+	for _, source := range []string{j.Password, j.PasswordEnv, j.PasswordFile} {
+		if source != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("only one of password, password_env and password_file may be set")
+	}
+	return nil
+}
+
+// ResolvePassword returns the password of the job, read from PasswordEnv or
+// PasswordFile when one is set
+func (j *Job) ResolvePassword() (string, error) {
+	switch {
+	case j.PasswordEnv != "":
+		password, ok := os.LookupEnv(j.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", j.PasswordEnv)
+		}
+		return password, nil
+	case j.PasswordFile != "":
+		data, err := os.ReadFile(j.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return j.Password, nil
+}
+
+// Next returns the next time the job runs after t
+func (j *Job) Next(t time.Time) time.Time {
+	schedule, err := cron.ParseStandard(j.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	return schedule.Next(t)
+}
+
+// Store is an embedded database of scheduled jobs, read by guard daemon
+type Store struct {
+	db *bolt.DB
+}
+
+// DefaultPath returns the job store location: GUARD_JOBS, or
+// ~/.guard/jobs.db
+func DefaultPath() string {
+	if path := os.Getenv("GUARD_JOBS"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".guard", "jobs.db")
+	}
+	return filepath.Join(home, ".guard", "jobs.db")
+}
+
+// Open opens the job store at path, creating it if needed. Jobs hold
+// database passwords, so the store is only readable by its owner. The
+// store is locked while open, so callers should close it as soon as
+// possible.
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create job store directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the store
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// itob encodes a job ID as a key that sorts numerically
+func itob(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// Add validates a job, gives it the next free ID and stores it
+func (s *Store) Add(j *Job) error {
+	if err := j.Validate(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		j.ID = int64(id)
+		if j.CreatedAt.IsZero() {
+			j.CreatedAt = time.Now()
+		}
+		data, err := json.Marshal(j)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(itob(j.ID), data)
+	})
+}
+
+// Get returns the job with the given ID
+func (s *Store) Get(id int64) (*Job, error) {
+	var j *Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobsBucket).Get(itob(id))
+		if data == nil {
+			return fmt.Errorf("job %d: %w", id, ErrNotFound)
+		}
+		j = &Job{}
+		return json.Unmarshal(data, j)
+	})
+	return j, err
+}
+
+// List returns every job ordered by ID
+func (s *Store) List() ([]Job, error) {
+	var jobs []Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var j Job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return fmt.Errorf("corrupt job %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			jobs = append(jobs, j)
+			return nil
+		})
+	})
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].ID < jobs[k].ID })
+	return jobs, err
+}
+
+// Update applies fn to the job with the given ID and stores the result
+func (s *Store) Update(id int64, fn func(j *Job)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		data := bucket.Get(itob(id))
+		if data == nil {
+			return fmt.Errorf("job %d: %w", id, ErrNotFound)
+		}
+		j := &Job{}
+		if err := json.Unmarshal(data, j); err != nil {
+			return err
+		}
+		fn(j)
+		j.ID = id
+		data, err := json.Marshal(j)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(itob(id), data)
+	})
+}
+
+// Remove deletes the job with the given ID. Jobs declared in a config
+// file are removed from the file instead.
+func (s *Store) Remove(id int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		data := bucket.Get(itob(id))
+		if data == nil {
+			return fmt.Errorf("job %d: %w", id, ErrNotFound)
+		}
+		var j Job
+		if err := json.Unmarshal(data, &j); err != nil {
+			return err
+		}
+		if j.Config != "" {
+			return fmt.Errorf("job %d: %w, remove %s from %s instead", id, ErrDeclared, j.Name, j.Config)
+		}
+		return bucket.Delete(itob(id))
+	})
+}
+
+// SyncConfig makes the jobs declared in the config file at path match
+// list, matching jobs by name. Jobs keep their ID, creation time and
+// whether they are paused, and jobs no longer declared are removed. It
+// returns the number of added, changed and removed jobs.
+func (s *Store) SyncConfig(path string, list []Job) (added, changed, removed int, err error) {
+	declared := make(map[string]*Job, len(list))
+	for i := range list {
+		if list[i].Name == "" {
+			return 0, 0, 0, fmt.Errorf("job %d of %s has no name", i+1, path)
+		}
+		if err := list[i].Validate(); err != nil {
+			return 0, 0, 0, fmt.Errorf("job %s: %w", list[i].Name, err)
+		}
+		if declared[list[i].Name] != nil {
+			return 0, 0, 0, fmt.Errorf("job %s is declared twice", list[i].Name)
+		}
+		declared[list[i].Name] = &list[i]
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		// The bucket must not change while ForEach walks it
+		puts := make(map[int64][]byte)
+		var deletes []int64
+		seen := make(map[string]bool, len(list))
+		err := bucket.ForEach(func(k, v []byte) error {
+			var stored Job
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("corrupt job %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			if stored.Config != path {
+				return nil
+			}
+			j := declared[stored.Name]
+			if j == nil {
+				deletes = append(deletes, stored.ID)
+				return nil
+			}
+			seen[stored.Name] = true
+			j.ID, j.Config, j.CreatedAt, j.Paused = stored.ID, path, stored.CreatedAt, stored.Paused
+			data, err := json.Marshal(j)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(data, v) {
+				puts[j.ID] = data
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range deletes {
+			if err := bucket.Delete(itob(id)); err != nil {
+				return err
+			}
+		}
+		for id, data := range puts {
+			if err := bucket.Put(itob(id), data); err != nil {
+				return err
+			}
+		}
+		for i := range list {
+			j := &list[i]
+			if seen[j.Name] {
+				continue
+			}
+			id, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			j.ID, j.Config, j.CreatedAt = int64(id), path, time.Now()
+			data, err := json.Marshal(j)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(itob(j.ID), data); err != nil {
+				return err
+			}
+			added++
+		}
+		changed, removed = len(puts), len(deletes)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return added, changed, removed, nil
+}
@@ -0,0 +1,226 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the manifest format version written by this build
+const Version = 1
+
+// Suffix is appended to a backup artifact name to get its manifest name
+const Suffix = ".manifest.json"
+
+// ChunkDir holds the chunks of deduplicated backups, below the root of a
+// storage location
+const ChunkDir = "chunks/"
+
+// LockDir holds the locks that keep garbage collection from deleting the
+// chunks of backups in progress
+const LockDir = "locks/"
+
+// shardInfix separates an artifact name from the shard number in shard keys
+const shardInfix = ".shard"
+
+// Table records a table contained in a backup
+type Table struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+}
+
+// Destination statuses
+const (
+	StatusStored = "stored"
+	StatusFailed = "failed"
+)
+
+// Encryption records the server-side encryption of a stored backup. For
+// customer-provided keys only the MD5 of the key is recorded.
+type Encryption struct {
+	Mode     string `json:"mode"`
+	KMSKeyID string `json:"kms_key_id,omitempty"`
+	KeyMD5   string `json:"key_md5,omitempty"`
+}
+
+// Destination records whether a backup reached one of its storage locations
+type Destination struct {
+	URL        string      `json:"url"`
+	Status     string      `json:"status"`
+	Error      string      `json:"error,omitempty"`
+	Encryption *Encryption `json:"encryption,omitempty"`
+}
+
+// Erasure records how an erasure-coded backup is split into shards. Any
+// Data of the Data+Parity shards are enough to rebuild it.
+type Erasure struct {
+	Data   int `json:"data"`
+	Parity int `json:"parity"`
+	// ShardSize is the size of every shard; the last data shard is padded
+	// with zeros
+	ShardSize int64   `json:"shard_size"`
+	Shards    []Shard `json:"shards"`
+}
+
+// Shard records where one shard of an erasure-coded backup is stored.
+// Shards 0 to Data-1 hold the data, the others parity.
+type Shard struct {
+	Index    int    `json:"index"`
+	URL      string `json:"url"`
+	Key      string `json:"key"`
+	Checksum string `json:"checksum"`
+}
+
+// ShardIn returns the shard stored in the location url
+func (e *Erasure) ShardIn(url string) (Shard, bool) {
+	for _, s := range e.Shards {
+		if s.URL == url {
+			return s, true
+		}
+	}
+	return Shard{}, false
+}
+
+// Chunk is one piece of a deduplicated backup, stored under ChunkKey(Hash)
+type Chunk struct {
+	// Hash is the hex encoded SHA-256 of the chunk
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Manifest describes a single backup artifact
+type Manifest struct {
+	Version   int       `json:"version"`
+	ID        string    `json:"id"`
+	Database  string    `json:"database"`
+	DBMS      string    `json:"dbms"`
+	Type      string    `json:"type"`
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"created_at"`
+	// DurationSeconds is how long the backup took
+	DurationSeconds float64 `json:"duration_seconds"`
+	Tables          []Table `json:"tables"`
+	// Compression is the algorithm the artifact is compressed with, such
+	// as gzip, empty for uncompressed dumps
+	Compression string `json:"compression,omitempty"`
+	// Destinations lists the storage locations the backup was sent to
+	Destinations []Destination `json:"destinations,omitempty"`
+	// Erasure is set for erasure-coded backups, whose artifact is only
+	// stored as shards
+	Erasure *Erasure `json:"erasure,omitempty"`
+	// Chunks is set for deduplicated backups, whose artifact is only stored
+	// as these chunks, in order
+	Chunks []Chunk `json:"chunks,omitempty"`
+}
+
+// PathFor returns the manifest path belonging to a backup artifact
+func PathFor(artifact string) string {
+	return artifact + Suffix
+}
+
+// IsManifest reports whether name is a manifest file name
+func IsManifest(name string) bool {
+	return strings.HasSuffix(name, Suffix)
+}
+
+// ArtifactFor returns the backup artifact name a manifest belongs to
+func ArtifactFor(manifestPath string) string {
+	return strings.TrimSuffix(manifestPath, Suffix)
+}
+
+// ShardKey returns the key of a shard of an erasure-coded backup artifact
+func ShardKey(artifact string, index int) string {
+	return fmt.Sprintf("%s%s%02d", artifact, shardInfix, index)
+}
+
+// ShardOf returns the backup artifact a shard key belongs to
+func ShardOf(key string) (string, bool) {
+	i := strings.LastIndex(key, shardInfix)
+	if i < 0 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(key[i+len(shardInfix):]); err != nil {
+		return "", false
+	}
+	return key[:i], true
+}
+
+// ChunkKey returns the key of the chunk with the given hash
+func ChunkKey(hash string) string {
+	return ChunkDir + hash[:2] + "/" + hash
+}
+
+// IsChunk reports whether key is the key of a chunk
+func IsChunk(key string) bool {
+	return strings.HasPrefix(key, ChunkDir)
+}
+
+// IsLock reports whether key is the key of a lock
+func IsLock(key string) bool {
+	return strings.HasPrefix(key, LockDir)
+}
+
+// Deduplicated reports whether the backup is stored as chunks
+func (m *Manifest) Deduplicated() bool {
+	return len(m.Chunks) > 0
+}
+
+// Table looks up a table by name
+func (m *Manifest) Table(name string) (Table, bool) {
+	for _, t := range m.Tables {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Table{}, false
+}
+
+// Encode writes the manifest as JSON
+func (m *Manifest) Encode(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// Decode reads a manifest from JSON
+func Decode(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if m.Version > Version {
+		return nil, fmt.Errorf("manifest version %d is newer than supported version %d", m.Version, Version)
+	}
+	return m, nil
+}
+
+// Write stores the manifest at path
+func (m *Manifest) Write(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if err := m.Encode(file); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %w", path, err)
+	}
+	return file.Sync()
+}
+
+// Read loads the manifest stored at path
+func Read(path string) (*Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Decode(file)
+}
@@ -0,0 +1,163 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// When a target is notified
+const (
+	OnFailure = "failure"
+	OnSuccess = "success"
+	OnAlways  = "always"
+)
+
+// Statuses of a run
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// timeout bounds every webhook request, so that a slow receiver does not
+// hold up the next run of a job
+const timeout = 10 * time.Second
+
+// Target is a webhook that is sent an Event as JSON after job runs
+type Target struct {
+	URL string
+	// On is when the target is notified: OnFailure, the default, OnSuccess
+	// or OnAlways
+	On string
+	// Headers are sent with every request, e.g. an Authorization header
+	Headers map[string]string
+}
+
+// Validate checks the URL and the event of a target
+func (t Target) Validate() error {
+	u, err := url.Parse(t.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid notification URL %q, expected an http or https URL", t.URL)
+	}
+	switch t.On {
+	case "", OnFailure, OnSuccess, OnAlways:
+		return nil
+	}
+	return fmt.Errorf("invalid notification event %q, expected %s, %s or %s", t.On, OnFailure, OnSuccess, OnAlways)
+}
+
+// wants reports whether the target is notified about a run with status
+func (t Target) wants(status string) bool {
+	switch t.On {
+	case OnAlways:
+		return true
+	case OnSuccess:
+		return status == StatusSucceeded
+	}
+	return status == StatusFailed
+}
+
+// Event describes a finished run of a job
+type Event struct {
+	Job             int64     `json:"job"`
+	Name            string    `json:"name,omitempty"`
+	Task            string    `json:"task"`
+	Database        string    `json:"database"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Host            string    `json:"host,omitempty"`
+	// Text summarizes the event for chat webhooks such as Slack's
+	Text string `json:"text"`
+}
+
+// NewEvent describes a run of a job that started at started and ended with
+// err
+func NewEvent(id int64, name, task, database string, started time.Time, err error) Event {
+	e := Event{
+		Job:             id,
+		Name:            name,
+		Task:            task,
+		Database:        database,
+		Status:          StatusSucceeded,
+		Started:         started,
+		DurationSeconds: time.Since(started).Seconds(),
+	}
+	e.Host, _ = os.Hostname()
+	label := fmt.Sprintf("job %d", id)
+	if name != "" {
+		label = fmt.Sprintf("job %d (%s)", id, name)
+	}
+	duration := time.Duration(e.DurationSeconds * float64(time.Second)).Round(time.Second)
+	if err != nil {
+		e.Status = StatusFailed
+		e.Error = err.Error()
+		e.Text = fmt.Sprintf("guard: %s of %s, %s, failed after %s: %v", task, database, label, duration, err)
+	} else {
+		e.Text = fmt.Sprintf("guard: %s of %s, %s, succeeded in %s", task, database, label, duration)
+	}
+	return e
+}
+
+// Send posts e to every target that wants it. A failed notification does
+// not stop the others.
+func Send(ctx context.Context, targets []Target, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, t := range targets {
+		if !t.wants(e.Status) {
+			continue
+		}
+		if err := post(ctx, t, body); err != nil {
+			errs = append(errs, fmt.Errorf("failed to notify %s: %w", Redact(t.URL), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func post(ctx context.Context, t Target, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Leave out the URL the client adds to its errors
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Redact hides the path and query of a webhook URL, which often hold its
+// secret
+func Redact(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "webhook"
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,325 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Restore modes
+const (
+	// ModeFull recreates the database and applies the whole dump
+	ModeFull = "full"
+	// ModeData only loads table data into an existing database
+	ModeData = "data"
+)
+
+// Conflict strategies for rows that already exist in a data-only restore
+const (
+	// ConflictError fails the restore on duplicate rows
+	ConflictError = "error"
+	// ConflictSkip keeps existing rows and skips the dumped ones
+	ConflictSkip = "skip"
+	// ConflictUpsert overwrites existing rows matched by primary key
+	ConflictUpsert = "upsert"
+	// ConflictTruncate empties all tables in the dump before loading them
+	ConflictTruncate = "truncate"
+)
+
+// stagingTable receives COPY data before it is merged into the live table
+const stagingTable = "guard_restore_stage"
+
+// validateMode applies defaults and checks the mode and conflict strategy
+func validateMode(opts *Options) error {
+	if opts.Mode == "" {
+		opts.Mode = ModeFull
+	}
+	switch opts.Mode {
+	case ModeFull:
+		if opts.Conflict != "" && opts.Conflict != ConflictError {
+			return fmt.Errorf("--conflict=%s requires --mode %s", opts.Conflict, ModeData)
+		}
+	case ModeData:
+	default:
+		return fmt.Errorf("unknown restore mode %q, expected %s or %s", opts.Mode, ModeFull, ModeData)
+	}
+
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictError
+	}
+	switch opts.Conflict {
+	case ConflictError, ConflictSkip, ConflictUpsert, ConflictTruncate:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict strategy %q, expected error, skip, upsert or truncate", opts.Conflict)
+}
+
+// tableInfo holds the catalog details needed to merge rows into a table
+type tableInfo struct {
+	columns    []string
+	primaryKey []string
+}
+
+// tableInfo looks up the columns and primary key of a live table
+func (r *runner) tableInfo(ctx context.Context, table string) (*tableInfo, error) {
+	if info, ok := r.tables[table]; ok {
+		return info, nil
+	}
+
+	info := &tableInfo{}
+	var err error
+	info.columns, err = r.queryNames(ctx, `SELECT a.attname FROM pg_attribute a
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, quoteQualified(table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up columns of %s: %w", table, err)
+	}
+	info.primaryKey, err = r.queryNames(ctx, `SELECT a.attname FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = $1::regclass AND i.indisprimary
+		ORDER BY array_position(i.indkey, a.attnum)`, quoteQualified(table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up primary key of %s: %w", table, err)
+	}
+
+	if r.tables == nil {
+		r.tables = make(map[string]*tableInfo)
+	}
+	r.tables[table] = info
+	return info, nil
+}
+
+func (r *runner) queryNames(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := r.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// conflictClause builds the ON CONFLICT clause for inserting columns
+func (info *tableInfo) conflictClause(table, strategy string, columns []string) (string, error) {
+	switch strategy {
+	case ConflictSkip:
+		return " ON CONFLICT DO NOTHING", nil
+	case ConflictUpsert:
+		if len(info.primaryKey) == 0 {
+			return "", fmt.Errorf("table %s has no primary key to upsert on", table)
+		}
+	default:
+		return "", nil
+	}
+
+	key := make(map[string]bool, len(info.primaryKey))
+	for _, col := range info.primaryKey {
+		key[col] = true
+	}
+	var updates []string
+	for _, col := range columns {
+		if !key[col] {
+			updates = append(updates, pq.QuoteIdentifier(col)+" = EXCLUDED."+pq.QuoteIdentifier(col))
+		}
+	}
+	target := " ON CONFLICT (" + quoteList(info.primaryKey) + ")"
+	if len(updates) == 0 {
+		return target + " DO NOTHING", nil
+	}
+	return target + " DO UPDATE SET " + strings.Join(updates, ", "), nil
+}
+
+// hasConflictClause reports whether an INSERT statement already has a
+// top-level ON CONFLICT clause, ignoring literals and identifiers
+func hasConflictClause(sqlText string) bool {
+	tokens := tokenize(sqlText)
+	depth := 0
+	for i, tok := range tokens {
+		switch {
+		case tok.text == "(":
+			depth++
+		case tok.text == ")":
+			depth--
+		case depth == 0 && tok.keyword() == "ON":
+			if next := nextSignificant(tokens, i+1); next < len(tokens) && tokens[next].keyword() == "CONFLICT" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// truncateTables empties all tables the dump loads data into with a single
+// TRUNCATE, so foreign keys between them do not get in the way
+func (r *runner) truncateTables(ctx context.Context, tables []string) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(tables))
+	for i, table := range tables {
+		quoted[i] = quoteQualified(table)
+	}
+	customLog.Infof("Truncating %d tables before loading: %s", len(tables), strings.Join(tables, ", "))
+	if _, err := r.conn.ExecContext(ctx, "TRUNCATE TABLE "+strings.Join(quoted, ", ")); err != nil {
+		return fmt.Errorf("failed to truncate tables: %w", err)
+	}
+	return nil
+}
+
+// dumpTables returns the tables a dump loads data into, in dump order
+func dumpTables(filePath string, rw *Rewriter) ([]string, error) {
+	dump, err := openDump(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer dump.Close()
+
+	var tables []string
+	seen := make(map[string]bool)
+	sc := NewScanner(dump)
+	for {
+		stmt, err := sc.Next()
+		if errors.Is(err, io.EOF) {
+			return tables, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dump: %w", err)
+		}
+		if rw.Rewrite(stmt) && stmt.Data() && !seen[stmt.Table] {
+			seen[stmt.Table] = true
+			tables = append(tables, stmt.Table)
+		}
+	}
+}
+
+// loadData applies a COPY or INSERT statement of a data-only restore using
+// the configured conflict strategy
+func (r *runner) loadData(ctx context.Context, sc *Scanner, stmt *Statement, replay bool) error {
+	strategy := r.opts.Conflict
+	// Tables were emptied by truncateTables before the load started
+	if strategy == ConflictTruncate {
+		strategy = ConflictError
+	}
+	// Rows replayed after a resume may already have been committed
+	if replay && strategy == ConflictError {
+		strategy = ConflictSkip
+	}
+
+	info, err := r.tableInfo(ctx, stmt.Table)
+	if err != nil {
+		return err
+	}
+	columns := stmt.Columns
+	if len(columns) == 0 {
+		columns = info.columns
+	}
+	clause, err := info.conflictClause(stmt.Table, strategy, columns)
+	if err != nil {
+		return err
+	}
+
+	if stmt.Kind != KindCopy {
+		sqlText := stmt.SQL
+		if clause != "" && !hasConflictClause(sqlText) {
+			sqlText += clause
+		}
+		_, err := r.tx.ExecContext(ctx, sqlText)
+		return err
+	}
+
+	if clause == "" {
+		rows, err := r.copyRows(ctx, sc, stmt.SQL)
+		if err != nil {
+			return err
+		}
+		r.journal.Tables[stmt.Table].Rows += rows
+		customLog.Infof("Loaded %d rows into %s", rows, stmt.Table)
+		return nil
+	}
+
+	// Merge COPY data through a staging table so conflicts can be resolved
+	stage := pq.QuoteIdentifier(stagingTable)
+	setup := []string{
+		"DROP TABLE IF EXISTS pg_temp." + stage,
+		"CREATE TEMP TABLE " + stage + " (LIKE " + quoteQualified(stmt.Table) + ") ON COMMIT DROP",
+	}
+	for _, q := range setup {
+		if _, err := r.tx.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+
+	colList := quoteList(columns)
+	rows, err := r.copyRows(ctx, sc, "COPY "+stage+" ("+colList+") FROM stdin")
+	if err != nil {
+		return err
+	}
+
+	merge := "INSERT INTO " + quoteQualified(stmt.Table) + " (" + colList + ") SELECT " + colList + " FROM " + stage + clause
+	res, err := r.tx.ExecContext(ctx, merge)
+	if err != nil {
+		return err
+	}
+	merged, _ := res.RowsAffected()
+	r.journal.Tables[stmt.Table].Rows += merged
+	customLog.Infof("Merged %d of %d rows into %s (%s)", merged, rows, stmt.Table, strategy)
+	return nil
+}
+
+// resetSequences moves the sequences owned by loaded tables past the
+// highest value now present in their columns
+func (r *runner) resetSequences(ctx context.Context) error {
+	for table := range r.journal.Tables {
+		rows, err := r.conn.QueryContext(ctx, `SELECT a.attname, pg_get_serial_sequence($1, a.attname)
+			FROM pg_attribute a
+			WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+			AND pg_get_serial_sequence($1, a.attname) IS NOT NULL`, quoteQualified(table))
+		if err != nil {
+			return fmt.Errorf("failed to look up sequences of %s: %w", table, err)
+		}
+
+		sequences := make(map[string]string)
+		for rows.Next() {
+			var column, sequence string
+			if err := rows.Scan(&column, &sequence); err != nil {
+				rows.Close()
+				return err
+			}
+			sequences[column] = sequence
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for column, sequence := range sequences {
+			query := fmt.Sprintf("SELECT setval($1, COALESCE((SELECT max(%s) FROM %s), 0) + 1, false)",
+				pq.QuoteIdentifier(column), quoteQualified(table))
+			if _, err := r.conn.ExecContext(ctx, query, sequence); err != nil {
+				return fmt.Errorf("failed to reset sequence %s: %w", sequence, err)
+			}
+			customLog.Infof("Reset sequence %s to follow %s.%s", sequence, table, column)
+		}
+	}
+	return nil
+}
+
+func quoteList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = pq.QuoteIdentifier(name)
+	}
+	return strings.Join(quoted, ", ")
+}
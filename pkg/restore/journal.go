@@ -0,0 +1,156 @@
+package restore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Table load states recorded in the journal
+const (
+	TableLoading = "loading"
+	TableLoaded  = "loaded"
+)
+
+// TableProgress records how far the data of a single table got
+type TableProgress struct {
+	State string `json:"state"`
+	// FirstStatement is the index of the first statement loading the table
+	FirstStatement int   `json:"first_statement"`
+	Rows           int64 `json:"rows"`
+}
+
+// Journal is a local checkpoint file recording restore progress so that an
+// interrupted restore can be resumed instead of started from scratch
+type Journal struct {
+	path string
+
+	Source    string    `json:"source"`
+	Database  string    `json:"database"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Applied is the index of the last statement known to be committed
+	Applied int                       `json:"applied"`
+	Tables  map[string]*TableProgress `json:"tables"`
+	// Rewrite holds the rewrite options the restore was started with
+	Rewrite *Rewriter `json:"rewrite,omitempty"`
+	// Mode, Conflict and DisableTriggers hold the data-only restore options
+	Mode            string `json:"mode,omitempty"`
+	Conflict        string `json:"conflict,omitempty"`
+	DisableTriggers bool   `json:"disable_triggers,omitempty"`
+}
+
+// NewJournal creates a journal for restoring source into database
+func NewJournal(path, source, database string) *Journal {
+	return &Journal{
+		path:      path,
+		Source:    source,
+		Database:  database,
+		StartedAt: time.Now(),
+		Tables:    make(map[string]*TableProgress),
+	}
+}
+
+// LoadJournal reads a journal written by a previous restore
+func LoadJournal(path string) (*Journal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read restore journal %s: %w", path, err)
+	}
+
+	j := &Journal{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("failed to parse restore journal %s: %w", path, err)
+	}
+	if j.Tables == nil {
+		j.Tables = make(map[string]*TableProgress)
+	}
+	j.path = path
+	return j, nil
+}
+
+// Path returns the location of the journal file
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Save atomically writes the journal to disk
+func (j *Journal) Save() error {
+	j.UpdatedAt = time.Now()
+
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write restore journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync restore journal: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), j.path)
+}
+
+// Remove deletes the journal once the restore has completed
+func (j *Journal) Remove() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// StartTable marks a table as being loaded starting at statement index. It
+// returns false if the table has been (partly) loaded before, in which case
+// its original first statement is kept so a reload covers all its data.
+func (j *Journal) StartTable(table string, index int) bool {
+	if p, ok := j.Tables[table]; ok {
+		p.State = TableLoading
+		return false
+	}
+	j.Tables[table] = &TableProgress{State: TableLoading, FirstStatement: index}
+	return true
+}
+
+// FinishTable marks a table as completely loaded
+func (j *Journal) FinishTable(table string) {
+	if p, ok := j.Tables[table]; ok {
+		p.State = TableLoaded
+	}
+}
+
+// Reloading reports whether statement index belongs to a partly loaded
+// table that has to be reloaded on resume
+func (j *Journal) Reloading(table string, index int) bool {
+	p, ok := j.Tables[table]
+	return ok && p.State == TableLoading && index >= p.FirstStatement
+}
+
+// PartialTables returns the tables whose load was interrupted
+func (j *Journal) PartialTables() []string {
+	var tables []string
+	for name, p := range j.Tables {
+		if p.State == TableLoading {
+			tables = append(tables, name)
+		}
+	}
+	return tables
+}
@@ -0,0 +1,359 @@
+package restore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// StatementKind identifies how a parsed statement has to be applied
+type StatementKind int
+
+const (
+	// KindStatement is a plain SQL statement executed as-is
+	KindStatement StatementKind = iota
+	// KindCopy is a COPY ... FROM stdin statement followed by data rows
+	KindCopy
+)
+
+var (
+	copyPattern    = regexp.MustCompile(`(?is)^COPY\s+([^\s(]+)\s*(?:\(([^)]*)\))?\s+FROM\s+stdin`)
+	insertPattern  = regexp.MustCompile(`(?is)^INSERT\s+INTO\s+([^\s(]+)\s*(?:\(([^)]*)\))?`)
+	sessionPattern = regexp.MustCompile(`(?is)^(SET\s|SELECT\s+(pg_catalog\.)?set_config\s*\()`)
+)
+
+// Statement is a single statement read from a SQL dump
+type Statement struct {
+	// Index is the 1-based position of the statement in the dump
+	Index int
+	Kind  StatementKind
+	SQL   string
+	// Table is set for statements that load data (COPY and INSERT)
+	Table string
+	// Columns is the column list of a COPY or INSERT statement
+	Columns []string
+}
+
+// Session reports whether the statement only changes session settings
+func (s *Statement) Session() bool {
+	return sessionPattern.MatchString(s.SQL)
+}
+
+// Scanner splits a SQL dump into statements while streaming it, keeping
+// quoted strings, comments and COPY data blocks intact.
+type Scanner struct {
+	r      *bufio.Reader
+	count  int
+	inCopy bool
+}
+
+// NewScanner creates a scanner reading SQL from r
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next statement in the dump, or io.EOF once the dump is
+// exhausted. Any unread rows of a previous COPY statement are discarded.
+func (s *Scanner) Next() (*Statement, error) {
+	for s.inCopy {
+		if _, err := s.NextRow(); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+	}
+
+	sqlText, err := s.readStatement()
+	if err != nil {
+		return nil, err
+	}
+
+	s.count++
+	stmt := &Statement{Index: s.count, SQL: sqlText}
+	stmt.classify()
+
+	if stmt.Kind == KindCopy {
+		// COPY data starts on the line following the statement
+		if _, err := s.r.ReadString('\n'); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		s.inCopy = true
+	}
+
+	return stmt, nil
+}
+
+// classify derives the kind, table and columns of a statement from its SQL
+func (s *Statement) classify() {
+	s.Kind = KindStatement
+	s.Table = ""
+	s.Columns = nil
+
+	m := copyPattern.FindStringSubmatch(s.SQL)
+	if m != nil {
+		s.Kind = KindCopy
+	} else if m = insertPattern.FindStringSubmatch(s.SQL); m == nil {
+		return
+	}
+
+	s.Table = unquoteIdentifier(m[1])
+	for _, col := range strings.Split(m[2], ",") {
+		if col = strings.TrimSpace(col); col != "" {
+			s.Columns = append(s.Columns, unquoteIdentifier(col))
+		}
+	}
+}
+
+// Data reports whether the statement loads table data
+func (s *Statement) Data() bool {
+	return s.Table != ""
+}
+
+// NextRow returns the next data row of the current COPY statement. It
+// returns io.EOF once the end-of-data marker has been read. NULL values
+// are returned as nil.
+func (s *Scanner) NextRow() ([]*string, error) {
+	if !s.inCopy {
+		return nil, io.EOF
+	}
+
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if line == "" {
+			return nil, fmt.Errorf("unexpected end of dump inside COPY data: %w", io.ErrUnexpectedEOF)
+		}
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if line == `\.` {
+		s.inCopy = false
+		return nil, io.EOF
+	}
+
+	fields := strings.Split(line, "\t")
+	row := make([]*string, len(fields))
+	for i, field := range fields {
+		if field == `\N` {
+			continue
+		}
+		value := decodeCopyField(field)
+		row[i] = &value
+	}
+	return row, nil
+}
+
+// readStatement reads up to and including the next top-level semicolon.
+// Comments are dropped; string literals and identifiers are kept verbatim.
+func (s *Scanner) readStatement() (string, error) {
+	var sb strings.Builder
+
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if text := strings.TrimSpace(sb.String()); text != "" {
+					return text, nil
+				}
+			}
+			return "", err
+		}
+
+		switch b {
+		case ';':
+			if text := strings.TrimSpace(sb.String()); text != "" {
+				return text, nil
+			}
+			sb.Reset()
+
+		case '\'', '"':
+			sb.WriteByte(b)
+			if err := s.copyQuoted(&sb, b); err != nil {
+				return "", err
+			}
+
+		case '-':
+			if next, _ := s.r.Peek(1); len(next) == 1 && next[0] == '-' {
+				if _, err := s.r.ReadString('\n'); err != nil && !errors.Is(err, io.EOF) {
+					return "", err
+				}
+				sb.WriteByte('\n')
+				continue
+			}
+			sb.WriteByte(b)
+
+		case '/':
+			if next, _ := s.r.Peek(1); len(next) == 1 && next[0] == '*' {
+				s.r.ReadByte()
+				if err := s.skipBlockComment(); err != nil {
+					return "", err
+				}
+				sb.WriteByte(' ')
+				continue
+			}
+			sb.WriteByte(b)
+
+		case '$':
+			sb.WriteByte(b)
+			tag, ok := s.peekDollarTag()
+			if !ok {
+				continue
+			}
+			if err := s.copyDollarQuoted(&sb, tag); err != nil {
+				return "", err
+			}
+
+		default:
+			sb.WriteByte(b)
+		}
+	}
+}
+
+// copyQuoted copies a quoted literal or identifier, handling doubled quotes
+func (s *Scanner) copyQuoted(sb *strings.Builder, quote byte) error {
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		sb.WriteByte(b)
+		if b != quote {
+			continue
+		}
+		if next, _ := s.r.Peek(1); len(next) == 1 && next[0] == quote {
+			s.r.ReadByte()
+			sb.WriteByte(quote)
+			continue
+		}
+		return nil
+	}
+}
+
+// skipBlockComment skips a (possibly nested) /* */ comment
+func (s *Scanner) skipBlockComment() error {
+	depth := 1
+	var prev byte
+	for depth > 0 {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		switch {
+		case prev == '/' && b == '*':
+			depth++
+			b = 0
+		case prev == '*' && b == '/':
+			depth--
+			b = 0
+		}
+		prev = b
+	}
+	return nil
+}
+
+// peekDollarTag checks whether the '$' just read opens a dollar quote and
+// returns the tag including its closing '$'
+func (s *Scanner) peekDollarTag() (string, bool) {
+	for n := 1; n <= 64; n++ {
+		buf, err := s.r.Peek(n)
+		if err != nil || len(buf) < n {
+			return "", false
+		}
+		c := buf[n-1]
+		switch {
+		case c == '$':
+			return "$" + string(buf), true
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80:
+		case c >= '0' && c <= '9' && n > 1:
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// copyDollarQuoted copies a dollar-quoted string body up to its closing tag
+func (s *Scanner) copyDollarQuoted(sb *strings.Builder, tag string) error {
+	// The opening tag is still unread apart from its leading '$'
+	if _, err := s.r.Discard(len(tag) - 1); err != nil {
+		return unexpectedEOF(err)
+	}
+	sb.WriteString(tag[1:])
+
+	var body strings.Builder
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		body.WriteByte(b)
+		sb.WriteByte(b)
+		if b == '$' && strings.HasSuffix(body.String(), tag) {
+			return nil
+		}
+	}
+}
+
+// decodeCopyField reverses the backslash escaping of the COPY text format
+func decodeCopyField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c != '\\' || i+1 == len(field) {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		switch field[i] {
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'v':
+			sb.WriteByte('\v')
+		default:
+			sb.WriteByte(field[i])
+		}
+	}
+	return sb.String()
+}
+
+// unquoteIdentifier strips double quotes from a (possibly qualified) name
+func unquoteIdentifier(name string) string {
+	name = strings.TrimSpace(name)
+	if !strings.Contains(name, `"`) {
+		return name
+	}
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if len(part) >= 2 && part[0] == '"' && part[len(part)-1] == '"' {
+			part = strings.ReplaceAll(part[1:len(part)-1], `""`, `"`)
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, ".")
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
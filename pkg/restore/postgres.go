@@ -1,28 +1,516 @@
 package restore
 
 import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 
 	"github.com/Annany2002/guard/pkg/logger"
 	"github.com/Annany2002/guard/pkg/utils"
+	"github.com/lib/pq"
 )
 
 var customLog = logger.NewLogger()
 
+// checkpointInterval is the number of plain statements applied in one
+// transaction before progress is written to the journal
+const checkpointInterval = 500
+
+// Options configures a PostgreSQL restore
+type Options struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	DBName   string
+	FilePath string
+
+	// JournalPath is the checkpoint file; defaults to FilePath + ".journal"
+	JournalPath string
+	// Resume continues the restore recorded in JournalPath instead of
+	// recreating the database
+	Resume bool
+
+	// Rewrite remaps roles and schemas and drops ownership or privilege
+	// statements while the dump streams through
+	Rewrite Rewriter
+
+	// Mode is ModeFull (default) to recreate the database or ModeData to
+	// only load table data into an existing database
+	Mode string
+	// Conflict decides what happens to rows that already exist in a
+	// data-only restore
+	Conflict string
+	// DisableTriggers turns off triggers and foreign key checks during a
+	// data-only restore instead of deferring constraints
+	DisableTriggers bool
+}
+
+// DefaultJournalPath returns the journal location used for a backup file
+func DefaultJournalPath(filePath string) string {
+	return filePath + ".journal"
+}
+
 // RestorePostgres restores a PostgreSQL database from a backup file
 func RestorePostgres(host, username, password, dbname, filePath, port string) error {
-	customLog.Infof("Restoring PostgreSQL database %s from file %s", dbname, filePath)
+	return Run(context.TODO(), Options{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		DBName:   dbname,
+		FilePath: filePath,
+	})
+}
+
+// Run restores a PostgreSQL database, checkpointing progress into a
+// journal so that an interrupted restore can be resumed
+func Run(ctx context.Context, opts Options) error {
+	journal, err := prepareJournal(&opts)
+	if err != nil {
+		return err
+	}
+	if err := validateMode(&opts); err != nil {
+		return err
+	}
+
+	if !opts.Resume && opts.Mode == ModeFull {
+		customLog.Infof("Restoring PostgreSQL database %s from file %s", opts.DBName, opts.FilePath)
+		if err := recreateDatabase(opts); err != nil {
+			return err
+		}
+	}
+
+	db, err := connect(opts, opts.DBName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return apply(ctx, db, opts, journal)
+}
 
-	// Determine the file extension
-	ext := filepath.Ext(filePath)
-	if ext == ".gz" {
-		return utils.RestoreGzFile(filePath, host, username, password, dbname, port)
+// RunDB restores into the open database db like Run, except that a full
+// restore does not recreate the database, which has to be empty
+func RunDB(ctx context.Context, db *sql.DB, opts Options) error {
+	journal, err := prepareJournal(&opts)
+	if err != nil {
+		return err
 	}
-	err := utils.RestoreSqlFile(filePath, host, username, password, dbname, port)
+	if err := validateMode(&opts); err != nil {
+		return err
+	}
+	return apply(ctx, db, opts, journal)
+}
+
+// apply streams the dump into db, resuming after the last statement the
+// journal records as committed
+func apply(ctx context.Context, db *sql.DB, opts Options, journal *Journal) error {
+	if opts.Resume {
+		customLog.Infof("Resuming restore of %s into %s after statement %d", opts.FilePath, opts.DBName, journal.Applied)
+	} else {
+		if opts.Mode == ModeData {
+			customLog.Infof("Loading data from %s into existing database %s (conflict: %s)", opts.FilePath, opts.DBName, opts.Conflict)
+		}
+		if err := journal.Save(); err != nil {
+			return err
+		}
+	}
+
+	dump, err := openDump(opts.FilePath)
 	if err != nil {
-		customLog.Fatal(err)
+		return err
+	}
+	defer dump.Close()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Close()
+
+	if !opts.Resume && opts.Mode == ModeFull {
+		for _, schema := range opts.Rewrite.Schemas() {
+			if _, err := conn.ExecContext(ctx, "CREATE SCHEMA IF NOT EXISTS "+pq.QuoteIdentifier(schema)); err != nil {
+				return fmt.Errorf("failed to create schema %s: %w", schema, err)
+			}
+		}
+	}
+
+	r := &runner{conn: conn, journal: journal, opts: &opts}
+	if !opts.Resume && opts.Mode == ModeData && opts.Conflict == ConflictTruncate {
+		tables, err := dumpTables(opts.FilePath, &opts.Rewrite)
+		if err != nil {
+			return err
+		}
+		if err := r.truncateTables(ctx, tables); err != nil {
+			return err
+		}
+	}
+	if err := r.truncatePartial(ctx); err != nil {
+		return err
+	}
+	if err := r.run(ctx, NewScanner(dump)); err != nil {
+		customLog.Errorf("Restore stopped, resume with --resume %s", journal.Path())
+		return err
+	}
+	if opts.Mode == ModeData {
+		if err := r.resetSequences(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := journal.Remove(); err != nil {
+		customLog.Warnf("Failed to remove restore journal %s: %v", journal.Path(), err)
 	}
 
-	customLog.Infof("Successfully restored PostgreSQL database %s from file %s", dbname, filePath)
+	customLog.Infof("Successfully restored PostgreSQL database %s from file %s", opts.DBName, opts.FilePath)
 	return nil
 }
+
+// prepareJournal loads the journal to resume from or creates a fresh one
+func prepareJournal(opts *Options) (*Journal, error) {
+	if !opts.Resume {
+		if opts.FilePath == "" || opts.DBName == "" {
+			return nil, errors.New("backup file and database name are required")
+		}
+		if opts.JournalPath == "" {
+			opts.JournalPath = DefaultJournalPath(opts.FilePath)
+		}
+		journal := NewJournal(opts.JournalPath, opts.FilePath, opts.DBName)
+		if !opts.Rewrite.Empty() {
+			journal.Rewrite = &opts.Rewrite
+		}
+		journal.Mode = opts.Mode
+		journal.Conflict = opts.Conflict
+		journal.DisableTriggers = opts.DisableTriggers
+		return journal, nil
+	}
+
+	journal, err := LoadJournal(opts.JournalPath)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FilePath == "" {
+		opts.FilePath = journal.Source
+	}
+	if opts.DBName == "" {
+		opts.DBName = journal.Database
+	}
+	if opts.FilePath != journal.Source || opts.DBName != journal.Database {
+		return nil, fmt.Errorf("journal %s belongs to restoring %s into %s", opts.JournalPath, journal.Source, journal.Database)
+	}
+	// A resumed restore has to rewrite statements exactly like the original
+	if opts.Rewrite.Empty() && journal.Rewrite != nil {
+		opts.Rewrite = *journal.Rewrite
+	}
+	if opts.Mode == "" {
+		opts.Mode = journal.Mode
+		opts.Conflict = journal.Conflict
+		opts.DisableTriggers = journal.DisableTriggers
+	}
+	return journal, nil
+}
+
+// runner applies parsed statements and keeps the journal up to date
+type runner struct {
+	conn    *sql.Conn
+	journal *Journal
+	opts    *Options
+
+	tx      *sql.Tx
+	pending int
+	last    int
+	current string
+	tables  map[string]*tableInfo
+}
+
+func (r *runner) run(ctx context.Context, sc *Scanner) error {
+	defer r.rollback()
+
+	if r.opts.Mode == ModeData && r.opts.DisableTriggers {
+		// Replica mode skips triggers, including foreign key checks
+		if _, err := r.conn.ExecContext(ctx, "SET session_replication_role = replica"); err != nil {
+			return fmt.Errorf("failed to disable triggers: %w", err)
+		}
+		defer r.conn.ExecContext(ctx, "SET session_replication_role = DEFAULT")
+	}
+
+	for {
+		stmt, err := sc.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse dump: %w", err)
+		}
+
+		if !r.opts.Rewrite.Rewrite(stmt) {
+			customLog.Debugf("Skipping statement %d: %s", stmt.Index, stmt.SQL)
+			continue
+		}
+		if r.opts.Mode == ModeData && !stmt.Data() && !stmt.Session() {
+			continue
+		}
+
+		replay := stmt.Index <= r.journal.Applied
+		if replay && !r.journal.Reloading(stmt.Table, stmt.Index) {
+			// Session settings are not persisted, so replay them on resume
+			if stmt.Session() {
+				if _, err := r.conn.ExecContext(ctx, stmt.SQL); err != nil {
+					return fmt.Errorf("failed to replay session setting %q: %w", stmt.SQL, err)
+				}
+			}
+			continue
+		}
+
+		if err := r.trackTable(stmt); err != nil {
+			return err
+		}
+		if err := r.begin(ctx); err != nil {
+			return err
+		}
+
+		if stmt.Data() && r.opts.Mode == ModeData {
+			if err := r.loadData(ctx, sc, stmt, replay); err != nil {
+				return fmt.Errorf("failed to load data into %s: %w", stmt.Table, err)
+			}
+		} else if stmt.Kind == KindCopy {
+			rows, err := r.copyRows(ctx, sc, stmt.SQL)
+			if err != nil {
+				return fmt.Errorf("failed to load data into %s: %w", stmt.Table, err)
+			}
+			r.journal.Tables[stmt.Table].Rows += rows
+			customLog.Infof("Loaded %d rows into %s", rows, stmt.Table)
+		} else if _, err := r.tx.ExecContext(ctx, stmt.SQL); err != nil {
+			customLog.Errorf("Failed to execute SQL statement: %s\nError: %v", stmt.SQL, err)
+			return err
+		}
+
+		r.pending++
+		r.last = stmt.Index
+		if stmt.Kind == KindCopy || r.pending >= checkpointInterval {
+			if err := r.checkpoint(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.current != "" {
+		r.journal.FinishTable(r.current)
+	}
+	return r.checkpoint()
+}
+
+// trackTable records which table is being loaded so that a partial load
+// can be truncated and reloaded on resume
+func (r *runner) trackTable(stmt *Statement) error {
+	if stmt.Table == r.current {
+		return nil
+	}
+	if r.current != "" {
+		r.journal.FinishTable(r.current)
+	}
+	r.current = stmt.Table
+	if r.current == "" {
+		return nil
+	}
+	r.journal.StartTable(r.current, stmt.Index)
+	return r.journal.Save()
+}
+
+func (r *runner) begin(ctx context.Context) error {
+	if r.tx != nil {
+		return nil
+	}
+	tx, err := r.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	r.tx = tx
+
+	if r.opts.Mode == ModeData && !r.opts.DisableTriggers {
+		// Check deferrable foreign keys only once the batch is complete
+		if _, err := tx.ExecContext(ctx, "SET CONSTRAINTS ALL DEFERRED"); err != nil {
+			return fmt.Errorf("failed to defer constraints: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkpoint commits the open transaction and records it in the journal
+func (r *runner) checkpoint() error {
+	if r.tx != nil {
+		if err := r.tx.Commit(); err != nil {
+			r.tx = nil
+			return fmt.Errorf("failed to commit statements up to %d: %w", r.last, err)
+		}
+		r.tx = nil
+	}
+	if r.last > r.journal.Applied {
+		r.journal.Applied = r.last
+	}
+	r.pending = 0
+	return r.journal.Save()
+}
+
+func (r *runner) rollback() {
+	if r.tx != nil {
+		r.tx.Rollback()
+		r.tx = nil
+	}
+}
+
+// copyRows streams the data rows of the current COPY statement into the
+// database using the given COPY ... FROM stdin statement
+func (r *runner) copyRows(ctx context.Context, sc *Scanner, copySQL string) (int64, error) {
+	copyStmt, err := r.tx.PrepareContext(ctx, copySQL)
+	if err != nil {
+		return 0, err
+	}
+	defer copyStmt.Close()
+
+	var count int64
+	for {
+		row, err := sc.NextRow()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		args := make([]interface{}, len(row))
+		for i, value := range row {
+			if value != nil {
+				args[i] = *value
+			}
+		}
+		if _, err := copyStmt.ExecContext(ctx, args...); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	if _, err := copyStmt.ExecContext(ctx); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+// truncatePartial empties tables whose load was interrupted so they can be
+// reloaded from their first statement
+func (r *runner) truncatePartial(ctx context.Context) error {
+	// Live tables of a data-only restore are never emptied on resume;
+	// reloading with skip or upsert semantics is idempotent instead
+	if r.opts.Mode == ModeData {
+		return nil
+	}
+
+	for _, table := range r.journal.PartialTables() {
+		customLog.Infof("Truncating partly loaded table %s", table)
+		if _, err := r.conn.ExecContext(ctx, "TRUNCATE TABLE "+quoteQualified(table)); err != nil {
+			return fmt.Errorf("failed to truncate table %s: %w", table, err)
+		}
+		r.journal.Tables[table].Rows = 0
+	}
+	return nil
+}
+
+// recreateDatabase drops and creates the target database
+func recreateDatabase(opts Options) error {
+	db, err := connect(opts, "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	name := pq.QuoteIdentifier(opts.DBName)
+	if _, err := db.Exec("DROP DATABASE IF EXISTS " + name); err != nil {
+		customLog.Errorf("Failed to drop database %s: %v", opts.DBName, err)
+		return err
+	}
+	if _, err := db.Exec("CREATE DATABASE " + name); err != nil {
+		customLog.Errorf("Failed to create database %s: %v", opts.DBName, err)
+		return err
+	}
+	return nil
+}
+
+// connect opens and pings a connection to the given database
+func connect(opts Options, dbname string) (*sql.DB, error) {
+	connStr, err := utils.GenerateConnectionString(dbname, opts.Password, opts.Username, opts.Host, opts.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		customLog.Errorf("Failed to connect to PostgreSQL: %v", err)
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		customLog.Errorf("Failed to ping PostgreSQL: %v", err)
+		return nil, err
+	}
+	return db, nil
+}
+
+// dumpReader is a backup file opened for reading, decompressed if needed
+type dumpReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *dumpReader) Close() error {
+	var err error
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if cerr := d.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func openDump(filePath string) (*dumpReader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		customLog.Errorf("Failed to open backup file %s: %v", filePath, err)
+		return nil, err
+	}
+
+	if filepath.Ext(filePath) != ".gz" {
+		return &dumpReader{Reader: file, closers: []io.Closer{file}}, nil
+	}
+
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		customLog.Errorf("Failed to create gzip reader: %v", err)
+		return nil, err
+	}
+	return &dumpReader{Reader: gzReader, closers: []io.Closer{file, gzReader}}, nil
+}
+
+// quoteQualified quotes a possibly schema-qualified table name
+func quoteQualified(name string) string {
+	schema, table := splitQualified(name)
+	if schema == "" {
+		return pq.QuoteIdentifier(table)
+	}
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table)
+}
+
+func splitQualified(name string) (string, string) {
+	for i := len(name) - 1; i >= 0; i-- {
+		if name[i] == '.' {
+			return name[:i], name[i+1:]
+		}
+	}
+	return "", name
+}
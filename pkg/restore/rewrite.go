@@ -0,0 +1,436 @@
+package restore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ownerPattern       = regexp.MustCompile(`(?is)^ALTER\s.*\sOWNER\s+TO\s`)
+	sessionRolePattern = regexp.MustCompile(`(?is)^SET\s+(SESSION\s+AUTHORIZATION|ROLE)\s`)
+	privilegePattern   = regexp.MustCompile(`(?is)^(GRANT|REVOKE)\s|^ALTER\s+DEFAULT\s+PRIVILEGES\s`)
+	schemaOwnerPattern = regexp.MustCompile(`(?is)^CREATE\s+SCHEMA\s`)
+	policyPattern      = regexp.MustCompile(`(?is)^(CREATE|ALTER)\s+POLICY\s`)
+	searchPathPattern  = regexp.MustCompile(`(?is)^(SET\s+(SESSION\s+|LOCAL\s+)?search_path\s|SELECT\s+(pg_catalog\.)?set_config\s*\(\s*'search_path')`)
+)
+
+// Rewriter adjusts ownership, privileges and schemas of statements while a
+// dump streams through restore, so that production dumps can be loaded into
+// clusters with different roles and schemas
+type Rewriter struct {
+	// RoleMap renames roles in ownership and privilege statements
+	RoleMap map[string]string `json:"role_map,omitempty"`
+	// SchemaMap moves objects from one schema into another
+	SchemaMap map[string]string `json:"schema_map,omitempty"`
+	// NoOwner skips statements that set object ownership
+	NoOwner bool `json:"no_owner,omitempty"`
+	// NoPrivileges skips GRANT and REVOKE statements
+	NoPrivileges bool `json:"no_privileges,omitempty"`
+}
+
+// ParseMappings parses from=to pairs as given on the command line
+func ParseMappings(pairs []string) (map[string]string, error) {
+	mappings := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected from=to", pair)
+		}
+		mappings[from] = to
+	}
+	return mappings, nil
+}
+
+// Empty reports whether the rewriter leaves every statement untouched
+func (rw *Rewriter) Empty() bool {
+	return rw == nil || (len(rw.RoleMap) == 0 && len(rw.SchemaMap) == 0 && !rw.NoOwner && !rw.NoPrivileges)
+}
+
+// Rewrite adjusts stmt in place and reports whether it should be applied
+func (rw *Rewriter) Rewrite(stmt *Statement) bool {
+	if rw.Empty() {
+		return true
+	}
+
+	sqlText := stmt.SQL
+	owner := ownerPattern.MatchString(sqlText) || sessionRolePattern.MatchString(sqlText)
+	privilege := privilegePattern.MatchString(sqlText)
+
+	if (rw.NoOwner && owner) || (rw.NoPrivileges && privilege) {
+		return false
+	}
+
+	tokens := tokenize(sqlText)
+	changed := false
+
+	if len(rw.RoleMap) > 0 {
+		switch {
+		case policyPattern.MatchString(sqlText):
+			// Policy expressions may reference tables, only map the TO list
+			changed = rw.mapRoles(tokens, "TO")
+		case owner || privilege || schemaOwnerPattern.MatchString(sqlText):
+			changed = rw.mapRoles(tokens, "TO", "FROM", "AUTHORIZATION", "ROLE", "USER", "BY")
+		}
+	}
+	if len(rw.SchemaMap) > 0 {
+		changed = rw.mapSchemas(tokens, searchPathPattern.MatchString(sqlText)) || changed
+	}
+
+	if changed {
+		var sb strings.Builder
+		for _, tok := range tokens {
+			sb.WriteString(tok.text)
+		}
+		stmt.SQL = sb.String()
+		stmt.classify()
+	}
+	return true
+}
+
+// mapRoles renames role specifications following the given keywords
+func (rw *Rewriter) mapRoles(tokens []token, keywords ...string) bool {
+	changed := false
+	isGrant := len(tokens) > 0 && (tokens[0].keyword() == "GRANT" || tokens[0].keyword() == "REVOKE")
+	hasOn := false
+	for _, tok := range tokens {
+		if tok.keyword() == "ON" {
+			hasOn = true
+			break
+		}
+	}
+
+	for i, tok := range tokens {
+		kw := tok.keyword()
+		if kw == "" {
+			continue
+		}
+		for _, k := range keywords {
+			if kw == k {
+				changed = rw.mapRoleList(tokens, i+1) || changed
+			}
+		}
+		// GRANT role TO role: the granted roles are roles as well
+		if i == 0 && isGrant && !hasOn {
+			changed = rw.mapRoleList(tokens, i+1) || changed
+		}
+	}
+	return changed
+}
+
+// mapRoleList renames a comma separated list of roles starting at from
+func (rw *Rewriter) mapRoleList(tokens []token, from int) bool {
+	changed := false
+	for i := nextSignificant(tokens, from); i < len(tokens); i = nextSignificant(tokens, i+1) {
+		tok := &tokens[i]
+		switch tok.keyword() {
+		case "GROUP", "ADMIN", "OPTION", "FOR":
+			continue
+		}
+
+		switch tok.kind {
+		case tokWord, tokQuoted:
+			if to, ok := rw.RoleMap[tok.ident()]; ok {
+				tok.text = quoteIdent(to)
+				changed = true
+			}
+		case tokString:
+			// SET SESSION AUTHORIZATION 'role'
+			if to, ok := rw.RoleMap[tok.literal()]; ok {
+				tok.text = pq.QuoteLiteral(to)
+				changed = true
+			}
+		default:
+			return changed
+		}
+
+		next := nextSignificant(tokens, i+1)
+		if next >= len(tokens) || tokens[next].text != "," {
+			return changed
+		}
+		i = next
+	}
+	return changed
+}
+
+// mapSchemas renames schema qualifiers, schema names following the SCHEMA
+// keyword, search_path settings and regclass literals
+func (rw *Rewriter) mapSchemas(tokens []token, searchPath bool) bool {
+	changed := false
+	for i := range tokens {
+		tok := &tokens[i]
+		switch tok.kind {
+		case tokWord, tokQuoted:
+			if tok.keyword() == "SCHEMA" {
+				changed = rw.mapSchemaList(tokens, i+1) || changed
+				continue
+			}
+			next := nextSignificant(tokens, i+1)
+			if next < len(tokens) && tokens[next].text == "." {
+				if to, ok := rw.SchemaMap[tok.ident()]; ok {
+					tok.text = quoteIdent(to)
+					changed = true
+				}
+			}
+		case tokString:
+			value := tok.literal()
+			if searchPath {
+				if mapped, ok := rw.mapSearchPath(value); ok {
+					tok.text = pq.QuoteLiteral(mapped)
+					changed = true
+				}
+				continue
+			}
+			// Sequence defaults reference 'schema.sequence'::regclass
+			if !regclassLiteral(tokens, i) {
+				continue
+			}
+			if schema, rest, ok := strings.Cut(value, "."); ok {
+				if to, ok := rw.SchemaMap[unquoteIdentifier(schema)]; ok {
+					tok.text = pq.QuoteLiteral(quoteIdent(to) + "." + rest)
+					changed = true
+				}
+			}
+		}
+	}
+
+	// SET search_path = a, b
+	if searchPath && len(tokens) > 0 && tokens[0].keyword() == "SET" {
+		for i := range tokens {
+			if k := tokens[i].keyword(); k == "TO" || tokens[i].text == "=" {
+				changed = rw.mapSchemaList(tokens, i+1) || changed
+				break
+			}
+		}
+	}
+	return changed
+}
+
+// regclassLiteral reports whether the string literal at i names a relation,
+// either through a ::regclass cast or as argument of a sequence function
+func regclassLiteral(tokens []token, i int) bool {
+	next := nextSignificant(tokens, i+1)
+	if next+2 < len(tokens) && tokens[next].text == ":" && tokens[next+1].text == ":" &&
+		strings.EqualFold(tokens[next+2].text, "regclass") {
+		return true
+	}
+
+	prev := prevSignificant(tokens, i-1)
+	if prev < 0 || tokens[prev].text != "(" {
+		return false
+	}
+	fn := prevSignificant(tokens, prev-1)
+	if fn < 0 {
+		return false
+	}
+	switch tokens[fn].keyword() {
+	case "NEXTVAL", "SETVAL", "CURRVAL", "TO_REGCLASS":
+		return true
+	}
+	return false
+}
+
+// mapSchemaList renames a comma separated list of schema names
+func (rw *Rewriter) mapSchemaList(tokens []token, from int) bool {
+	changed := false
+	for i := nextSignificant(tokens, from); i < len(tokens); i = nextSignificant(tokens, i+1) {
+		tok := &tokens[i]
+		switch tok.keyword() {
+		case "IF", "NOT", "EXISTS":
+			continue
+		}
+		if tok.kind != tokWord && tok.kind != tokQuoted {
+			return changed
+		}
+		if to, ok := rw.SchemaMap[tok.ident()]; ok {
+			tok.text = quoteIdent(to)
+			changed = true
+		}
+
+		next := nextSignificant(tokens, i+1)
+		if next >= len(tokens) || tokens[next].text != "," {
+			return changed
+		}
+		i = next
+	}
+	return changed
+}
+
+// mapSearchPath renames the schemas of a search_path value
+func (rw *Rewriter) mapSearchPath(value string) (string, bool) {
+	parts := strings.Split(value, ",")
+	changed := false
+	for i, part := range parts {
+		if to, ok := rw.SchemaMap[unquoteIdentifier(part)]; ok {
+			parts[i] = quoteIdent(to)
+			changed = true
+		} else {
+			parts[i] = strings.TrimSpace(part)
+		}
+	}
+	return strings.Join(parts, ", "), changed
+}
+
+// Schemas returns the target schemas of the schema mapping
+func (rw *Rewriter) Schemas() []string {
+	if rw == nil {
+		return nil
+	}
+	var schemas []string
+	for _, to := range rw.SchemaMap {
+		schemas = append(schemas, to)
+	}
+	return schemas
+}
+
+type tokenKind int
+
+const (
+	tokOther tokenKind = iota
+	tokSpace
+	tokWord
+	tokQuoted
+	tokString
+	tokDollar
+)
+
+// token is a lexical element of a statement; concatenating the text of all
+// tokens yields the original statement
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// keyword returns the upper-cased text of an unquoted word
+func (t token) keyword() string {
+	if t.kind != tokWord {
+		return ""
+	}
+	return strings.ToUpper(t.text)
+}
+
+// ident returns the identifier value of a word or quoted identifier
+func (t token) ident() string {
+	if t.kind == tokQuoted {
+		return unquoteIdentifier(t.text)
+	}
+	return strings.ToLower(t.text)
+}
+
+// literal returns the value of a string literal
+func (t token) literal() string {
+	if len(t.text) < 2 {
+		return t.text
+	}
+	return strings.ReplaceAll(t.text[1:len(t.text)-1], "''", "'")
+}
+
+// tokenize splits a statement into tokens, keeping literals intact
+func tokenize(sqlText string) []token {
+	var tokens []token
+	for i := 0; i < len(sqlText); {
+		c := sqlText[i]
+		start := i
+		kind := tokOther
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			kind = tokSpace
+			for i < len(sqlText) && strings.IndexByte(" \t\n\r", sqlText[i]) >= 0 {
+				i++
+			}
+		case c == '\'' || c == '"':
+			kind = tokString
+			if c == '"' {
+				kind = tokQuoted
+			}
+			i++
+			for i < len(sqlText) {
+				if sqlText[i] == c {
+					if i+1 < len(sqlText) && sqlText[i+1] == c {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+		case c == '$':
+			kind = tokDollar
+			end := strings.IndexByte(sqlText[i+1:], '$')
+			tag := ""
+			if end >= 0 {
+				tag = sqlText[i : i+end+2]
+			}
+			if tag != "" && isDollarTag(tag) {
+				closing := strings.Index(sqlText[i+len(tag):], tag)
+				if closing < 0 {
+					i = len(sqlText)
+				} else {
+					i += len(tag) + closing + len(tag)
+				}
+			} else {
+				kind = tokOther
+				i++
+			}
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80:
+			kind = tokWord
+			for i < len(sqlText) && isWordByte(sqlText[i]) {
+				i++
+			}
+		default:
+			i++
+		}
+
+		tokens = append(tokens, token{kind: kind, text: sqlText[start:i]})
+	}
+	return tokens
+}
+
+func isDollarTag(tag string) bool {
+	inner := tag[1 : len(tag)-1]
+	for i := 0; i < len(inner); i++ {
+		if !isWordByte(inner[i]) || (i == 0 && inner[i] >= '0' && inner[i] <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+// nextSignificant returns the index of the next non-whitespace token
+func nextSignificant(tokens []token, from int) int {
+	for from < len(tokens) && tokens[from].kind == tokSpace {
+		from++
+	}
+	return from
+}
+
+// prevSignificant returns the index of the previous non-whitespace token
+func prevSignificant(tokens []token, from int) int {
+	for from >= 0 && tokens[from].kind == tokSpace {
+		from--
+	}
+	return from
+}
+
+// quoteIdent quotes an identifier unless it is a plain lower-case name
+func quoteIdent(name string) string {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (i > 0 && c >= '0' && c <= '9')) {
+			return pq.QuoteIdentifier(name)
+		}
+	}
+	if name == "" {
+		return pq.QuoteIdentifier(name)
+	}
+	return name
+}
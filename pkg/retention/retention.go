@@ -0,0 +1,269 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/logger"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+var customLog = logger.NewLogger()
+
+// Policy is a grandfather-father-son retention policy. A backup is kept if
+// any rule keeps it; the daily, weekly, monthly and yearly rules keep the
+// newest backup of each of the last N periods that have backups.
+type Policy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	// KeepWithin keeps every backup younger than this
+	KeepWithin time.Duration
+}
+
+// IsZero reports whether the policy has no rules. An empty policy keeps
+// everything.
+func (p Policy) IsZero() bool {
+	return p == Policy{}
+}
+
+// Backup is a backup found in a storage backend
+type Backup struct {
+	// Key is the key of the backup artifact
+	Key      string
+	Manifest *manifest.Manifest
+}
+
+// Decision is the outcome of applying a policy to a backup
+type Decision struct {
+	Backup Backup
+	Keep   bool
+	// Reasons lists the rules that keep the backup
+	Reasons []string
+	// Deleted is set once Prune has deleted the backup
+	Deleted bool
+}
+
+// rule groups backups into periods
+type rule struct {
+	name   string
+	count  int
+	period func(t time.Time) string
+}
+
+// Apply decides which backups the policy keeps. Every database is handled on
+// its own. Decisions are returned newest first per database.
+func (p Policy) Apply(backups []Backup, now time.Time) []Decision {
+	byDatabase := make(map[string][]Backup)
+	var databases []string
+	for _, b := range backups {
+		if _, ok := byDatabase[b.Manifest.Database]; !ok {
+			databases = append(databases, b.Manifest.Database)
+		}
+		byDatabase[b.Manifest.Database] = append(byDatabase[b.Manifest.Database], b)
+	}
+	sort.Strings(databases)
+
+	var decisions []Decision
+	for _, database := range databases {
+		decisions = append(decisions, p.apply(byDatabase[database], now)...)
+	}
+	return decisions
+}
+
+func (p Policy) apply(backups []Backup, now time.Time) []Decision {
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Manifest.CreatedAt.After(backups[j].Manifest.CreatedAt)
+	})
+
+	rules := []*rule{
+		{name: "daily", count: p.KeepDaily, period: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{name: "weekly", count: p.KeepWeekly, period: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{name: "monthly", count: p.KeepMonthly, period: func(t time.Time) string { return t.Format("2006-01") }},
+		{name: "yearly", count: p.KeepYearly, period: func(t time.Time) string { return t.Format("2006") }},
+	}
+	last := make(map[string]string)
+
+	decisions := make([]Decision, 0, len(backups))
+	for i, b := range backups {
+		d := Decision{Backup: b}
+		created := b.Manifest.CreatedAt.Local()
+		if p.IsZero() {
+			d.Reasons = append(d.Reasons, "no policy")
+		}
+		if i < p.KeepLast {
+			d.Reasons = append(d.Reasons, "last")
+		}
+		if p.KeepWithin > 0 && now.Sub(created) < p.KeepWithin {
+			d.Reasons = append(d.Reasons, "within")
+		}
+		for _, r := range rules {
+			if r.count <= 0 {
+				continue
+			}
+			if period := r.period(created); period != last[r.name] {
+				last[r.name] = period
+				r.count--
+				d.Reasons = append(d.Reasons, r.name)
+			}
+		}
+		d.Keep = len(d.Reasons) > 0
+		decisions = append(decisions, d)
+	}
+	return decisions
+}
+
+// Scan returns the backups in b that have a readable manifest, optionally
+// only those of one database. Artifacts without a manifest are incomplete
+// and ignored.
+func Scan(ctx context.Context, b storage.Backend, database string) ([]Backup, error) {
+	objects, err := b.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []Backup
+	for _, obj := range objects {
+		if !manifest.IsManifest(obj.Key) {
+			continue
+		}
+		m, err := readManifest(ctx, b, obj.Key)
+		if err != nil {
+			customLog.Warnf("Skipping unreadable manifest %s: %v", obj.Key, err)
+			continue
+		}
+		if database != "" && m.Database != database {
+			continue
+		}
+		backups = append(backups, Backup{Key: manifest.ArtifactFor(obj.Key), Manifest: m})
+	}
+	return backups, nil
+}
+
+func readManifest(ctx context.Context, b storage.Backend, key string) (*manifest.Manifest, error) {
+	body, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return manifest.Decode(body)
+}
+
+// PruneOptions configures a prune run
+type PruneOptions struct {
+	// Database limits pruning to the backups of one database
+	Database string
+	// DryRun reports what would be deleted without deleting anything
+	DryRun bool
+	// Now is the reference time for KeepWithin, default time.Now()
+	Now time.Time
+}
+
+// Prune applies the policy to the backups in b and deletes those it does
+// not keep. Backups whose artifact or manifest is locked by the backend
+// (retention period or legal hold) are kept. The manifest of a backup is
+// deleted before its artifact so that an interrupted prune never leaves a
+// manifest without its backup. Deletion carries on past failures, which are
+// returned together.
+func Prune(ctx context.Context, b storage.Backend, p Policy, opts PruneOptions) ([]Decision, error) {
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	backups, err := Scan(ctx, b, opts.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	decisions := p.Apply(backups, opts.Now)
+	var errs []error
+	for i, d := range decisions {
+		if d.Keep {
+			continue
+		}
+		if lock, err := ActiveLock(ctx, b, d.Backup.Key, opts.Now); err != nil {
+			customLog.Errorf("Failed to check the lock of %s: %v", storage.JoinURL(b, d.Backup.Key), err)
+			errs = append(errs, err)
+			continue
+		} else if lock != nil {
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, "locked: "+lock.String())
+			continue
+		}
+		if opts.DryRun {
+			customLog.Infof("Would delete %s", storage.JoinURL(b, d.Backup.Key))
+			continue
+		}
+		if err := DeleteBackup(ctx, b, d.Backup.Key); err != nil {
+			customLog.Errorf("Failed to delete %s: %v", storage.JoinURL(b, d.Backup.Key), err)
+			errs = append(errs, err)
+			continue
+		}
+		decisions[i].Deleted = true
+	}
+	return decisions, errors.Join(errs...)
+}
+
+// ActiveLock returns the active lock of a backup's artifact or manifest, if
+// any
+func ActiveLock(ctx context.Context, b storage.Backend, key string, now time.Time) (*storage.Lock, error) {
+	locker, ok := b.(storage.Locker)
+	if !ok {
+		return nil, nil
+	}
+	for _, k := range []string{key, manifest.PathFor(key)} {
+		lock, err := locker.ObjectLock(ctx, k)
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if lock.Active(now) {
+			return lock, nil
+		}
+	}
+	return nil, nil
+}
+
+// DeleteBackup deletes the manifest of a backup and then its artifact, or
+// the shards of an erasure-coded backup that are stored in b
+func DeleteBackup(ctx context.Context, b storage.Backend, key string) error {
+	keys := []string{manifest.PathFor(key), key}
+	if m, err := readManifest(ctx, b, manifest.PathFor(key)); err == nil && m.Erasure != nil {
+		if shard, ok := m.Erasure.ShardIn(b.URL()); ok {
+			keys = append(keys, shard.Key)
+		}
+	}
+	for _, k := range keys {
+		if err := b.Delete(ctx, k); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseDuration parses a duration that may also use days and weeks, such as
+// "30d" or "2w"
+func ParseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			value, err := strconv.Atoi(n)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(value) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,287 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/jobs"
+	"github.com/Annany2002/guard/pkg/logger"
+	"github.com/Annany2002/guard/pkg/notify"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/robfig/cron/v3"
+)
+
+var customLog = logger.NewLogger()
+
+// ErrRunning is returned when a job is started while it is running
+var ErrRunning = errors.New("job is already running")
+
+// Runner runs a job once
+type Runner func(job jobs.Job) error
+
+// Scheduler runs jobs on their cron schedules. A job that is still running
+// when it is due again is skipped rather than run twice.
+type Scheduler struct {
+	cron *cron.Cron
+	run  Runner
+	// manual tracks runs started by RunNow, which cron does not wait for
+	manual sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[int64]*scheduled
+}
+
+// scheduled is a job known to the scheduler
+type scheduled struct {
+	job     jobs.Job
+	entry   cron.EntryID
+	running bool
+	started time.Time
+	last    Run
+	runs    int
+}
+
+// Run is the outcome of the last run of a job
+type Run struct {
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// Status is the state of a scheduled job. The database password of the
+// job is left out.
+type Status struct {
+	Job jobs.Job `json:"job"`
+	// Next is the next scheduled run, zero while the job is paused
+	Next    time.Time `json:"next"`
+	Running bool      `json:"running"`
+	// Started is when the current run started
+	Started time.Time `json:"started"`
+	// Last is the last finished run, if any
+	Last *Run `json:"last,omitempty"`
+	// Runs counts the runs since the scheduler started
+	Runs int `json:"runs"`
+}
+
+// New returns a scheduler that runs jobs with run
+func New(run Runner) *Scheduler {
+	return &Scheduler{cron: cron.New(), run: run, jobs: make(map[int64]*scheduled)}
+}
+
+// Load schedules the jobs in the job store at path as Sync does. The store
+// is only opened while reading, so that other guard commands can change it.
+func (s *Scheduler) Load(path string) error {
+	store, err := jobs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	list, err := store.List()
+	if err != nil {
+		return err
+	}
+	s.Sync(list)
+	return nil
+}
+
+// Sync makes the scheduled jobs match list: new jobs are added, changed
+// jobs rescheduled and jobs missing from list removed. Jobs that are
+// running finish their current run.
+func (s *Scheduler) Sync(list []jobs.Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[int64]bool, len(list))
+	for _, job := range list {
+		seen[job.ID] = true
+		current, ok := s.jobs[job.ID]
+		if ok && sameSchedule(current.job, job) {
+			if current.job.Paused != job.Paused {
+				if job.Paused {
+					customLog.Infof("Paused job %d", job.ID)
+				} else {
+					customLog.Infof("Resumed job %d", job.ID)
+				}
+			}
+			current.job = job
+			continue
+		}
+		if ok {
+			s.cron.Remove(current.entry)
+		}
+		id := job.ID
+		entry, err := s.cron.AddFunc(job.Cron, func() { s.runScheduled(id) })
+		if err != nil {
+			customLog.Errorf("Failed to schedule job %d: %v", job.ID, err)
+			delete(s.jobs, job.ID)
+			continue
+		}
+		if ok {
+			current.job, current.entry = job, entry
+			customLog.Infof("Rescheduled job %d: %s of %s at %s", job.ID, job.Task, job.Database, job.Cron)
+			continue
+		}
+		s.jobs[job.ID] = &scheduled{job: job, entry: entry}
+		customLog.Infof("Scheduled job %d: %s of %s at %s", job.ID, job.Task, job.Database, job.Cron)
+	}
+	for id, current := range s.jobs {
+		if !seen[id] {
+			s.cron.Remove(current.entry)
+			delete(s.jobs, id)
+			customLog.Infof("Unscheduled job %d", id)
+		}
+	}
+}
+
+// sameSchedule reports whether two versions of a job only differ in
+// whether they are paused
+func sameSchedule(a, b jobs.Job) bool {
+	a.Paused, b.Paused = false, false
+	return reflect.DeepEqual(a, b)
+}
+
+// runScheduled runs a job when it is due, unless it is paused or running
+func (s *Scheduler) runScheduled(id int64) {
+	s.mu.Lock()
+	current, ok := s.jobs[id]
+	paused := ok && current.job.Paused
+	s.mu.Unlock()
+	if !ok || paused {
+		return
+	}
+	if err := s.start(id, false); errors.Is(err, ErrRunning) {
+		customLog.Warnf("Skipping job %d, its previous run has not finished", id)
+	}
+}
+
+// RunNow starts a job in the background, even if it is paused
+func (s *Scheduler) RunNow(id int64) error {
+	return s.start(id, true)
+}
+
+// start marks a job as running and runs it, in the background if
+// background is set
+func (s *Scheduler) start(id int64, background bool) error {
+	s.mu.Lock()
+	current, ok := s.jobs[id]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("job %d: %w", id, jobs.ErrNotFound)
+	}
+	if current.running {
+		s.mu.Unlock()
+		return fmt.Errorf("job %d: %w", id, ErrRunning)
+	}
+	current.running = true
+	current.started = time.Now()
+	job, started := current.job, current.started
+	s.mu.Unlock()
+
+	if background {
+		s.manual.Add(1)
+		go func() {
+			defer s.manual.Done()
+			s.execute(current, job, started)
+		}()
+		return nil
+	}
+	s.execute(current, job, started)
+	return nil
+}
+
+// execute runs a job that start marked as running and records the outcome
+func (s *Scheduler) execute(current *scheduled, job jobs.Job, start time.Time) {
+	err := s.run(job)
+	run := Run{Started: start, DurationSeconds: time.Since(start).Seconds()}
+	if err != nil {
+		run.Error = err.Error()
+		customLog.Errorf("Job %d failed after %s: %v", job.ID, time.Since(start).Round(time.Second), err)
+	} else {
+		customLog.Infof("Job %d finished in %s", job.ID, time.Since(start).Round(time.Second))
+	}
+
+	s.mu.Lock()
+	current.running = false
+	current.last = run
+	current.runs++
+	s.mu.Unlock()
+}
+
+// Status returns the state of every scheduled job ordered by ID
+func (s *Scheduler) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]Status, 0, len(s.jobs))
+	for _, current := range s.jobs {
+		status := Status{Job: current.job, Running: current.running, Runs: current.runs}
+		status.Job.Password = ""
+		status.Job.Notify = redactNotify(current.job.Notify)
+		status.Job.Storage = redactStorage(current.job.Storage)
+		if !current.job.Paused {
+			status.Next = current.job.Next(now)
+		}
+		if current.running {
+			status.Started = current.started
+		}
+		if !current.last.Started.IsZero() {
+			last := current.last
+			status.Last = &last
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Job.ID < statuses[k].Job.ID })
+	return statuses
+}
+
+// redactedValue replaces secrets in job status
+const redactedValue = "redacted"
+
+// redactStorage copies storage locations without the credentials they may
+// carry
+func redactStorage(locations []string) []string {
+	if locations == nil {
+		return nil
+	}
+	redacted := make([]string, len(locations))
+	for i, location := range locations {
+		redacted[i] = storage.RedactURL(location)
+	}
+	return redacted
+}
+
+// redactNotify copies notification targets without their secrets: URLs are
+// cut down to scheme and host as in notify errors, and header values are
+// hidden
+func redactNotify(targets []jobs.Notification) []jobs.Notification {
+	if targets == nil {
+		return nil
+	}
+	redacted := make([]jobs.Notification, len(targets))
+	for i, n := range targets {
+		redacted[i] = jobs.Notification{URL: notify.Redact(n.URL), On: n.On}
+		if n.Headers != nil {
+			redacted[i].Headers = make(map[string]string, len(n.Headers))
+			for name := range n.Headers {
+				redacted[i].Headers[name] = redactedValue
+			}
+		}
+	}
+	return redacted
+}
+
+// Start runs the scheduler in the background
+func (s *Scheduler) Start() {
+	s.cron.Start()
+}
+
+// Stop stops scheduling jobs and waits for running jobs to finish
+func (s *Scheduler) Stop() {
+	<-s.cron.Stop().Done()
+	s.manual.Wait()
+}
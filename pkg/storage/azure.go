@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+const (
+	// DefaultBlockSize is the size of staged block blob blocks
+	DefaultBlockSize = 8 << 20
+	// maxBlocks is the largest number of blocks in a block blob
+	maxBlocks = 50000
+)
+
+// AzureOptions configures how an Azure Blob Storage client connects and
+// authenticates. Credentials are tried in the order connection string,
+// SAS token, shared key; without any the container is accessed anonymously.
+type AzureOptions struct {
+	// Account is the storage account name
+	Account string
+	// Endpoint is the blob service URL, default
+	// https://<account>.blob.core.windows.net. Azurite listens on
+	// http://127.0.0.1:10000/<account>.
+	Endpoint string
+	// ConnectionString holds the endpoint and credentials in one value
+	ConnectionString string
+	// SASToken is a shared access signature for the container
+	SASToken string
+	// AccountKey is the shared key of the storage account
+	AccountKey string
+	// Tier is the access tier of uploaded blobs (hot, cool, cold, archive)
+	Tier string
+	// BlockSize is the size of staged blocks
+	BlockSize int64
+	// Concurrency is the number of blocks staged in parallel
+	Concurrency int
+}
+
+// AzureClient stores objects as block blobs in an Azure Blob Storage
+// container
+type AzureClient struct {
+	client      *container.Client
+	account     string
+	endpoint    string
+	container   string
+	prefix      string
+	tier        *blob.AccessTier
+	blockSize   int64
+	concurrency int
+}
+
+var (
+	_ Backend     = (*AzureClient)(nil)
+	_ RangeGetter = (*AzureClient)(nil)
+)
+
+// NewAzureClient creates a client for the container containerName
+func NewAzureClient(containerName string, opts AzureOptions) (*AzureClient, error) {
+	tier, err := ParseAccessTier(opts.Tier)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimSuffix(opts.Endpoint, "/")
+	if endpoint == "" && opts.Account != "" {
+		endpoint = "https://" + opts.Account + ".blob.core.windows.net"
+	}
+	containerURL := endpoint + "/" + url.PathEscape(containerName)
+
+	var client *container.Client
+	switch {
+	case opts.ConnectionString != "":
+		client, err = container.NewClientFromConnectionString(opts.ConnectionString, containerName, nil)
+	case endpoint == "":
+		return nil, errors.New("missing Azure storage account, set account= or AZURE_STORAGE_ACCOUNT")
+	case opts.SASToken != "":
+		client, err = container.NewClientWithNoCredential(containerURL+"?"+strings.TrimPrefix(opts.SASToken, "?"), nil)
+	case opts.AccountKey != "":
+		var cred *container.SharedKeyCredential
+		cred, err = container.NewSharedKeyCredential(opts.Account, opts.AccountKey)
+		if err == nil {
+			client, err = container.NewClientWithSharedKeyCredential(containerURL, cred, nil)
+		}
+	default:
+		client, err = container.NewClientWithNoCredential(containerURL, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure client: %w", err)
+	}
+
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return &AzureClient{
+		client:      client,
+		account:     opts.Account,
+		endpoint:    strings.TrimSuffix(opts.Endpoint, "/"),
+		container:   containerName,
+		tier:        tier,
+		blockSize:   blockSize,
+		concurrency: opts.Concurrency,
+	}, nil
+}
+
+// ParseAccessTier parses an access tier name, an empty name selects the
+// account default
+func ParseAccessTier(name string) (*blob.AccessTier, error) {
+	if name == "" {
+		return nil, nil
+	}
+	for _, tier := range blob.PossibleAccessTierValues() {
+		if strings.EqualFold(string(tier), name) {
+			return &tier, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown Azure access tier %q, expected hot, cool, cold or archive", name)
+}
+
+// azureParams are the query parameters of azblob:// URLs that are not part
+// of a SAS token
+var azureParams = map[string]bool{"account": true, "endpoint": true, "sas": true, "tier": true, "block_size": true, "concurrency": true}
+
+// ParseAzureOptions reads Azure options from the query of an
+// azblob://container/prefix URL, on top of the AZURE_STORAGE_ACCOUNT,
+// AZURE_STORAGE_KEY, AZURE_STORAGE_SAS_TOKEN and
+// AZURE_STORAGE_CONNECTION_STRING environment variables. Supported
+// parameters are account, endpoint, sas, tier, block_size and concurrency;
+// the parameters of a SAS token (sv, sig, ...) may also be given directly.
+func ParseAzureOptions(u *url.URL) (AzureOptions, error) {
+	opts := AzureOptions{
+		Account:          os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		AccountKey:       os.Getenv("AZURE_STORAGE_KEY"),
+		SASToken:         os.Getenv("AZURE_STORAGE_SAS_TOKEN"),
+		ConnectionString: os.Getenv("AZURE_STORAGE_CONNECTION_STRING"),
+	}
+
+	q := u.Query()
+	if v := q.Get("account"); v != "" {
+		opts.Account = v
+	}
+	if v := q.Get("endpoint"); v != "" {
+		opts.Endpoint = v
+	}
+	if v := q.Get("sas"); v != "" {
+		opts.SASToken = v
+	}
+	// A SAS token may also be pasted as is into the query
+	if q.Has("sig") {
+		sas := url.Values{}
+		for name, values := range q {
+			if !azureParams[name] {
+				sas[name] = values
+			}
+		}
+		opts.SASToken = sas.Encode()
+	}
+	if v := q.Get("tier"); v != "" {
+		if _, err := ParseAccessTier(v); err != nil {
+			return opts, err
+		}
+		opts.Tier = v
+	}
+	if v := q.Get("block_size"); v != "" {
+		blockSize, err := ParseSize(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid block_size in storage location %s: %w", u.Redacted(), err)
+		}
+		opts.BlockSize = blockSize
+	}
+	if v := q.Get("concurrency"); v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil || concurrency < 1 {
+			return opts, fmt.Errorf("invalid concurrency %q in storage location %s", v, u.Redacted())
+		}
+		opts.Concurrency = concurrency
+	}
+	// An explicit account or endpoint overrides the connection string
+	if q.Get("account") != "" || q.Get("endpoint") != "" {
+		opts.ConnectionString = ""
+	}
+	return opts, nil
+}
+
+// openAzure opens an Azure Blob backend for azblob://container/prefix URLs
+func openAzure(ctx context.Context, u *url.URL) (Backend, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing container in storage location %s", u.Redacted())
+	}
+	opts, err := ParseAzureOptions(u)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewAzureClient(u.Host, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.prefix = strings.Trim(u.Path, "/")
+	return c, nil
+}
+
+// Put uploads r to the block blob stored under key. The data is staged in
+// blocks named after their content, so blocks staged by an interrupted
+// upload are reused by the next upload of the same key.
+func (c *AzureClient) Put(ctx context.Context, key string, r io.Reader) error {
+	src, err := newSource(r)
+	if err != nil {
+		return err
+	}
+	defer src.cleanup()
+
+	client := c.client.NewBlockBlobClient(c.blobName(key))
+	staged := make(map[string]int64)
+	list, err := client.GetBlockList(ctx, blockblob.BlockListTypeUncommitted, nil)
+	if err == nil {
+		for _, block := range list.UncommittedBlocks {
+			staged[*block.Name] = *block.Size
+		}
+	} else if !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return c.wrapErr(key, err)
+	}
+	if len(staged) > 0 {
+		customLog.Infof("Resuming upload of %s (%d blocks already staged)", key, len(staged))
+	}
+
+	blockSize := c.blockSize
+	if src.size > blockSize*maxBlocks {
+		blockSize = (src.size + maxBlocks - 1) / maxBlocks
+	}
+	blockCount := int((src.size + blockSize - 1) / blockSize)
+	ids := make([]string, blockCount)
+
+	err = forEachPart(ctx, blockCount, c.concurrency, func(ctx context.Context, i int) error {
+		offset := int64(i) * blockSize
+		length := min(blockSize, src.size-offset)
+		section := io.NewSectionReader(src, offset, length)
+
+		hash := md5.New()
+		if _, err := io.Copy(hash, section); err != nil {
+			return err
+		}
+		// Block IDs must have the same length within a blob
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%06d-%s", i, hex.EncodeToString(hash.Sum(nil)))))
+		ids[i] = id
+		if size, ok := staged[id]; ok && size == length {
+			return nil
+		}
+
+		if _, err := section.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := client.StageBlock(ctx, id, streaming.NopCloser(section), nil)
+		if err != nil {
+			return fmt.Errorf("failed to stage block %d of %s: %w", i, key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		customLog.Errorf("Upload of %s to Azure interrupted, it will resume on the next upload: %v", key, err)
+		return err
+	}
+
+	_, err = client.CommitBlockList(ctx, ids, &blockblob.CommitBlockListOptions{Tier: c.tier})
+	if err != nil {
+		customLog.Errorf("Failed to commit %s to Azure: %v", key, err)
+		return c.wrapErr(key, err)
+	}
+
+	customLog.Infof("Successfully uploaded %s to Azure container %s as %s", key, c.container, c.blobName(key))
+	return nil
+}
+
+// Get opens the blob stored under key
+func (c *AzureClient) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return c.GetRange(ctx, key, 0, -1)
+}
+
+// GetRange opens length bytes of the blob stored under key starting at
+// offset. A negative length reads to the end of the blob.
+func (c *AzureClient) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	opts := &blob.DownloadStreamOptions{Range: blob.HTTPRange{Offset: offset}}
+	if length >= 0 {
+		opts.Range.Count = length
+	}
+	resp, err := c.client.NewBlobClient(c.blobName(key)).DownloadStream(ctx, opts)
+	if err != nil {
+		return nil, c.wrapErr(key, err)
+	}
+	return resp.Body, nil
+}
+
+// List returns the blobs whose keys start with prefix
+func (c *AzureClient) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	listPrefix := c.blobName(prefix)
+	pager := c.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &listPrefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			customLog.Errorf("Failed to list blobs in Azure container %s: %v", c.container, err)
+			return nil, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			obj := Object{Key: c.relativeKey(*item.Name)}
+			if item.Properties != nil {
+				if item.Properties.ContentLength != nil {
+					obj.Size = *item.Properties.ContentLength
+				}
+				if item.Properties.LastModified != nil {
+					obj.ModTime = *item.Properties.LastModified
+				}
+			}
+			objects = append(objects, obj)
+		}
+	}
+
+	sortObjects(objects)
+	return objects, nil
+}
+
+// Stat returns the metadata of the blob stored under key
+func (c *AzureClient) Stat(ctx context.Context, key string) (*Object, error) {
+	props, err := c.client.NewBlobClient(c.blobName(key)).GetProperties(ctx, nil)
+	if err != nil {
+		return nil, c.wrapErr(key, err)
+	}
+	obj := &Object{Key: key}
+	if props.ContentLength != nil {
+		obj.Size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		obj.ModTime = *props.LastModified
+	}
+	return obj, nil
+}
+
+// Delete removes the blob stored under key
+func (c *AzureClient) Delete(ctx context.Context, key string) error {
+	if _, err := c.client.NewBlobClient(c.blobName(key)).Delete(ctx, nil); err != nil {
+		return c.wrapErr(key, err)
+	}
+	customLog.Infof("Deleted %s from Azure container %s", c.blobName(key), c.container)
+	return nil
+}
+
+// Exists reports whether a blob is stored under key
+func (c *AzureClient) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := c.Stat(ctx, key)
+	if errors.Is(err, ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// URL returns the azblob:// location of the backend with its account and
+// endpoint, but without credentials
+func (c *AzureClient) URL() string {
+	location := "azblob://" + c.container
+	if c.prefix != "" {
+		location += "/" + c.prefix
+	}
+	q := url.Values{}
+	if c.account != "" {
+		q.Set("account", c.account)
+	}
+	if c.endpoint != "" {
+		q.Set("endpoint", c.endpoint)
+	}
+	if len(q) > 0 {
+		location += "?" + q.Encode()
+	}
+	return location
+}
+
+// blobName prepends the backend prefix to a key
+func (c *AzureClient) blobName(key string) string {
+	key = strings.TrimPrefix(key, "/")
+	if c.prefix == "" {
+		return key
+	}
+	return c.prefix + "/" + key
+}
+
+// relativeKey strips the backend prefix from a blob name
+func (c *AzureClient) relativeKey(name string) string {
+	if c.prefix == "" {
+		return name
+	}
+	return strings.TrimPrefix(name, c.prefix+"/")
+}
+
+// wrapErr maps Azure not-found errors to ErrNotExist
+func (c *AzureClient) wrapErr(key string, err error) error {
+	if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ResourceNotFound) {
+		return fmt.Errorf("%s: %w", key, ErrNotExist)
+	}
+	return err
+}
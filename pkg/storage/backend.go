@@ -0,0 +1,427 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotExist is returned when an object is not present in a backend
+var ErrNotExist = errors.New("object does not exist")
+
+// Object describes an object stored in a backend
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend is a location backups are stored in. Keys are slash separated
+// and relative to the location the backend was opened with.
+type Backend interface {
+	// Put streams r into the object stored under key
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the object stored under key for reading
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the objects whose keys start with prefix
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Stat returns the metadata of the object stored under key
+	Stat(ctx context.Context, key string) (*Object, error)
+	// Delete removes the object stored under key
+	Delete(ctx context.Context, key string) error
+	// Exists reports whether an object is stored under key
+	Exists(ctx context.Context, key string) (bool, error)
+	// URL returns the location of the backend
+	URL() string
+}
+
+// RangeGetter is implemented by backends that can read part of an object
+type RangeGetter interface {
+	// GetRange opens length bytes of the object stored under key starting
+	// at offset. A negative length reads to the end of the object.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// Lock describes how an object is protected against deletion
+type Lock struct {
+	// Mode is the retention mode, such as GOVERNANCE or COMPLIANCE, empty
+	// if the object has no retention period
+	Mode        string
+	RetainUntil time.Time
+	LegalHold   bool
+}
+
+// Active reports whether the lock prevents deleting the object at now
+func (l *Lock) Active(now time.Time) bool {
+	return l.LegalHold || (l.Mode != "" && now.Before(l.RetainUntil))
+}
+
+// String describes the lock
+func (l *Lock) String() string {
+	var parts []string
+	if l.Mode != "" {
+		parts = append(parts, fmt.Sprintf("%s retention until %s", strings.ToLower(l.Mode), l.RetainUntil.Local().Format(time.DateTime)))
+	}
+	if l.LegalHold {
+		parts = append(parts, "legal hold")
+	}
+	if len(parts) == 0 {
+		return "unlocked"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Locker is implemented by backends that can make objects immutable
+type Locker interface {
+	// ObjectLock returns the protection of the object stored under key
+	ObjectLock(ctx context.Context, key string) (*Lock, error)
+	// SetLegalHold places or releases a legal hold on the object stored
+	// under key
+	SetLegalHold(ctx context.Context, key string, hold bool) error
+}
+
+// ArchiveStatus describes the storage class of an object and whether it
+// must be restored before it can be read
+type ArchiveStatus struct {
+	Class string
+	// Archived objects must be restored before they can be read
+	Archived bool
+	// Restoring is set while a restore is in progress
+	Restoring bool
+	// Restored is set when a readable copy of an archived object exists,
+	// until RestoredUntil
+	Restored      bool
+	RestoredUntil time.Time
+}
+
+// Archiver is implemented by backends with storage classes
+type Archiver interface {
+	// ArchiveStatus returns the storage class and restore state of the
+	// object stored under key
+	ArchiveStatus(ctx context.Context, key string) (*ArchiveStatus, error)
+	// SetStorageClass moves the object stored under key to another
+	// storage class
+	SetStorageClass(ctx context.Context, key, class string) error
+	// Restore requests a readable copy of an archived object for days days
+	// using a retrieval tier such as Standard, Bulk or Expedited
+	Restore(ctx context.Context, key string, days int, tier string) error
+}
+
+// ThawOptions configures how archived objects are restored
+type ThawOptions struct {
+	// Days the restored copy stays readable, default 1
+	Days int
+	// Tier is the retrieval tier, default Standard
+	Tier string
+	// PollInterval is the time between status checks, default 1 minute
+	PollInterval time.Duration
+}
+
+// Thaw makes an archived object readable: it requests a restore unless one
+// is in progress and waits until the restored copy is available, or ctx is
+// done. Objects that are not archived are left alone.
+func Thaw(ctx context.Context, b Backend, key string, opts ThawOptions) error {
+	archiver, ok := b.(Archiver)
+	if !ok {
+		return nil
+	}
+	if opts.Days <= 0 {
+		opts.Days = 1
+	}
+	if opts.Tier == "" {
+		opts.Tier = "Standard"
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Minute
+	}
+
+	status, err := archiver.ArchiveStatus(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !status.Archived || status.Restored {
+		return nil
+	}
+	if !status.Restoring {
+		if err := archiver.Restore(ctx, key, opts.Days, opts.Tier); err != nil {
+			return fmt.Errorf("failed to restore %s from %s: %w", JoinURL(b, key), status.Class, err)
+		}
+	}
+	customLog.Infof("Waiting for %s to be restored from %s", JoinURL(b, key), status.Class)
+
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for %s to be restored: %w", JoinURL(b, key), ctx.Err())
+		case <-ticker.C:
+		}
+		status, err := archiver.ArchiveStatus(ctx, key)
+		if err != nil {
+			return err
+		}
+		if status.Restored {
+			customLog.Infof("Restored %s until %s", JoinURL(b, key), status.RestoredUntil.Local().Format(time.DateTime))
+			return nil
+		}
+	}
+}
+
+// Factory opens a backend for a parsed storage URL
+type Factory func(ctx context.Context, u *url.URL) (Backend, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a backend available for URLs with the given scheme
+func Register(scheme string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[strings.ToLower(scheme)] = factory
+}
+
+func init() {
+	Register("file", openLocal)
+	// local:/backups is accepted as a shorthand for file:///backups
+	Register("local", openLocal)
+	Register("s3", openS3)
+	Register("gs", openGCS)
+	Register("gcs", openGCS)
+	Register("azblob", openAzure)
+	Register("azure", openAzure)
+	Register("sftp", openSFTP)
+}
+
+// Open returns the backend for a storage URL such as file:///backups or
+// s3://bucket/prefix. Plain paths are treated as local directories.
+func Open(ctx context.Context, rawURL string) (Backend, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[u.Scheme]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage scheme %q in %s", u.Scheme, rawURL)
+	}
+	return factory(ctx, u)
+}
+
+// ParseURL parses a storage URL, treating plain paths as file URLs
+func ParseURL(rawURL string) (*url.URL, error) {
+	if rawURL == "" {
+		return nil, errors.New("empty storage location")
+	}
+	if !strings.Contains(rawURL, ":") || filepath.IsAbs(rawURL) {
+		return &url.URL{Scheme: "file", Path: rawURL}, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage location %s: %w", rawURL, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	return u, nil
+}
+
+// Close releases the connections held by a backend, if any
+func Close(b Backend) error {
+	if closer, ok := b.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Upload stores a local file in the backend under key
+func Upload(ctx context.Context, b Backend, filePath, key string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := b.Put(ctx, key, file); err != nil {
+		return fmt.Errorf("failed to upload %s to %s: %w", filePath, JoinURL(b, key), err)
+	}
+	return nil
+}
+
+// Download copies the object stored under key into a local file. The data
+// is written to <filePath>.part first; if the backend supports ranged reads
+// an interrupted download continues where the partial file ends.
+func Download(ctx context.Context, b Backend, key, filePath string) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	partPath := filePath + ".part"
+
+	var offset int64
+	if ranged, ok := b.(RangeGetter); ok {
+		if info, err := os.Stat(partPath); err == nil && info.Size() > 0 {
+			obj, err := b.Stat(ctx, key)
+			if err != nil {
+				return fmt.Errorf("failed to download %s: %w", JoinURL(b, key), err)
+			}
+			if info.Size() < obj.Size {
+				offset = info.Size()
+			}
+			if info.Size() == obj.Size {
+				return os.Rename(partPath, filePath)
+			}
+			if offset > 0 {
+				customLog.Infof("Resuming download of %s at byte %d", JoinURL(b, key), offset)
+				body, err := ranged.GetRange(ctx, key, offset, -1)
+				if err != nil {
+					return fmt.Errorf("failed to download %s: %w", JoinURL(b, key), err)
+				}
+				defer body.Close()
+				return finishDownload(b, key, body, partPath, filePath, os.O_WRONLY|os.O_APPEND)
+			}
+		}
+	}
+
+	body, err := b.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", JoinURL(b, key), err)
+	}
+	defer body.Close()
+	return finishDownload(b, key, body, partPath, filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+}
+
+// finishDownload writes body to partPath and moves it to filePath once the
+// download is complete and flushed to disk. The partial file is kept on
+// errors so the download can be resumed.
+func finishDownload(b Backend, key string, body io.Reader, partPath, filePath string, flag int) error {
+	file, err := os.OpenFile(partPath, flag, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to download %s: %w", JoinURL(b, key), err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, filePath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+// source is an upload body that can be read in parts
+type source struct {
+	io.ReaderAt
+	size    int64
+	cleanup func()
+	// path and modTime identify a local file read from its start, so that
+	// upload state can be kept for it
+	path    string
+	modTime time.Time
+}
+
+// newSource prepares r for a part-wise upload. Files and in-memory readers
+// are read in place; other streams are spooled to a temporary file.
+func newSource(r io.Reader) (*source, error) {
+	switch body := r.(type) {
+	case *os.File:
+		offset, err := body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		info, err := body.Stat()
+		if err != nil {
+			return nil, err
+		}
+		src := &source{ReaderAt: io.NewSectionReader(body, offset, info.Size()-offset), size: info.Size() - offset, cleanup: func() {}}
+		if offset == 0 && info.Mode().IsRegular() {
+			if path, err := filepath.Abs(body.Name()); err == nil {
+				src.path, src.modTime = path, info.ModTime()
+			}
+		}
+		return src, nil
+	case interface {
+		io.ReaderAt
+		io.Seeker
+	}:
+		offset, err := body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		end, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		return &source{ReaderAt: io.NewSectionReader(body, offset, end-offset), size: end - offset, cleanup: func() {}}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "guard-s3-*")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return &source{ReaderAt: tmp, size: size, cleanup: cleanup}, nil
+}
+
+// JoinURL returns the full location of key within a backend. The key goes
+// into the path, in front of any query the backend URL carries.
+func JoinURL(b Backend, key string) string {
+	location, query, hasQuery := strings.Cut(b.URL(), "?")
+	joined := strings.TrimSuffix(location, "/") + "/" + strings.TrimPrefix(key, "/")
+	if hasQuery {
+		joined += "?" + query
+	}
+	return joined
+}
+
+// RedactURL hides the credentials a storage location may carry: userinfo,
+// and the SAS token of azblob:// URLs, whether given as sas= or pasted into
+// the query
+func RedactURL(location string) string {
+	u, err := ParseURL(location)
+	if err != nil {
+		return "invalid storage location"
+	}
+	if u.User == nil && u.RawQuery == "" {
+		return location
+	}
+	u.User = nil
+	q := u.Query()
+	for name := range q {
+		if name == "sas" || name == "sig" || (u.Scheme == "azblob" && !azureParams[name]) {
+			q.Del(name)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// sortObjects orders listed objects by key
+func sortObjects(objects []Object) {
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+}
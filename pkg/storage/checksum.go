@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrChecksumMismatch is returned when data does not match its SHA-256
+// checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Checksummer is implemented by backends that know the SHA-256 of stored
+// objects without downloading them
+type Checksummer interface {
+	// Checksum returns the SHA-256 of the object stored under key in the
+	// manifest format, or "" if the backend does not know it
+	Checksum(ctx context.Context, key string) (string, error)
+}
+
+// FormatChecksum formats a SHA-256 digest as in manifests, "sha256:<hex>"
+func FormatChecksum(sum []byte) string {
+	return "sha256:" + hex.EncodeToString(sum)
+}
+
+// ChecksumMismatch returns an ErrChecksumMismatch error for what
+func ChecksumMismatch(what, got, want string) error {
+	return fmt.Errorf("%s: %w: got %s, expected %s", what, ErrChecksumMismatch, got, want)
+}
+
+// FileChecksum returns the SHA-256 of a local file in the manifest format
+func FileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return FormatChecksum(hash.Sum(nil)), nil
+}
+
+// VerifyFile checks a local file against a checksum in the manifest format
+func VerifyFile(path, want string) error {
+	got, err := FileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return ChecksumMismatch(path, got, want)
+	}
+	return nil
+}
+
+// UploadVerified stores a local file in the backend under key. The file is
+// checked against checksum before it is sent, and the stored copy after it
+// is written if the backend reports checksums.
+func UploadVerified(ctx context.Context, b Backend, filePath, key, checksum string) error {
+	if checksum == "" {
+		return Upload(ctx, b, filePath, key)
+	}
+	if err := VerifyFile(filePath, checksum); err != nil {
+		return err
+	}
+	if err := Upload(ctx, b, filePath, key); err != nil {
+		return err
+	}
+	if checksummer, ok := b.(Checksummer); ok {
+		got, err := checksummer.Checksum(ctx, key)
+		if err != nil {
+			return err
+		}
+		if got != "" && got != checksum {
+			return ChecksumMismatch(JoinURL(b, key), got, checksum)
+		}
+	}
+	return nil
+}
+
+// DownloadVerified downloads the object stored under key like Download and
+// checks the local copy against checksum. A corrupt copy is removed.
+func DownloadVerified(ctx context.Context, b Backend, key, filePath, checksum string) error {
+	if err := Download(ctx, b, key, filePath); err != nil {
+		return err
+	}
+	if checksum == "" {
+		return nil
+	}
+	if err := VerifyFile(filePath, checksum); err != nil {
+		os.Remove(filePath)
+		return fmt.Errorf("download of %s is corrupt: %w", JoinURL(b, key), err)
+	}
+	return nil
+}
+
+// syncDir flushes a directory so that a rename into it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,617 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// DefaultGCSEndpoint is the Cloud Storage JSON API endpoint
+	DefaultGCSEndpoint = "https://storage.googleapis.com"
+	// DefaultChunkSize is the size of resumable upload requests
+	DefaultChunkSize = 16 << 20
+	// chunkAlignment is the granularity GCS requires for upload chunks
+	chunkAlignment = 256 << 10
+	// chunkAttempts is how often a chunk is retried before the upload fails
+	chunkAttempts = 3
+
+	gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// GCSOptions configures how a Cloud Storage client connects and
+// authenticates
+type GCSOptions struct {
+	// Endpoint of the JSON API, e.g. a fake-gcs-server
+	Endpoint string
+	// CredentialsFile is a service account key file. Without it the
+	// application default credentials are used.
+	CredentialsFile string
+	// Anonymous disables authentication, for emulators and public buckets
+	Anonymous bool
+	// ChunkSize is the size of resumable upload requests, rounded up to a
+	// multiple of 256 KiB
+	ChunkSize int64
+}
+
+// GCSClient stores objects in a Google Cloud Storage bucket
+type GCSClient struct {
+	http      *http.Client
+	endpoint  string
+	bucket    string
+	prefix    string
+	chunkSize int64
+
+	mu sync.Mutex
+	// sessions holds unfinished resumable uploads by object name so that
+	// a retried Put continues instead of starting over
+	sessions map[string]*gcsSession
+}
+
+type gcsSession struct {
+	uri  string
+	size int64
+	// state is the file the session is persisted in, if any
+	state string
+}
+
+// gcsUploadState is a resumable upload session persisted in the upload
+// state directory, so that an upload interrupted by a restart can resume
+type gcsUploadState struct {
+	URI     string    `json:"uri"`
+	Bucket  string    `json:"bucket"`
+	Name    string    `json:"name"`
+	Source  string    `json:"source"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// GCSUploadDir returns the directory resumable upload sessions are kept in,
+// GUARD_GCS_UPLOADS or ~/.guard/gcs-uploads
+func GCSUploadDir() string {
+	if dir := os.Getenv("GUARD_GCS_UPLOADS"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".guard", "gcs-uploads")
+	}
+	return filepath.Join(home, ".guard", "gcs-uploads")
+}
+
+// gcsTimeout bounds connecting to GCS and waiting for its response to a
+// request; transfers themselves may take longer
+const gcsTimeout = 30 * time.Second
+
+// newGCSHTTPClient returns an HTTP client that gives up on unresponsive
+// servers
+func newGCSHTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: gcsTimeout, KeepAlive: gcsTimeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = gcsTimeout
+	transport.ResponseHeaderTimeout = 2 * gcsTimeout
+	return &http.Client{Transport: transport}
+}
+
+// gcsObject is the object resource of the JSON API
+type gcsObject struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+var (
+	_ Backend     = (*GCSClient)(nil)
+	_ RangeGetter = (*GCSClient)(nil)
+)
+
+// NewGCSClient creates a Cloud Storage client for bucketName
+func NewGCSClient(ctx context.Context, bucketName string, opts GCSOptions) (*GCSClient, error) {
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultGCSEndpoint
+	}
+
+	client := newGCSHTTPClient()
+	if !opts.Anonymous {
+		var creds *google.Credentials
+		var err error
+		if opts.CredentialsFile != "" {
+			data, readErr := os.ReadFile(opts.CredentialsFile)
+			if readErr != nil {
+				return nil, fmt.Errorf("failed to read GCS credentials: %w", readErr)
+			}
+			creds, err = google.CredentialsFromJSON(ctx, data, gcsScope)
+		} else {
+			creds, err = google.FindDefaultCredentials(ctx, gcsScope)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load GCS credentials: %w", err)
+		}
+		// The authenticated client sends its requests through the one above
+		client = oauth2.NewClient(context.WithValue(context.Background(), oauth2.HTTPClient, client), creds.TokenSource)
+	}
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	chunkSize = (chunkSize + chunkAlignment - 1) / chunkAlignment * chunkAlignment
+
+	return &GCSClient{
+		http:      client,
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucketName,
+		chunkSize: chunkSize,
+		sessions:  make(map[string]*gcsSession),
+	}, nil
+}
+
+// ParseGCSOptions reads Cloud Storage options from the query of a gs:// URL.
+// Supported parameters are endpoint, credentials_file, anonymous and
+// chunk_size. STORAGE_EMULATOR_HOST selects an emulator without
+// authentication, as with the Google client libraries.
+func ParseGCSOptions(u *url.URL) (GCSOptions, error) {
+	var opts GCSOptions
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		opts.Endpoint = host
+		opts.Anonymous = true
+	}
+
+	q := u.Query()
+	if v := q.Get("endpoint"); v != "" {
+		opts.Endpoint = v
+	}
+	if v := q.Get("credentials_file"); v != "" {
+		opts.CredentialsFile = v
+	}
+	if v := q.Get("anonymous"); v != "" {
+		anonymous, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid anonymous %q in storage location %s", v, u.Redacted())
+		}
+		opts.Anonymous = anonymous
+	}
+	if v := q.Get("chunk_size"); v != "" {
+		chunkSize, err := ParseSize(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid chunk_size in storage location %s: %w", u.Redacted(), err)
+		}
+		opts.ChunkSize = chunkSize
+	}
+	return opts, nil
+}
+
+// openGCS opens a Cloud Storage backend for gs://bucket/prefix URLs
+func openGCS(ctx context.Context, u *url.URL) (Backend, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing bucket in storage location %s", u.Redacted())
+	}
+	opts, err := ParseGCSOptions(u)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewGCSClient(ctx, u.Host, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.prefix = strings.Trim(u.Path, "/")
+	return c, nil
+}
+
+// Put uploads r to the object stored under key with a resumable upload. A
+// chunk that fails is retried from the offset the server confirmed, and an
+// upload that still fails is continued by the next Put of the same key.
+func (c *GCSClient) Put(ctx context.Context, key string, r io.Reader) error {
+	src, err := newSource(r)
+	if err != nil {
+		return err
+	}
+	defer src.cleanup()
+
+	name := c.objectName(key)
+	session, offset, err := c.session(ctx, name, src)
+	if err != nil {
+		customLog.Errorf("Failed to upload %s to GCS: %v", key, err)
+		return err
+	}
+
+	failures := 0
+	for {
+		length := min(c.chunkSize, src.size-offset)
+		next, done, err := c.putChunk(ctx, session, src, offset, length)
+		if done {
+			break
+		}
+		if err == nil && next <= offset {
+			err = fmt.Errorf("upload made no progress at byte %d", offset)
+		}
+		if err == nil {
+			offset, failures = next, 0
+			continue
+		}
+
+		failures++
+		if failures == chunkAttempts || ctx.Err() != nil {
+			customLog.Errorf("Failed to upload %s to GCS, it will resume on the next upload: %v", key, err)
+			return err
+		}
+		customLog.Warnf("Upload of %s to GCS failed at byte %d, resuming: %v", key, offset, err)
+		if offset, err = c.uploadedBytes(ctx, session); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	delete(c.sessions, name)
+	c.mu.Unlock()
+	removeSessionState(session)
+	customLog.Infof("Successfully uploaded %s to GCS bucket %s as %s", key, c.bucket, name)
+	return nil
+}
+
+// session returns the resumable upload session of an object and the number
+// of bytes it already holds, starting a new session if there is none. A
+// session is looked up in memory first and then in the upload state
+// directory.
+func (c *GCSClient) session(ctx context.Context, name string, src *source) (*gcsSession, int64, error) {
+	size := src.size
+	c.mu.Lock()
+	session, ok := c.sessions[name]
+	c.mu.Unlock()
+	if !ok {
+		session, ok = c.loadSession(name, src)
+	}
+	if ok && session.size == size {
+		offset, err := c.uploadedBytes(ctx, session)
+		if err == nil {
+			customLog.Infof("Resuming upload of %s at byte %d", name, offset)
+			return session, offset, nil
+		}
+		customLog.Warnf("Discarding upload session of %s: %v", name, err)
+		removeSessionState(session)
+	}
+
+	body, _ := json.Marshal(map[string]string{"name": name})
+	endpoint := c.endpoint + "/upload/storage/v1/b/" + url.PathEscape(c.bucket) + "/o?uploadType=resumable&name=" + url.QueryEscape(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, 0, c.responseErr(name, resp)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, 0, errors.New("GCS did not return an upload session")
+	}
+
+	session = &gcsSession{uri: location, size: size}
+	c.saveSession(name, session, src)
+	c.mu.Lock()
+	c.sessions[name] = session
+	c.mu.Unlock()
+	return session, 0, nil
+}
+
+// statePath returns the file the session for uploading src as name is
+// persisted in, keyed by a hash of bucket, object and source file
+func (c *GCSClient) statePath(name string, src *source) string {
+	hash := sha256.Sum256([]byte(c.bucket + "\x00" + name + "\x00" + src.path))
+	return filepath.Join(GCSUploadDir(), hex.EncodeToString(hash[:])+".json")
+}
+
+// loadSession reads the session persisted for uploading src as name. The
+// state is only used if the file is unchanged since it was written.
+func (c *GCSClient) loadSession(name string, src *source) (*gcsSession, bool) {
+	if src.path == "" {
+		return nil, false
+	}
+	statePath := c.statePath(name, src)
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, false
+	}
+	var state gcsUploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		customLog.Warnf("Ignoring unreadable upload state %s: %v", statePath, err)
+		return nil, false
+	}
+	if state.Bucket != c.bucket || state.Name != name || state.Source != src.path || state.Size != src.size || !state.ModTime.Equal(src.modTime) {
+		return nil, false
+	}
+	return &gcsSession{uri: state.URI, size: state.Size, state: statePath}, true
+}
+
+// saveSession persists a new session in the upload state directory. The
+// upload still works without it, it just cannot survive a restart.
+func (c *GCSClient) saveSession(name string, session *gcsSession, src *source) {
+	if src.path == "" {
+		return
+	}
+	statePath := c.statePath(name, src)
+	data, err := json.Marshal(gcsUploadState{URI: session.uri, Bucket: c.bucket, Name: name, Source: src.path, Size: src.size, ModTime: src.modTime})
+	if err != nil {
+		return
+	}
+	// The session URI grants upload access, so keep it private
+	if err := os.MkdirAll(filepath.Dir(statePath), 0o700); err != nil {
+		customLog.Warnf("Failed to save upload state %s: %v", statePath, err)
+		return
+	}
+	if err := os.WriteFile(statePath, data, 0o600); err != nil {
+		customLog.Warnf("Failed to save upload state %s: %v", statePath, err)
+		return
+	}
+	session.state = statePath
+}
+
+// removeSessionState deletes the persisted state of a finished or
+// discarded session
+func removeSessionState(session *gcsSession) {
+	if session.state == "" {
+		return
+	}
+	if err := os.Remove(session.state); err != nil && !os.IsNotExist(err) {
+		customLog.Warnf("Failed to remove upload state %s: %v", session.state, err)
+	}
+	session.state = ""
+}
+
+// putChunk sends length bytes at offset. It returns the offset the server
+// expects next, or done once the object is complete.
+func (c *GCSClient) putChunk(ctx context.Context, session *gcsSession, src *source, offset, length int64) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session.uri, io.NewSectionReader(src, offset, length))
+	if err != nil {
+		return offset, false, err
+	}
+	req.ContentLength = length
+	if length == 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", src.size))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, src.size))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return offset, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return src.size, true, nil
+	case http.StatusPermanentRedirect:
+		return committedOffset(resp), false, nil
+	}
+	return offset, false, c.responseErr(session.uri, resp)
+}
+
+// uploadedBytes asks the server how much of a resumable upload it holds
+func (c *GCSClient) uploadedBytes(ctx context.Context, session *gcsSession) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session.uri, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", session.size))
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return session.size, nil
+	case http.StatusPermanentRedirect:
+		return committedOffset(resp), nil
+	}
+	return 0, c.responseErr(session.uri, resp)
+}
+
+// committedOffset reads the Range header of a 308 response
+func committedOffset(resp *http.Response) int64 {
+	var first, last int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Range"), "bytes=%d-%d", &first, &last); err != nil {
+		return 0
+	}
+	return last + 1
+}
+
+// Get opens the object stored under key
+func (c *GCSClient) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return c.GetRange(ctx, key, 0, -1)
+}
+
+// GetRange opens length bytes of the object stored under key starting at
+// offset. A negative length reads to the end of the object.
+func (c *GCSClient) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 || length >= 0 {
+		byteRange := fmt.Sprintf("bytes=%d-", offset)
+		if length >= 0 {
+			byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+		}
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, c.responseErr(key, resp)
+	}
+	return resp.Body, nil
+}
+
+// List returns the objects whose keys start with prefix
+func (c *GCSClient) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	pageToken := ""
+	for {
+		query := url.Values{"prefix": {c.objectName(prefix)}}
+		if c.prefix == "" && prefix == "" {
+			query.Del("prefix")
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		var page struct {
+			Items         []gcsObject `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		endpoint := c.endpoint + "/storage/v1/b/" + url.PathEscape(c.bucket) + "/o?" + query.Encode()
+		if err := c.getJSON(ctx, endpoint, c.bucket, &page); err != nil {
+			customLog.Errorf("Failed to list objects in GCS bucket %s: %v", c.bucket, err)
+			return nil, err
+		}
+		for _, item := range page.Items {
+			objects = append(objects, c.object(c.relativeKey(item.Name), item))
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+
+	sortObjects(objects)
+	return objects, nil
+}
+
+// Stat returns the metadata of the object stored under key
+func (c *GCSClient) Stat(ctx context.Context, key string) (*Object, error) {
+	var item gcsObject
+	if err := c.getJSON(ctx, c.objectURL(key), key, &item); err != nil {
+		return nil, err
+	}
+	obj := c.object(key, item)
+	return &obj, nil
+}
+
+// Delete removes the object stored under key
+func (c *GCSClient) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return c.responseErr(key, resp)
+	}
+	customLog.Infof("Deleted %s from GCS bucket %s", c.objectName(key), c.bucket)
+	return nil
+}
+
+// Exists reports whether an object is stored under key
+func (c *GCSClient) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := c.Stat(ctx, key)
+	if errors.Is(err, ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// URL returns the gs:// location of the backend
+func (c *GCSClient) URL() string {
+	if c.prefix == "" {
+		return "gs://" + c.bucket
+	}
+	return "gs://" + c.bucket + "/" + c.prefix
+}
+
+func (c *GCSClient) getJSON(ctx context.Context, endpoint, name string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return c.responseErr(name, resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *GCSClient) object(key string, item gcsObject) Object {
+	size, _ := strconv.ParseInt(item.Size, 10, 64)
+	return Object{Key: key, Size: size, ModTime: item.Updated}
+}
+
+// objectURL returns the JSON API URL of the object stored under key
+func (c *GCSClient) objectURL(key string) string {
+	return c.endpoint + "/storage/v1/b/" + url.PathEscape(c.bucket) + "/o/" + url.PathEscape(c.objectName(key))
+}
+
+// objectName prepends the backend prefix to a key
+func (c *GCSClient) objectName(key string) string {
+	key = strings.TrimPrefix(key, "/")
+	if c.prefix == "" {
+		return key
+	}
+	return c.prefix + "/" + key
+}
+
+// relativeKey strips the backend prefix from an object name
+func (c *GCSClient) relativeKey(name string) string {
+	if c.prefix == "" {
+		return name
+	}
+	return strings.TrimPrefix(name, c.prefix+"/")
+}
+
+// responseErr turns an error response into an error, mapping 404 to
+// ErrNotExist
+func (c *GCSClient) responseErr(name string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", name, ErrNotExist)
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil && body.Error.Message != "" {
+		return fmt.Errorf("GCS request for %s failed with %s: %s", name, resp.Status, body.Error.Message)
+	}
+	return fmt.Errorf("GCS request for %s failed with %s", name, resp.Status)
+}
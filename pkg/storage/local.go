@@ -1,8 +1,18 @@
 package storage
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"syscall"
 )
 
 // LocalStorage represents local storage
@@ -10,6 +20,11 @@ type LocalStorage struct {
 	directory string
 }
 
+var (
+	_ Backend     = (*LocalStorage)(nil)
+	_ RangeGetter = (*LocalStorage)(nil)
+)
+
 // NewLocalStorage creates a new local storage instance
 func NewLocalStorage(directory string) (*LocalStorage, error) {
 	if err := os.MkdirAll(directory, os.ModePerm); err != nil {
@@ -21,10 +36,28 @@ func NewLocalStorage(directory string) (*LocalStorage, error) {
 	}, nil
 }
 
-// UploadFile uploads a file to local storage
+// openLocal opens a local backend for file:// and local: URLs
+func openLocal(ctx context.Context, u *url.URL) (Backend, error) {
+	directory := u.Host + u.Path
+	if directory == "" {
+		directory = u.Opaque
+	}
+	if directory == "" {
+		return nil, fmt.Errorf("missing directory in storage location %s", u)
+	}
+	return NewLocalStorage(filepath.FromSlash(directory))
+}
+
+// UploadFile moves a file into local storage under objectKey. The file is
+// renamed into place when it is on the same filesystem and copied through
+// Put otherwise, for example from a tmpfs staging directory to a network
+// mount.
 func (l *LocalStorage) UploadFile(filePath, objectKey string) error {
-	destPath := filepath.Join(l.directory, objectKey)
-	if err := os.Rename(filePath, destPath); err != nil {
+	destPath, err := l.path(objectKey)
+	if err != nil {
+		return err
+	}
+	if err := l.moveFile(filePath, objectKey, destPath); err != nil {
 		customLog.Errorf("Failed to move file %s to %s: %v", filePath, destPath, err)
 		return err
 	}
@@ -32,19 +65,43 @@ func (l *LocalStorage) UploadFile(filePath, objectKey string) error {
 	return nil
 }
 
-// DownloadFile downloads a file from local storage
-func (l *LocalStorage) DownloadFile(objectKey, filePath string) error {
-	srcPath := filepath.Join(l.directory, objectKey)
-	data, err := os.ReadFile(srcPath)
+// moveFile flushes a file and renames it to destPath, falling back to a
+// copy when the rename crosses filesystems
+func (l *LocalStorage) moveFile(filePath, key, destPath string) error {
+	file, err := os.Open(filePath)
 	if err != nil {
-		customLog.Errorf("Failed to read file %s from local storage: %v", srcPath, err)
 		return err
 	}
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		customLog.Errorf("Failed to write file %s to %s: %v", srcPath, filePath, err)
+	defer file.Close()
+	if err := file.Sync(); err != nil {
 		return err
 	}
-	customLog.Infof("Successfully downloaded file %s from local storage to %s", srcPath, filePath)
+	if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	err = os.Rename(filePath, destPath)
+	if errors.Is(err, syscall.EXDEV) {
+		if err := l.Put(context.TODO(), key, file); err != nil {
+			return err
+		}
+		return os.Remove(filePath)
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(destPath))
+}
+
+// DownloadFile copies a file from local storage to filePath. The file is
+// streamed, not read into memory, and only appears at filePath once it is
+// complete.
+func (l *LocalStorage) DownloadFile(objectKey, filePath string) error {
+	if err := Download(context.TODO(), l, objectKey, filePath); err != nil {
+		customLog.Errorf("Failed to download %s from local storage: %v", objectKey, err)
+		return err
+	}
+	customLog.Infof("Successfully downloaded file %s from local storage to %s", objectKey, filePath)
 	return nil
 }
 
@@ -64,3 +121,182 @@ func (l *LocalStorage) ListObjects() ([]string, error) {
 	customLog.Infof("Listed %d files in local storage directory %s", len(objects), l.directory)
 	return objects, nil
 }
+
+// Put writes r to the object stored under key, replacing it atomically. The
+// data is flushed to disk and read back, and the object is only replaced if
+// the SHA-256 of the written file matches the data received.
+func (l *LocalStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	destPath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), "."+filepath.Base(destPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(tmp, io.TeeReader(r, hash)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := VerifyFile(tmp.Name(), FormatChecksum(hash.Sum(nil))); err != nil {
+		return fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), destPath); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(destPath)); err != nil {
+		return err
+	}
+
+	customLog.Infof("Stored %s in local storage as %s", key, destPath)
+	return nil
+}
+
+// Get opens the object stored under key
+func (l *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	srcPath, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(srcPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotExist)
+	}
+	return file, err
+}
+
+// GetRange opens length bytes of the object stored under key starting at
+// offset. A negative length reads to the end of the object.
+func (l *LocalStorage) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	body, err := l.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	file := body.(*os.File)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+// List returns the objects below the storage directory whose keys start
+// with prefix
+func (l *LocalStorage) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(l.directory, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.directory, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(path.Base(key), ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		customLog.Errorf("Failed to list files in local storage directory %s: %v", l.directory, err)
+		return nil, err
+	}
+
+	sortObjects(objects)
+	return objects, nil
+}
+
+// Stat returns the metadata of the object stored under key
+func (l *LocalStorage) Stat(ctx context.Context, key string) (*Object, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the object stored under key and the directories below the
+// storage directory that it leaves empty
+func (l *LocalStorage) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%s: %w", key, ErrNotExist)
+		}
+		return err
+	}
+	root := filepath.Clean(l.directory)
+	for dir := filepath.Dir(p); dir != root; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	customLog.Infof("Deleted %s from local storage", p)
+	return nil
+}
+
+// Exists reports whether an object is stored under key
+func (l *LocalStorage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := l.Stat(ctx, key)
+	if errors.Is(err, ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// URL returns the file:// location of the storage directory
+func (l *LocalStorage) URL() string {
+	abs, err := filepath.Abs(l.directory)
+	if err != nil {
+		abs = l.directory
+	}
+	return "file://" + filepath.ToSlash(abs)
+}
+
+// path maps a key to a file below the storage directory
+func (l *LocalStorage) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(l.directory, filepath.FromSlash(clean)), nil
+}
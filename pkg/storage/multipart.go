@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// DefaultPartSize is the size of multipart upload parts
+	DefaultPartSize = 16 << 20
+	// MinPartSize is the smallest part size S3 accepts
+	MinPartSize = 5 << 20
+	// DefaultConcurrency is the number of parts uploaded in parallel
+	DefaultConcurrency = 4
+	// maxParts is the largest number of parts in a multipart upload
+	maxParts = 10000
+)
+
+// partSizeFor returns the part size used for an object of size bytes,
+// growing the configured size when the upload would exceed 10000 parts
+func (c *S3Client) partSizeFor(size int64) int64 {
+	partSize := c.partSize
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	if size > partSize*maxParts {
+		partSize = (size + maxParts - 1) / maxParts
+	}
+	return partSize
+}
+
+// putMultipart uploads src in parts. An unfinished upload of the same key
+// is resumed: parts that were already uploaded with the same content are
+// kept. A failed upload is left open so that the next Put can resume it.
+func (c *S3Client) putMultipart(ctx context.Context, key string, src *source) error {
+	objectKey := c.objectKey(key)
+	partSize := c.partSizeFor(src.size)
+
+	uploadID, uploaded, err := c.findUpload(ctx, objectKey)
+	if err != nil {
+		return err
+	}
+	if uploadID == "" {
+		out, err := c.client.CreateMultipartUpload(ctx, c.createUploadInput(objectKey, c.class))
+		if err != nil {
+			return fmt.Errorf("failed to start multipart upload of %s: %w", key, err)
+		}
+		uploadID = aws.ToString(out.UploadId)
+	} else {
+		customLog.Infof("Resuming multipart upload of %s (%d parts already uploaded)", key, len(uploaded))
+	}
+
+	partCount := int32((src.size + partSize - 1) / partSize)
+	completed := make([]types.CompletedPart, partCount)
+
+	err = forEachPart(ctx, int(partCount), c.concurrency, func(ctx context.Context, i int) error {
+		number := int32(i + 1)
+		part, err := c.uploadPart(ctx, objectKey, uploadID, src, number, partSize, uploaded[number])
+		if err != nil {
+			return err
+		}
+		completed[i] = part
+		return nil
+	})
+	if err != nil {
+		customLog.Errorf("Multipart upload of %s interrupted, it will resume on the next upload: %v", key, err)
+		return err
+	}
+
+	out, err := c.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(c.bucket),
+		Key:             aws.String(objectKey),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload of %s: %w", key, err)
+	}
+	if got, want := aws.ToString(out.ChecksumSHA256), compositeChecksum(completed); got != "" && got != want {
+		return ChecksumMismatch(key, got, want)
+	}
+	return nil
+}
+
+// compositeChecksum returns the checksum S3 reports for an object uploaded
+// in parts, the SHA-256 of the part checksums followed by the part count
+func compositeChecksum(parts []types.CompletedPart) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		sum, _ := base64.StdEncoding.DecodeString(aws.ToString(part.ChecksumSHA256))
+		hash.Write(sum)
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)) + "-" + strconv.Itoa(len(parts))
+}
+
+// sectionSHA256 returns the SHA-256 of a section of a source
+func sectionSHA256(section *io.SectionReader) ([]byte, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, section); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// createUploadInput returns the request starting a multipart upload of
+// objectKey with the lock and encryption settings of the client. Parts carry
+// SHA-256 checksums.
+func (c *S3Client) createUploadInput(objectKey string, class types.StorageClass) *s3.CreateMultipartUploadInput {
+	mode, retainUntil := c.retention()
+	encryption, kmsKeyID := c.serverSide()
+	algorithm, customerKey, customerKeyMD5 := c.customer()
+	return &s3.CreateMultipartUploadInput{
+		Bucket:                    aws.String(c.bucket),
+		Key:                       aws.String(objectKey),
+		ChecksumAlgorithm:         types.ChecksumAlgorithmSha256,
+		ObjectLockMode:            mode,
+		ObjectLockRetainUntilDate: retainUntil,
+		StorageClass:              class,
+		ServerSideEncryption:      encryption,
+		SSEKMSKeyId:               kmsKeyID,
+		SSECustomerAlgorithm:      algorithm,
+		SSECustomerKey:            customerKey,
+		SSECustomerKeyMD5:         customerKeyMD5,
+	}
+}
+
+// forEachPart calls fn for parts 0 to count-1 with up to concurrency calls
+// in flight. The first error cancels the remaining parts and is returned.
+func forEachPart(ctx context.Context, count, concurrency int, fn func(ctx context.Context, i int) error) error {
+	if concurrency < 1 {
+		concurrency = DefaultConcurrency
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	parts := make(chan int)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				if err := fn(ctx, part); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	for part := 0; part < count && ctx.Err() == nil; part++ {
+		parts <- part
+	}
+	close(parts)
+	wg.Wait()
+	return firstErr
+}
+
+// uploadPart uploads one part with its SHA-256 unless an identical part is
+// already stored
+func (c *S3Client) uploadPart(ctx context.Context, objectKey, uploadID string, src *source, number int32, partSize int64, existing *types.Part) (types.CompletedPart, error) {
+	offset := int64(number-1) * partSize
+	length := partSize
+	if offset+length > src.size {
+		length = src.size - offset
+	}
+	section := io.NewSectionReader(src, offset, length)
+
+	hash, sha := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(hash, sha), section); err != nil {
+		return types.CompletedPart{}, err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+	checksum := base64.StdEncoding.EncodeToString(sha.Sum(nil))
+	if existing != nil && aws.ToInt64(existing.Size) == length && aws.ToString(existing.ETag) == etag &&
+		aws.ToString(existing.ChecksumSHA256) == checksum {
+		return types.CompletedPart{PartNumber: aws.Int32(number), ETag: existing.ETag, ChecksumSHA256: existing.ChecksumSHA256}, nil
+	}
+
+	if _, err := section.Seek(0, io.SeekStart); err != nil {
+		return types.CompletedPart{}, err
+	}
+	algorithm, customerKey, customerKeyMD5 := c.customer()
+	out, err := c.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:               aws.String(c.bucket),
+		Key:                  aws.String(objectKey),
+		UploadId:             aws.String(uploadID),
+		PartNumber:           aws.Int32(number),
+		Body:                 section,
+		ContentLength:        aws.Int64(length),
+		ChecksumAlgorithm:    types.ChecksumAlgorithmSha256,
+		ChecksumSHA256:       aws.String(checksum),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
+		SSECustomerKeyMD5:    customerKeyMD5,
+	})
+	if err != nil {
+		return types.CompletedPart{}, fmt.Errorf("failed to upload part %d of %s: %w", number, objectKey, c.wrapErr(objectKey, err))
+	}
+	return types.CompletedPart{PartNumber: aws.Int32(number), ETag: out.ETag, ChecksumSHA256: aws.String(checksum)}, nil
+}
+
+// findUpload returns the most recent unfinished multipart upload of an
+// object key and its uploaded parts by number. Uploads without SHA-256 part
+// checksums cannot be resumed.
+func (c *S3Client) findUpload(ctx context.Context, objectKey string) (string, map[int32]*types.Part, error) {
+	var latest *types.MultipartUpload
+	paginator := s3.NewListMultipartUploadsPaginator(c.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(objectKey),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to list multipart uploads in S3 bucket %s: %w", c.bucket, err)
+		}
+		for i := range page.Uploads {
+			upload := &page.Uploads[i]
+			if aws.ToString(upload.Key) != objectKey || upload.ChecksumAlgorithm != types.ChecksumAlgorithmSha256 {
+				continue
+			}
+			if latest == nil || aws.ToTime(upload.Initiated).After(aws.ToTime(latest.Initiated)) {
+				latest = upload
+			}
+		}
+	}
+	if latest == nil {
+		return "", nil, nil
+	}
+
+	uploaded := make(map[int32]*types.Part)
+	parts := s3.NewListPartsPaginator(c.client, &s3.ListPartsInput{
+		Bucket:   aws.String(c.bucket),
+		Key:      aws.String(objectKey),
+		UploadId: latest.UploadId,
+	})
+	for parts.HasMorePages() {
+		page, err := parts.NextPage(ctx)
+		if err != nil {
+			var noSuchUpload *types.NoSuchUpload
+			if errors.As(err, &noSuchUpload) {
+				return "", nil, nil
+			}
+			return "", nil, fmt.Errorf("failed to list parts of %s: %w", objectKey, err)
+		}
+		for i := range page.Parts {
+			uploaded[aws.ToInt32(page.Parts[i].PartNumber)] = &page.Parts[i]
+		}
+	}
+	return aws.ToString(latest.UploadId), uploaded, nil
+}
+
+// AbortUploads discards the unfinished multipart uploads of objects whose
+// keys start with prefix and returns the keys of the aborted uploads
+func (c *S3Client) AbortUploads(ctx context.Context, prefix string) ([]string, error) {
+	var aborted []string
+	paginator := s3.NewListMultipartUploadsPaginator(c.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(c.objectKey(prefix)),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return aborted, err
+		}
+		for _, upload := range page.Uploads {
+			_, err := c.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(c.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return aborted, err
+			}
+			aborted = append(aborted, c.relativeKey(aws.ToString(upload.Key)))
+		}
+	}
+	sort.Strings(aborted)
+	return aborted, nil
+}
+
+// ParseSize parses a byte size such as 16777216, 64MB or 16MiB
+func ParseSize(s string) (int64, error) {
+	value := strings.TrimSpace(strings.ToUpper(s))
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+		{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1},
+	}
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * factor, nil
+}
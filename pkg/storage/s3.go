@@ -2,52 +2,332 @@ package storage
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/Annany2002/guard/pkg/logger"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 	"github.com/joho/godotenv"
 )
 
 // S3Client represents an S3 client
 type S3Client struct {
-	client *s3.Client
-	bucket string
+	client      *s3.Client
+	bucket      string
+	prefix      string
+	partSize    int64
+	concurrency int
+	lockMode    types.ObjectLockMode
+	lockDays    int
+	class       types.StorageClass
+	sse         *sse
+	// endpoint, pathStyle and region are kept in URL, so that it reopens
+	// the same service
+	endpoint  string
+	pathStyle bool
+	region    string
 }
 
 var (
 	customLog = logger.NewLogger()
+
+	_ Backend     = (*S3Client)(nil)
+	_ RangeGetter = (*S3Client)(nil)
+	_ Locker      = (*S3Client)(nil)
+	_ Archiver    = (*S3Client)(nil)
+	_ Encrypter   = (*S3Client)(nil)
+	_ Checksummer = (*S3Client)(nil)
 )
 
+// S3Options configures how an S3 client connects and authenticates. Empty
+// fields fall back to the AWS default configuration chain (environment,
+// shared config and credentials files, container and instance roles).
+type S3Options struct {
+	// Region of the bucket, default us-east-1 when none is configured
+	Region string
+	// Endpoint of an S3-compatible service such as MinIO, Ceph or R2
+	Endpoint string
+	// PathStyle addresses buckets as endpoint/bucket instead of bucket.endpoint
+	PathStyle bool
+	// Profile selects a profile from the shared AWS config files
+	Profile string
+	// RoleARN is assumed with the resolved credentials, or with the web
+	// identity token when WebIdentityTokenFile is set
+	RoleARN string
+	// ExternalID is passed when assuming RoleARN
+	ExternalID string
+	// WebIdentityTokenFile holds an OIDC token exchanged for RoleARN
+	WebIdentityTokenFile string
+	// PartSize is the size of multipart upload parts, objects up to this
+	// size are uploaded in a single request
+	PartSize int64
+	// Concurrency is the number of parts uploaded in parallel
+	Concurrency int
+	// EnvFile is loaded into the environment if it exists, without
+	// overriding variables that are already set
+	EnvFile string
+	// LockMode writes every object with S3 Object Lock retention in this
+	// mode, governance or compliance. The bucket must have Object Lock
+	// enabled.
+	LockMode string
+	// LockDays is the retention period of locked objects
+	LockDays int
+	// StorageClass of new objects such as STANDARD_IA, GLACIER or
+	// DEEP_ARCHIVE, default STANDARD
+	StorageClass string
+	// SSE is the server-side encryption of new objects: aes256, kms or c
+	// (customer-provided key)
+	SSE string
+	// SSEKMSKeyID is the KMS key used with SSE kms, default the AWS
+	// managed key
+	SSEKMSKeyID string
+	// SSECustomerKey is the base64 encoded 32 byte key used with SSE c
+	SSECustomerKey string
+	// SSECustomerKeyFile holds the key used with SSE c, raw or base64
+	// encoded
+	SSECustomerKeyFile string
+}
+
+// defaultEnvFiles are loaded by NewS3Client when present
+var defaultEnvFiles = []string{".env", "../.env"}
+
 // Creates a new s3 Client
 func NewS3Client(bucketName string) (*S3Client, error) {
-	// Load environment variables from .env file
-	if err := godotenv.Load("../.env"); err != nil {
-		return nil, err
+	return NewS3ClientWithOptions(context.TODO(), bucketName, S3OptionsFromEnv())
+}
+
+// NewS3ClientWithOptions creates an S3 client for bucketName
+func NewS3ClientWithOptions(ctx context.Context, bucketName string, opts S3Options) (*S3Client, error) {
+	envFiles := defaultEnvFiles
+	if opts.EnvFile != "" {
+		envFiles = []string{opts.EnvFile}
+	}
+	for _, envFile := range envFiles {
+		if _, err := os.Stat(envFile); err != nil {
+			continue
+		}
+		if err := godotenv.Load(envFile); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", envFile, err)
+		}
 	}
 
-	// Ensure required variables are set
-	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" || os.Getenv("AWS_REGION") == "" {
-		return nil, errors.New("aws credentials or region not set. Ensure your .env file contains AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_REGION")
+	loadOpts := []func(*config.LoadOptions) error{
+		config.WithDefaultRegion("us-east-1"),
+	}
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(opts.Region))
+	}
+	if opts.Profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(opts.Profile))
 	}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithDefaultRegion(os.Getenv("AWS_REGION")))
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+
+	if opts.RoleARN != "" {
+		stsClient := sts.NewFromConfig(cfg)
+		if opts.WebIdentityTokenFile != "" {
+			cfg.Credentials = aws.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(
+				stsClient, opts.RoleARN, stscreds.IdentityTokenFile(opts.WebIdentityTokenFile),
+			))
+		} else {
+			cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(
+				stsClient, opts.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+					if opts.ExternalID != "" {
+						o.ExternalID = aws.String(opts.ExternalID)
+					}
+				},
+			))
+		}
 	}
 
 	// Create an S3 service client
-	s3Client := s3.NewFromConfig(cfg)
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+		o.UsePathStyle = opts.PathStyle
+	})
+
+	partSize := opts.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	if partSize < MinPartSize {
+		return nil, fmt.Errorf("part size %d is below the S3 minimum of %d bytes", partSize, MinPartSize)
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	lockMode, err := parseLockMode(opts.LockMode)
+	if err != nil {
+		return nil, err
+	}
+	if lockMode != "" && opts.LockDays <= 0 {
+		return nil, fmt.Errorf("object lock mode %s requires a retention period in days", opts.LockMode)
+	}
+	class, err := parseStorageClass(opts.StorageClass)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := newSSE(opts)
+	if err != nil {
+		return nil, err
+	}
 
 	return &S3Client{
-		client: s3Client,
-		bucket: bucketName,
+		client:      s3Client,
+		bucket:      bucketName,
+		partSize:    partSize,
+		concurrency: concurrency,
+		lockMode:    lockMode,
+		lockDays:    opts.LockDays,
+		class:       class,
+		sse:         encryption,
+		endpoint:    opts.Endpoint,
+		pathStyle:   opts.PathStyle,
+		region:      opts.Region,
 	}, nil
 }
 
+// S3OptionsFromEnv reads S3 options from GUARD_S3_* environment variables.
+// Region, profile and credentials are also picked up by the AWS default
+// configuration chain from the standard AWS_* variables.
+func S3OptionsFromEnv() S3Options {
+	pathStyle, _ := strconv.ParseBool(os.Getenv("GUARD_S3_PATH_STYLE"))
+	partSize, _ := ParseSize(os.Getenv("GUARD_S3_PART_SIZE"))
+	concurrency, _ := strconv.Atoi(os.Getenv("GUARD_S3_CONCURRENCY"))
+	lockDays, _ := strconv.Atoi(os.Getenv("GUARD_S3_LOCK_DAYS"))
+	return S3Options{
+		PartSize:             partSize,
+		Concurrency:          concurrency,
+		Endpoint:             os.Getenv("GUARD_S3_ENDPOINT"),
+		PathStyle:            pathStyle,
+		RoleARN:              os.Getenv("GUARD_S3_ROLE_ARN"),
+		ExternalID:           os.Getenv("GUARD_S3_EXTERNAL_ID"),
+		WebIdentityTokenFile: os.Getenv("GUARD_S3_WEB_IDENTITY_TOKEN_FILE"),
+		EnvFile:              os.Getenv("GUARD_ENV_FILE"),
+		LockMode:             os.Getenv("GUARD_S3_LOCK_MODE"),
+		LockDays:             lockDays,
+		StorageClass:         os.Getenv("GUARD_S3_STORAGE_CLASS"),
+		SSE:                  os.Getenv("GUARD_S3_SSE"),
+		SSEKMSKeyID:          os.Getenv("GUARD_S3_SSE_KMS_KEY_ID"),
+		SSECustomerKey:       os.Getenv("GUARD_S3_SSE_C_KEY"),
+		SSECustomerKeyFile:   os.Getenv("GUARD_S3_SSE_C_KEY_FILE"),
+	}
+}
+
+// ParseS3Options reads S3 options from the query of an s3:// URL, on top
+// of the options from the environment. Supported parameters are endpoint,
+// path_style, region, profile, role_arn, external_id,
+// web_identity_token_file, part_size, concurrency, env_file, lock_mode,
+// lock_days, storage_class, sse, sse_kms_key_id and sse_c_key_file. Customer
+// keys are only read from files or the environment, never from URLs.
+func ParseS3Options(u *url.URL) (S3Options, error) {
+	opts := S3OptionsFromEnv()
+	q := u.Query()
+	if v := q.Get("endpoint"); v != "" {
+		opts.Endpoint = v
+	}
+	if v := q.Get("path_style"); v != "" {
+		pathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid path_style %q in storage location %s", v, u.Redacted())
+		}
+		opts.PathStyle = pathStyle
+	}
+	if v := q.Get("region"); v != "" {
+		opts.Region = v
+	}
+	if v := q.Get("profile"); v != "" {
+		opts.Profile = v
+	}
+	if v := q.Get("role_arn"); v != "" {
+		opts.RoleARN = v
+	}
+	if v := q.Get("external_id"); v != "" {
+		opts.ExternalID = v
+	}
+	if v := q.Get("web_identity_token_file"); v != "" {
+		opts.WebIdentityTokenFile = v
+	}
+	if v := q.Get("part_size"); v != "" {
+		partSize, err := ParseSize(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid part_size in storage location %s: %w", u.Redacted(), err)
+		}
+		opts.PartSize = partSize
+	}
+	if v := q.Get("concurrency"); v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil || concurrency < 1 {
+			return opts, fmt.Errorf("invalid concurrency %q in storage location %s", v, u.Redacted())
+		}
+		opts.Concurrency = concurrency
+	}
+	if v := q.Get("env_file"); v != "" {
+		opts.EnvFile = v
+	}
+	if v := q.Get("lock_mode"); v != "" {
+		opts.LockMode = v
+	}
+	if v := q.Get("lock_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return opts, fmt.Errorf("invalid lock_days %q in storage location %s", v, u.Redacted())
+		}
+		opts.LockDays = days
+	}
+	if v := q.Get("storage_class"); v != "" {
+		opts.StorageClass = v
+	}
+	if v := q.Get("sse"); v != "" {
+		opts.SSE = v
+	}
+	if v := q.Get("sse_kms_key_id"); v != "" {
+		opts.SSEKMSKeyID = v
+	}
+	if v := q.Get("sse_c_key_file"); v != "" {
+		opts.SSECustomerKeyFile = v
+	}
+	if opts.WebIdentityTokenFile != "" && opts.RoleARN == "" {
+		return opts, fmt.Errorf("web_identity_token_file requires role_arn in storage location %s", u.Redacted())
+	}
+	return opts, nil
+}
+
+// openS3 opens an S3 backend for s3://bucket/prefix URLs
+func openS3(ctx context.Context, u *url.URL) (Backend, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing bucket in storage location %s", u.Redacted())
+	}
+	opts, err := ParseS3Options(u)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewS3ClientWithOptions(ctx, u.Host, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.prefix = strings.Trim(u.Path, "/")
+	return c, nil
+}
+
 // Uploads a file to s3 with a specified file path
 func (c *S3Client) UploadFileToS3(filePath, objectKey string) error {
 	file, err := os.Open(filePath)
@@ -57,16 +337,250 @@ func (c *S3Client) UploadFileToS3(filePath, objectKey string) error {
 	}
 	defer file.Close()
 
-	_, err = c.client.PutObject(context.TODO(), &s3.PutObjectInput{
+	return c.Put(context.TODO(), objectKey, file)
+}
+
+// Put uploads r to the object stored under key. Objects larger than the
+// part size are uploaded in parts, resuming an interrupted upload of the
+// same key.
+func (c *S3Client) Put(ctx context.Context, key string, r io.Reader) error {
+	src, err := newSource(r)
+	if err != nil {
+		return err
+	}
+	defer src.cleanup()
+
+	if src.size > c.partSize {
+		err = c.putMultipart(ctx, key, src)
+	} else {
+		err = c.putObject(ctx, key, src)
+	}
+	if err != nil {
+		customLog.Errorf("Failed to upload %s to S3: %v", key, err)
+		return c.wrapErr(key, err)
+	}
+
+	customLog.Infof("Successfully uploaded %s to S3 bucket %s as %s", key, c.bucket, c.objectKey(key))
+	return nil
+}
+
+// putObject uploads src in a single request together with its SHA-256,
+// which S3 verifies before storing the object
+func (c *S3Client) putObject(ctx context.Context, key string, src *source) error {
+	sum, err := sectionSHA256(io.NewSectionReader(src, 0, src.size))
+	if err != nil {
+		return err
+	}
+	mode, retainUntil := c.retention()
+	encryption, kmsKeyID := c.serverSide()
+	algorithm, customerKey, customerKeyMD5 := c.customer()
+	_, err = c.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:                    aws.String(c.bucket),
+		Key:                       aws.String(c.objectKey(key)),
+		Body:                      io.NewSectionReader(src, 0, src.size),
+		ContentLength:             aws.Int64(src.size),
+		ChecksumAlgorithm:         types.ChecksumAlgorithmSha256,
+		ChecksumSHA256:            aws.String(base64.StdEncoding.EncodeToString(sum)),
+		ObjectLockMode:            mode,
+		ObjectLockRetainUntilDate: retainUntil,
+		StorageClass:              c.class,
+		ServerSideEncryption:      encryption,
+		SSEKMSKeyId:               kmsKeyID,
+		SSECustomerAlgorithm:      algorithm,
+		SSECustomerKey:            customerKey,
+		SSECustomerKeyMD5:         customerKeyMD5,
+	})
+	return err
+}
+
+// Get opens the object stored under key. Reading an object that was stored
+// with a checksum fails if the data does not match it.
+func (c *S3Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	algorithm, customerKey, customerKeyMD5 := c.customer()
+	out, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:               aws.String(c.bucket),
+		Key:                  aws.String(c.objectKey(key)),
+		ChecksumMode:         types.ChecksumModeEnabled,
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
+		SSECustomerKeyMD5:    customerKeyMD5,
+	})
+	if err != nil {
+		return nil, c.wrapErr(key, err)
+	}
+	return out.Body, nil
+}
+
+// GetRange opens length bytes of the object stored under key starting at
+// offset. A negative length reads to the end of the object.
+func (c *S3Client) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+	algorithm, customerKey, customerKeyMD5 := c.customer()
+	out, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:               aws.String(c.bucket),
+		Key:                  aws.String(c.objectKey(key)),
+		Range:                aws.String(byteRange),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
+		SSECustomerKeyMD5:    customerKeyMD5,
+	})
+	if err != nil {
+		return nil, c.wrapErr(key, err)
+	}
+	return out.Body, nil
+}
+
+// List returns the objects whose keys start with prefix
+func (c *S3Client) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	paginator := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(c.bucket),
-		Key:    aws.String(objectKey),
-		Body:   file,
+		Prefix: aws.String(c.objectKey(prefix)),
 	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			customLog.Errorf("Failed to list objects in S3 bucket %s: %v", c.bucket, err)
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, Object{
+				Key:     c.relativeKey(aws.ToString(obj.Key)),
+				Size:    aws.ToInt64(obj.Size),
+				ModTime: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+
+	sortObjects(objects)
+	return objects, nil
+}
+
+// Stat returns the metadata of the object stored under key
+func (c *S3Client) Stat(ctx context.Context, key string) (*Object, error) {
+	out, err := c.client.HeadObject(ctx, c.headInput(key))
 	if err != nil {
-		customLog.Errorf("Failed to upload file %s to S3: %v", filePath, err)
-		return err
+		return nil, c.wrapErr(key, err)
 	}
+	return &Object{
+		Key:     key,
+		Size:    aws.ToInt64(out.ContentLength),
+		ModTime: aws.ToTime(out.LastModified),
+	}, nil
+}
 
-	customLog.Infof("Successfully uploaded file %s to S3 bucket %s as %s", filePath, c.bucket, objectKey)
+// Checksum returns the SHA-256 that S3 stored with the object under key.
+// Objects uploaded in parts only carry a checksum of their part checksums,
+// for them and for objects stored without a checksum it returns "".
+func (c *S3Client) Checksum(ctx context.Context, key string) (string, error) {
+	input := c.headInput(key)
+	input.ChecksumMode = types.ChecksumModeEnabled
+	out, err := c.client.HeadObject(ctx, input)
+	if err != nil {
+		return "", c.wrapErr(key, err)
+	}
+	value := aws.ToString(out.ChecksumSHA256)
+	if value == "" || strings.Contains(value, "-") {
+		return "", nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid checksum %q of %s", value, key)
+	}
+	return FormatChecksum(sum), nil
+}
+
+// headInput returns the HeadObject request of the object stored under key
+func (c *S3Client) headInput(key string) *s3.HeadObjectInput {
+	algorithm, customerKey, customerKeyMD5 := c.customer()
+	return &s3.HeadObjectInput{
+		Bucket:               aws.String(c.bucket),
+		Key:                  aws.String(c.objectKey(key)),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
+		SSECustomerKeyMD5:    customerKeyMD5,
+	}
+}
+
+// Delete removes the object stored under key
+func (c *S3Client) Delete(ctx context.Context, key string) error {
+	_, err := c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.objectKey(key)),
+	})
+	if err != nil {
+		return c.wrapErr(key, err)
+	}
+	customLog.Infof("Deleted %s from S3 bucket %s", c.objectKey(key), c.bucket)
 	return nil
 }
+
+// Exists reports whether an object is stored under key
+func (c *S3Client) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := c.Stat(ctx, key)
+	if errors.Is(err, ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// URL returns the s3:// location of the backend. The endpoint, path_style
+// and region parameters are kept, so that the URL can be reopened and tells
+// buckets of the same name at different services apart; credentials and
+// upload settings are left out.
+func (c *S3Client) URL() string {
+	location := "s3://" + c.bucket
+	if c.prefix != "" {
+		location += "/" + c.prefix
+	}
+	q := url.Values{}
+	if c.endpoint != "" {
+		q.Set("endpoint", c.endpoint)
+	}
+	if c.pathStyle {
+		q.Set("path_style", "true")
+	}
+	if c.region != "" {
+		q.Set("region", c.region)
+	}
+	if len(q) > 0 {
+		location += "?" + q.Encode()
+	}
+	return location
+}
+
+// objectKey prepends the backend prefix to a key
+func (c *S3Client) objectKey(key string) string {
+	key = strings.TrimPrefix(key, "/")
+	if c.prefix == "" {
+		return key
+	}
+	return c.prefix + "/" + key
+}
+
+// relativeKey strips the backend prefix from an object key
+func (c *S3Client) relativeKey(key string) string {
+	if c.prefix == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, c.prefix+"/")
+}
+
+// wrapErr maps S3 not-found errors to ErrNotExist and rejected checksums to
+// ErrChecksumMismatch
+func (c *S3Client) wrapErr(key string, err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var apiErr smithy.APIError
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) ||
+		(errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey") {
+		return fmt.Errorf("%s: %w", key, ErrNotExist)
+	}
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "BadDigest" {
+		return fmt.Errorf("%s: %w: %v", key, ErrChecksumMismatch, err)
+	}
+	return err
+}
@@ -0,0 +1,422 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPOptions configures how an SFTP client connects and authenticates
+type SFTPOptions struct {
+	// User to log in as, default $USER
+	User string
+	// KeyFile is a private key used for public key authentication. Without
+	// it the SSH agent and the default keys in ~/.ssh are tried.
+	KeyFile string
+	// KeyPassphrase decrypts an encrypted KeyFile
+	KeyPassphrase string
+	// KnownHostsFile verifies the host key, default ~/.ssh/known_hosts
+	KnownHostsFile string
+	// HostKeyFingerprint pins the SHA256 fingerprint of the host key
+	// instead of using a known_hosts file
+	HostKeyFingerprint string
+	// Timeout for establishing the connection
+	Timeout time.Duration
+}
+
+// SFTPClient stores objects in a directory of a host reachable over SSH
+type SFTPClient struct {
+	ssh       *ssh.Client
+	client    *sftp.Client
+	user      string
+	host      string
+	directory string
+	// agent is the connection to the SSH agent, if one is used
+	agent net.Conn
+}
+
+var (
+	_ Backend     = (*SFTPClient)(nil)
+	_ RangeGetter = (*SFTPClient)(nil)
+	_ io.Closer   = (*SFTPClient)(nil)
+)
+
+// NewSFTPClient connects to addr (host:port) and stores objects below
+// directory
+func NewSFTPClient(ctx context.Context, addr, directory string, opts SFTPOptions) (*SFTPClient, error) {
+	user := opts.User
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	hostKeyCallback, err := opts.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	auth, agentConn, err := opts.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	closeAgent := func() {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		closeAgent()
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	})
+	if err != nil {
+		conn.Close()
+		closeAgent()
+		return nil, fmt.Errorf("SSH handshake with %s failed: %w", addr, err)
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		closeAgent()
+		return nil, fmt.Errorf("failed to start SFTP session on %s: %w", addr, err)
+	}
+	return &SFTPClient{
+		ssh:       sshClient,
+		client:    client,
+		agent:     agentConn,
+		user:      user,
+		host:      addr,
+		directory: path.Clean("/" + directory),
+	}, nil
+}
+
+// hostKeyCallback verifies host keys against a pinned fingerprint or the
+// known_hosts file
+func (opts SFTPOptions) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if opts.HostKeyFingerprint != "" {
+		want := opts.HostKeyFingerprint
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); got != want {
+				return fmt.Errorf("host key of %s has fingerprint %s, expected %s", hostname, got, want)
+			}
+			return nil
+		}, nil
+	}
+
+	file := opts.KnownHostsFile
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts from %s: %w", file, err)
+	}
+	return callback, nil
+}
+
+// authMethods returns the configured key, or the SSH agent and the default
+// keys in ~/.ssh. The connection to the agent, if any, is returned to be
+// closed with the client.
+func (opts SFTPOptions) authMethods() ([]ssh.AuthMethod, net.Conn, error) {
+	if opts.KeyFile != "" {
+		signer, err := loadSigner(opts.KeyFile, opts.KeyPassphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil, nil
+	}
+
+	var methods []ssh.AuthMethod
+	var agentConn net.Conn
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			agentConn = conn
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		var signers []ssh.Signer
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			if signer, err := loadSigner(filepath.Join(home, ".ssh", name), opts.KeyPassphrase); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+		if len(signers) > 0 {
+			methods = append(methods, ssh.PublicKeys(signers...))
+		}
+	}
+	if len(methods) == 0 {
+		return nil, nil, errors.New("no SSH key or agent available, set key= or SSH_AUTH_SOCK")
+	}
+	return methods, agentConn, nil
+}
+
+func loadSigner(file, passphrase string) (ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key %s: %w", file, err)
+	}
+	return signer, nil
+}
+
+// ParseSFTPOptions reads SFTP options from an sftp://user@host/path URL.
+// Supported parameters are key, known_hosts, host_key and timeout. The key
+// passphrase is read from GUARD_SFTP_KEY_PASSPHRASE and the key file
+// defaults to GUARD_SFTP_KEY.
+func ParseSFTPOptions(u *url.URL) (SFTPOptions, error) {
+	opts := SFTPOptions{
+		User:          u.User.Username(),
+		KeyFile:       os.Getenv("GUARD_SFTP_KEY"),
+		KeyPassphrase: os.Getenv("GUARD_SFTP_KEY_PASSPHRASE"),
+	}
+	q := u.Query()
+	if v := q.Get("key"); v != "" {
+		opts.KeyFile = v
+	}
+	if v := q.Get("known_hosts"); v != "" {
+		opts.KnownHostsFile = v
+	}
+	if v := q.Get("host_key"); v != "" {
+		opts.HostKeyFingerprint = v
+	}
+	if v := q.Get("timeout"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid timeout %q in storage location %s", v, u.Redacted())
+		}
+		opts.Timeout = timeout
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		return opts, fmt.Errorf("passwords are not supported in storage location %s, use a key or the SSH agent", u.Redacted())
+	}
+	return opts, nil
+}
+
+// openSFTP opens an SFTP backend for sftp://user@host:port/path URLs
+func openSFTP(ctx context.Context, u *url.URL) (Backend, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in storage location %s", u.Redacted())
+	}
+	opts, err := ParseSFTPOptions(u)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	return NewSFTPClient(ctx, addr, u.Path, opts)
+}
+
+// Put uploads r to a temporary file next to the object and renames it into
+// place, so readers never see a partial object
+func (c *SFTPClient) Put(ctx context.Context, key string, r io.Reader) error {
+	destPath, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	if err := c.client.MkdirAll(path.Dir(destPath)); err != nil {
+		return fmt.Errorf("failed to create %s on %s: %w", path.Dir(destPath), c.host, err)
+	}
+
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	tmpPath := path.Join(path.Dir(destPath), "."+path.Base(destPath)+".tmp-"+hex.EncodeToString(suffix))
+	tmp, err := c.client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("failed to create %s on %s: %w", tmpPath, c.host, err)
+	}
+	defer c.client.Remove(tmpPath)
+
+	if _, err := tmp.ReadFrom(r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to upload %s to %s: %w", key, c.host, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := c.rename(tmpPath, destPath); err != nil {
+		return fmt.Errorf("failed to move %s into place on %s: %w", key, c.host, err)
+	}
+
+	customLog.Infof("Successfully uploaded %s to %s:%s", key, c.host, destPath)
+	return nil
+}
+
+// rename replaces newPath atomically where the server supports it
+func (c *SFTPClient) rename(oldPath, newPath string) error {
+	if _, ok := c.client.HasExtension("posix-rename@openssh.com"); ok {
+		return c.client.PosixRename(oldPath, newPath)
+	}
+	// Plain SFTP rename fails if the target exists
+	if err := c.client.Rename(oldPath, newPath); err == nil {
+		return nil
+	}
+	if err := c.client.Remove(newPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return c.client.Rename(oldPath, newPath)
+}
+
+// Get opens the object stored under key
+func (c *SFTPClient) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return c.GetRange(ctx, key, 0, -1)
+}
+
+// GetRange opens length bytes of the object stored under key starting at
+// offset. A negative length reads to the end of the object.
+func (c *SFTPClient) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := c.client.Open(p)
+	if err != nil {
+		return nil, c.wrapErr(key, err)
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+// List returns the objects below the directory whose keys start with
+// prefix
+func (c *SFTPClient) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	walker := c.client.Walk(c.directory)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, fs.ErrNotExist) && walker.Path() == c.directory {
+				return nil, nil
+			}
+			customLog.Errorf("Failed to list %s on %s: %v", c.directory, c.host, err)
+			return nil, err
+		}
+		info := walker.Stat()
+		if info.IsDir() {
+			continue
+		}
+		key := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), c.directory), "/")
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(path.Base(key), ".") {
+			continue
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	}
+
+	sortObjects(objects)
+	return objects, nil
+}
+
+// Stat returns the metadata of the object stored under key
+func (c *SFTPClient) Stat(ctx context.Context, key string) (*Object, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.client.Stat(p)
+	if err != nil {
+		return nil, c.wrapErr(key, err)
+	}
+	return &Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the object stored under key
+func (c *SFTPClient) Delete(ctx context.Context, key string) error {
+	p, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	if err := c.client.Remove(p); err != nil {
+		return c.wrapErr(key, err)
+	}
+	customLog.Infof("Deleted %s from %s", p, c.host)
+	return nil
+}
+
+// Exists reports whether an object is stored under key
+func (c *SFTPClient) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := c.Stat(ctx, key)
+	if errors.Is(err, ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// URL returns the sftp:// location of the backend
+func (c *SFTPClient) URL() string {
+	return (&url.URL{Scheme: "sftp", User: url.User(c.user), Host: c.host, Path: c.directory}).String()
+}
+
+// Close ends the SFTP session and the SSH connection
+func (c *SFTPClient) Close() error {
+	c.client.Close()
+	if c.agent != nil {
+		c.agent.Close()
+	}
+	return c.ssh.Close()
+}
+
+// path maps a key to a file below the directory
+func (c *SFTPClient) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return path.Join(c.directory, clean), nil
+}
+
+// wrapErr maps missing files to ErrNotExist
+func (c *SFTPClient) wrapErr(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s: %w", key, ErrNotExist)
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Server-side encryption modes
+const (
+	// SSEAES256 encrypts with keys managed by the storage service
+	SSEAES256 = "aes256"
+	// SSEKMS encrypts with a key managed by AWS KMS
+	SSEKMS = "kms"
+	// SSEC encrypts with a key supplied by the client on every request
+	SSEC = "c"
+)
+
+// Encryption describes the server-side encryption of the objects a backend
+// writes
+type Encryption struct {
+	Mode string
+	// KMSKeyID is the KMS key of SSEKMS, empty for the default key
+	KMSKeyID string
+	// KeyMD5 identifies the customer key of SSEC without revealing it
+	KeyMD5 string
+}
+
+// Encrypter is implemented by backends that encrypt objects server-side
+type Encrypter interface {
+	// Encryption returns the encryption of new objects, nil if the backend
+	// does not request any
+	Encryption() *Encryption
+}
+
+// sse holds the server-side encryption settings of an S3 client
+type sse struct {
+	mode     string
+	kmsKeyID string
+	// key and keyMD5 are the base64 encoded customer key and its MD5
+	key    string
+	keyMD5 string
+}
+
+// newSSE validates the server-side encryption options. The customer key is
+// read from SSECustomerKeyFile, which holds the 32 byte key raw or base64
+// encoded, or from SSECustomerKey, base64 encoded.
+func newSSE(opts S3Options) (*sse, error) {
+	mode := strings.ToLower(opts.SSE)
+	switch mode {
+	case "":
+		if opts.SSEKMSKeyID != "" || opts.SSECustomerKey != "" || opts.SSECustomerKeyFile != "" {
+			return nil, fmt.Errorf("encryption keys require an sse mode")
+		}
+		return nil, nil
+	case SSEAES256:
+		return &sse{mode: mode}, nil
+	case SSEKMS:
+		return &sse{mode: mode, kmsKeyID: opts.SSEKMSKeyID}, nil
+	case SSEC:
+		key, err := customerKey(opts)
+		if err != nil {
+			return nil, err
+		}
+		sum := md5.Sum(key)
+		return &sse{
+			mode:   mode,
+			key:    base64.StdEncoding.EncodeToString(key),
+			keyMD5: base64.StdEncoding.EncodeToString(sum[:]),
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid sse mode %q, expected aes256, kms or c", opts.SSE)
+}
+
+// customerKey reads the 32 byte SSE-C key
+func customerKey(opts S3Options) ([]byte, error) {
+	encoded := opts.SSECustomerKey
+	if opts.SSECustomerKeyFile != "" {
+		data, err := os.ReadFile(opts.SSECustomerKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the sse customer key: %w", err)
+		}
+		if len(data) == 32 {
+			return data, nil
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("sse mode c requires a customer key")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("the sse customer key must be 32 bytes, raw or base64 encoded")
+	}
+	return key, nil
+}
+
+// Encryption returns the server-side encryption of new objects
+func (c *S3Client) Encryption() *Encryption {
+	if c.sse == nil {
+		return nil
+	}
+	return &Encryption{Mode: c.sse.mode, KMSKeyID: c.sse.kmsKeyID, KeyMD5: c.sse.keyMD5}
+}
+
+// serverSide returns the encryption headers of writes using AES256 or KMS
+func (c *S3Client) serverSide() (types.ServerSideEncryption, *string) {
+	switch {
+	case c.sse == nil:
+		return "", nil
+	case c.sse.mode == SSEAES256:
+		return types.ServerSideEncryptionAes256, nil
+	case c.sse.mode == SSEKMS && c.sse.kmsKeyID != "":
+		return types.ServerSideEncryptionAwsKms, aws.String(c.sse.kmsKeyID)
+	case c.sse.mode == SSEKMS:
+		return types.ServerSideEncryptionAwsKms, nil
+	}
+	return "", nil
+}
+
+// customer returns the algorithm, key and key MD5 that every request on an
+// SSE-C object must carry, all nil unless the client uses SSE-C
+func (c *S3Client) customer() (algorithm, key, keyMD5 *string) {
+	if c.sse == nil || c.sse.mode != SSEC {
+		return nil, nil, nil
+	}
+	return aws.String("AES256"), aws.String(c.sse.key), aws.String(c.sse.keyMD5)
+}
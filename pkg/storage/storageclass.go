@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// maxCopySize is the largest object S3 copies in a single request
+const maxCopySize = 5 << 30
+
+// restoreHeader matches the x-amz-restore header of a HeadObject response
+var restoreHeader = regexp.MustCompile(`ongoing-request="(true|false)"(?:,\s*expiry-date="([^"]+)")?`)
+
+// parseStorageClass parses an S3 storage class, case-insensitively
+func parseStorageClass(class string) (types.StorageClass, error) {
+	if class == "" {
+		return "", nil
+	}
+	for _, c := range types.StorageClass("").Values() {
+		if strings.EqualFold(string(c), class) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("invalid storage class %q", class)
+}
+
+// isArchiveClass reports whether objects in class must be restored before
+// they can be read
+func isArchiveClass(class types.StorageClass) bool {
+	return class == types.StorageClassGlacier || class == types.StorageClassDeepArchive
+}
+
+// ArchiveStatus returns the storage class of the object stored under key
+// and whether it is archived, being restored or restored
+func (c *S3Client) ArchiveStatus(ctx context.Context, key string) (*ArchiveStatus, error) {
+	out, err := c.client.HeadObject(ctx, c.headInput(key))
+	if err != nil {
+		return nil, c.wrapErr(key, err)
+	}
+
+	class := types.StorageClass(out.StorageClass)
+	if class == "" {
+		class = types.StorageClassStandard
+	}
+	status := &ArchiveStatus{
+		Class:    string(class),
+		Archived: isArchiveClass(class) || out.ArchiveStatus != "",
+	}
+	if m := restoreHeader.FindStringSubmatch(aws.ToString(out.Restore)); m != nil {
+		status.Restoring = m[1] == "true"
+		if m[1] == "false" {
+			status.Restored = true
+			status.RestoredUntil, _ = time.Parse(time.RFC1123, m[2])
+		}
+	}
+	return status, nil
+}
+
+// SetStorageClass moves the object stored under key to another storage
+// class by copying it onto itself. In versioned buckets the previous
+// version is kept as a noncurrent version.
+func (c *S3Client) SetStorageClass(ctx context.Context, key, class string) error {
+	storageClass, err := parseStorageClass(class)
+	if err != nil {
+		return err
+	}
+	if storageClass == "" {
+		storageClass = types.StorageClassStandard
+	}
+	obj, err := c.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	objectKey := c.objectKey(key)
+	source := c.bucket + "/" + (&url.URL{Path: objectKey}).EscapedPath()
+	mode, retainUntil := c.retention()
+	encryption, kmsKeyID := c.serverSide()
+	algorithm, customerKey, customerKeyMD5 := c.customer()
+	if obj.Size <= maxCopySize {
+		_, err = c.client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:                         aws.String(c.bucket),
+			Key:                            aws.String(objectKey),
+			CopySource:                     aws.String(source),
+			MetadataDirective:              types.MetadataDirectiveCopy,
+			ChecksumAlgorithm:              types.ChecksumAlgorithmSha256,
+			StorageClass:                   storageClass,
+			ObjectLockMode:                 mode,
+			ObjectLockRetainUntilDate:      retainUntil,
+			ServerSideEncryption:           encryption,
+			SSEKMSKeyId:                    kmsKeyID,
+			SSECustomerAlgorithm:           algorithm,
+			SSECustomerKey:                 customerKey,
+			SSECustomerKeyMD5:              customerKeyMD5,
+			CopySourceSSECustomerAlgorithm: algorithm,
+			CopySourceSSECustomerKey:       customerKey,
+			CopySourceSSECustomerKeyMD5:    customerKeyMD5,
+		})
+	} else {
+		err = c.copyMultipart(ctx, objectKey, source, obj.Size, storageClass)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move %s to %s: %w", key, storageClass, c.wrapErr(key, err))
+	}
+	customLog.Infof("Moved %s in S3 bucket %s to %s", objectKey, c.bucket, storageClass)
+	return nil
+}
+
+// copyMultipart copies an object larger than 5 GiB onto objectKey in parts
+func (c *S3Client) copyMultipart(ctx context.Context, objectKey, source string, size int64, class types.StorageClass) error {
+	out, err := c.client.CreateMultipartUpload(ctx, c.createUploadInput(objectKey, class))
+	if err != nil {
+		return err
+	}
+	uploadID := out.UploadId
+
+	algorithm, customerKey, customerKeyMD5 := c.customer()
+	partSize := c.partSizeFor(size)
+	partCount := int((size + partSize - 1) / partSize)
+	completed := make([]types.CompletedPart, partCount)
+	err = forEachPart(ctx, partCount, c.concurrency, func(ctx context.Context, i int) error {
+		first := int64(i) * partSize
+		last := min(first+partSize, size) - 1
+		part, err := c.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:                         aws.String(c.bucket),
+			Key:                            aws.String(objectKey),
+			UploadId:                       uploadID,
+			PartNumber:                     aws.Int32(int32(i + 1)),
+			CopySource:                     aws.String(source),
+			CopySourceRange:                aws.String(fmt.Sprintf("bytes=%d-%d", first, last)),
+			SSECustomerAlgorithm:           algorithm,
+			SSECustomerKey:                 customerKey,
+			SSECustomerKeyMD5:              customerKeyMD5,
+			CopySourceSSECustomerAlgorithm: algorithm,
+			CopySourceSSECustomerKey:       customerKey,
+			CopySourceSSECustomerKeyMD5:    customerKeyMD5,
+		})
+		if err != nil {
+			return err
+		}
+		completed[i] = types.CompletedPart{
+			ETag:           part.CopyPartResult.ETag,
+			ChecksumSHA256: part.CopyPartResult.ChecksumSHA256,
+			PartNumber:     aws.Int32(int32(i + 1)),
+		}
+		return nil
+	})
+	if err == nil {
+		_, err = c.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(c.bucket),
+			Key:             aws.String(objectKey),
+			UploadId:        uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		})
+	}
+	if err != nil {
+		c.client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(c.bucket),
+			Key:      aws.String(objectKey),
+			UploadId: uploadID,
+		})
+	}
+	return err
+}
+
+// Restore requests a readable copy of an archived object for days days
+// using the Standard, Bulk or Expedited retrieval tier. A restore that is
+// already in progress is not an error.
+func (c *S3Client) Restore(ctx context.Context, key string, days int, tier string) error {
+	var retrievalTier types.Tier
+	for _, t := range types.Tier("").Values() {
+		if strings.EqualFold(string(t), tier) {
+			retrievalTier = t
+		}
+	}
+	if retrievalTier == "" {
+		return fmt.Errorf("invalid retrieval tier %q, expected Standard, Bulk or Expedited", tier)
+	}
+
+	_, err := c.client.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.objectKey(key)),
+		RestoreRequest: &types.RestoreRequest{
+			Days:                 aws.Int32(int32(days)),
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: retrievalTier},
+		},
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	if err != nil {
+		return c.wrapErr(key, err)
+	}
+	customLog.Infof("Requested a %s restore of %s in S3 bucket %s", retrievalTier, c.objectKey(key), c.bucket)
+	return nil
+}
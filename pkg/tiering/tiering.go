@@ -0,0 +1,313 @@
+package tiering
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/logger"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/Annany2002/guard/pkg/transfer"
+)
+
+var customLog = logger.NewLogger()
+
+// storageClass matches stage targets that name a storage class
+var storageClass = regexp.MustCompile(`^[A-Z][A-Z_]*$`)
+
+// coldness orders S3 storage classes from hot to cold. Backups only move to
+// colder classes.
+var coldness = map[string]int{
+	"STANDARD":            0,
+	"REDUCED_REDUNDANCY":  0,
+	"INTELLIGENT_TIERING": 1,
+	"STANDARD_IA":         2,
+	"ONEZONE_IA":          2,
+	"GLACIER_IR":          3,
+	"GLACIER":             4,
+	"DEEP_ARCHIVE":        5,
+}
+
+// Stage moves backups older than After to another storage location, or to
+// another storage class in the current location
+type Stage struct {
+	After    time.Duration
+	Location string
+	Class    string
+}
+
+// ParseStage parses a stage given as AGE:TARGET, where TARGET is a storage
+// location such as s3://bucket/prefix or an upper case storage class such
+// as GLACIER, for example "7d:s3://backups/prod" or "30d:GLACIER"
+func ParseStage(spec string) (Stage, error) {
+	age, target, ok := strings.Cut(spec, ":")
+	if !ok || target == "" {
+		return Stage{}, fmt.Errorf("invalid stage %q, expected AGE:LOCATION or AGE:CLASS", spec)
+	}
+	after, err := retention.ParseDuration(age)
+	if err != nil {
+		return Stage{}, fmt.Errorf("invalid stage %q: %w", spec, err)
+	}
+	if storageClass.MatchString(target) {
+		return Stage{After: after, Class: target}, nil
+	}
+	return Stage{After: after, Location: target}, nil
+}
+
+// Policy moves backups written to Source through the stages by age
+type Policy struct {
+	Source string
+	Stages []Stage
+}
+
+// step is where a backup belongs once it reaches a stage: an index into
+// the locations of the policy and a storage class, empty for the default
+type step struct {
+	after    time.Duration
+	location int
+	class    string
+}
+
+// Validate checks that the stages are ordered by age and do not revisit a
+// location
+func (p Policy) Validate() error {
+	_, _, err := p.steps()
+	return err
+}
+
+// steps returns the locations of the policy, Source first, and the step
+// of each stage
+func (p Policy) steps() ([]string, []step, error) {
+	if p.Source == "" {
+		return nil, nil, errors.New("no source location")
+	}
+	locations := []string{p.Source}
+	steps := make([]step, 0, len(p.Stages))
+	current := step{}
+	for i, stage := range p.Stages {
+		if i > 0 && stage.After <= p.Stages[i-1].After {
+			return nil, nil, fmt.Errorf("stage %s must be older than the stage before it", stage.After)
+		}
+		if stage.Location != "" {
+			for _, l := range locations {
+				if l == stage.Location {
+					return nil, nil, fmt.Errorf("location %s appears twice in the policy", l)
+				}
+			}
+			locations = append(locations, stage.Location)
+			current = step{location: len(locations) - 1}
+		} else {
+			if _, ok := coldness[stage.Class]; !ok {
+				return nil, nil, fmt.Errorf("unknown storage class %s", stage.Class)
+			}
+			if current.class != "" && coldness[stage.Class] <= coldness[current.class] {
+				return nil, nil, fmt.Errorf("storage class %s is not colder than %s", stage.Class, current.class)
+			}
+			current.class = stage.Class
+		}
+		current.after = stage.After
+		steps = append(steps, current)
+	}
+	return locations, steps, nil
+}
+
+// Action is a move of a backup to another location or storage class
+type Action struct {
+	Backup retention.Backup
+	// From is the location holding the backup
+	From string
+	// To is the location the backup moves to, empty for a storage class
+	// change within From
+	To string
+	// Class is the storage class the backup moves to, empty for the
+	// default class of To
+	Class string
+	// Done is set once the action has been carried out
+	Done bool
+	// Skipped explains why a due action was not carried out
+	Skipped string
+}
+
+// Options configures a tiering run
+type Options struct {
+	// Database limits tiering to the backups of one database
+	Database string
+	// DryRun reports what would be moved without moving anything
+	DryRun bool
+	// Now is the reference time for backup ages, default time.Now()
+	Now time.Time
+}
+
+// Apply moves every backup in the locations of the policy to the location
+// and storage class of the oldest stage it has reached. Backups never move
+// back to an earlier location or a warmer class. A move copies the artifact
+// and then its manifest, verifies the copy and deletes the source; locked
+// and archived sources are skipped. Manifests stay in the default class so
+// that backups can still be listed. Failures are returned together after
+// every backup has been tried.
+func Apply(ctx context.Context, p Policy, opts Options) ([]Action, error) {
+	locations, steps, err := p.steps()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+
+	backends := make([]storage.Backend, len(locations))
+	defer func() {
+		for _, b := range backends {
+			if b != nil {
+				storage.Close(b)
+			}
+		}
+	}()
+	for i, location := range locations {
+		if backends[i], err = storage.Open(ctx, location); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range steps {
+		if _, ok := backends[s.location].(storage.Archiver); s.class != "" && !ok {
+			return nil, fmt.Errorf("%s does not support storage classes", backends[s.location].URL())
+		}
+	}
+
+	var (
+		actions []Action
+		errs    []error
+	)
+	for i, b := range backends {
+		backups, err := retention.Scan(ctx, b, opts.Database)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, backup := range backups {
+			target, ok := stepFor(steps, opts.Now.Sub(backup.Manifest.CreatedAt))
+			if !ok || target.location < i {
+				continue
+			}
+			action := Action{Backup: backup, From: b.URL(), Class: target.class}
+			if target.location > i {
+				action.To = backends[target.location].URL()
+			} else if target.class == "" {
+				continue
+			}
+
+			if backup.Manifest.Erasure != nil {
+				// Shards are placed by the erasure scheme, not by tiering
+				action.Skipped = "erasure coded"
+				actions = append(actions, action)
+				continue
+			}
+			if backup.Manifest.Deduplicated() {
+				// Chunks are shared with other backups
+				action.Skipped = "deduplicated"
+				actions = append(actions, action)
+				continue
+			}
+
+			var err error
+			switch {
+			case action.To != "":
+				err = move(ctx, b, backends[target.location], &action, opts)
+			default:
+				err = transition(ctx, b, &action, opts)
+			}
+			if err != nil {
+				customLog.Errorf("Failed to tier %s: %v", storage.JoinURL(b, backup.Key), err)
+				errs = append(errs, err)
+			}
+			if action.Done || action.Skipped != "" || (opts.DryRun && (action.To != "" || action.Class != "")) {
+				actions = append(actions, action)
+			}
+		}
+	}
+	return actions, errors.Join(errs...)
+}
+
+// stepFor returns the step of the oldest stage a backup of this age has
+// reached
+func stepFor(steps []step, age time.Duration) (step, bool) {
+	var (
+		found step
+		ok    bool
+	)
+	for _, s := range steps {
+		if age >= s.after {
+			found, ok = s, true
+		}
+	}
+	return found, ok
+}
+
+// transition moves a backup's artifact to a colder storage class
+func transition(ctx context.Context, b storage.Backend, action *Action, opts Options) error {
+	archiver := b.(storage.Archiver)
+	status, err := archiver.ArchiveStatus(ctx, action.Backup.Key)
+	if err != nil {
+		return err
+	}
+	if coldness[status.Class] >= coldness[action.Class] {
+		// Already there or colder
+		action.Class = ""
+		return nil
+	}
+	if opts.DryRun {
+		customLog.Infof("Would move %s from %s to %s", storage.JoinURL(b, action.Backup.Key), status.Class, action.Class)
+		return nil
+	}
+	if err := archiver.SetStorageClass(ctx, action.Backup.Key, action.Class); err != nil {
+		return err
+	}
+	action.Done = true
+	return nil
+}
+
+// move copies a backup to another location, optionally changes its storage
+// class there and deletes the source
+func move(ctx context.Context, from, to storage.Backend, action *Action, opts Options) error {
+	key := action.Backup.Key
+	if lock, err := retention.ActiveLock(ctx, from, key, opts.Now); err != nil {
+		return err
+	} else if lock != nil {
+		action.Skipped = "locked: " + lock.String()
+		customLog.Infof("Keeping %s in place (%s)", storage.JoinURL(from, key), action.Skipped)
+		return nil
+	}
+	if archiver, ok := from.(storage.Archiver); ok {
+		status, err := archiver.ArchiveStatus(ctx, key)
+		if err != nil {
+			return err
+		}
+		if status.Archived && !status.Restored {
+			action.Skipped = "archived in " + status.Class
+			customLog.Infof("Keeping %s in place (%s)", storage.JoinURL(from, key), action.Skipped)
+			return nil
+		}
+	}
+	if opts.DryRun {
+		customLog.Infof("Would move %s to %s", storage.JoinURL(from, key), storage.JoinURL(to, key))
+		return nil
+	}
+
+	if err := transfer.Copy(ctx, from, to, action.Backup); err != nil {
+		return err
+	}
+	if action.Class != "" {
+		if err := to.(storage.Archiver).SetStorageClass(ctx, key, action.Class); err != nil {
+			return err
+		}
+	}
+	if err := retention.DeleteBackup(ctx, from, key); err != nil {
+		return fmt.Errorf("copied to %s but failed to delete the source: %w", to.URL(), err)
+	}
+	customLog.Infof("Moved %s to %s", storage.JoinURL(from, key), storage.JoinURL(to, key))
+	action.Done = true
+	return nil
+}
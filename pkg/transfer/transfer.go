@@ -0,0 +1,300 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/dedup"
+	"github.com/Annany2002/guard/pkg/logger"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+var customLog = logger.NewLogger()
+
+// Selector picks the backups to transfer. Zero fields match everything.
+type Selector struct {
+	Database string
+	ID       string
+	// Since matches backups younger than this
+	Since time.Duration
+	// Before matches backups older than this
+	Before time.Duration
+}
+
+// ParseSelector parses a selector such as "db=orders,since=30d". Supported
+// keys are db, id, since and before.
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(term, "=")
+		if !ok || value == "" {
+			return sel, fmt.Errorf("invalid selector %q, expected key=value", term)
+		}
+		var err error
+		switch key {
+		case "db", "database":
+			sel.Database = value
+		case "id":
+			sel.ID = value
+		case "since":
+			sel.Since, err = retention.ParseDuration(value)
+		case "before":
+			sel.Before, err = retention.ParseDuration(value)
+		default:
+			return sel, fmt.Errorf("unknown selector key %q, expected db, id, since or before", key)
+		}
+		if err != nil {
+			return sel, fmt.Errorf("invalid selector %q: %w", term, err)
+		}
+	}
+	return sel, nil
+}
+
+// Matches reports whether a backup created at m.CreatedAt is selected
+func (s Selector) Matches(m *manifest.Manifest, now time.Time) bool {
+	age := now.Sub(m.CreatedAt)
+	return (s.Database == "" || m.Database == s.Database) &&
+		(s.ID == "" || m.ID == s.ID) &&
+		(s.Since == 0 || age <= s.Since) &&
+		(s.Before == 0 || age >= s.Before)
+}
+
+// Options configures a transfer
+type Options struct {
+	Select Selector
+	// DeleteSource deletes every verified copy from the source
+	DeleteSource bool
+	// DryRun reports what would be transferred without copying anything
+	DryRun bool
+	// Now is the reference time for the selector, default time.Now()
+	Now time.Time
+}
+
+// Item is the outcome of transferring one backup
+type Item struct {
+	Backup retention.Backup
+	// Copied is set once the backup is verified at the destination,
+	// including backups that were already there
+	Copied bool
+	// Deleted is set once the source copy has been deleted
+	Deleted bool
+	// Skipped explains why a backup was not transferred or its source not
+	// deleted
+	Skipped string
+}
+
+// Transfer copies the selected backups from one backend to another. Every
+// artifact is streamed to the destination, read back and its SHA-256
+// compared with the manifest before the manifest is copied; a copy that does
+// not verify is deleted again. Deduplicated backups are copied chunk by
+// chunk as in CopyDeduplicated. Backups whose manifest is already at the
+// destination are only verified. With DeleteSource the source copy of every
+// verified backup is deleted unless it is locked. Failures are returned
+// together after every backup has been tried.
+func Transfer(ctx context.Context, from, to storage.Backend, opts Options) ([]Item, error) {
+	if from.URL() == to.URL() {
+		return nil, fmt.Errorf("source and destination are both %s", from.URL())
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	backups, err := retention.Scan(ctx, from, opts.Select.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		items []Item
+		errs  []error
+	)
+	for _, backup := range backups {
+		if !opts.Select.Matches(backup.Manifest, opts.Now) {
+			continue
+		}
+		item := Item{Backup: backup}
+		if opts.DryRun {
+			customLog.Infof("Would transfer %s to %s", storage.JoinURL(from, backup.Key), storage.JoinURL(to, backup.Key))
+			items = append(items, item)
+			continue
+		}
+		if err := transfer(ctx, from, to, &item, opts); err != nil {
+			customLog.Errorf("Failed to transfer %s: %v", storage.JoinURL(from, backup.Key), err)
+			errs = append(errs, err)
+		}
+		items = append(items, item)
+	}
+	return items, errors.Join(errs...)
+}
+
+func transfer(ctx context.Context, from, to storage.Backend, item *Item, opts Options) error {
+	key := item.Backup.Key
+	if item.Backup.Manifest.Erasure != nil {
+		item.Skipped = "erasure coded"
+		customLog.Warnf("Skipping %s, erasure-coded backups are only stored as shards", storage.JoinURL(from, key))
+		return nil
+	}
+	// Deduplicated backups have no artifact, and their chunks are never
+	// archived
+	if archiver, ok := from.(storage.Archiver); ok && !item.Backup.Manifest.Deduplicated() {
+		status, err := archiver.ArchiveStatus(ctx, key)
+		if err != nil {
+			return err
+		}
+		if status.Archived && !status.Restored {
+			item.Skipped = "archived in " + status.Class
+			customLog.Warnf("Skipping %s (%s), restore it first", storage.JoinURL(from, key), item.Skipped)
+			return nil
+		}
+	}
+
+	copyBackup := Copy
+	if item.Backup.Manifest.Deduplicated() {
+		copyBackup = CopyDeduplicated
+	}
+	if err := copyBackup(ctx, from, to, item.Backup); err != nil {
+		return err
+	}
+	item.Copied = true
+	if !opts.DeleteSource {
+		return nil
+	}
+
+	if lock, err := retention.ActiveLock(ctx, from, key, opts.Now); err != nil {
+		return err
+	} else if lock != nil {
+		item.Skipped = "source locked: " + lock.String()
+		customLog.Infof("Keeping %s (%s)", storage.JoinURL(from, key), item.Skipped)
+		return nil
+	}
+	if err := retention.DeleteBackup(ctx, from, key); err != nil {
+		return fmt.Errorf("copied to %s but failed to delete the source: %w", to.URL(), err)
+	}
+	item.Deleted = true
+	return nil
+}
+
+// Copy copies a backup and then its manifest from one backend to another
+// and verifies the SHA-256 of the copied artifact against the manifest.
+// Nothing is copied if the destination already holds a verified copy.
+func Copy(ctx context.Context, from, to storage.Backend, backup retention.Backup) error {
+	key := backup.Key
+	want := backup.Manifest.Checksum
+	if exists, err := to.Exists(ctx, manifest.PathFor(key)); err != nil {
+		return err
+	} else if exists {
+		if got, err := Checksum(ctx, to, key); err == nil && (want == "" || got == want) {
+			customLog.Infof("%s is already stored in %s", backup.Manifest.ID, to.URL())
+			return nil
+		}
+	}
+
+	streamed, err := copyObject(ctx, from, to, key)
+	if err != nil {
+		return err
+	}
+	if want != "" && streamed != want {
+		to.Delete(ctx, key)
+		return storage.ChecksumMismatch(storage.JoinURL(from, key), streamed, want)
+	}
+	got, err := Checksum(ctx, to, key)
+	if err != nil {
+		return err
+	}
+	if got != streamed {
+		to.Delete(ctx, key)
+		return fmt.Errorf("copy is corrupt: %w", storage.ChecksumMismatch(storage.JoinURL(to, key), got, streamed))
+	}
+
+	// The manifest goes last so that its presence marks a complete backup
+	if _, err := copyObject(ctx, from, to, manifest.PathFor(key)); err != nil {
+		return err
+	}
+	customLog.Infof("Copied %s to %s", storage.JoinURL(from, key), storage.JoinURL(to, key))
+	return nil
+}
+
+// CopyDeduplicated copies the chunks of a deduplicated backup that the
+// destination lacks and then its manifest, holding a lock on the
+// destination so that garbage collection keeps the chunks in between.
+// Every chunk at the destination is read back and checked against its hash
+// before the manifest is copied. Nothing is copied if the destination
+// already holds the manifest and every chunk.
+func CopyDeduplicated(ctx context.Context, from, to storage.Backend, backup retention.Backup) error {
+	m := backup.Manifest
+	manifestKey := manifest.PathFor(backup.Key)
+	if exists, err := to.Exists(ctx, manifestKey); err != nil {
+		return err
+	} else if exists {
+		if report, err := dedup.Verify(ctx, to, m); err == nil && report.Healthy() {
+			customLog.Infof("%s is already stored in %s", m.ID, to.URL())
+			return nil
+		}
+	}
+
+	lock, err := dedup.Lock(ctx, to)
+	if err != nil {
+		return err
+	}
+	defer lock.Release(ctx)
+	stats, err := dedup.Copy(ctx, from, to, m)
+	if err != nil {
+		return err
+	}
+	report, err := dedup.Verify(ctx, to, m)
+	if err != nil {
+		return err
+	}
+	if !report.Healthy() {
+		return fmt.Errorf("copy of %s is incomplete, %d chunks are missing and %d corrupt in %s", m.ID, len(report.Missing), len(report.Corrupt), to.URL())
+	}
+
+	// The manifest goes last so that its presence marks a complete backup
+	if _, err := copyObject(ctx, from, to, manifestKey); err != nil {
+		return err
+	}
+	customLog.Infof("Copied %s to %s, %d new of %d chunks (%d bytes)", storage.JoinURL(from, manifestKey), to.URL(), stats.New, stats.Chunks, stats.NewBytes)
+	return nil
+}
+
+// copyObject streams an object from one backend to another and returns the
+// checksum of the streamed data
+func copyObject(ctx context.Context, from, to storage.Backend, key string) (string, error) {
+	body, err := from.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if err := to.Put(ctx, key, io.TeeReader(body, hash)); err != nil {
+		return "", err
+	}
+	return storage.FormatChecksum(hash.Sum(nil)), nil
+}
+
+// Checksum reads the object stored under key and returns its SHA-256 in
+// the manifest format
+func Checksum(ctx context.Context, b storage.Backend, key string) (string, error) {
+	body, err := b.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", storage.JoinURL(b, key), err)
+	}
+	return storage.FormatChecksum(hash.Sum(nil)), nil
+}
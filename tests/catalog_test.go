@@ -0,0 +1,218 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/catalog"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+func TestCatalog(t *testing.T) {
+	cat, err := catalog.Open(filepath.Join(t.TempDir(), "guard", "catalog.db"))
+	if err != nil {
+		t.Fatalf("Failed to open catalog: %v", err)
+	}
+	defer cat.Close()
+
+	now := time.Now()
+	for i, database := range []string{"orders", "users", "orders"} {
+		m := &manifest.Manifest{
+			ID:        database + "-" + string(rune('a'+i)),
+			Database:  database,
+			File:      database + ".sql",
+			Size:      int64(100 * (i + 1)),
+			CreatedAt: now.AddDate(0, 0, -10*i),
+			Destinations: []manifest.Destination{
+				{URL: "file:///backups", Status: manifest.StatusStored},
+				{URL: "s3://bucket", Status: manifest.StatusStored},
+			},
+		}
+		if i == 1 {
+			m.Destinations[1] = manifest.Destination{URL: "s3://bucket", Status: manifest.StatusFailed, Error: "access denied"}
+		}
+		if err := cat.Put(catalog.FromManifest(m)); err != nil {
+			t.Fatalf("Failed to add backup: %v", err)
+		}
+	}
+
+	entries, err := cat.List(catalog.Filter{Database: "orders"})
+	if err != nil || len(entries) != 2 || entries[0].ID != "orders-a" || entries[1].ID != "orders-c" {
+		t.Fatalf("Unexpected backups of orders: %+v, %v", entries, err)
+	}
+	if entries, _ := cat.List(catalog.Filter{Since: now.AddDate(0, 0, -15)}); len(entries) != 2 {
+		t.Fatalf("Expected 2 backups in the last 15 days, got %d", len(entries))
+	}
+	if entries, _ := cat.List(catalog.Filter{Status: catalog.StatusPartial}); len(entries) != 1 || entries[0].ID != "users-b" {
+		t.Fatalf("Expected users-b to be partial, got %+v", entries)
+	}
+
+	entry, err := cat.Get("users-b")
+	if err != nil || entry.Size != 200 || len(entry.Locations) != 2 || entry.Locations[1].Error != "access denied" {
+		t.Fatalf("Unexpected entry %+v: %v", entry, err)
+	}
+	if _, err := cat.Get("missing"); !errors.Is(err, catalog.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Deleting one copy keeps the backup, deleting all marks it deleted
+	cat.RemoveLocation("orders-a", "file:///backups")
+	if entry, _ := cat.Get("orders-a"); entry.Status != catalog.StatusCompleted || len(entry.Stored()) != 1 {
+		t.Fatalf("Unexpected entry after deleting one copy: %+v", entry)
+	}
+	cat.RemoveLocation("orders-a", "s3://bucket")
+	if entry, _ := cat.Get("orders-a"); entry.Status != catalog.StatusDeleted {
+		t.Fatalf("Expected orders-a to be deleted, got %s", entry.Status)
+	}
+
+	latest, err := cat.Latest("orders")
+	if err != nil || latest.ID != "orders-c" {
+		t.Fatalf("Expected the latest stored backup to be orders-c, got %+v, %v", latest, err)
+	}
+}
+
+func TestCatalogRebuildAndReconcile(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open local storage: %v", err)
+	}
+	cat, err := catalog.Open(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatalf("Failed to open catalog: %v", err)
+	}
+	defer cat.Close()
+
+	putBackup := func(id, contents string) {
+		sum := sha256.Sum256([]byte(contents))
+		m := &manifest.Manifest{
+			Version:   manifest.Version,
+			ID:        id,
+			Database:  "orders",
+			File:      "orders/" + id + ".sql",
+			Size:      int64(len(contents)),
+			Checksum:  "sha256:" + hex.EncodeToString(sum[:]),
+			CreatedAt: time.Now(),
+		}
+		var buf bytes.Buffer
+		m.Encode(&buf)
+		backend.Put(ctx, m.File, strings.NewReader(contents))
+		backend.Put(ctx, manifest.PathFor(m.File), &buf)
+	}
+	putBackup("orders-1", "first dump")
+	putBackup("orders-2", "second dump")
+	putBackup("orders-3", "third dump")
+
+	count, err := cat.Rebuild(ctx, backend)
+	if err != nil || count != 3 {
+		t.Fatalf("Expected 3 backups indexed, got %d: %v", count, err)
+	}
+	entry, err := cat.Get("orders-2")
+	if err != nil || entry.Status != catalog.StatusCompleted || len(entry.Locations) != 1 || entry.Locations[0].URL != backend.URL() {
+		t.Fatalf("Unexpected rebuilt entry %+v: %v", entry, err)
+	}
+	if issues, err := cat.Reconcile(ctx, backend, true); err != nil || len(issues) != 0 {
+		t.Fatalf("Expected no issues after rebuild, got %+v: %v", issues, err)
+	}
+
+	backend.Put(ctx, "orders/stray.sql", strings.NewReader("stray"))
+	backend.Delete(ctx, "orders/orders-1.sql")
+	backend.Put(ctx, "orders/orders-2.sql", strings.NewReader("SECOND DUMP"))
+	putBackup("orders-4", "fourth dump")
+
+	issues, err := cat.Reconcile(ctx, backend, false)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	found := make(map[string]bool)
+	for _, issue := range issues {
+		found[issue.Kind+" "+issue.Key] = true
+	}
+	for _, want := range []string{
+		"orphan orders/stray.sql",
+		"orphan orders/orders-1.sql.manifest.json",
+		"missing orders/orders-1.sql",
+		"untracked orders/orders-4.sql",
+	} {
+		if !found[want] {
+			t.Fatalf("Expected issue %q, got %+v", want, issues)
+		}
+	}
+	// Same size, different contents: only found when verifying checksums
+	if found["drift orders/orders-2.sql"] {
+		t.Fatalf("Did not expect drift without verification")
+	}
+	issues, _ = cat.Reconcile(ctx, backend, true)
+	drift := false
+	for _, issue := range issues {
+		drift = drift || (issue.Kind == catalog.IssueDrift && issue.ID == "orders-2")
+	}
+	if !drift {
+		t.Fatalf("Expected checksum drift of orders-2, got %+v", issues)
+	}
+}
+
+// failingDelete is a backend refusing to delete one key
+type failingDelete struct {
+	storage.Backend
+	key string
+}
+
+func (b *failingDelete) Delete(ctx context.Context, key string) error {
+	if key == b.key {
+		return errors.New("permission denied")
+	}
+	return b.Backend.Delete(ctx, key)
+}
+
+func TestCatalogForgetPruned(t *testing.T) {
+	ctx := context.Background()
+	local, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open local storage: %v", err)
+	}
+	cat, err := catalog.Open(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatalf("Failed to open catalog: %v", err)
+	}
+	defer cat.Close()
+
+	backups := dailyBackups("orders", time.Now(), 3)
+	for i, b := range backups {
+		b.Manifest.ID = "orders-" + string(rune('a'+i))
+		putRetentionBackup(t, local, b)
+		b.Manifest.Destinations = []manifest.Destination{{URL: local.URL(), Status: manifest.StatusStored}}
+		if err := cat.Put(catalog.FromManifest(b.Manifest)); err != nil {
+			t.Fatalf("Failed to add backup: %v", err)
+		}
+	}
+
+	// The oldest backup cannot be deleted, the one before it can
+	backend := &failingDelete{Backend: local, key: manifest.PathFor(backups[2].Key)}
+	decisions, err := retention.Prune(ctx, backend, retention.Policy{KeepLast: 1}, retention.PruneOptions{})
+	if err == nil {
+		t.Fatalf("Expected the failing delete to be reported")
+	}
+	if err := cat.ForgetPruned(backend.URL(), decisions); err != nil {
+		t.Fatalf("Failed to update the catalog: %v", err)
+	}
+
+	for id, want := range map[string]string{"orders-a": catalog.StatusCompleted, "orders-b": catalog.StatusDeleted, "orders-c": catalog.StatusCompleted} {
+		entry, err := cat.Get(id)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", id, err)
+		}
+		if entry.Status != want {
+			t.Fatalf("Expected %s to be %s, got %s", id, want, entry.Status)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/backup"
+	"github.com/Annany2002/guard/pkg/config"
+	"github.com/Annany2002/guard/pkg/jobs"
+	"github.com/Annany2002/guard/pkg/notify"
+)
+
+const guardYAML = `
+connections:
+  Orders:
+    host: db1.internal
+    port: 6432
+    username: guard
+    password_env: GUARD_TEST_ORDERS_PASSWORD
+  billing:
+    username: guard
+    password_file: %s
+    database: billing
+jobs:
+  - name: orders-nightly
+    connection: orders
+    database: orders
+    cron: "0 3 * * *"
+    storage: [s3://backups/orders, /var/backups]
+    require: any
+    filters:
+      schema: sales
+      table_prefix: order_
+    compression: gzip:9
+    retention:
+      keep_daily: 7
+      keep_within: 30d
+    notify:
+      - url: https://hooks.example.com/guard
+        on: always
+        headers:
+          Authorization: Bearer token
+  - name: billing-drill
+    connection: billing
+    task: drill
+    cron: "@weekly"
+    storage: [/var/backups]
+    assertions: ["SELECT count(*) > 0 FROM invoices"]
+`
+
+func writeConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "guard.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "billing.password")
+	if err := os.WriteFile(passwordFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write password file: %v", err)
+	}
+	t.Setenv("GUARD_TEST_ORDERS_PASSWORD", "hunter2")
+	path := writeConfig(t, dir, strings.Replace(guardYAML, "%s", passwordFile, 1))
+
+	f, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	list, err := f.Resolve()
+	if err != nil {
+		t.Fatalf("Failed to resolve jobs: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 jobs, got %d", len(list))
+	}
+
+	// Passwords are only read when a job runs, so that they stay out of
+	// the job store and rotated passwords take effect
+	orders := list[0]
+	if orders.Name != "orders-nightly" || orders.Task != jobs.TaskBackup || orders.Host != "db1.internal" || orders.Port != "6432" || orders.Password != "" || orders.PasswordEnv != "GUARD_TEST_ORDERS_PASSWORD" {
+		t.Fatalf("Unexpected connection of orders-nightly: %+v", orders)
+	}
+	if password, err := orders.ResolvePassword(); err != nil || password != "hunter2" {
+		t.Fatalf("Expected password hunter2, got %q: %v", password, err)
+	}
+	t.Setenv("GUARD_TEST_ORDERS_PASSWORD", "rotated")
+	if password, _ := orders.ResolvePassword(); password != "rotated" {
+		t.Fatalf("Expected the rotated password, got %q", password)
+	}
+	if orders.Tables != (jobs.Filter{Schema: "sales", Prefix: "order_"}) || orders.Compression != "gzip:9" || orders.Require != "any" {
+		t.Fatalf("Unexpected options of orders-nightly: %+v", orders)
+	}
+	if orders.Retention.KeepDaily != 7 || orders.Retention.KeepWithin != "30d" || len(orders.Storage) != 2 {
+		t.Fatalf("Unexpected retention or storage of orders-nightly: %+v", orders)
+	}
+	if len(orders.Notify) != 1 || orders.Notify[0].On != notify.OnAlways || orders.Notify[0].Headers["authorization"] != "Bearer token" {
+		t.Fatalf("Unexpected notifications of orders-nightly: %+v", orders.Notify)
+	}
+
+	drill := list[1]
+	if drill.Task != jobs.TaskDrill || drill.Database != "billing" || drill.Password != "" || drill.Host != "localhost" || drill.Port != "5432" {
+		t.Fatalf("Unexpected billing-drill: %+v", drill)
+	}
+	if password, err := drill.ResolvePassword(); err != nil || password != "s3cret" {
+		t.Fatalf("Expected password s3cret, got %q: %v", password, err)
+	}
+
+	// The job store holds where the passwords are, not the passwords
+	store, err := jobs.Open(filepath.Join(dir, "jobs.db"))
+	if err != nil {
+		t.Fatalf("Failed to open job store: %v", err)
+	}
+	if _, _, _, err := store.SyncConfig(path, list); err != nil {
+		t.Fatalf("Failed to sync jobs: %v", err)
+	}
+	stored, err := store.List()
+	store.Close()
+	if err != nil || len(stored) != 2 {
+		t.Fatalf("Expected 2 stored jobs, got %+v: %v", stored, err)
+	}
+	raw, _ := os.ReadFile(filepath.Join(dir, "jobs.db"))
+	if strings.Contains(string(raw), "rotated") || strings.Contains(string(raw), "s3cret") {
+		t.Fatalf("Expected the job store to hold no passwords")
+	}
+	unset := jobs.Job{PasswordEnv: "GUARD_TEST_UNSET"}
+	if _, err := unset.ResolvePassword(); err == nil {
+		t.Fatalf("Expected an unset password variable to fail the run")
+	}
+
+	for name, content := range map[string]string{
+		"unknown key":        "jobs:\n  - name: a\n    connection: c\n    database: d\n    cron: '@daily'\n    storage: [x]\n    retension: {keep_last: 1}\nconnections:\n  c: {username: u, password: p}\n",
+		"unknown connection": "jobs:\n  - name: a\n    connection: missing\n    database: d\n    cron: '@daily'\n    storage: [x]\n",
+		"missing name":       "jobs:\n  - connection: c\n    database: d\n    cron: '@daily'\n    storage: [x]\nconnections:\n  c: {username: u, password: p}\n",
+		"invalid cron":       "jobs:\n  - name: a\n    connection: c\n    database: d\n    cron: nightly\n    storage: [x]\nconnections:\n  c: {username: u, password: p}\n",
+		"two passwords":      "jobs:\n  - name: a\n    connection: c\n    database: d\n    cron: '@daily'\n    storage: [x]\nconnections:\n  c: {username: u, password: p, password_env: HOME}\n",
+		"no jobs":            "connections:\n  c: {username: u, password: p}\n",
+	} {
+		path := writeConfig(t, t.TempDir(), content)
+		f, err := config.Load(path)
+		if err == nil {
+			_, err = f.Resolve()
+		}
+		if err == nil {
+			t.Fatalf("Expected the config with %s to be rejected", name)
+		}
+	}
+}
+
+func TestJobStoreSyncConfig(t *testing.T) {
+	store, err := jobs.Open(filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatalf("Failed to open job store: %v", err)
+	}
+	defer store.Close()
+
+	manual := &jobs.Job{Task: jobs.TaskBackup, Cron: "@daily", Database: "crm", Storage: []string{"backups"}}
+	if err := store.Add(manual); err != nil {
+		t.Fatalf("Failed to add job: %v", err)
+	}
+	declared := func(cron string) []jobs.Job {
+		return []jobs.Job{
+			{Name: "orders", Task: jobs.TaskBackup, Cron: cron, Database: "orders", Storage: []string{"backups"}},
+			{Name: "billing", Task: jobs.TaskBackup, Cron: "@daily", Database: "billing", Storage: []string{"backups"}},
+		}
+	}
+
+	if added, changed, removed, err := store.SyncConfig("/etc/guard.yaml", declared("@daily")); err != nil || added != 2 || changed != 0 || removed != 0 {
+		t.Fatalf("Expected 2 added jobs, got %d, %d, %d: %v", added, changed, removed, err)
+	}
+	if added, changed, removed, err := store.SyncConfig("/etc/guard.yaml", declared("@daily")); err != nil || added+changed+removed != 0 {
+		t.Fatalf("Expected an unchanged config to change nothing, got %d, %d, %d: %v", added, changed, removed, err)
+	}
+	list, _ := store.List()
+	if len(list) != 3 || list[1].Name != "orders" || list[1].Config != "/etc/guard.yaml" {
+		t.Fatalf("Unexpected jobs %+v", list)
+	}
+	orders := list[1]
+
+	if err := store.Remove(orders.ID); !errors.Is(err, jobs.ErrDeclared) {
+		t.Fatalf("Expected a declared job not to be removed, got %v", err)
+	}
+	if err := store.Update(orders.ID, func(j *jobs.Job) { j.Paused = true }); err != nil {
+		t.Fatalf("Failed to pause job: %v", err)
+	}
+
+	// A changed job keeps its ID and stays paused, a dropped one is removed
+	if added, changed, removed, err := store.SyncConfig("/etc/guard.yaml", declared("@hourly")[:1]); err != nil || added != 0 || changed != 1 || removed != 1 {
+		t.Fatalf("Expected 1 changed and 1 removed job, got %d, %d, %d: %v", added, changed, removed, err)
+	}
+	job, err := store.Get(orders.ID)
+	if err != nil || job.Cron != "@hourly" || !job.Paused || !job.CreatedAt.Equal(orders.CreatedAt) {
+		t.Fatalf("Unexpected changed job %+v: %v", job, err)
+	}
+	list, _ = store.List()
+	if len(list) != 2 || list[0].ID != manual.ID {
+		t.Fatalf("Expected the manual job and orders to be left, got %+v", list)
+	}
+
+	invalid := declared("@daily")
+	invalid[1].Name = "orders"
+	if _, _, _, err := store.SyncConfig("/etc/guard.yaml", invalid); err == nil {
+		t.Fatalf("Expected duplicate names to be rejected")
+	}
+	if list, _ := store.List(); len(list) != 2 {
+		t.Fatalf("Expected a rejected config to change nothing, got %+v", list)
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for input, want := range map[string]backup.Compression{
+		"":       {},
+		"none":   {},
+		"gzip":   {Algorithm: backup.CompressionGzip},
+		"gzip:9": {Algorithm: backup.CompressionGzip, Level: 9},
+	} {
+		got, err := backup.ParseCompression(input)
+		if err != nil || got != want {
+			t.Fatalf("ParseCompression(%q) = %+v, %v, expected %+v", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"zstd", "gzip:0", "gzip:10", "gzip:x"} {
+		if _, err := backup.ParseCompression(input); err == nil {
+			t.Fatalf("Expected compression %q to be rejected", input)
+		}
+	}
+	if ext := (backup.Compression{Algorithm: backup.CompressionGzip}).Ext(); ext != ".gz" {
+		t.Fatalf("Expected gzip dumps to end in .gz, got %q", ext)
+	}
+	if err := (backup.Filter{Schema: "sales", Prefix: "order_"}).Validate(); err != nil {
+		t.Fatalf("Expected a valid filter: %v", err)
+	}
+	if err := (backup.Filter{Prefix: "x'; DROP TABLE y; --"}).Validate(); err == nil {
+		t.Fatalf("Expected a filter with quotes to be rejected")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var events []notify.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e notify.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events = append(events, e)
+	}))
+	defer server.Close()
+
+	headers := map[string]string{"Authorization": "Bearer token"}
+	targets := []notify.Target{
+		{URL: server.URL + "/failures", Headers: headers},
+		{URL: server.URL + "/always", On: notify.OnAlways, Headers: headers},
+	}
+	for _, target := range targets {
+		if err := target.Validate(); err != nil {
+			t.Fatalf("Expected a valid target: %v", err)
+		}
+	}
+	started := time.Now().Add(-time.Minute)
+
+	if err := notify.Send(context.Background(), targets, notify.NewEvent(1, "orders", jobs.TaskBackup, "orders", started, nil)); err != nil {
+		t.Fatalf("Failed to notify: %v", err)
+	}
+	if len(events) != 1 || events[0].Status != notify.StatusSucceeded {
+		t.Fatalf("Expected only the always target to hear of a success, got %+v", events)
+	}
+
+	failure := notify.NewEvent(1, "orders", jobs.TaskBackup, "orders", started, errors.New("connection refused"))
+	if err := notify.Send(context.Background(), targets, failure); err != nil {
+		t.Fatalf("Failed to notify: %v", err)
+	}
+	if len(events) != 3 || events[1].Error != "connection refused" || !strings.Contains(events[1].Text, "failed") {
+		t.Fatalf("Expected both targets to hear of a failure, got %+v", events)
+	}
+
+	unauthorized := []notify.Target{{URL: server.URL + "/secret-path"}}
+	err := notify.Send(context.Background(), unauthorized, failure)
+	if err == nil || strings.Contains(err.Error(), "secret-path") {
+		t.Fatalf("Expected a failed notification without the webhook path, got %v", err)
+	}
+
+	for _, invalid := range []notify.Target{{URL: "ftp://example.com"}, {URL: "https://example.com", On: "sometimes"}} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("Expected target %+v to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/backup"
+	"github.com/Annany2002/guard/pkg/catalog"
+	"github.com/Annany2002/guard/pkg/dedup"
+	"github.com/Annany2002/guard/pkg/drill"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+// chunks returns the chunks the chunker cuts data into
+func chunks(t *testing.T, data []byte, params dedup.Params) [][]byte {
+	t.Helper()
+	chunker, err := dedup.NewChunker(bytes.NewReader(data), params)
+	if err != nil {
+		t.Fatalf("Failed to create chunker: %v", err)
+	}
+	var result [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return result
+		}
+		if err != nil {
+			t.Fatalf("Failed to chunk: %v", err)
+		}
+		result = append(result, bytes.Clone(chunk))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	params := dedup.Params{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+	for _, invalid := range []dedup.Params{{Min: 1 << 10, Avg: 3 << 10, Max: 16 << 10}, {Min: 8 << 10, Avg: 4 << 10, Max: 16 << 10}, {Min: 1 << 10, Avg: 4 << 10, Max: 4 << 10}} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("Expected params %+v to be rejected", invalid)
+		}
+	}
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	original := chunks(t, data, params)
+	if !bytes.Equal(bytes.Join(original, nil), data) {
+		t.Fatalf("Chunks do not add up to the data")
+	}
+	for i, chunk := range original {
+		if len(chunk) > params.Max || (len(chunk) < params.Min && i != len(original)-1) {
+			t.Fatalf("Chunk %d has size %d outside %d-%d", i, len(chunk), params.Min, params.Max)
+		}
+	}
+	if n := len(original); n < 128 || n > 512 {
+		t.Fatalf("Expected about 256 chunks of 4 KiB, got %d", n)
+	}
+
+	// Inserting bytes only changes the chunks around the insertion
+	edited := append(bytes.Clone(data[:1000]), append([]byte("inserted row"), data[1000:]...)...)
+	seen := make(map[[32]byte]bool)
+	for _, chunk := range original {
+		seen[sha256.Sum256(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range chunks(t, edited, params) {
+		if !seen[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("Expected an insertion to change at most 2 chunks, %d changed", changed)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging")
+	os.MkdirAll(staging, 0o755)
+	local := filepath.Join(dir, "repo")
+	fake := newFakeS3(t)
+	locations := []string{local, fake.location("guard-test", "")}
+
+	dump := make([]byte, 6<<20)
+	rand.New(rand.NewSource(2)).Read(dump)
+	store := func(id, file string, data []byte) *manifest.Manifest {
+		path := filepath.Join(staging, filepath.Base(file))
+		os.WriteFile(path, data, 0o644)
+		sum := sha256.Sum256(data)
+		m := &manifest.Manifest{Version: manifest.Version, ID: id, Database: "orders", File: file, Size: int64(len(data)), Checksum: storage.FormatChecksum(sum[:]), CreatedAt: time.Now()}
+		if err := backup.Deduplicate(ctx, &backup.Result{FilePath: path, ManifestPath: manifest.PathFor(path), Manifest: m}, locations, 1, backup.Policy{}); err != nil {
+			t.Fatalf("Failed to store backup %s: %v", id, err)
+		}
+		return m
+	}
+	first := store("orders-1", "orders-1.sql", dump)
+	// The next day a few rows changed
+	changed := bytes.Clone(dump)
+	copy(changed[3<<20:], "UPDATE orders SET status = 'shipped';")
+	second := store("orders-2", "daily/orders-2.sql", changed)
+
+	b, _ := storage.Open(ctx, local)
+	stored, err := b.List(ctx, manifest.ChunkDir)
+	if err != nil {
+		t.Fatalf("Failed to list chunks: %v", err)
+	}
+	if len(first.Chunks) < 4 || len(stored) > len(first.Chunks)+2 {
+		t.Fatalf("Expected the second backup to add at most 2 chunks to %d, %d are stored", len(first.Chunks), len(stored))
+	}
+	if _, err := os.Stat(filepath.Join(local, "orders-1.sql")); !os.IsNotExist(err) {
+		t.Fatalf("Expected only chunks to be stored, got the whole backup")
+	}
+	if locks, _ := b.List(ctx, manifest.LockDir); len(locks) != 0 {
+		t.Fatalf("Expected the backups to release their locks, got %+v", locks)
+	}
+
+	// Both backups restore from every location
+	for _, location := range locations {
+		backend, _ := storage.Open(ctx, location)
+		for _, want := range []struct {
+			m    *manifest.Manifest
+			data []byte
+		}{{first, dump}, {second, changed}} {
+			path, err := drill.Fetch(ctx, backend, want.m.File, t.TempDir())
+			if err != nil {
+				t.Fatalf("Failed to restore %s from %s: %v", want.m.ID, location, err)
+			}
+			if restored, _ := os.ReadFile(path); !bytes.Equal(restored, want.data) {
+				t.Fatalf("Restored %s from %s differs from the dump", want.m.ID, location)
+			}
+		}
+	}
+
+	// Chunks are neither orphans nor drift in the catalog
+	cat, err := catalog.Open(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatalf("Failed to open catalog: %v", err)
+	}
+	defer cat.Close()
+	if _, err := cat.Rebuild(ctx, b); err != nil {
+		t.Fatalf("Failed to rebuild the catalog: %v", err)
+	}
+	if issues, err := cat.Reconcile(ctx, b, true); err != nil || len(issues) != 0 {
+		t.Fatalf("Expected no issues, got %+v, %v", issues, err)
+	}
+
+	// Pruning the first backup collects only its own chunks, once they are
+	// past the grace period
+	if err := retention.DeleteBackup(ctx, b, first.File); err != nil {
+		t.Fatalf("Failed to delete the backup: %v", err)
+	}
+	gc, err := dedup.GC(ctx, b, dedup.GCOptions{})
+	if err != nil || gc.Unreferenced == 0 || gc.Deleted != 0 {
+		t.Fatalf("Expected young chunks to be kept, got %+v, %v", gc, err)
+	}
+	gc, err = dedup.GC(ctx, b, dedup.GCOptions{DryRun: true, Now: time.Now().Add(48 * time.Hour)})
+	if err != nil || gc.Deleted != gc.Unreferenced {
+		t.Fatalf("Unexpected dry run %+v, %v", gc, err)
+	}
+	gc, err = dedup.GC(ctx, b, dedup.GCOptions{Now: time.Now().Add(48 * time.Hour)})
+	if err != nil || gc.Deleted == 0 || gc.Deleted > 2 || gc.Deleted != gc.Unreferenced {
+		t.Fatalf("Expected the chunks only used by the first backup to be deleted, got %+v, %v", gc, err)
+	}
+	report, err := dedup.Verify(ctx, b, second)
+	if err != nil || !report.Healthy() {
+		t.Fatalf("Expected the second backup to keep its chunks, got %+v, %v", report, err)
+	}
+
+	// Corrupt and missing chunks are reported
+	os.WriteFile(filepath.Join(local, filepath.FromSlash(manifest.ChunkKey(second.Chunks[0].Hash))), []byte("garbage"), 0o644)
+	os.Remove(filepath.Join(local, filepath.FromSlash(manifest.ChunkKey(second.Chunks[1].Hash))))
+	report, err = dedup.Verify(ctx, b, second)
+	if err != nil || len(report.Corrupt) != 1 || len(report.Missing) != 1 {
+		t.Fatalf("Expected one corrupt and one missing chunk, got %+v, %v", report, err)
+	}
+	if _, err := drill.Fetch(ctx, b, second.File, t.TempDir()); err == nil {
+		t.Fatalf("Expected a backup with damaged chunks to fail to restore")
+	}
+
+	// An unreadable manifest stops garbage collection
+	b.Put(ctx, manifest.PathFor(second.File), bytes.NewReader([]byte("{")))
+	if _, err := dedup.GC(ctx, b, dedup.GCOptions{Now: time.Now().Add(48 * time.Hour)}); err == nil {
+		t.Fatalf("Expected an unreadable manifest to stop garbage collection")
+	}
+}
+
+func TestDedupLock(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, err := storage.Open(ctx, dir)
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	chunk := manifest.ChunkKey("0123456789abcdef")
+	b.Put(ctx, chunk, bytes.NewReader([]byte("unreferenced")))
+	later := dedup.GCOptions{Now: time.Now().Add(48 * time.Hour)}
+
+	// A running backup keeps garbage collection from deleting chunks it
+	// found to be stored
+	lock, err := dedup.Lock(ctx, b)
+	if err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+	if _, err := dedup.GC(ctx, b, later); !errors.Is(err, dedup.ErrLocked) {
+		t.Fatalf("Expected garbage collection to fail while a backup runs, got %v", err)
+	}
+	if _, err := b.Stat(ctx, chunk); err != nil {
+		t.Fatalf("Expected the chunk to survive, got %v", err)
+	}
+	if gc, err := dedup.GC(ctx, b, dedup.GCOptions{DryRun: true, Now: later.Now}); err != nil || gc.Deleted != 1 {
+		t.Fatalf("Expected a dry run to ignore the lock, got %+v, %v", gc, err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatalf("Failed to release the lock: %v", err)
+	}
+	if gc, err := dedup.GC(ctx, b, later); err != nil || gc.Deleted != 1 {
+		t.Fatalf("Expected the chunk to be collected once the backup is done, got %+v, %v", gc, err)
+	}
+	if locks, _ := b.List(ctx, manifest.LockDir); len(locks) != 0 {
+		t.Fatalf("Expected no locks to be left, got %+v", locks)
+	}
+
+	// A backup waits for a running garbage collection
+	gcLock := filepath.Join(dir, "locks", "gc-1.json")
+	os.MkdirAll(filepath.Dir(gcLock), 0o755)
+	os.WriteFile(gcLock, []byte("{}"), 0o644)
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := dedup.Lock(short, b); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the backup to wait for garbage collection, got %v", err)
+	}
+
+	// Locks left behind by a process that died are ignored
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(gcLock, old, old)
+	lock, err = dedup.Lock(ctx, b)
+	if err != nil {
+		t.Fatalf("Expected a stale lock to be ignored, got %v", err)
+	}
+	lock.Release(ctx)
+}
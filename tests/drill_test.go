@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/drill"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+func TestDrillLatestBackup(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ctx := context.Background()
+
+	backend, err := storage.NewLocalStorage(dir)
+	if err != nil {
+		t.Fatalf("Failed to open local storage: %v", err)
+	}
+
+	backups := []struct {
+		file     string
+		database string
+		created  time.Time
+	}{
+		{"orders-1.sql", "orders", now.Add(-2 * time.Hour)},
+		{"orders-2.sql", "orders", now.Add(-1 * time.Hour)},
+		{"users/users-1.sql", "users", now},
+	}
+	for _, b := range backups {
+		m := &manifest.Manifest{Version: manifest.Version, Database: b.database, File: b.file, CreatedAt: b.created}
+		var buf bytes.Buffer
+		if err := m.Encode(&buf); err != nil {
+			t.Fatalf("Failed to encode manifest: %v", err)
+		}
+		if err := backend.Put(ctx, manifest.PathFor(b.file), &buf); err != nil {
+			t.Fatalf("Failed to store manifest: %v", err)
+		}
+	}
+
+	latest, err := drill.Latest(ctx, backend, "orders")
+	if err != nil {
+		t.Fatalf("Failed to find latest backup: %v", err)
+	}
+	if latest != "orders-2.sql" {
+		t.Fatalf("Expected orders-2.sql, got %s", latest)
+	}
+
+	latest, err = drill.Latest(ctx, backend, "")
+	if err != nil {
+		t.Fatalf("Failed to find latest backup: %v", err)
+	}
+	if latest != "users/users-1.sql" {
+		t.Fatalf("Expected users/users-1.sql, got %s", latest)
+	}
+
+	if _, err := drill.Latest(ctx, backend, "missing"); err == nil {
+		t.Fatalf("Expected an error for a database without backups")
+	}
+}
+
+func TestDrillScratchName(t *testing.T) {
+	name := drill.ScratchName("/backups/Orders-20250101T120000.sql")
+	if len(name) > 63 {
+		t.Fatalf("Scratch name exceeds PostgreSQL identifier length: %s", name)
+	}
+	for _, r := range name {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')) {
+			t.Fatalf("Scratch name contains unexpected character %q: %s", r, name)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Annany2002/guard/pkg/backup"
+	"github.com/Annany2002/guard/pkg/catalog"
+	"github.com/Annany2002/guard/pkg/erasure"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+func TestParseScheme(t *testing.T) {
+	for value, want := range map[string]erasure.Scheme{"": {}, "3+2": {Data: 3, Parity: 2}, "10+4": {Data: 10, Parity: 4}} {
+		scheme, err := erasure.ParseScheme(value)
+		if err != nil || scheme != want {
+			t.Fatalf("ParseScheme(%q) = %+v, %v; want %+v", value, scheme, err, want)
+		}
+	}
+	for _, value := range []string{"3", "3+0", "0+2", "a+b", "200+100"} {
+		if _, err := erasure.ParseScheme(value); err == nil {
+			t.Fatalf("Expected ParseScheme(%q) to fail", value)
+		}
+	}
+}
+
+func TestErasureCoding(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging")
+	os.MkdirAll(staging, 0o755)
+	var locations []string
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		locations = append(locations, filepath.Join(dir, name))
+	}
+
+	// A dump that does not divide evenly into shards
+	dump := bytes.Repeat([]byte("COPY orders FROM stdin;\n"), 1000)
+	dump = append(dump, "done"...)
+	sum := sha256.Sum256(dump)
+	file := filepath.Join(staging, "orders.sql")
+	os.WriteFile(file, dump, 0o644)
+	m := &manifest.Manifest{Version: manifest.Version, ID: "orders-1", Database: "orders", File: "orders/orders.sql", Size: int64(len(dump)), Checksum: storage.FormatChecksum(sum[:])}
+	result := &backup.Result{FilePath: file, ManifestPath: manifest.PathFor(file), Manifest: m}
+
+	scheme := erasure.Scheme{Data: 3, Parity: 2}
+	if err := backup.Disperse(ctx, result, locations[:4], 1, scheme, backup.Policy{}); err == nil {
+		t.Fatalf("Expected a scheme with more shards than locations to be rejected")
+	}
+	if err := backup.Disperse(ctx, result, locations, 1, scheme, backup.Policy{}); err != nil {
+		t.Fatalf("Failed to disperse the backup: %v", err)
+	}
+	if len(m.Erasure.Shards) != 5 {
+		t.Fatalf("Expected 5 shards, got %+v", m.Erasure)
+	}
+	for i, location := range locations {
+		if _, err := os.Stat(filepath.Join(location, "orders", "orders.sql")); !os.IsNotExist(err) {
+			t.Fatalf("Expected only shards in %s, got the whole backup", location)
+		}
+		stored, err := manifest.Read(filepath.Join(location, "orders", "orders.sql.manifest.json"))
+		if err != nil || stored.Erasure == nil || len(stored.Erasure.Shards) != 5 {
+			t.Fatalf("Expected the manifest in %s to record the shards, got %+v, %v", location, stored, err)
+		}
+		if _, err := os.Stat(filepath.Join(location, m.Erasure.Shards[i].Key)); err != nil {
+			t.Fatalf("Expected shard %d in %s: %v", i, location, err)
+		}
+	}
+
+	// The catalog points each location at its shard
+	entry := catalog.FromManifest(m)
+	for i, l := range entry.Locations {
+		if l.Key != m.Erasure.Shards[i].Key {
+			t.Fatalf("Expected location %s to hold %s, got %s", l.URL, m.Erasure.Shards[i].Key, l.Key)
+		}
+	}
+
+	restore := func() error {
+		target := filepath.Join(dir, "restored.sql")
+		os.Remove(target)
+		if err := erasure.Join(ctx, m, nil, target); err != nil {
+			return err
+		}
+		restored, _ := os.ReadFile(target)
+		if !bytes.Equal(restored, dump) {
+			t.Fatalf("Restored backup differs from the dump")
+		}
+		return nil
+	}
+	if err := restore(); err != nil {
+		t.Fatalf("Failed to restore from all shards: %v", err)
+	}
+
+	// Lose a data shard and corrupt another, any three shards still restore
+	os.Remove(filepath.Join(locations[0], m.Erasure.Shards[0].Key))
+	os.WriteFile(filepath.Join(locations[2], m.Erasure.Shards[2].Key), []byte("garbage"), 0o644)
+	if err := restore(); err != nil {
+		t.Fatalf("Failed to restore from three shards: %v", err)
+	}
+	first, err := storage.Open(ctx, locations[0])
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", locations[0], err)
+	}
+	report, err := erasure.Verify(ctx, m, []storage.Backend{first})
+	if err != nil {
+		t.Fatalf("Failed to verify the shards: %v", err)
+	}
+	statuses := []string{erasure.StatusMissing, erasure.StatusHealthy, erasure.StatusCorrupt, erasure.StatusHealthy, erasure.StatusHealthy}
+	for i, h := range report {
+		if h.Status != statuses[i] {
+			t.Fatalf("Shard %d: expected %s, got %+v", i, statuses[i], h)
+		}
+	}
+	if erasure.Healthy(report) != 3 {
+		t.Fatalf("Expected 3 healthy shards, got %d", erasure.Healthy(report))
+	}
+
+	// Losing a third shard leaves too few to restore
+	os.Remove(filepath.Join(locations[4], m.Erasure.Shards[4].Key))
+	if err := restore(); err == nil {
+		t.Fatalf("Expected a backup with two healthy shards to be unrecoverable")
+	}
+
+	// Deleting the backup removes the shard stored in a location
+	b, _ := storage.Open(ctx, locations[1])
+	if err := retention.DeleteBackup(ctx, b, m.File); err != nil {
+		t.Fatalf("Failed to delete the backup: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(locations[1], "orders")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the shard to be deleted with the backup, got %v", err)
+	}
+}
+
+func TestErasureSameBucketOnTwoEndpoints(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	east, west := newFakeS3(t), newFakeS3(t)
+	locations := []string{east.location("guard-test/prod", ""), west.location("guard-test/prod", ""), filepath.Join(dir, "local")}
+
+	dump := bytes.Repeat([]byte("INSERT INTO orders VALUES (1);\n"), 500)
+	sum := sha256.Sum256(dump)
+	file := filepath.Join(dir, "orders.sql")
+	os.WriteFile(file, dump, 0o644)
+	m := &manifest.Manifest{Version: manifest.Version, ID: "orders-1", Database: "orders", File: "orders/orders.sql", Size: int64(len(dump)), Checksum: storage.FormatChecksum(sum[:])}
+	result := &backup.Result{FilePath: file, ManifestPath: manifest.PathFor(file), Manifest: m}
+
+	// The buckets share their name but are different locations
+	if err := backup.Disperse(ctx, result, locations, 1, erasure.Scheme{Data: 2, Parity: 1}, backup.Policy{}); err != nil {
+		t.Fatalf("Failed to disperse the backup: %v", err)
+	}
+	if err := backup.Disperse(ctx, result, []string{locations[0], locations[0], locations[2]}, 1, erasure.Scheme{Data: 2, Parity: 1}, backup.Policy{}); err == nil {
+		t.Fatalf("Expected a location given twice to be rejected")
+	}
+	if m.Erasure.Shards[0].URL == m.Erasure.Shards[1].URL {
+		t.Fatalf("Expected the shard URLs to tell the endpoints apart, got %s", m.Erasure.Shards[0].URL)
+	}
+
+	var backends []storage.Backend
+	for _, location := range locations {
+		b, err := storage.Open(ctx, location)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", location, err)
+		}
+		defer storage.Close(b)
+		backends = append(backends, b)
+	}
+
+	// Without the local shard both shards on S3 have to be found
+	os.Remove(filepath.Join(locations[2], m.Erasure.Shards[2].Key))
+	target := filepath.Join(dir, "restored.sql")
+	if err := erasure.Join(ctx, m, backends, target); err != nil {
+		t.Fatalf("Failed to rebuild from the given locations: %v", err)
+	}
+	if restored, _ := os.ReadFile(target); !bytes.Equal(restored, dump) {
+		t.Fatalf("Restored backup differs from the dump")
+	}
+	// The shard URLs in the manifest reopen the right endpoints
+	if err := erasure.Join(ctx, m, nil, filepath.Join(dir, "reopened.sql")); err != nil {
+		t.Fatalf("Failed to rebuild from the shard URLs: %v", err)
+	}
+
+	report, err := erasure.Verify(ctx, m, backends)
+	if err != nil {
+		t.Fatalf("Failed to verify the shards: %v", err)
+	}
+	statuses := []string{erasure.StatusHealthy, erasure.StatusHealthy, erasure.StatusMissing}
+	for i, h := range report {
+		if h.Status != statuses[i] {
+			t.Fatalf("Shard %d: expected %s, got %+v", i, statuses[i], h)
+		}
+	}
+}
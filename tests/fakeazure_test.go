@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAzure is a minimal in-memory Azure Blob service, in the spirit of
+// Azurite, supporting staged block blobs. Requests are not authenticated.
+type fakeAzure struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	blobs  map[string][]byte
+	tiers  map[string]string
+	staged map[string]map[string][]byte
+	// failAt makes the StageBlock request with this count fail
+	failAt int
+	// stagedBlocks counts StageBlock requests
+	stagedBlocks int
+}
+
+func newFakeAzure(t *testing.T) *fakeAzure {
+	t.Helper()
+	f := &fakeAzure{
+		blobs:  make(map[string][]byte),
+		tiers:  make(map[string]string),
+		staged: make(map[string]map[string][]byte),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// location returns the storage URL of a container on the fake service,
+// authenticated with the well-known Azurite account key
+func (f *fakeAzure) location(containerAndPrefix, params string) string {
+	location := "azblob://" + containerAndPrefix + "?account=devstoreaccount1&endpoint=" + f.URL + "/devstoreaccount1"
+	if params != "" {
+		location += "&" + params
+	}
+	return location
+}
+
+func (f *fakeAzure) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 {
+		azureError(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+	containerName := parts[1]
+	q := r.URL.Query()
+
+	if len(parts) == 2 {
+		if q.Get("comp") == "list" {
+			f.list(w, containerName, q.Get("prefix"))
+			return
+		}
+		azureError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	name := containerName + "/" + parts[2]
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		f.stagedBlocks++
+		if f.stagedBlocks == f.failAt {
+			azureError(w, http.StatusBadRequest, "InjectedFailure")
+			return
+		}
+		if f.staged[name] == nil {
+			f.staged[name] = make(map[string][]byte)
+		}
+		f.staged[name][q.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			azureError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var data []byte
+		for _, id := range list.Latest {
+			block, ok := f.staged[name][id]
+			if !ok {
+				azureError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		f.blobs[name] = data
+		f.tiers[name] = r.Header.Get("x-ms-access-tier")
+		delete(f.staged, name)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet && q.Get("comp") == "blocklist":
+		if f.staged[name] == nil && f.blobs[name] == nil {
+			azureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		type block struct {
+			Name string
+			Size int64
+		}
+		var list struct {
+			XMLName           xml.Name `xml:"BlockList"`
+			UncommittedBlocks []block  `xml:"UncommittedBlocks>Block"`
+		}
+		for id, data := range f.staged[name] {
+			list.UncommittedBlocks = append(list.UncommittedBlocks, block{id, int64(len(data))})
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.blobs[name]
+		if !ok {
+			azureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		status := http.StatusOK
+		if spec := r.Header.Get("x-ms-range"); spec != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(spec, "bytes=%d-%d", &start, &end); err != nil {
+				end = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[name]; !ok {
+			azureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		azureError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeAzure) list(w http.ResponseWriter, containerName, prefix string) {
+	type properties struct {
+		ContentLength int64  `xml:"Content-Length"`
+		LastModified  string `xml:"Last-Modified"`
+		BlobType      string `xml:"BlobType"`
+	}
+	type blobItem struct {
+		Name       string
+		Properties properties
+	}
+	var result struct {
+		XMLName xml.Name   `xml:"EnumerationResults"`
+		Blobs   []blobItem `xml:"Blobs>Blob"`
+	}
+	for name, data := range f.blobs {
+		blobName := strings.TrimPrefix(name, containerName+"/")
+		if strings.HasPrefix(name, containerName+"/") && strings.HasPrefix(blobName, prefix) {
+			result.Blobs = append(result.Blobs, blobItem{blobName, properties{int64(len(data)), time.Now().UTC().Format(http.TimeFormat), "BlockBlob"}})
+		}
+	}
+	sort.Slice(result.Blobs, func(i, j int) bool { return result.Blobs[i].Name < result.Blobs[j].Name })
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func azureError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
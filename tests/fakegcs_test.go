@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCS is a minimal in-memory Cloud Storage JSON API server, in the
+// spirit of fake-gcs-server, supporting resumable uploads
+type fakeGCS struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	sessions map[string]*fakeSession
+	// failChunks makes this many upload chunks fail
+	failChunks int
+	// chunkLimit makes every chunk fail once this many were accepted
+	chunkLimit int
+	accepted   int
+}
+
+type fakeSession struct {
+	name string
+	data []byte
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	t.Helper()
+	f := &fakeGCS{objects: make(map[string][]byte), sessions: make(map[string]*fakeSession)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// location returns the storage URL of a bucket on the fake server
+func (f *fakeGCS) location(bucketAndPrefix, params string) string {
+	location := "gs://" + bucketAndPrefix + "?anonymous=true&endpoint=" + f.URL
+	if params != "" {
+		location += "&" + params
+	}
+	return location
+}
+
+func (f *fakeGCS) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.EscapedPath()
+	switch {
+	case strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		bucket, _ := url.PathUnescape(strings.TrimSuffix(strings.TrimPrefix(path, "/upload/storage/v1/b/"), "/o"))
+		id := strconv.Itoa(len(f.sessions) + 1)
+		f.sessions[id] = &fakeSession{name: bucket + "/" + r.URL.Query().Get("name")}
+		w.Header().Set("Location", f.URL+"/upload/session/"+id)
+	case strings.HasPrefix(path, "/upload/session/"):
+		f.chunk(w, r, f.sessions[strings.TrimPrefix(path, "/upload/session/")])
+	case strings.HasPrefix(path, "/storage/v1/b/"):
+		bucket, object, isObject := strings.Cut(strings.TrimPrefix(path, "/storage/v1/b/"), "/o/")
+		if !isObject {
+			bucket = strings.TrimSuffix(bucket, "/o")
+			f.list(w, bucket, r.URL.Query())
+			return
+		}
+		object, _ = url.PathUnescape(object)
+		f.object(w, r, bucket+"/"+object, object)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeGCS) chunk(w http.ResponseWriter, r *http.Request, session *fakeSession) {
+	if session == nil {
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	spec := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	span, total, _ := strings.Cut(spec, "/")
+	size, _ := strconv.Atoi(total)
+
+	if span != "*" {
+		if f.failChunks > 0 {
+			f.failChunks--
+			http.Error(w, "injected failure", http.StatusServiceUnavailable)
+			return
+		}
+		if f.chunkLimit > 0 && f.accepted >= f.chunkLimit {
+			http.Error(w, "injected failure", http.StatusServiceUnavailable)
+			return
+		}
+		var first, last int
+		fmt.Sscanf(span, "%d-%d", &first, &last)
+		if first != len(session.data) || last-first+1 != len(body) {
+			http.Error(w, "unexpected range", http.StatusBadRequest)
+			return
+		}
+		session.data = append(session.data, body...)
+		f.accepted++
+	}
+
+	if len(session.data) == size {
+		f.objects[session.name] = session.data
+		json.NewEncoder(w).Encode(map[string]string{"name": session.name, "size": total})
+		return
+	}
+	if len(session.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func (f *fakeGCS) list(w http.ResponseWriter, bucket string, q url.Values) {
+	type item struct {
+		Name    string    `json:"name"`
+		Size    string    `json:"size"`
+		Updated time.Time `json:"updated"`
+	}
+	var result struct {
+		Items []item `json:"items"`
+	}
+	for name, data := range f.objects {
+		object := strings.TrimPrefix(name, bucket+"/")
+		if strings.HasPrefix(name, bucket+"/") && strings.HasPrefix(object, q.Get("prefix")) {
+			result.Items = append(result.Items, item{object, strconv.Itoa(len(data)), time.Now()})
+		}
+	}
+	sort.Slice(result.Items, func(i, j int) bool { return result.Items[i].Name < result.Items[j].Name })
+	json.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeGCS) object(w http.ResponseWriter, r *http.Request, name, object string) {
+	data, ok := f.objects[name]
+	if !ok {
+		http.Error(w, `{"error":{"code":404,"message":"Not Found"}}`, http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Query().Get("alt") == "media":
+		status := http.StatusOK
+		if spec := r.Header.Get("Range"); spec != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(spec, "bytes=%d-%d", &start, &end); err != nil {
+				end = len(data) - 1
+			}
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.WriteHeader(status)
+		w.Write(data)
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":    object,
+			"size":    strconv.Itoa(len(data)),
+			"updated": time.Now(),
+		})
+	}
+}
@@ -0,0 +1,542 @@
+package tests
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal in-memory S3 server with path-style addressing, just
+// enough to exercise the S3 backend without network access
+type fakeS3 struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]*fakeUpload
+	// locks holds the Object Lock state of objects
+	locks  map[string]*fakeLock
+	nextID int
+	// failPart makes the next upload of this part number fail
+	failPart int
+	// partUploads counts UploadPart requests
+	partUploads int
+	// puts counts PutObject requests
+	puts int
+	// classes holds the storage class of objects not in STANDARD
+	classes map[string]string
+	// restores holds the restore state of archived objects
+	restores map[string]*fakeRestore
+	// thawPolls is how many status checks report a restore as ongoing
+	thawPolls int
+	// encryption holds the server-side encryption of objects
+	encryption map[string]*fakeSSE
+	// checksums holds the base64 SHA-256 of objects written with one,
+	// "<checksum of part checksums>-<parts>" for multipart objects
+	checksums map[string]string
+	// corruptUploads flips a byte of every uploaded body before it is
+	// checked, like a transfer error
+	corruptUploads bool
+}
+
+type fakeSSE struct {
+	algorithm string
+	kmsKeyID  string
+	// keyMD5 is the MD5 of the customer key of SSE-C objects
+	keyMD5 string
+}
+
+// sseFrom reads the encryption headers of a write request
+func sseFrom(r *http.Request) *fakeSSE {
+	sse := &fakeSSE{
+		algorithm: r.Header.Get("X-Amz-Server-Side-Encryption"),
+		kmsKeyID:  r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"),
+		keyMD5:    customerKeyMD5(r, ""),
+	}
+	if *sse == (fakeSSE{}) {
+		return nil
+	}
+	return sse
+}
+
+// customerKeyMD5 checks the SSE-C key headers of a request, or of the copy
+// source with prefix "Copy-Source-", and returns the MD5 of the key
+func customerKeyMD5(r *http.Request, prefix string) string {
+	key, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-Amz-" + prefix + "Server-Side-Encryption-Customer-Key"))
+	sum := md5.Sum(key)
+	md5Header := r.Header.Get("X-Amz-" + prefix + "Server-Side-Encryption-Customer-Key-Md5")
+	if md5Header == "" || md5Header != base64.StdEncoding.EncodeToString(sum[:]) {
+		return ""
+	}
+	return md5Header
+}
+
+// decrypts reports whether a request carries the key of an object
+func (f *fakeS3) decrypts(r *http.Request, name, prefix string) bool {
+	sse := f.encryption[name]
+	return sse == nil || sse.keyMD5 == "" || customerKeyMD5(r, prefix) == sse.keyMD5
+}
+
+type fakeRestore struct {
+	// polls left until the restore completes
+	polls int
+	days  int
+}
+
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int][]byte
+	lock      *fakeLock
+	class     string
+	sse       *fakeSSE
+	// checksum is the checksum algorithm of the parts
+	checksum string
+}
+
+type fakeLock struct {
+	mode        string
+	retainUntil time.Time
+	legalHold   string
+}
+
+// lockFrom reads the Object Lock headers of a write request
+func lockFrom(r *http.Request) *fakeLock {
+	mode := r.Header.Get("X-Amz-Object-Lock-Mode")
+	if mode == "" {
+		return nil
+	}
+	until, _ := time.Parse(time.RFC3339, r.Header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	return &fakeLock{mode: mode, retainUntil: until}
+}
+
+// newFakeS3 starts a fake S3 server and points the AWS SDK at static
+// credentials so no real configuration is picked up
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	f := &fakeS3{objects: make(map[string][]byte), uploads: make(map[string]*fakeUpload), locks: make(map[string]*fakeLock), classes: make(map[string]string), restores: make(map[string]*fakeRestore), encryption: make(map[string]*fakeSSE), checksums: make(map[string]string)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// location returns the storage URL of a bucket on the fake server
+func (f *fakeS3) location(bucketAndPrefix, params string) string {
+	location := "s3://" + bucketAndPrefix + "?path_style=true&endpoint=" + f.URL
+	if params != "" {
+		location += "&" + params
+	}
+	return location
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+	name := bucket + "/" + key
+	if f.corruptUploads && r.Method == http.MethodPut && len(body) > 0 {
+		body = append([]byte(nil), body...)
+		body[0] ^= 0xff
+	}
+	if want := r.Header.Get("X-Amz-Checksum-Sha256"); want != "" && want != sha256Base64(body) {
+		writeError(w, http.StatusBadRequest, "BadDigest")
+		return
+	}
+
+	if q.Has("retention") || q.Has("legal-hold") {
+		f.objectLock(w, r, name, body)
+		return
+	}
+	if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+		source, _ = url.PathUnescape(strings.TrimPrefix(source, "/"))
+		data, ok := f.objects[source]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if !f.decrypts(r, source, "Copy-Source-") {
+			writeError(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		if spec := r.Header.Get("X-Amz-Copy-Source-Range"); spec != "" {
+			var start, end int
+			fmt.Sscanf(spec, "bytes=%d-%d", &start, &end)
+			data = data[start : end+1]
+		}
+		body = append([]byte(nil), data...)
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && q.Has("uploads"):
+		type upload struct {
+			Key               string
+			UploadId          string
+			Initiated         string
+			ChecksumAlgorithm string
+		}
+		var result struct {
+			XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+			IsTruncated bool
+			Upload      []upload
+		}
+		for id, u := range f.uploads {
+			if strings.HasPrefix(u.key, bucket+"/"+q.Get("prefix")) {
+				result.Upload = append(result.Upload, upload{strings.TrimPrefix(u.key, bucket+"/"), id, u.initiated.Format(time.RFC3339), u.checksum})
+			}
+		}
+		writeXML(w, result)
+	case r.Method == http.MethodGet && key == "":
+		type content struct {
+			Key          string
+			Size         int64
+			LastModified string
+		}
+		var result struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			IsTruncated bool
+			Contents    []content
+		}
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, bucket+"/"+q.Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			result.Contents = append(result.Contents, content{strings.TrimPrefix(k, bucket+"/"), int64(len(f.objects[k])), time.Now().UTC().Format(time.RFC3339)})
+		}
+		writeXML(w, result)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = &fakeUpload{key: name, initiated: time.Now(), parts: make(map[int][]byte), lock: lockFrom(r), class: r.Header.Get("X-Amz-Storage-Class"), sse: sseFrom(r), checksum: r.Header.Get("X-Amz-Checksum-Algorithm")}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has("partNumber"):
+		upload, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if upload.sse != nil && upload.sse.keyMD5 != "" && customerKeyMD5(r, "") != upload.sse.keyMD5 {
+			writeError(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		number, _ := strconv.Atoi(q.Get("partNumber"))
+		f.partUploads++
+		if number == f.failPart {
+			f.failPart = 0
+			writeError(w, http.StatusBadRequest, "InjectedFailure")
+			return
+		}
+		upload.parts[number] = body
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			writeXML(w, struct {
+				XMLName        xml.Name `xml:"CopyPartResult"`
+				ETag           string
+				ChecksumSHA256 string `xml:",omitempty"`
+			}{ETag: etag(body), ChecksumSHA256: upload.partChecksum(body)})
+			return
+		}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet && q.Has("uploadId"):
+		upload, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		type part struct {
+			PartNumber     int
+			ETag           string
+			Size           int64
+			ChecksumSHA256 string `xml:",omitempty"`
+		}
+		var result struct {
+			XMLName     xml.Name `xml:"ListPartsResult"`
+			IsTruncated bool
+			Part        []part
+		}
+		for number, data := range upload.parts {
+			result.Part = append(result.Part, part{number, etag(data), int64(len(data)), upload.partChecksum(data)})
+		}
+		sort.Slice(result.Part, func(i, j int) bool { return result.Part[i].PartNumber < result.Part[j].PartNumber })
+		writeXML(w, result)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		upload, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Part []struct {
+				PartNumber     int
+				ETag           string
+				ChecksumSHA256 string
+			}
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		composite := sha256.New()
+		for _, p := range complete.Part {
+			part, ok := upload.parts[p.PartNumber]
+			if !ok || etag(part) != p.ETag || p.ChecksumSHA256 != upload.partChecksum(part) {
+				writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, part...)
+			sum := sha256.Sum256(part)
+			composite.Write(sum[:])
+		}
+		f.objects[name] = data
+		checksum := ""
+		if upload.checksum != "" {
+			checksum = base64.StdEncoding.EncodeToString(composite.Sum(nil)) + "-" + strconv.Itoa(len(complete.Part))
+		}
+		f.setChecksum(name, checksum)
+		f.setClass(name, upload.class)
+		f.setSSE(name, upload.sse)
+		if upload.lock != nil {
+			f.locks[name] = upload.lock
+		}
+		delete(f.uploads, q.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName        xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key            string
+			ChecksumSHA256 string `xml:",omitempty"`
+		}{Key: key, ChecksumSHA256: checksum})
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && q.Has("restore"):
+		f.restore(w, name, body)
+	case r.Method == http.MethodPut:
+		f.puts++
+		f.objects[name] = body
+		checksum := ""
+		if r.Header.Get("X-Amz-Checksum-Sha256") != "" || r.Header.Get("X-Amz-Checksum-Algorithm") == "SHA256" {
+			checksum = sha256Base64(body)
+		}
+		f.setChecksum(name, checksum)
+		f.setClass(name, r.Header.Get("X-Amz-Storage-Class"))
+		f.setSSE(name, sseFrom(r))
+		if lock := lockFrom(r); lock != nil {
+			f.locks[name] = lock
+		}
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"CopyObjectResult"`
+				ETag    string
+			}{ETag: etag(body)})
+			return
+		}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if !f.decrypts(r, name, "") {
+			writeError(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		if sse := f.encryption[name]; sse != nil && sse.algorithm != "" {
+			w.Header().Set("X-Amz-Server-Side-Encryption", sse.algorithm)
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if class := f.classes[name]; class != "" {
+			w.Header().Set("X-Amz-Storage-Class", class)
+		}
+		if checksum := f.checksums[name]; checksum != "" && r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" && r.Header.Get("Range") == "" {
+			w.Header().Set("X-Amz-Checksum-Sha256", checksum)
+		}
+		restore := f.restores[name]
+		if restore != nil && r.Method == http.MethodHead {
+			if restore.polls > 0 {
+				restore.polls--
+				w.Header().Set("X-Amz-Restore", `ongoing-request="true"`)
+			} else {
+				expiry := time.Now().AddDate(0, 0, restore.days).UTC().Format(http.TimeFormat)
+				w.Header().Set("X-Amz-Restore", `ongoing-request="false", expiry-date="`+expiry+`"`)
+			}
+		}
+		if archived(f.classes[name]) && (restore == nil || restore.polls > 0) && r.Method == http.MethodGet {
+			writeError(w, http.StatusForbidden, "InvalidObjectState")
+			return
+		}
+		status := http.StatusOK
+		if spec := r.Header.Get("Range"); spec != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(spec, "bytes=%d-%d", &start, &end); err != nil {
+				end = len(data) - 1
+			}
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		if lock := f.locks[name]; lock != nil && (lock.legalHold == "ON" || time.Now().Before(lock.retainUntil)) {
+			writeError(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		delete(f.objects, name)
+		delete(f.classes, name)
+		delete(f.restores, name)
+		delete(f.encryption, name)
+		delete(f.checksums, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// objectLock serves the retention and legal hold subresources
+func (f *fakeS3) objectLock(w http.ResponseWriter, r *http.Request, name string, body []byte) {
+	if _, ok := f.objects[name]; !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	lock := f.locks[name]
+	switch {
+	case r.Method == http.MethodPut && r.URL.Query().Has("legal-hold"):
+		var hold struct{ Status string }
+		xml.Unmarshal(body, &hold)
+		if lock == nil {
+			lock = &fakeLock{}
+			f.locks[name] = lock
+		}
+		lock.legalHold = hold.Status
+	case r.URL.Query().Has("retention") && lock != nil && lock.mode != "":
+		writeXML(w, struct {
+			XMLName         xml.Name `xml:"Retention"`
+			Mode            string
+			RetainUntilDate string
+		}{Mode: lock.mode, RetainUntilDate: lock.retainUntil.Format(time.RFC3339)})
+	case r.URL.Query().Has("legal-hold") && lock != nil && lock.legalHold != "":
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"LegalHold"`
+			Status  string
+		}{Status: lock.legalHold})
+	default:
+		writeError(w, http.StatusNotFound, "NoSuchObjectLockConfiguration")
+	}
+}
+
+// setClass records the storage class of a written object
+func (f *fakeS3) setClass(name, class string) {
+	delete(f.restores, name)
+	if class == "" || class == "STANDARD" {
+		delete(f.classes, name)
+		return
+	}
+	f.classes[name] = class
+}
+
+// setSSE records the encryption of a written object
+func (f *fakeS3) setSSE(name string, sse *fakeSSE) {
+	if sse == nil {
+		delete(f.encryption, name)
+		return
+	}
+	f.encryption[name] = sse
+}
+
+// setChecksum records the checksum of a written object
+func (f *fakeS3) setChecksum(name, checksum string) {
+	if checksum == "" {
+		delete(f.checksums, name)
+		return
+	}
+	f.checksums[name] = checksum
+}
+
+// partChecksum returns the checksum S3 keeps for a part of the upload
+func (u *fakeUpload) partChecksum(data []byte) string {
+	if u.checksum == "" {
+		return ""
+	}
+	return sha256Base64(data)
+}
+
+func sha256Base64(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// restore starts a restore of an archived object
+func (f *fakeS3) restore(w http.ResponseWriter, name string, body []byte) {
+	if _, ok := f.objects[name]; !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if !archived(f.classes[name]) {
+		writeError(w, http.StatusForbidden, "InvalidObjectState")
+		return
+	}
+	if restore := f.restores[name]; restore != nil && restore.polls > 0 {
+		writeError(w, http.StatusConflict, "RestoreAlreadyInProgress")
+		return
+	}
+	var request struct{ Days int }
+	xml.Unmarshal(body, &request)
+	f.restores[name] = &fakeRestore{polls: f.thawPolls, days: request.Days}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func archived(class string) bool {
+	return class == "GLACIER" || class == "DEEP_ARCHIVE"
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
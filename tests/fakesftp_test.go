@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fakeSFTP is an in-process SSH server with the SFTP subsystem serving the
+// local filesystem. It accepts a single client key.
+type fakeSFTP struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	// keyFile and knownHosts are the client key and a known_hosts file
+	// trusting the host key
+	keyFile    string
+	knownHosts string
+}
+
+func newFakeSFTP(t *testing.T) *fakeSFTP {
+	t.Helper()
+	dir := t.TempDir()
+	hostKey := newSSHKey(t, "")
+	clientPEM := filepath.Join(dir, "id_ed25519")
+	clientKey := newSSHKey(t, clientPEM)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	f := &fakeSFTP{listener: listener, hostKey: hostKey, keyFile: clientPEM, knownHosts: filepath.Join(dir, "known_hosts")}
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostKey.PublicKey())
+	if err := os.WriteFile(f.knownHosts, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientKey.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostKey)
+	go f.serve(config)
+	return f
+}
+
+// location returns the storage URL of a directory on the fake server
+func (f *fakeSFTP) location(dir, params string) string {
+	location := "sftp://guard@" + f.listener.Addr().String() + filepath.ToSlash(dir) + "?key=" + f.keyFile + "&known_hosts=" + f.knownHosts
+	if params != "" {
+		location += "&" + params
+	}
+	return location
+}
+
+func (f *fakeSFTP) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go func() {
+					for req := range requests {
+						ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+						req.Reply(ok, nil)
+						if ok {
+							server, err := sftp.NewServer(channel)
+							if err == nil {
+								server.Serve()
+								server.Close()
+							}
+							channel.Close()
+						}
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// newSSHKey generates an ed25519 key, writing it to file unless file is
+// empty
+func newSSHKey(t *testing.T, file string) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	if file != "" {
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			t.Fatalf("Failed to encode key: %v", err)
+		}
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("Failed to write key: %v", err)
+		}
+	}
+	return signer
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQL is a minimal database/sql driver recording the statements that
+// reach the database. Statements run inside a transaction only count once
+// it commits; COPY data rows are recorded as "<COPY statement>\t<values>".
+type fakeSQL struct {
+	mu        sync.Mutex
+	committed []string
+	// fail returns an error to make a statement fail
+	fail func(query string) error
+	// rows answers queries with result columns and rows
+	rows func(query string, args []driver.Value) ([]string, [][]driver.Value)
+}
+
+func newFakeSQL(t *testing.T) (*fakeSQL, *sql.DB) {
+	t.Helper()
+	f := &fakeSQL{}
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return f, db
+}
+
+// statements returns the committed statements in order
+func (f *fakeSQL) statements() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.committed...)
+}
+
+// count returns how often a statement was committed
+func (f *fakeSQL) count(query string) int {
+	n := 0
+	for _, stmt := range f.statements() {
+		if stmt == query {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeSQL) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+func (f *fakeSQL) Driver() driver.Driver                        { return fakeDriver{f} }
+
+type fakeDriver struct{ db *fakeSQL }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{db: d.db}, nil }
+
+type fakeConn struct {
+	db *fakeSQL
+	// tx buffers the statements of the open transaction
+	tx []string
+	// inTx is set while a transaction is open
+	inTx bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	if c.inTx {
+		return nil, errors.New("transaction already open")
+	}
+	c.inTx = true
+	c.tx = nil
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.mu.Lock()
+	c.db.committed = append(c.db.committed, c.tx...)
+	c.db.mu.Unlock()
+	c.inTx, c.tx = false, nil
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.inTx, c.tx = false, nil
+	return nil
+}
+
+func (c *fakeConn) record(entry string) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	if c.db.fail != nil {
+		if err := c.db.fail(entry); err != nil {
+			return err
+		}
+	}
+	if c.inTx {
+		c.tx = append(c.tx, entry)
+	} else {
+		c.db.committed = append(c.db.committed, entry)
+	}
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	entry := s.query
+	if strings.HasPrefix(strings.ToUpper(s.query), "COPY ") {
+		// The final Exec without arguments ends the COPY
+		if len(args) == 0 {
+			return driver.RowsAffected(0), nil
+		}
+		values := make([]string, len(args))
+		for i, arg := range args {
+			values[i] = fmt.Sprint(arg)
+		}
+		entry += "\t" + strings.Join(values, ",")
+	}
+	if err := s.conn.record(entry); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := &fakeRows{columns: []string{"name"}}
+	if s.conn.db.rows != nil {
+		if columns, values := s.conn.db.rows(s.query, args); columns != nil {
+			rows.columns, rows.values = columns, values
+		}
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
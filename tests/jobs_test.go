@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/jobs"
+)
+
+func TestJobStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guard", "jobs.db")
+	store, err := jobs.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open job store: %v", err)
+	}
+
+	for _, invalid := range []jobs.Job{
+		{Task: "vacuum", Cron: "@daily", Database: "orders", Storage: []string{"backups"}},
+		{Task: jobs.TaskBackup, Cron: "every day", Database: "orders", Storage: []string{"backups"}},
+		{Task: jobs.TaskBackup, Cron: "@daily", Storage: []string{"backups"}},
+		{Task: jobs.TaskBackup, Cron: "@daily", Database: "orders"},
+	} {
+		if err := store.Add(&invalid); err == nil {
+			t.Fatalf("Expected job %+v to be rejected", invalid)
+		}
+	}
+
+	backupJob := &jobs.Job{Task: jobs.TaskBackup, Cron: "0 3 * * *", Database: "orders", Password: "secret", Storage: []string{"backups", "s3://guard/prod"}, Retention: jobs.Retention{KeepDaily: 7, KeepWithin: "30d"}}
+	drillJob := &jobs.Job{Task: jobs.TaskDrill, Cron: "@weekly", Database: "orders", Storage: []string{"backups"}, Assertions: []string{"SELECT true"}}
+	for _, job := range []*jobs.Job{backupJob, drillJob} {
+		if err := store.Add(job); err != nil {
+			t.Fatalf("Failed to add job: %v", err)
+		}
+	}
+	if backupJob.ID != 1 || drillJob.ID != 2 || backupJob.CreatedAt.IsZero() {
+		t.Fatalf("Expected jobs 1 and 2, got %+v and %+v", backupJob, drillJob)
+	}
+	next := backupJob.Next(time.Date(2026, 3, 7, 4, 0, 0, 0, time.Local))
+	if !next.Equal(time.Date(2026, 3, 8, 3, 0, 0, 0, time.Local)) {
+		t.Fatalf("Unexpected next run %s", next)
+	}
+	store.Close()
+
+	// Jobs survive reopening the store, which only its owner can read
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected the job store to be private, got %v, %v", info.Mode(), err)
+	}
+	store, err = jobs.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen job store: %v", err)
+	}
+	defer store.Close()
+	list, err := store.List()
+	if err != nil || len(list) != 2 || list[0].ID != 1 || list[1].Task != jobs.TaskDrill {
+		t.Fatalf("Unexpected jobs %+v, %v", list, err)
+	}
+	job, err := store.Get(1)
+	if err != nil || job.Password != "secret" || job.Retention.KeepWithin != "30d" || len(job.Storage) != 2 {
+		t.Fatalf("Unexpected job %+v, %v", job, err)
+	}
+
+	if err := store.Remove(1); err != nil {
+		t.Fatalf("Failed to remove job: %v", err)
+	}
+	if err := store.Remove(1); !errors.Is(err, jobs.ErrNotFound) {
+		t.Fatalf("Expected removing a missing job to fail, got %v", err)
+	}
+	if _, err := store.Get(1); !errors.Is(err, jobs.ErrNotFound) {
+		t.Fatalf("Expected the removed job to be gone, got %v", err)
+	}
+	// IDs of removed jobs are not reused
+	next3 := &jobs.Job{Task: jobs.TaskBackup, Cron: "@hourly", Database: "users", Storage: []string{"backups"}}
+	if err := store.Add(next3); err != nil || next3.ID != 3 {
+		t.Fatalf("Expected job 3, got %d, %v", next3.ID, err)
+	}
+}
@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/backup"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+func TestBackupLayout(t *testing.T) {
+	created := time.Date(2026, 3, 7, 4, 5, 6, 0, time.Local)
+	for layout, want := range map[string]string{
+		"":                                       "orders-20260307T040506.sql",
+		"{db}/{yyyy}/{mm}/{db}-{ts}.{ext}":       "orders/2026/03/orders-20260307T040506.sql",
+		"daily/{yyyy}-{mm}-{dd}/{hh}/{id}.{ext}": "daily/2026-03-07/04/orders-20260307T040506.sql",
+	} {
+		key, err := backup.Key(layout, "orders", created, "sql")
+		if err != nil || key != want {
+			t.Fatalf("Expected layout %q to give %s, got %s, %v", layout, want, key, err)
+		}
+	}
+	for _, layout := range []string{"{db}/latest.sql", "{db}/{when}/{ts}.sql", "/abs/{ts}.sql", "{db}/../{ts}.sql", "{db}//{ts}.sql", "{db}/{ts}/", "chunks/{ts}.sql"} {
+		if err := backup.ValidateLayout(layout); err == nil {
+			t.Fatalf("Expected layout %q to be rejected", layout)
+		}
+	}
+	if _, err := backup.Key("{db}/{ts}.sql", "..", created, "sql"); err == nil {
+		t.Fatalf("Expected a database name escaping the layout to be rejected")
+	}
+
+	// Backups in nested keys are found by retention and their directories
+	// are removed with them
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, _ := storage.Open(ctx, dir)
+	key, _ := backup.Key("{db}/{yyyy}/{mm}/{db}-{ts}.{ext}", "orders", created, "sql")
+	putRetentionBackup(t, b, retention.Backup{Key: key, Manifest: &manifest.Manifest{ID: "orders-1", Database: "orders", CreatedAt: created}})
+	backups, err := retention.Scan(ctx, b, "orders")
+	if err != nil || len(backups) != 1 || backups[0].Key != key {
+		t.Fatalf("Expected to find the backup at %s, got %+v, %v", key, backups, err)
+	}
+	if err := retention.DeleteBackup(ctx, b, key); err != nil {
+		t.Fatalf("Failed to delete the backup: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "orders")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the empty backup directories to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Annany2002/guard/pkg/backup"
+	"github.com/Annany2002/guard/pkg/manifest"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for value, want := range map[string]int{"": 0, "all": 0, "any": 1, "2": 2} {
+		policy, err := backup.ParsePolicy(value)
+		if err != nil || policy.MinStored != want {
+			t.Fatalf("ParsePolicy(%q) = %+v, %v; want MinStored %d", value, policy, err, want)
+		}
+	}
+	for _, value := range []string{"0", "-1", "most"} {
+		if _, err := backup.ParsePolicy(value); err == nil {
+			t.Fatalf("Expected ParsePolicy(%q) to fail", value)
+		}
+	}
+	if !(backup.Policy{}).Satisfied(2, 2) || (backup.Policy{}).Satisfied(1, 2) || !(backup.Policy{MinStored: 1}).Satisfied(1, 2) {
+		t.Fatalf("Unexpected policy decisions")
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging")
+	os.MkdirAll(staging, 0o755)
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	// A directory below a regular file cannot be created
+	blocked := filepath.Join(dir, "blocked")
+	os.WriteFile(blocked, nil, 0o644)
+	broken := filepath.Join(blocked, "backups")
+
+	newResult := func() *backup.Result {
+		file := filepath.Join(staging, "orders.sql")
+		os.WriteFile(file, []byte("dump of orders"), 0o644)
+		m := &manifest.Manifest{Version: manifest.Version, ID: "orders-1", Database: "orders", File: "orders/orders.sql"}
+		return &backup.Result{FilePath: file, ManifestPath: manifest.PathFor(file), Manifest: m}
+	}
+
+	result := newResult()
+	if err := backup.Replicate(ctx, result, []string{first, broken, second}, 1, backup.Policy{MinStored: 1}); err != nil {
+		t.Fatalf("Expected partial success to satisfy the policy: %v", err)
+	}
+	statuses := []string{manifest.StatusStored, manifest.StatusFailed, manifest.StatusStored}
+	if len(result.Manifest.Destinations) != 3 {
+		t.Fatalf("Unexpected destinations %+v", result.Manifest.Destinations)
+	}
+	for i, d := range result.Manifest.Destinations {
+		if d.Status != statuses[i] {
+			t.Fatalf("Destination %d: expected %s, got %+v", i, statuses[i], d)
+		}
+	}
+	for _, location := range []string{first, second} {
+		m, err := manifest.Read(filepath.Join(location, "orders", "orders.sql.manifest.json"))
+		if err != nil {
+			t.Fatalf("Failed to read stored manifest: %v", err)
+		}
+		if len(m.Destinations) != 3 || m.Destinations[1].Error == "" {
+			t.Fatalf("Stored manifest does not record the failed destination: %+v", m.Destinations)
+		}
+	}
+
+	if err := backup.Replicate(ctx, newResult(), []string{first, broken}, 2, backup.Policy{}); err == nil {
+		t.Fatalf("Expected a failed destination to fail the backup under the all policy")
+	}
+
+	// The manifest records the server-side encryption of each copy
+	fake := newFakeS3(t)
+	result = newResult()
+	if err := backup.Replicate(ctx, result, []string{first, fake.location("guard-test", "sse=aes256")}, 1, backup.Policy{}); err != nil {
+		t.Fatalf("Failed to replicate to S3: %v", err)
+	}
+	if d := result.Manifest.Destinations; d[0].Encryption != nil || d[1].Encryption == nil || d[1].Encryption.Mode != "aes256" {
+		t.Fatalf("Unexpected encryption of destinations %+v, %+v", d[0].Encryption, d[1].Encryption)
+	}
+}
@@ -0,0 +1,428 @@
+package tests
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Annany2002/guard/pkg/restore"
+)
+
+const sampleDump = `-- Go PostgreSQL Dump v0.2.1
+SET client_encoding = 'UTF8';
+CREATE TABLE users (
+    id integer,
+    name text -- trailing comment; with a semicolon
+);
+
+CREATE FUNCTION touch() RETURNS trigger AS $body$
+BEGIN
+    NEW.name := 'a;b';
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+
+COPY users (id, name) FROM stdin;
+1	alice
+2	\N
+3	tab\there
+\.
+
+INSERT INTO "Orders" VALUES (1, 'it''s; fine');
+`
+
+func TestRestoreScanner(t *testing.T) {
+	sc := restore.NewScanner(strings.NewReader(sampleDump))
+
+	var stmts []*restore.Statement
+	for {
+		stmt, err := sc.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to scan dump: %v", err)
+		}
+		stmts = append(stmts, stmt)
+
+		if stmt.Kind == restore.KindCopy {
+			var rows [][]*string
+			for {
+				row, err := sc.NextRow()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Failed to read COPY row: %v", err)
+				}
+				rows = append(rows, row)
+			}
+			if len(rows) != 3 {
+				t.Fatalf("Expected 3 COPY rows, got %d", len(rows))
+			}
+			if rows[1][1] != nil {
+				t.Fatalf("Expected NULL for \\N, got %q", *rows[1][1])
+			}
+			if *rows[2][1] != "tab\there" {
+				t.Fatalf("Expected escaped tab to be decoded, got %q", *rows[2][1])
+			}
+		}
+	}
+
+	if len(stmts) != 5 {
+		t.Fatalf("Expected 5 statements, got %d", len(stmts))
+	}
+	if !stmts[0].Session() {
+		t.Fatalf("Expected SET statement to be a session statement")
+	}
+	if !strings.Contains(stmts[2].SQL, "'a;b'") {
+		t.Fatalf("Dollar-quoted body was split: %s", stmts[2].SQL)
+	}
+	if stmts[3].Kind != restore.KindCopy || stmts[3].Table != "users" || len(stmts[3].Columns) != 2 {
+		t.Fatalf("Unexpected COPY statement: %+v", stmts[3])
+	}
+	if stmts[4].Table != "Orders" || stmts[4].Index != 5 {
+		t.Fatalf("Unexpected INSERT statement: %+v", stmts[4])
+	}
+}
+
+func TestRestoreJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "restore.journal")
+
+	journal := restore.NewJournal(path, "backup.sql", "shop")
+	journal.StartTable("users", 4)
+	journal.Applied = 3
+	if err := journal.Save(); err != nil {
+		t.Fatalf("Failed to save journal: %v", err)
+	}
+
+	loaded, err := restore.LoadJournal(path)
+	if err != nil {
+		t.Fatalf("Failed to load journal: %v", err)
+	}
+	if loaded.Applied != 3 || loaded.Source != "backup.sql" || loaded.Database != "shop" {
+		t.Fatalf("Unexpected journal contents: %+v", loaded)
+	}
+	if partial := loaded.PartialTables(); len(partial) != 1 || partial[0] != "users" {
+		t.Fatalf("Expected users to be partly loaded, got %v", partial)
+	}
+	if !loaded.Reloading("users", 4) || loaded.Reloading("users", 3) {
+		t.Fatalf("Unexpected reload decision for users")
+	}
+
+	loaded.FinishTable("users")
+	if len(loaded.PartialTables()) != 0 {
+		t.Fatalf("Expected no partly loaded tables after finishing users")
+	}
+}
+
+func TestRestoreRewriter(t *testing.T) {
+	rw := &restore.Rewriter{
+		RoleMap:   map[string]string{"prod_app": "staging_app"},
+		SchemaMap: map[string]string{"public": "prod_copy"},
+	}
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"ALTER TABLE public.users OWNER TO prod_app", "ALTER TABLE prod_copy.users OWNER TO staging_app"},
+		{"GRANT SELECT ON TABLE public.users TO prod_app, reporting", "GRANT SELECT ON TABLE prod_copy.users TO staging_app, reporting"},
+		{"REVOKE ALL ON SCHEMA public FROM \"prod_app\"", "REVOKE ALL ON SCHEMA prod_copy FROM staging_app"},
+		{"GRANT prod_app TO alice", "GRANT staging_app TO alice"},
+		{"SELECT pg_catalog.set_config('search_path', 'public', false)", "SELECT pg_catalog.set_config('search_path', 'prod_copy', false)"},
+		{"ALTER TABLE ONLY public.users ALTER COLUMN id SET DEFAULT nextval('public.users_id_seq'::regclass)", "ALTER TABLE ONLY prod_copy.users ALTER COLUMN id SET DEFAULT nextval('prod_copy.users_id_seq'::regclass)"},
+		{"INSERT INTO public.notes VALUES ('public.prod_app')", "INSERT INTO prod_copy.notes VALUES ('public.prod_app')"},
+		{"CREATE TABLE prod_app (id integer)", "CREATE TABLE prod_app (id integer)"},
+	}
+	for _, c := range cases {
+		stmt := &restore.Statement{SQL: c.in}
+		if !rw.Rewrite(stmt) {
+			t.Fatalf("Statement was unexpectedly skipped: %s", c.in)
+		}
+		if stmt.SQL != c.want {
+			t.Fatalf("Rewrite(%q)\n got: %s\nwant: %s", c.in, stmt.SQL, c.want)
+		}
+	}
+
+	stmt := &restore.Statement{SQL: "INSERT INTO public.users VALUES (1)"}
+	rw.Rewrite(stmt)
+	if stmt.Table != "prod_copy.users" {
+		t.Fatalf("Expected table to follow the schema mapping, got %s", stmt.Table)
+	}
+
+	skipping := &restore.Rewriter{NoOwner: true, NoPrivileges: true}
+	for _, sqlText := range []string{
+		"ALTER TABLE public.users OWNER TO prod_app",
+		"SET SESSION AUTHORIZATION 'prod_app'",
+		"GRANT SELECT ON public.users TO reporting",
+		"REVOKE ALL ON SCHEMA public FROM PUBLIC",
+	} {
+		if skipping.Rewrite(&restore.Statement{SQL: sqlText}) {
+			t.Fatalf("Expected statement to be skipped: %s", sqlText)
+		}
+	}
+	if !skipping.Rewrite(&restore.Statement{SQL: "CREATE TABLE users (id integer)"}) {
+		t.Fatalf("Expected CREATE TABLE to be kept")
+	}
+
+	if _, err := restore.ParseMappings([]string{"missing-separator"}); err == nil {
+		t.Fatalf("Expected an error for a mapping without '='")
+	}
+}
+
+func TestRestoreDataStatements(t *testing.T) {
+	sc := restore.NewScanner(strings.NewReader(`CREATE TABLE t (id integer);
+INSERT INTO public.t (id, "Name") VALUES (1, 'a');
+INSERT INTO t VALUES (2, 'b');
+`))
+
+	var stmts []*restore.Statement
+	for {
+		stmt, err := sc.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to scan dump: %v", err)
+		}
+		stmts = append(stmts, stmt)
+	}
+
+	if len(stmts) != 3 {
+		t.Fatalf("Expected 3 statements, got %d", len(stmts))
+	}
+	if stmts[0].Data() {
+		t.Fatalf("CREATE TABLE must not be treated as data")
+	}
+	if !stmts[1].Data() || stmts[1].Table != "public.t" || strings.Join(stmts[1].Columns, ",") != "id,Name" {
+		t.Fatalf("Unexpected INSERT with column list: %+v", stmts[1])
+	}
+	if !stmts[2].Data() || len(stmts[2].Columns) != 0 {
+		t.Fatalf("Unexpected INSERT without column list: %+v", stmts[2])
+	}
+}
+
+func TestRestoreResume(t *testing.T) {
+	var dump strings.Builder
+	dump.WriteString("SET client_encoding = 'UTF8';\n")
+	dump.WriteString("CREATE TABLE users (id integer, name text);\n")
+	dump.WriteString("CREATE TABLE orders (id integer);\n")
+	dump.WriteString("COPY users (id, name) FROM stdin;\n1\talice\n2\tbob\n3\t\\N\n\\.\n")
+	for i := 1; i <= 600; i++ {
+		fmt.Fprintf(&dump, "INSERT INTO orders VALUES (%d);\n", i)
+	}
+
+	dir := t.TempDir()
+	dumpPath := filepath.Join(dir, "shop.sql")
+	if err := os.WriteFile(dumpPath, []byte(dump.String()), 0644); err != nil {
+		t.Fatalf("Failed to write dump: %v", err)
+	}
+	journalPath := filepath.Join(dir, "shop.journal")
+
+	fake, db := newFakeSQL(t)
+	failed := false
+	fake.fail = func(query string) error {
+		if query == "INSERT INTO orders VALUES (550)" && !failed {
+			failed = true
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+
+	opts := restore.Options{DBName: "shop", FilePath: dumpPath, JournalPath: journalPath}
+	if err := restore.RunDB(context.Background(), db, opts); err == nil {
+		t.Fatalf("Expected the restore to be interrupted")
+	}
+
+	journal, err := restore.LoadJournal(journalPath)
+	if err != nil {
+		t.Fatalf("Expected a journal after the interruption: %v", err)
+	}
+	// The last checkpoint covers the COPY and the first 500 inserts
+	if journal.Applied != 504 {
+		t.Fatalf("Expected statements up to 504 to be committed, got %d", journal.Applied)
+	}
+	if partial := journal.PartialTables(); len(partial) != 1 || partial[0] != "orders" {
+		t.Fatalf("Expected orders to be partly loaded, got %v", partial)
+	}
+	if n := fake.count("INSERT INTO orders VALUES (549)"); n != 0 {
+		t.Fatalf("Uncommitted insert reached the database %d times", n)
+	}
+
+	if err := restore.RunDB(context.Background(), db, restore.Options{DBName: "other", JournalPath: journalPath, Resume: true}); err == nil {
+		t.Fatalf("Expected resuming into a different database to fail")
+	}
+	if err := restore.RunDB(context.Background(), db, restore.Options{JournalPath: journalPath, Resume: true}); err != nil {
+		t.Fatalf("Failed to resume restore: %v", err)
+	}
+
+	stmts := fake.statements()
+	truncate := -1
+	for i, stmt := range stmts {
+		if stmt == `TRUNCATE TABLE "orders"` {
+			truncate = i
+		}
+	}
+	if truncate < 0 {
+		t.Fatalf("Expected the partly loaded orders table to be truncated")
+	}
+	reloaded := make(map[string]int)
+	for _, stmt := range stmts[truncate+1:] {
+		if strings.HasPrefix(stmt, "INSERT INTO orders") {
+			reloaded[stmt]++
+		}
+	}
+	if len(reloaded) != 600 {
+		t.Fatalf("Expected all 600 orders to be reloaded after the truncate, got %d", len(reloaded))
+	}
+	for stmt, n := range reloaded {
+		if n != 1 {
+			t.Fatalf("%s was applied %d times after the truncate", stmt, n)
+		}
+	}
+
+	rows := 0
+	for _, stmt := range stmts {
+		if strings.HasPrefix(stmt, "COPY users (id, name) FROM stdin\t") {
+			rows++
+		}
+	}
+	if rows != 3 {
+		t.Fatalf("Expected the 3 users rows to be copied once, got %d", rows)
+	}
+	if n := fake.count("CREATE TABLE users (id integer, name text)"); n != 1 {
+		t.Fatalf("Expected CREATE TABLE users to be applied once, got %d", n)
+	}
+	if n := fake.count("SET client_encoding = 'UTF8'"); n != 2 {
+		t.Fatalf("Expected the session setting to be replayed on resume, got %d", n)
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Fatalf("Expected the journal to be removed after the restore, got %v", err)
+	}
+}
+
+const conflictDump = `SET client_encoding = 'UTF8';
+COPY users (id, name) FROM stdin;
+1	alice
+\.
+INSERT INTO orders VALUES (1, 'ON CONFLICT DO NOTHING');
+INSERT INTO orders (id) VALUES (2) ON CONFLICT DO NOTHING;
+INSERT INTO orders (id) VALUES (3);
+`
+
+func TestRestoreConflict(t *testing.T) {
+	dumpPath := filepath.Join(t.TempDir(), "shop.sql")
+	if err := os.WriteFile(dumpPath, []byte(conflictDump), 0644); err != nil {
+		t.Fatalf("Failed to write dump: %v", err)
+	}
+	columns := map[string][]string{`"users"`: {"id", "name"}, `"orders"`: {"id", "note"}}
+
+	cases := []struct {
+		conflict string
+		noKey    bool
+		want     []string
+		unwanted []string
+		wantErr  string
+	}{
+		{
+			conflict: restore.ConflictError,
+			want: []string{
+				"COPY users (id, name) FROM stdin\t1,alice",
+				"INSERT INTO orders VALUES (1, 'ON CONFLICT DO NOTHING')",
+				"INSERT INTO orders (id) VALUES (3)",
+			},
+		},
+		{
+			conflict: restore.ConflictSkip,
+			want: []string{
+				"COPY \"guard_restore_stage\" (\"id\", \"name\") FROM stdin\t1,alice",
+				`INSERT INTO "users" ("id", "name") SELECT "id", "name" FROM "guard_restore_stage" ON CONFLICT DO NOTHING`,
+				"INSERT INTO orders VALUES (1, 'ON CONFLICT DO NOTHING') ON CONFLICT DO NOTHING",
+				"INSERT INTO orders (id) VALUES (2) ON CONFLICT DO NOTHING",
+				"INSERT INTO orders (id) VALUES (3) ON CONFLICT DO NOTHING",
+			},
+		},
+		{
+			conflict: restore.ConflictUpsert,
+			want: []string{
+				`INSERT INTO "users" ("id", "name") SELECT "id", "name" FROM "guard_restore_stage" ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name"`,
+				"INSERT INTO orders VALUES (1, 'ON CONFLICT DO NOTHING') ON CONFLICT (\"id\") DO UPDATE SET \"note\" = EXCLUDED.\"note\"",
+				"INSERT INTO orders (id) VALUES (2) ON CONFLICT DO NOTHING",
+				`INSERT INTO orders (id) VALUES (3) ON CONFLICT ("id") DO NOTHING`,
+			},
+		},
+		{
+			conflict: restore.ConflictUpsert,
+			noKey:    true,
+			wantErr:  "no primary key",
+		},
+		{
+			conflict: restore.ConflictTruncate,
+			want: []string{
+				`TRUNCATE TABLE "users", "orders"`,
+				"COPY users (id, name) FROM stdin\t1,alice",
+				"INSERT INTO orders VALUES (1, 'ON CONFLICT DO NOTHING')",
+				"INSERT INTO orders (id) VALUES (3)",
+			},
+			unwanted: []string{`TRUNCATE TABLE "users"`, `TRUNCATE TABLE "orders"`},
+		},
+	}
+
+	for _, c := range cases {
+		fake, db := newFakeSQL(t)
+		fake.rows = func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+			var names []string
+			switch {
+			case strings.Contains(query, "pg_get_serial_sequence"):
+				return nil, nil
+			case strings.Contains(query, "indisprimary"):
+				if !c.noKey {
+					names = []string{"id"}
+				}
+			case strings.Contains(query, "pg_attribute"):
+				names = columns[args[0].(string)]
+			}
+			var rows [][]driver.Value
+			for _, name := range names {
+				rows = append(rows, []driver.Value{name})
+			}
+			return []string{"attname"}, rows
+		}
+
+		err := restore.RunDB(context.Background(), db, restore.Options{
+			DBName:      "shop",
+			FilePath:    dumpPath,
+			JournalPath: filepath.Join(t.TempDir(), "shop.journal"),
+			Mode:        restore.ModeData,
+			Conflict:    c.conflict,
+		})
+		if c.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("%s: expected error containing %q, got %v", c.conflict, c.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: restore failed: %v", c.conflict, err)
+		}
+
+		stmts := fake.statements()
+		for _, want := range c.want {
+			if fake.count(want) != 1 {
+				t.Fatalf("%s: expected %q to be applied once, got:\n%s", c.conflict, want, strings.Join(stmts, "\n"))
+			}
+		}
+		for _, unwanted := range c.unwanted {
+			if fake.count(unwanted) != 0 {
+				t.Fatalf("%s: unexpected statement %q", c.conflict, unwanted)
+			}
+		}
+	}
+}
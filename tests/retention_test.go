@@ -0,0 +1,176 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+)
+
+// dailyBackups returns one backup of database per day, newest first,
+// starting at now
+func dailyBackups(database string, now time.Time, days int) []retention.Backup {
+	var backups []retention.Backup
+	for i := 0; i < days; i++ {
+		created := now.AddDate(0, 0, -i)
+		backups = append(backups, retention.Backup{
+			Key:      fmt.Sprintf("%s/%s-%s.sql", database, database, created.Format("20060102")),
+			Manifest: &manifest.Manifest{Database: database, CreatedAt: created},
+		})
+	}
+	return backups
+}
+
+func keptKeys(decisions []retention.Decision) []string {
+	var keys []string
+	for _, d := range decisions {
+		if d.Keep {
+			keys = append(keys, d.Backup.Key)
+		}
+	}
+	return keys
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	now := time.Date(2025, 3, 31, 12, 0, 0, 0, time.Local)
+	backups := dailyBackups("orders", now, 100)
+
+	kept := keptKeys(retention.Policy{KeepDaily: 3}.Apply(backups, now))
+	if strings.Join(kept, " ") != "orders/orders-20250331.sql orders/orders-20250330.sql orders/orders-20250329.sql" {
+		t.Fatalf("Unexpected daily backups kept: %v", kept)
+	}
+
+	// The newest backup of March, February and January
+	kept = keptKeys(retention.Policy{KeepMonthly: 3}.Apply(backups, now))
+	if strings.Join(kept, " ") != "orders/orders-20250331.sql orders/orders-20250228.sql orders/orders-20250131.sql" {
+		t.Fatalf("Unexpected monthly backups kept: %v", kept)
+	}
+
+	// Rules overlap: the newest backup is kept by every rule
+	decisions := retention.Policy{KeepLast: 2, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 3, KeepYearly: 1}.Apply(backups, now)
+	if got := strings.Join(decisions[0].Reasons, ","); got != "last,daily,weekly,monthly,yearly" {
+		t.Fatalf("Unexpected reasons for the newest backup: %s", got)
+	}
+	// 7 days (Monday back to Tuesday), the Sundays ending the two weeks
+	// before, and the ends of February and January
+	if kept := keptKeys(decisions); len(kept) != 11 {
+		t.Fatalf("Expected 11 backups kept, got %d: %v", len(kept), kept)
+	}
+
+	kept = keptKeys(retention.Policy{KeepWithin: 48 * time.Hour}.Apply(backups, now))
+	if len(kept) != 2 {
+		t.Fatalf("Expected the backups of the last 48 hours to be kept, got %v", kept)
+	}
+
+	// Databases are handled on their own
+	both := append(dailyBackups("users", now, 5), dailyBackups("orders", now, 5)...)
+	kept = keptKeys(retention.Policy{KeepLast: 1}.Apply(both, now))
+	if strings.Join(kept, " ") != "orders/orders-20250331.sql users/users-20250331.sql" {
+		t.Fatalf("Expected the newest backup of each database, got %v", kept)
+	}
+
+	if kept := keptKeys(retention.Policy{}.Apply(backups, now)); len(kept) != len(backups) {
+		t.Fatalf("Expected an empty policy to keep everything")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open local storage: %v", err)
+	}
+	now := time.Now()
+
+	for _, b := range append(dailyBackups("orders", now, 5), dailyBackups("users", now, 2)...) {
+		putRetentionBackup(t, backend, b)
+	}
+
+	policy := retention.Policy{KeepLast: 2}
+	decisions, err := retention.Prune(ctx, backend, policy, retention.PruneOptions{Database: "orders", DryRun: true})
+	if err != nil || len(decisions) != 5 {
+		t.Fatalf("Dry run failed (%d decisions): %v", len(decisions), err)
+	}
+	if objects, _ := backend.List(ctx, ""); len(objects) != 14 {
+		t.Fatalf("Dry run deleted objects, %d left", len(objects))
+	}
+
+	if _, err := retention.Prune(ctx, backend, policy, retention.PruneOptions{Database: "orders"}); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	objects, _ := backend.List(ctx, "orders/")
+	if len(objects) != 4 {
+		t.Fatalf("Expected 2 backups with manifests left, got %+v", objects)
+	}
+	if objects, _ := backend.List(ctx, "users/"); len(objects) != 4 {
+		t.Fatalf("Expected backups of other databases to be untouched, got %+v", objects)
+	}
+}
+
+// putRetentionBackup stores a backup and its manifest
+func putRetentionBackup(t *testing.T, backend storage.Backend, b retention.Backup) {
+	t.Helper()
+	ctx := context.Background()
+	var buf bytes.Buffer
+	b.Manifest.Version = manifest.Version
+	b.Manifest.File = b.Key
+	b.Manifest.Encode(&buf)
+	if err := backend.Put(ctx, b.Key, strings.NewReader("dump")); err != nil {
+		t.Fatalf("Failed to put %s: %v", b.Key, err)
+	}
+	if err := backend.Put(ctx, manifest.PathFor(b.Key), &buf); err != nil {
+		t.Fatalf("Failed to put manifest of %s: %v", b.Key, err)
+	}
+}
+
+func TestPruneRespectsLocks(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx := context.Background()
+	locked, err := storage.Open(ctx, fake.location("guard-test", "lock_mode=compliance&lock_days=30"))
+	if err != nil {
+		t.Fatalf("Failed to open S3 backend: %v", err)
+	}
+	backend, _ := storage.Open(ctx, fake.location("guard-test", ""))
+
+	backups := dailyBackups("orders", time.Now(), 4)
+	putRetentionBackup(t, backend, backups[0])
+	putRetentionBackup(t, backend, backups[1])
+	putRetentionBackup(t, locked, backups[2])
+	putRetentionBackup(t, backend, backups[3])
+	backend.(storage.Locker).SetLegalHold(ctx, backups[3].Key, true)
+
+	decisions, err := retention.Prune(ctx, backend, retention.Policy{KeepLast: 1}, retention.PruneOptions{})
+	if err != nil {
+		t.Fatalf("Expected locked backups to be skipped, got %v", err)
+	}
+	for i, d := range decisions {
+		wantKeep := i != 1
+		if d.Keep != wantKeep || d.Deleted == wantKeep {
+			t.Fatalf("Backup %d: unexpected decision %+v", i, d)
+		}
+	}
+	if !strings.Contains(strings.Join(decisions[2].Reasons, ","), "compliance retention") || !strings.Contains(strings.Join(decisions[3].Reasons, ","), "legal hold") {
+		t.Fatalf("Expected lock reasons, got %v and %v", decisions[2].Reasons, decisions[3].Reasons)
+	}
+	// Nothing of a locked backup is deleted, not even its manifest
+	if _, ok := fake.objects["guard-test/"+manifest.PathFor(backups[3].Key)]; !ok {
+		t.Fatalf("Expected the manifest of the held backup to remain")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for value, want := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "2w": 14 * 24 * time.Hour, "12h": 12 * time.Hour} {
+		if got, err := retention.ParseDuration(value); err != nil || got != want {
+			t.Fatalf("ParseDuration(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	if _, err := retention.ParseDuration("xd"); err == nil {
+		t.Fatalf("Expected an invalid duration to fail")
+	}
+}
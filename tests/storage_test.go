@@ -0,0 +1,746 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/storage"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestLocalBackend(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	backend, err := storage.Open(ctx, "file://"+filepath.ToSlash(dir))
+	if err != nil {
+		t.Fatalf("Failed to open local backend: %v", err)
+	}
+
+	checkBackend(t, backend)
+	if err := backend.Put(ctx, "../escape.sql", strings.NewReader("x")); err != nil {
+		t.Fatalf("Failed to put object: %v", err)
+	}
+	if exists, _ := backend.Exists(ctx, "escape.sql"); !exists {
+		t.Fatalf("Expected keys to stay inside the storage directory")
+	}
+}
+
+func TestLocalFileMoves(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := storage.NewLocalStorage(dir)
+	if err != nil {
+		t.Fatalf("Failed to open local backend: %v", err)
+	}
+
+	// Staging directories on another filesystem are copied instead of
+	// renamed
+	staging := []string{t.TempDir()}
+	if shm, err := os.MkdirTemp("/dev/shm", "guard-*"); err == nil {
+		defer os.RemoveAll(shm)
+		staging = append(staging, shm)
+	}
+	for i, stagingDir := range staging {
+		filePath := filepath.Join(stagingDir, "dump.sql")
+		os.WriteFile(filePath, []byte("select 1;"), 0o644)
+		key := fmt.Sprintf("orders/%d/dump.sql", i)
+		if err := backend.UploadFile(filePath, key); err != nil {
+			t.Fatalf("Failed to move %s into storage: %v", filePath, err)
+		}
+		if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be moved, got %v", filePath, err)
+		}
+
+		outPath := filepath.Join(t.TempDir(), "restored.sql")
+		if err := backend.DownloadFile(key, outPath); err != nil {
+			t.Fatalf("Failed to download %s: %v", key, err)
+		}
+		if data, _ := os.ReadFile(outPath); string(data) != "select 1;" {
+			t.Fatalf("Unexpected contents %q", data)
+		}
+	}
+	if err := backend.DownloadFile("orders/missing.sql", filepath.Join(t.TempDir(), "missing.sql")); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("Expected a missing file to fail with ErrNotExist, got %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "orders", "0")); len(entries) != 1 {
+		t.Fatalf("Expected no temporary files to be left behind, got %v", entries)
+	}
+}
+
+// TestS3CompatibleBackend runs against a real S3-compatible store, e.g. a
+// local MinIO:
+//
+//	docker run -d -p 9000:9000 -e MINIO_ROOT_USER=minio -e MINIO_ROOT_PASSWORD=minio123 minio/minio server /data
+//	AWS_ACCESS_KEY_ID=minio AWS_SECRET_ACCESS_KEY=minio123 \
+//	GUARD_TEST_S3_URL='s3://guard-test/run?endpoint=http://localhost:9000&path_style=true' go test ./tests -run S3Compatible
+//
+// The bucket must exist.
+func TestS3CompatibleBackend(t *testing.T) {
+	location := os.Getenv("GUARD_TEST_S3_URL")
+	if location == "" {
+		t.Skip("GUARD_TEST_S3_URL not set")
+	}
+
+	backend, err := storage.Open(context.Background(), location)
+	if err != nil {
+		t.Fatalf("Failed to open S3 backend: %v", err)
+	}
+	checkBackend(t, backend)
+}
+
+func TestS3Options(t *testing.T) {
+	u, err := storage.ParseURL("s3://bucket/prefix?endpoint=http://localhost:9000&path_style=true&region=eu-west-1&profile=backup")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	opts, err := storage.ParseS3Options(u)
+	if err != nil {
+		t.Fatalf("Failed to parse S3 options: %v", err)
+	}
+	if opts.Endpoint != "http://localhost:9000" || !opts.PathStyle || opts.Region != "eu-west-1" || opts.Profile != "backup" {
+		t.Fatalf("Unexpected S3 options: %+v", opts)
+	}
+
+	u, _ = storage.ParseURL("s3://bucket?web_identity_token_file=/var/run/token")
+	if _, err := storage.ParseS3Options(u); err == nil {
+		t.Fatalf("Expected an error for a web identity token without role_arn")
+	}
+	u, _ = storage.ParseURL("s3://bucket?path_style=maybe")
+	if _, err := storage.ParseS3Options(u); err == nil {
+		t.Fatalf("Expected an error for an invalid path_style")
+	}
+}
+
+func TestS3CustomEndpoint(t *testing.T) {
+	fake := newFakeS3(t)
+
+	backend, err := storage.Open(context.Background(), fake.location("guard-test/prod", ""))
+	if err != nil {
+		t.Fatalf("Failed to open S3 backend: %v", err)
+	}
+	checkBackend(t, backend)
+
+	if err := backend.Put(context.Background(), "orders.sql", strings.NewReader("dump")); err != nil {
+		t.Fatalf("Failed to put object: %v", err)
+	}
+	if string(fake.objects["guard-test/prod/orders.sql"]) != "dump" {
+		t.Fatalf("Expected a path-style upload to the custom endpoint, got %v", fake.objects)
+	}
+
+	// The URL keeps the endpoint, so that it reopens the same bucket
+	want := "s3://guard-test/prod?endpoint=" + url.QueryEscape(fake.URL) + "&path_style=true"
+	if backend.URL() != want {
+		t.Fatalf("Expected URL %s, got %s", want, backend.URL())
+	}
+	reopened, err := storage.Open(context.Background(), backend.URL())
+	if err != nil {
+		t.Fatalf("Failed to reopen %s: %v", backend.URL(), err)
+	}
+	if body, err := reopened.Get(context.Background(), "orders.sql"); err != nil {
+		t.Fatalf("Failed to read through the reopened URL: %v", err)
+	} else {
+		body.Close()
+	}
+}
+
+func TestS3MultipartResume(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx := context.Background()
+
+	backend, err := storage.Open(ctx, fake.location("guard-test", "part_size=5MiB&concurrency=1"))
+	if err != nil {
+		t.Fatalf("Failed to open S3 backend: %v", err)
+	}
+
+	data := make([]byte, 12<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// The upload is interrupted at the second of three parts
+	fake.failPart = 2
+	if err := backend.Put(ctx, "big.sql", bytes.NewReader(data)); err == nil {
+		t.Fatalf("Expected the interrupted upload to fail")
+	}
+	if err := backend.Put(ctx, "big.sql", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to resume upload: %v", err)
+	}
+	if !bytes.Equal(fake.objects["guard-test/big.sql"], data) {
+		t.Fatalf("Uploaded object does not match the source")
+	}
+	if fake.partUploads != 4 {
+		t.Fatalf("Expected the first part to be reused on resume, got %d part uploads", fake.partUploads)
+	}
+
+	// A partial download continues with a ranged read
+	filePath := filepath.Join(t.TempDir(), "big.sql")
+	if err := os.WriteFile(filePath+".part", data[:1<<20], 0644); err != nil {
+		t.Fatalf("Failed to write partial download: %v", err)
+	}
+	if err := storage.Download(ctx, backend, "big.sql", filePath); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	downloaded, err := os.ReadFile(filePath)
+	if err != nil || !bytes.Equal(downloaded, data) {
+		t.Fatalf("Downloaded file does not match the object (err=%v)", err)
+	}
+}
+
+func TestS3ObjectLock(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx := context.Background()
+
+	if _, err := storage.Open(ctx, fake.location("guard-test", "lock_mode=legal")); err == nil {
+		t.Fatalf("Expected an invalid lock mode to be rejected")
+	}
+	if _, err := storage.Open(ctx, fake.location("guard-test", "lock_mode=compliance")); err == nil {
+		t.Fatalf("Expected a lock mode without lock_days to be rejected")
+	}
+	backend, err := storage.Open(ctx, fake.location("guard-test", "lock_mode=governance&lock_days=7&part_size=5MiB"))
+	if err != nil {
+		t.Fatalf("Failed to open S3 backend: %v", err)
+	}
+	locker := backend.(storage.Locker)
+
+	// Single and multipart uploads are both written with retention
+	for key, size := range map[string]int{"small.sql": 10, "big.sql": 6 << 20} {
+		if err := backend.Put(ctx, key, bytes.NewReader(make([]byte, size))); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+		lock, err := locker.ObjectLock(ctx, key)
+		if err != nil {
+			t.Fatalf("Failed to get the lock of %s: %v", key, err)
+		}
+		if lock.Mode != "GOVERNANCE" || lock.RetainUntil.Before(time.Now().AddDate(0, 0, 6)) || !lock.Active(time.Now()) {
+			t.Fatalf("Unexpected lock of %s: %+v", key, lock)
+		}
+	}
+
+	unlocked, _ := storage.Open(ctx, fake.location("guard-test", ""))
+	if err := unlocked.Put(ctx, "plain.sql", strings.NewReader("plain")); err != nil {
+		t.Fatalf("Failed to put object: %v", err)
+	}
+	lock, err := locker.ObjectLock(ctx, "plain.sql")
+	if err != nil || lock.Active(time.Now()) {
+		t.Fatalf("Expected an unlocked object, got %+v: %v", lock, err)
+	}
+	if err := locker.SetLegalHold(ctx, "plain.sql", true); err != nil {
+		t.Fatalf("Failed to place legal hold: %v", err)
+	}
+	if lock, _ := locker.ObjectLock(ctx, "plain.sql"); !lock.LegalHold {
+		t.Fatalf("Expected a legal hold, got %+v", lock)
+	}
+	if err := unlocked.Delete(ctx, "plain.sql"); err == nil {
+		t.Fatalf("Expected deleting a held object to fail")
+	}
+	locker.SetLegalHold(ctx, "plain.sql", false)
+	if err := unlocked.Delete(ctx, "plain.sql"); err != nil {
+		t.Fatalf("Failed to delete released object: %v", err)
+	}
+	if _, err := locker.ObjectLock(ctx, "plain.sql"); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestS3ServerSideEncryption(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx := context.Background()
+	keyFile := filepath.Join(t.TempDir(), "sse.key")
+	key := make([]byte, 32)
+	rand.New(rand.NewSource(2)).Read(key)
+	os.WriteFile(keyFile, key, 0o600)
+
+	for _, params := range []string{"sse=rot13", "sse=c", "sse_kms_key_id=alias/backups", "sse=c&sse_c_key_file=" + os.DevNull} {
+		if _, err := storage.Open(ctx, fake.location("guard-test", params)); err == nil {
+			t.Fatalf("Expected %s to be rejected", params)
+		}
+	}
+
+	kms, err := storage.Open(ctx, fake.location("guard-test", "sse=kms&sse_kms_key_id=alias/backups&part_size=5MiB"))
+	if err != nil {
+		t.Fatalf("Failed to open S3 backend: %v", err)
+	}
+	if enc := kms.(storage.Encrypter).Encryption(); enc == nil || enc.Mode != storage.SSEKMS || enc.KMSKeyID != "alias/backups" {
+		t.Fatalf("Unexpected encryption %+v", enc)
+	}
+	for key, size := range map[string]int{"kms/small.sql": 10, "kms/big.sql": 6 << 20} {
+		if err := kms.Put(ctx, key, bytes.NewReader(make([]byte, size))); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+		if sse := fake.encryption["guard-test/"+key]; sse == nil || sse.algorithm != "aws:kms" || sse.kmsKeyID != "alias/backups" {
+			t.Fatalf("Expected %s to be encrypted with KMS, got %+v", key, sse)
+		}
+	}
+
+	customer, err := storage.Open(ctx, fake.location("guard-test", "sse=c&part_size=5MiB&sse_c_key_file="+url.QueryEscape(keyFile)))
+	if err != nil {
+		t.Fatalf("Failed to open S3 backend: %v", err)
+	}
+	data := make([]byte, 6<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+	if err := customer.Put(ctx, "c/big.sql", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to put with a customer key: %v", err)
+	}
+	if sse := fake.encryption["guard-test/c/big.sql"]; sse == nil || sse.keyMD5 != customer.(storage.Encrypter).Encryption().KeyMD5 {
+		t.Fatalf("Expected the object to be encrypted with the customer key, got %+v", sse)
+	}
+
+	// Reads supply the customer key, reads without it fail
+	filePath := filepath.Join(t.TempDir(), "big.sql")
+	if err := storage.Download(ctx, customer, "c/big.sql", filePath); err != nil {
+		t.Fatalf("Failed to download with a customer key: %v", err)
+	}
+	if downloaded, _ := os.ReadFile(filePath); !bytes.Equal(downloaded, data) {
+		t.Fatalf("Downloaded file does not match the object")
+	}
+	plain, _ := storage.Open(ctx, fake.location("guard-test", ""))
+	if _, err := plain.Get(ctx, "c/big.sql"); err == nil {
+		t.Fatalf("Expected a read without the customer key to fail")
+	}
+	if err := customer.(storage.Archiver).SetStorageClass(ctx, "c/big.sql", "STANDARD_IA"); err != nil {
+		t.Fatalf("Failed to copy an object encrypted with a customer key: %v", err)
+	}
+}
+
+func TestS3Checksums(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx := context.Background()
+	backend, err := storage.Open(ctx, fake.location("guard-test", "part_size=5MiB"))
+	if err != nil {
+		t.Fatalf("Failed to open S3 backend: %v", err)
+	}
+
+	dir := t.TempDir()
+	for name, size := range map[string]int{"small.sql": 100, "big.sql": 11 << 20} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		filePath := filepath.Join(dir, name)
+		os.WriteFile(filePath, data, 0o644)
+		checksum, err := storage.FileChecksum(filePath)
+		if err != nil {
+			t.Fatalf("Failed to hash %s: %v", name, err)
+		}
+		if err := storage.UploadVerified(ctx, backend, filePath, name, checksum); err != nil {
+			t.Fatalf("Failed to upload %s: %v", name, err)
+		}
+		if fake.checksums["guard-test/"+name] == "" {
+			t.Fatalf("Expected %s to be stored with a SHA-256 checksum", name)
+		}
+		if err := storage.DownloadVerified(ctx, backend, name, filepath.Join(dir, "out", name), checksum); err != nil {
+			t.Fatalf("Failed to download %s: %v", name, err)
+		}
+	}
+	if got, err := backend.(storage.Checksummer).Checksum(ctx, "small.sql"); err != nil || got == "" {
+		t.Fatalf("Expected the checksum of a single-part object, got %q, %v", got, err)
+	}
+	if got, err := backend.(storage.Checksummer).Checksum(ctx, "big.sql"); err != nil || got != "" {
+		t.Fatalf("Expected no checksum for a multipart object, got %q, %v", got, err)
+	}
+
+	// A file that changed since its checksum was taken is not uploaded
+	smallPath := filepath.Join(dir, "small.sql")
+	if err := storage.UploadVerified(ctx, backend, smallPath, "other.sql", "sha256:00"); !errors.Is(err, storage.ErrChecksumMismatch) {
+		t.Fatalf("Expected a checksum mismatch, got %v", err)
+	}
+
+	// Data corrupted in transit is rejected by the server
+	fake.corruptUploads = true
+	for _, name := range []string{"small.sql", "big.sql"} {
+		err := storage.Upload(ctx, backend, filepath.Join(dir, name), "corrupt/"+name)
+		if !errors.Is(err, storage.ErrChecksumMismatch) {
+			t.Fatalf("Expected the corrupted upload of %s to fail with a checksum mismatch, got %v", name, err)
+		}
+	}
+	fake.corruptUploads = false
+
+	// Data corrupted at rest fails the download and leaves no file behind
+	fake.objects["guard-test/small.sql"][0] ^= 0xff
+	outPath := filepath.Join(dir, "corrupt.sql")
+	if err := storage.DownloadVerified(ctx, backend, "small.sql", outPath, ""); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("Expected the corrupted download to fail its checksum, got %v", err)
+	}
+	if _, err := os.Stat(outPath); err == nil {
+		t.Fatalf("Expected no file for a corrupted download")
+	}
+}
+
+func TestLocalChecksums(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.Open(ctx, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open local backend: %v", err)
+	}
+	if err := backend.Put(ctx, "db/backup.sql", strings.NewReader("select 1;")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "expected.sql"), []byte("select 1;"), 0o644)
+	checksum, _ := storage.FileChecksum(filepath.Join(dir, "expected.sql"))
+
+	outPath := filepath.Join(dir, "backup.sql")
+	if err := storage.DownloadVerified(ctx, backend, "db/backup.sql", outPath, checksum); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	// Bit rot in the stored copy is caught against the manifest checksum
+	backend.Put(ctx, "db/backup.sql", strings.NewReader("select 2;"))
+	err = storage.DownloadVerified(ctx, backend, "db/backup.sql", outPath, checksum)
+	if !errors.Is(err, storage.ErrChecksumMismatch) {
+		t.Fatalf("Expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(outPath); err == nil {
+		t.Fatalf("Expected the corrupt download to be removed")
+	}
+}
+
+func TestGCSBackend(t *testing.T) {
+	fake := newFakeGCS(t)
+	ctx := context.Background()
+	stateDir := filepath.Join(t.TempDir(), "gcs-uploads")
+	t.Setenv("GUARD_GCS_UPLOADS", stateDir)
+
+	backend, err := storage.Open(ctx, fake.location("guard-test/prod", "chunk_size=256KiB"))
+	if err != nil {
+		t.Fatalf("Failed to open GCS backend: %v", err)
+	}
+	checkBackend(t, backend)
+
+	data := make([]byte, 700<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// A failed chunk is retried within the same upload
+	fake.failChunks = 1
+	if err := backend.Put(ctx, "big.sql", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to upload with a failing chunk: %v", err)
+	}
+	if !bytes.Equal(fake.objects["guard-test/prod/big.sql"], data) {
+		t.Fatalf("Uploaded object does not match the source")
+	}
+
+	// An upload that gives up is resumed by the next upload of the key
+	fake.failChunks = 3
+	if err := backend.Put(ctx, "again.sql", bytes.NewReader(data)); err == nil {
+		t.Fatalf("Expected the interrupted upload to fail")
+	}
+	sessions := len(fake.sessions)
+	if err := backend.Put(ctx, "again.sql", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to resume upload: %v", err)
+	}
+	if len(fake.sessions) != sessions {
+		t.Fatalf("Expected the upload session to be reused")
+	}
+	if !bytes.Equal(fake.objects["guard-test/prod/again.sql"], data) {
+		t.Fatalf("Resumed object does not match the source")
+	}
+
+	// The session of a file upload survives a restart in a private state
+	// file outside the directory of the uploaded file
+	uploadDir := t.TempDir()
+	filePath := filepath.Join(uploadDir, "restart.sql")
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatalf("Failed to write upload file: %v", err)
+	}
+	putFile := func(b storage.Backend) error {
+		file, err := os.Open(filePath)
+		if err != nil {
+			t.Fatalf("Failed to open upload file: %v", err)
+		}
+		defer file.Close()
+		return b.Put(ctx, "restart.sql", file)
+	}
+	fake.chunkLimit = fake.accepted + 1
+	if err := putFile(backend); err == nil {
+		t.Fatalf("Expected the interrupted upload to fail")
+	}
+	states, _ := os.ReadDir(stateDir)
+	if len(states) != 1 {
+		t.Fatalf("Expected the upload session to be persisted, got %v", states)
+	}
+	if info, err := states[0].Info(); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected upload state mode 0600, got %v: %v", info.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(uploadDir); len(entries) != 1 {
+		t.Fatalf("Expected nothing next to the uploaded file, got %v", entries)
+	}
+	restarted, err := storage.Open(ctx, fake.location("guard-test/prod", "chunk_size=256KiB"))
+	if err != nil {
+		t.Fatalf("Failed to reopen GCS backend: %v", err)
+	}
+	fake.chunkLimit = 0
+	sessions = len(fake.sessions)
+	if err := putFile(restarted); err != nil {
+		t.Fatalf("Failed to resume upload after a restart: %v", err)
+	}
+	if len(fake.sessions) != sessions {
+		t.Fatalf("Expected the persisted upload session to be reused")
+	}
+	if !bytes.Equal(fake.objects["guard-test/prod/restart.sql"], data) {
+		t.Fatalf("Resumed object does not match the source")
+	}
+	if states, _ := os.ReadDir(stateDir); len(states) != 0 {
+		t.Fatalf("Expected the upload state to be removed, got %v", states)
+	}
+}
+
+// TestGCSEmulator runs against a fake-gcs-server:
+//
+//	docker run -d -p 4443:4443 fsouza/fake-gcs-server -scheme http
+//	curl -X POST -d '{"name":"guard-test"}' http://localhost:4443/storage/v1/b
+//	STORAGE_EMULATOR_HOST=localhost:4443 GUARD_TEST_GCS_URL=gs://guard-test/run go test ./tests -run GCSEmulator
+func TestGCSEmulator(t *testing.T) {
+	location := os.Getenv("GUARD_TEST_GCS_URL")
+	if location == "" {
+		t.Skip("GUARD_TEST_GCS_URL not set")
+	}
+
+	backend, err := storage.Open(context.Background(), location)
+	if err != nil {
+		t.Fatalf("Failed to open GCS backend: %v", err)
+	}
+	checkBackend(t, backend)
+}
+
+func TestAzureBackend(t *testing.T) {
+	fake := newFakeAzure(t)
+	ctx := context.Background()
+	t.Setenv("AZURE_STORAGE_KEY", "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==")
+
+	backend, err := storage.Open(ctx, fake.location("backups/prod", "tier=cool&block_size=256KiB&concurrency=1"))
+	if err != nil {
+		t.Fatalf("Failed to open Azure backend: %v", err)
+	}
+	checkBackend(t, backend)
+	if got := storage.JoinURL(backend, "db/full.sql"); got != "azblob://backups/prod/db/full.sql?account=devstoreaccount1&endpoint="+url.QueryEscape(fake.URL+"/devstoreaccount1") {
+		t.Fatalf("Unexpected object URL %s", got)
+	}
+	// The URL keeps the endpoint, so that it reopens the same container
+	if reopened, err := storage.Open(ctx, backend.URL()); err != nil || reopened.URL() != backend.URL() {
+		t.Fatalf("Failed to reopen %s: %v", backend.URL(), err)
+	}
+
+	data := make([]byte, 700<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// The upload is interrupted at the second of three blocks
+	fake.stagedBlocks = 0
+	fake.failAt = 2
+	if err := backend.Put(ctx, "big.sql", bytes.NewReader(data)); err == nil {
+		t.Fatalf("Expected the interrupted upload to fail")
+	}
+	if err := backend.Put(ctx, "big.sql", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to resume upload: %v", err)
+	}
+	if fake.stagedBlocks != 4 {
+		t.Fatalf("Expected the first block to be reused on resume, got %d staged blocks", fake.stagedBlocks)
+	}
+	if !bytes.Equal(fake.blobs["backups/prod/big.sql"], data) || fake.tiers["backups/prod/big.sql"] != "Cool" {
+		t.Fatalf("Unexpected blob (tier %q)", fake.tiers["backups/prod/big.sql"])
+	}
+}
+
+// TestAzurite runs against a local Azurite:
+//
+//	docker run -d -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+//	AZURE_STORAGE_CONNECTION_STRING='UseDevelopmentStorage=true' GUARD_TEST_AZURE_URL=azblob://guard-test/run go test ./tests -run Azurite
+//
+// The container must exist.
+func TestAzurite(t *testing.T) {
+	location := os.Getenv("GUARD_TEST_AZURE_URL")
+	if location == "" {
+		t.Skip("GUARD_TEST_AZURE_URL not set")
+	}
+
+	backend, err := storage.Open(context.Background(), location)
+	if err != nil {
+		t.Fatalf("Failed to open Azure backend: %v", err)
+	}
+	checkBackend(t, backend)
+}
+
+func TestSFTPBackend(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeSFTP(t)
+	dir := t.TempDir()
+
+	backend, err := storage.Open(ctx, server.location(dir+"/backups", ""))
+	if err != nil {
+		t.Fatalf("Failed to open SFTP storage: %v", err)
+	}
+	defer storage.Close(backend)
+	checkBackend(t, backend)
+
+	// Uploads go through a temporary file that is renamed into place
+	if err := backend.Put(ctx, "orders/orders-1.sql", strings.NewReader("first")); err != nil {
+		t.Fatalf("Failed to put object: %v", err)
+	}
+	if err := backend.Put(ctx, "orders/orders-1.sql", strings.NewReader("second")); err != nil {
+		t.Fatalf("Failed to overwrite object: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "backups", "orders"))
+	if len(entries) != 1 {
+		t.Fatalf("Expected only the uploaded file, found %d entries", len(entries))
+	}
+	target := filepath.Join(t.TempDir(), "orders-1.sql")
+	if err := storage.Download(ctx, backend, "orders/orders-1.sql", target); err != nil {
+		t.Fatalf("Failed to download object: %v", err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "second" {
+		t.Fatalf("Unexpected downloaded contents %q", data)
+	}
+
+	// Hosts missing from known_hosts are rejected
+	os.WriteFile(server.knownHosts, nil, 0o600)
+	if _, err := storage.Open(ctx, server.location(dir, "")); err == nil {
+		t.Fatalf("Expected unknown host key to be rejected")
+	}
+	pinned, err := storage.Open(ctx, server.location(dir, "host_key="+url.QueryEscape(ssh.FingerprintSHA256(server.hostKey.PublicKey()))))
+	if err != nil {
+		t.Fatalf("Expected pinned host key to be accepted: %v", err)
+	}
+	storage.Close(pinned)
+}
+
+func TestSFTPAgent(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeSFTP(t)
+	// No default keys, the client key is only offered by the agent
+	t.Setenv("HOME", t.TempDir())
+	raw, _ := os.ReadFile(server.keyFile)
+	key, err := ssh.ParseRawPrivateKey(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse client key: %v", err)
+	}
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: key})
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	closed := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	location := "sftp://guard@" + server.listener.Addr().String() + filepath.ToSlash(t.TempDir()) + "?known_hosts=" + server.knownHosts
+	backend, err := storage.Open(ctx, location)
+	if err != nil {
+		t.Fatalf("Failed to open SFTP storage with the agent: %v", err)
+	}
+	checkBackend(t, backend)
+
+	// Closing the backend closes its connection to the agent
+	storage.Close(backend)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the agent connection to be closed")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{"1048576": 1 << 20, "16MiB": 16 << 20, "64MB": 64000000, "1g": 1 << 30}
+	for in, want := range cases {
+		got, err := storage.ParseSize(in)
+		if err != nil || got != want {
+			t.Fatalf("ParseSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	if _, err := storage.ParseSize("12abc"); err == nil {
+		t.Fatalf("Expected an error for an invalid size")
+	}
+}
+
+// checkBackend exercises the Backend interface on an empty location
+func checkBackend(t *testing.T, backend storage.Backend) {
+	t.Helper()
+	ctx := context.Background()
+
+	for _, key := range []string{"orders/orders-1.sql", "orders/orders-2.sql", "users/users-1.sql"} {
+		if err := backend.Put(ctx, key, strings.NewReader("dump of "+key)); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+
+	body, err := backend.Get(ctx, "orders/orders-1.sql")
+	if err != nil {
+		t.Fatalf("Failed to get object: %v", err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != "dump of orders/orders-1.sql" {
+		t.Fatalf("Unexpected object contents %q: %v", data, err)
+	}
+
+	objects, err := backend.List(ctx, "orders/")
+	if err != nil {
+		t.Fatalf("Failed to list objects: %v", err)
+	}
+	if len(objects) != 2 || objects[0].Key != "orders/orders-1.sql" || objects[1].Key != "orders/orders-2.sql" {
+		t.Fatalf("Unexpected listing: %+v", objects)
+	}
+
+	obj, err := backend.Stat(ctx, "users/users-1.sql")
+	if err != nil {
+		t.Fatalf("Failed to stat object: %v", err)
+	}
+	if obj.Size != int64(len("dump of users/users-1.sql")) {
+		t.Fatalf("Unexpected size %d", obj.Size)
+	}
+
+	if err := backend.Delete(ctx, "users/users-1.sql"); err != nil {
+		t.Fatalf("Failed to delete object: %v", err)
+	}
+	if exists, err := backend.Exists(ctx, "users/users-1.sql"); err != nil || exists {
+		t.Fatalf("Expected deleted object to be gone (exists=%v, err=%v)", exists, err)
+	}
+	if _, err := backend.Get(ctx, "users/users-1.sql"); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+	for _, key := range []string{"orders/orders-1.sql", "orders/orders-2.sql"} {
+		if err := backend.Delete(ctx, key); err != nil {
+			t.Fatalf("Failed to delete %s: %v", key, err)
+		}
+	}
+}
+
+func TestOpenStorageLocations(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	for _, location := range []string{dir, "file://" + filepath.ToSlash(dir), "local:" + filepath.ToSlash(dir)} {
+		backend, err := storage.Open(ctx, location)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", location, err)
+		}
+		if backend.URL() != "file://"+filepath.ToSlash(dir) {
+			t.Fatalf("Unexpected URL %s for %s", backend.URL(), location)
+		}
+	}
+
+	if _, err := storage.Open(ctx, "ftp://example.com/backups"); err == nil {
+		t.Fatalf("Expected an error for an unsupported scheme")
+	}
+}
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/retention"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/Annany2002/guard/pkg/tiering"
+)
+
+func TestParseStage(t *testing.T) {
+	stage, err := tiering.ParseStage("7d:s3://backups/prod?region=eu-west-1")
+	if err != nil || stage.After != 7*24*time.Hour || stage.Location != "s3://backups/prod?region=eu-west-1" || stage.Class != "" {
+		t.Fatalf("Unexpected location stage %+v: %v", stage, err)
+	}
+	stage, err = tiering.ParseStage("30d:GLACIER")
+	if err != nil || stage.Class != "GLACIER" || stage.Location != "" {
+		t.Fatalf("Unexpected class stage %+v: %v", stage, err)
+	}
+	for _, spec := range []string{"7d", "soon:GLACIER", "7d:"} {
+		if _, err := tiering.ParseStage(spec); err == nil {
+			t.Fatalf("Expected %q to be rejected", spec)
+		}
+	}
+
+	for _, stages := range [][]tiering.Stage{
+		{{After: 30 * 24 * time.Hour, Class: "GLACIER"}, {After: 7 * 24 * time.Hour, Location: "s3://b"}},
+		{{After: time.Hour, Location: "s3://b"}, {After: 2 * time.Hour, Class: "DEEP_ARCHIVE"}, {After: 3 * time.Hour, Class: "GLACIER"}},
+		{{After: time.Hour, Location: "./backup"}},
+		{{After: time.Hour, Class: "FROZEN"}},
+	} {
+		if err := (tiering.Policy{Source: "./backup", Stages: stages}).Validate(); err == nil {
+			t.Fatalf("Expected stages %+v to be rejected", stages)
+		}
+	}
+}
+
+func TestTiering(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3(t)
+	source := t.TempDir()
+	local, err := storage.Open(ctx, source)
+	if err != nil {
+		t.Fatalf("Failed to open local storage: %v", err)
+	}
+	remote, _ := storage.Open(ctx, fake.location("guard-test/prod", ""))
+
+	now := time.Now()
+	ages := map[string]int{"fresh": 3, "week": 10, "month": 40, "year": 200}
+	for name, days := range ages {
+		putRetentionBackup(t, local, retention.Backup{
+			Key:      "orders/" + name + ".sql",
+			Manifest: &manifest.Manifest{ID: name, Database: "orders", CreatedAt: now.AddDate(0, 0, -days)},
+		})
+	}
+
+	policy := tiering.Policy{Source: source, Stages: []tiering.Stage{
+		{After: 7 * 24 * time.Hour, Location: fake.location("guard-test/prod", "")},
+		{After: 30 * 24 * time.Hour, Class: "GLACIER"},
+		{After: 180 * 24 * time.Hour, Class: "DEEP_ARCHIVE"},
+	}}
+
+	actions, err := tiering.Apply(ctx, policy, tiering.Options{DryRun: true, Now: now})
+	if err != nil || len(actions) != 3 {
+		t.Fatalf("Expected 3 pending moves, got %+v: %v", actions, err)
+	}
+	if exists, _ := local.Exists(ctx, "orders/week.sql"); !exists {
+		t.Fatalf("Dry run moved a backup")
+	}
+
+	actions, err = tiering.Apply(ctx, policy, tiering.Options{Now: now})
+	if err != nil || len(actions) != 3 {
+		t.Fatalf("Expected 3 moves, got %+v: %v", actions, err)
+	}
+	for _, a := range actions {
+		if !a.Done || a.To != remote.URL() {
+			t.Fatalf("Unexpected action %+v", a)
+		}
+	}
+
+	if exists, _ := local.Exists(ctx, "orders/fresh.sql"); !exists {
+		t.Fatalf("Expected the fresh backup to stay local")
+	}
+	archiver := remote.(storage.Archiver)
+	for name, class := range map[string]string{"week": "STANDARD", "month": "GLACIER", "year": "DEEP_ARCHIVE"} {
+		key := "orders/" + name + ".sql"
+		if exists, _ := local.Exists(ctx, key); exists {
+			t.Fatalf("Expected %s to be deleted locally", key)
+		}
+		status, err := archiver.ArchiveStatus(ctx, key)
+		if err != nil || status.Class != class {
+			t.Fatalf("Expected %s in %s, got %+v: %v", key, class, status, err)
+		}
+		if status, _ := archiver.ArchiveStatus(ctx, manifest.PathFor(key)); status.Class != "STANDARD" {
+			t.Fatalf("Expected the manifest of %s to stay in STANDARD, got %s", key, status.Class)
+		}
+	}
+
+	// A month later the week old backup reaches Glacier, nothing else moves
+	actions, err = tiering.Apply(ctx, policy, tiering.Options{Now: now.AddDate(0, 0, 25)})
+	if err != nil || len(actions) != 2 {
+		t.Fatalf("Expected 2 moves a month later, got %+v: %v", actions, err)
+	}
+	if status, _ := archiver.ArchiveStatus(ctx, "orders/week.sql"); status.Class != "GLACIER" {
+		t.Fatalf("Expected the week old backup in GLACIER, got %s", status.Class)
+	}
+}
+
+func TestThawArchivedBackup(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3(t)
+	fake.thawPolls = 2
+	backend, err := storage.Open(ctx, fake.location("guard-test", "storage_class=deep_archive"))
+	if err != nil {
+		t.Fatalf("Failed to open S3 backend: %v", err)
+	}
+	if err := backend.Put(ctx, "orders.sql", strings.NewReader("archived dump")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if fake.classes["guard-test/orders.sql"] != "DEEP_ARCHIVE" {
+		t.Fatalf("Expected the backup in DEEP_ARCHIVE, got %q", fake.classes["guard-test/orders.sql"])
+	}
+
+	if _, err := backend.Get(ctx, "orders.sql"); err == nil {
+		t.Fatalf("Expected archived backup to be unreadable")
+	}
+	if err := storage.Thaw(ctx, backend, "orders.sql", storage.ThawOptions{Days: 2, Tier: "bulk", PollInterval: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("Thaw failed: %v", err)
+	}
+	status, err := backend.(storage.Archiver).ArchiveStatus(ctx, "orders.sql")
+	if err != nil || !status.Archived || !status.Restored || status.RestoredUntil.Before(time.Now().Add(24*time.Hour)) {
+		t.Fatalf("Unexpected status after thaw %+v: %v", status, err)
+	}
+	body, err := backend.Get(ctx, "orders.sql")
+	if err != nil {
+		t.Fatalf("Expected thawed backup to be readable: %v", err)
+	}
+	body.Close()
+
+	// Thawing a restored backup does not wait
+	fake.thawPolls = 100
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := storage.Thaw(ctx, backend, "orders.sql", storage.ThawOptions{PollInterval: time.Hour}); err != nil {
+		t.Fatalf("Thaw of a restored backup failed: %v", err)
+	}
+}
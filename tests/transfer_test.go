@@ -0,0 +1,199 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Annany2002/guard/pkg/backup"
+	"github.com/Annany2002/guard/pkg/drill"
+	"github.com/Annany2002/guard/pkg/manifest"
+	"github.com/Annany2002/guard/pkg/storage"
+	"github.com/Annany2002/guard/pkg/transfer"
+)
+
+func TestParseSelector(t *testing.T) {
+	sel, err := transfer.ParseSelector("db=orders, since=30d,before=1w")
+	if err != nil || sel.Database != "orders" || sel.Since != 30*24*time.Hour || sel.Before != 7*24*time.Hour {
+		t.Fatalf("Unexpected selector %+v: %v", sel, err)
+	}
+	if sel, err := transfer.ParseSelector(""); err != nil || sel != (transfer.Selector{}) {
+		t.Fatalf("Expected an empty selector to match everything, got %+v: %v", sel, err)
+	}
+	for _, s := range []string{"orders", "db=", "size=10", "since=soon"} {
+		if _, err := transfer.ParseSelector(s); err == nil {
+			t.Fatalf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+// putChecksummedBackup stores a backup whose manifest records the checksum
+// of contents
+func putChecksummedBackup(t *testing.T, backend storage.Backend, id, database, contents string, created time.Time) string {
+	t.Helper()
+	ctx := context.Background()
+	sum := sha256.Sum256([]byte(contents))
+	key := database + "/" + id + ".sql"
+	m := &manifest.Manifest{
+		Version:   manifest.Version,
+		ID:        id,
+		Database:  database,
+		File:      key,
+		Size:      int64(len(contents)),
+		Checksum:  "sha256:" + hex.EncodeToString(sum[:]),
+		CreatedAt: created,
+	}
+	var buf bytes.Buffer
+	m.Encode(&buf)
+	if err := backend.Put(ctx, key, strings.NewReader(contents)); err != nil {
+		t.Fatalf("Failed to put %s: %v", key, err)
+	}
+	if err := backend.Put(ctx, manifest.PathFor(key), &buf); err != nil {
+		t.Fatalf("Failed to put manifest of %s: %v", key, err)
+	}
+	return key
+}
+
+func TestTransfer(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3(t)
+	from, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open local storage: %v", err)
+	}
+	to, _ := storage.Open(ctx, fake.location("guard-test/archive", ""))
+
+	now := time.Now()
+	recent := putChecksummedBackup(t, from, "orders-1", "orders", "recent orders", now.AddDate(0, 0, -2))
+	old := putChecksummedBackup(t, from, "orders-2", "orders", "old orders", now.AddDate(0, 0, -60))
+	other := putChecksummedBackup(t, from, "users-1", "users", "users", now.AddDate(0, 0, -2))
+	// The artifact no longer matches its manifest
+	corrupt := putChecksummedBackup(t, from, "orders-3", "orders", "good dump", now.AddDate(0, 0, -3))
+	from.Put(ctx, corrupt, strings.NewReader("bad dump!"))
+
+	sel, _ := transfer.ParseSelector("db=orders,since=30d")
+	items, err := transfer.Transfer(ctx, from, to, transfer.Options{Select: sel, DryRun: true})
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Expected 2 selected backups, got %+v: %v", items, err)
+	}
+	if exists, _ := to.Exists(ctx, recent); exists {
+		t.Fatalf("Dry run copied a backup")
+	}
+
+	items, err = transfer.Transfer(ctx, from, to, transfer.Options{Select: sel, DeleteSource: true})
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("Expected the corrupt backup to fail verification, got %v", err)
+	}
+	copied := make(map[string]bool)
+	for _, item := range items {
+		copied[item.Backup.Manifest.ID] = item.Copied && item.Deleted
+	}
+	if !copied["orders-1"] || copied["orders-3"] || len(items) != 2 {
+		t.Fatalf("Unexpected transfer %+v", items)
+	}
+
+	// The verified backup moved, the corrupt one stayed and left nothing behind
+	if got, err := transfer.Checksum(ctx, to, recent); err != nil || !strings.HasPrefix(got, "sha256:") {
+		t.Fatalf("Expected the recent backup at the destination: %v", err)
+	}
+	if exists, _ := to.Exists(ctx, manifest.PathFor(recent)); !exists {
+		t.Fatalf("Expected the manifest at the destination")
+	}
+	if exists, _ := from.Exists(ctx, recent); exists {
+		t.Fatalf("Expected the source copy to be deleted")
+	}
+	for _, key := range []string{corrupt, manifest.PathFor(corrupt)} {
+		if exists, _ := to.Exists(ctx, key); exists {
+			t.Fatalf("Expected no copy of the corrupt backup, found %s", key)
+		}
+	}
+	for _, key := range []string{old, other, corrupt} {
+		if exists, _ := from.Exists(ctx, key); !exists {
+			t.Fatalf("Expected %s to stay in the source", key)
+		}
+	}
+
+	// Backups already at the destination are verified, not copied again
+	putChecksummedBackup(t, from, "orders-1", "orders", "recent orders", now.AddDate(0, 0, -2))
+	puts := fake.puts
+	sel, _ = transfer.ParseSelector("id=orders-1")
+	items, err = transfer.Transfer(ctx, from, to, transfer.Options{Select: sel})
+	if err != nil || len(items) != 1 || !items[0].Copied || fake.puts != puts {
+		t.Fatalf("Expected the existing copy to be verified, got %+v: %v", items, err)
+	}
+}
+
+func TestTransferDeduplicated(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeS3(t)
+	dir := t.TempDir()
+	source := filepath.Join(dir, "repo")
+	from, _ := storage.Open(ctx, source)
+	to, _ := storage.Open(ctx, fake.location("guard-test/archive", ""))
+
+	store := func(location, id string, data []byte) *manifest.Manifest {
+		path := filepath.Join(t.TempDir(), id+".sql")
+		os.WriteFile(path, data, 0o644)
+		sum := sha256.Sum256(data)
+		m := &manifest.Manifest{Version: manifest.Version, ID: id, Database: "orders", File: "orders/" + id + ".sql", Size: int64(len(data)), Checksum: storage.FormatChecksum(sum[:]), CreatedAt: time.Now()}
+		if err := backup.Deduplicate(ctx, &backup.Result{FilePath: path, ManifestPath: manifest.PathFor(path), Manifest: m}, []string{location}, 1, backup.Policy{}); err != nil {
+			t.Fatalf("Failed to store backup %s: %v", id, err)
+		}
+		return m
+	}
+	dump := make([]byte, 8<<20)
+	rand.New(rand.NewSource(3)).Read(dump)
+	first := store(source, "orders-1", dump)
+	// The destination already holds most chunks through a similar backup
+	changed := bytes.Clone(dump)
+	copy(changed[4<<20:], "UPDATE orders SET status = 'shipped';")
+	store(fake.location("guard-test/archive", ""), "orders-2", changed)
+
+	puts := fake.puts
+	sel, _ := transfer.ParseSelector("id=orders-1")
+	items, err := transfer.Transfer(ctx, from, to, transfer.Options{Select: sel, DeleteSource: true})
+	if err != nil || len(items) != 1 || !items[0].Copied || !items[0].Deleted {
+		t.Fatalf("Expected the deduplicated backup to move, got %+v: %v", items, err)
+	}
+	// Only the missing chunks and the manifest are uploaded
+	if uploaded := fake.puts - puts; uploaded > 4 || len(first.Chunks) < 6 {
+		t.Fatalf("Expected only the missing chunks to be copied, %d objects were uploaded for %d chunks", uploaded, len(first.Chunks))
+	}
+	path, err := drill.Fetch(ctx, to, first.File, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to restore the transferred backup: %v", err)
+	}
+	if restored, _ := os.ReadFile(path); !bytes.Equal(restored, dump) {
+		t.Fatalf("Transferred backup differs from the dump")
+	}
+	if exists, _ := from.Exists(ctx, manifest.PathFor(first.File)); exists {
+		t.Fatalf("Expected the source manifest to be deleted")
+	}
+	if locks, _ := to.List(ctx, manifest.LockDir); len(locks) != 0 {
+		t.Fatalf("Expected the transfer to release its lock, got %+v", locks)
+	}
+
+	// A corrupt source chunk fails the transfer before the manifest is copied
+	other := make([]byte, 1<<20)
+	rand.New(rand.NewSource(4)).Read(other)
+	third := store(source, "orders-3", other)
+	os.WriteFile(filepath.Join(source, filepath.FromSlash(manifest.ChunkKey(third.Chunks[0].Hash))), []byte("garbage"), 0o644)
+	sel, _ = transfer.ParseSelector("id=orders-3")
+	if _, err := transfer.Transfer(ctx, from, to, transfer.Options{Select: sel}); !errors.Is(err, storage.ErrChecksumMismatch) {
+		t.Fatalf("Expected the corrupt chunk to fail the transfer, got %v", err)
+	}
+	if exists, _ := to.Exists(ctx, manifest.PathFor(third.File)); exists {
+		t.Fatalf("Expected no manifest for the failed transfer")
+	}
+	if exists, _ := to.Exists(ctx, manifest.ChunkKey(third.Chunks[0].Hash)); exists {
+		t.Fatalf("Expected the corrupt chunk to be removed from the destination")
+	}
+}